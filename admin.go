@@ -0,0 +1,516 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------- admin request signing ----------------
+
+// Spartan is plaintext, so a bare admin token would be trivially replayable by
+// anyone who captured one request. Admin requests therefore carry a signed
+// preamble as the first line of the request body:
+//
+//	<unix-timestamp> <nonce> <hex hmac-sha256>\n<payload>
+//
+// The HMAC is keyed with the admin secret and computed over
+//
+//	host \n path \n timestamp \n nonce \n payload
+//
+// Requests outside the allowed clock skew, or reusing a nonce that is still
+// inside that window, are rejected.
+//
+// Besides -admin-secret, which may do anything, -admin-tokens gives each
+// operator a secret of their own with a role. The server finds the signer by
+// checking the signature against every secret, so clients sign the same way
+// with either.
+
+var (
+	errAdminUnsigned = errors.New("missing signature")
+	errAdminBadSig   = errors.New("bad signature")
+	errAdminStale    = errors.New("timestamp outside allowed window")
+	errAdminReplay   = errors.New("nonce already used")
+)
+
+type adminAuth struct {
+	mu     sync.Mutex
+	tokens []adminToken
+	skew   time.Duration
+	nonces map[string]time.Time // nonce -> expiry
+}
+
+func newAdminAuth(tokens []adminToken, skew time.Duration) *adminAuth {
+	return &adminAuth{
+		tokens: tokens,
+		skew:   skew,
+		nonces: make(map[string]time.Time),
+	}
+}
+
+func (a *adminAuth) setTokens(tokens []adminToken) {
+	a.mu.Lock()
+	a.tokens = tokens
+	a.mu.Unlock()
+}
+
+// enabled reports whether any token can sign requests.
+func (a *adminAuth) enabled() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.tokens) > 0
+}
+
+func (a *adminAuth) setSkew(d time.Duration) {
+	a.mu.Lock()
+	a.skew = d
+	a.mu.Unlock()
+}
+
+func adminSignature(secret []byte, host, path, ts, nonce string, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n", host, path, ts, nonce)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks the signed preamble of body and returns the remaining payload
+// and the token that signed it.
+func (a *adminAuth) verify(host, path string, body []byte, now time.Time) ([]byte, adminToken, error) {
+	preamble, payload, _ := bytes.Cut(body, []byte("\n"))
+	fields := strings.Fields(string(preamble))
+	if len(fields) != 3 {
+		return nil, adminToken{}, errAdminUnsigned
+	}
+	ts, nonce, sig := fields[0], fields[1], fields[2]
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var who adminToken
+	found := false
+	for _, t := range a.tokens {
+		want := adminSignature(t.secret, host, path, ts, nonce, payload)
+		if hmac.Equal([]byte(want), []byte(strings.ToLower(sig))) {
+			who, found = t, true
+			break
+		}
+	}
+	if !found {
+		return nil, adminToken{}, errAdminBadSig
+	}
+
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, adminToken{}, errAdminStale
+	}
+	at := time.Unix(sec, 0)
+	if at.Before(now.Add(-a.skew)) || at.After(now.Add(a.skew)) {
+		return nil, adminToken{}, errAdminStale
+	}
+	for n, exp := range a.nonces {
+		if now.After(exp) {
+			delete(a.nonces, n)
+		}
+	}
+	if _, seen := a.nonces[nonce]; seen {
+		return nil, adminToken{}, errAdminReplay
+	}
+	// Anything older than at+skew is rejected as stale, so the nonce only
+	// needs to be remembered until then.
+	a.nonces[nonce] = at.Add(a.skew)
+	return payload, who, nil
+}
+
+// ---------------- admin roles ----------------
+
+// Each admin token has a role, and each command needs at least a given role:
+// a viewer can look, a DJ can also change what plays, and an admin can do
+// everything. Commands missing from adminCommandRole need admin.
+
+type adminRole int
+
+const (
+	roleViewer adminRole = iota
+	roleDJ
+	roleAdmin
+)
+
+var adminRoleNames = []string{"viewer", "dj", "admin"}
+
+func (r adminRole) String() string { return adminRoleNames[r] }
+
+var adminCommandRole = map[string]adminRole{
+	"status":     roleViewer,
+	"listeners":  roleViewer,
+	"now":        roleViewer,
+	"queue":      roleViewer,
+	"report":     roleViewer,
+	"polls":      roleViewer,
+	"quarantine": roleViewer,
+
+	"skip":      roleDJ,
+	"queue/add": roleDJ,
+}
+
+// may reports whether r is allowed to run cmd.
+func (r adminRole) may(cmd string) bool {
+	need, ok := adminCommandRole[cmd]
+	if !ok {
+		need = roleAdmin
+	}
+	return r >= need
+}
+
+type adminToken struct {
+	name   string
+	role   adminRole
+	secret []byte
+}
+
+// adminTokenList is the -admin-tokens flag: comma-separated name:role:secret
+// entries. Secrets may contain colons but not commas.
+type adminTokenList struct {
+	raw    string
+	tokens []adminToken
+}
+
+func (l *adminTokenList) String() string { return l.raw }
+
+func (l *adminTokenList) Set(v string) error {
+	var tokens []adminToken
+	seen := make(map[string]bool)
+	for i, entry := range strings.Split(v, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		// Errors name the entry but never show its secret. An entry without
+		// a colon may be nothing but the secret, so it goes by position.
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) < 2 {
+			return fmt.Errorf("entry %d: want name:role:secret", i+1)
+		}
+		if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+			return fmt.Errorf("%q: want name:role:secret", parts[0])
+		}
+		role := slices.Index(adminRoleNames, parts[1])
+		if role < 0 {
+			return fmt.Errorf("%s: unknown role %q (use viewer, dj or admin)", parts[0], parts[1])
+		}
+		if seen[parts[0]] {
+			return fmt.Errorf("%s: listed twice", parts[0])
+		}
+		seen[parts[0]] = true
+		tokens = append(tokens, adminToken{parts[0], adminRole(role), []byte(parts[2])})
+	}
+	l.raw, l.tokens = v, tokens
+	return nil
+}
+
+// adminTokens combines -admin-secret, as a token named "admin", with the
+// -admin-tokens list.
+func adminTokens(secret string, list *adminTokenList) []adminToken {
+	var tokens []adminToken
+	if secret != "" {
+		tokens = append(tokens, adminToken{"admin", roleAdmin, []byte(secret)})
+	}
+	return append(tokens, list.tokens...)
+}
+
+// ---------------- admin handlers ----------------
+
+// Admin commands answer with JSON. Commands that act on a station take an
+// optional ?mount=/path query; the first station is the default.
+
+type adminStation struct {
+	Mount       string `json:"mount"`
+	Listeners   int    `json:"listeners"`
+	UniqueToday *int   `json:"unique_today,omitempty"`
+	HeaderBytes int    `json:"header_bytes"`
+	OnAir       string `json:"on_air,omitempty"`
+
+	WatchdogResets int    `json:"watchdog_resets"`
+	LastReset      string `json:"last_reset,omitempty"`
+
+	BitrateKbps      float64 `json:"bitrate_kbps,omitempty"`
+	BitrateAlarms    int     `json:"bitrate_alarms"`
+	LastBitrateAlarm string  `json:"last_bitrate_alarm,omitempty"`
+
+	Quarantined []quarantinedFile `json:"quarantined,omitempty"`
+}
+
+// status is the station's entry in /admin/status and in stats exports.
+func (st *station) status() adminStation {
+	n, last := st.watchdogResets()
+	as := adminStation{
+		Mount:          st.mount,
+		Listeners:      st.b.Listeners(),
+		HeaderBytes:    len(st.b.GetHeaderCopy()),
+		OnAir:          st.onAirLevel(),
+		WatchdogResets: n,
+	}
+	if st.uniques != nil {
+		today, _ := st.uniques.counts(time.Now())
+		as.UniqueToday = &today
+	}
+	if n > 0 {
+		as.LastReset = last.at.UTC().Format(time.RFC3339) + " " + last.reason
+	}
+	as.BitrateKbps, _ = st.b.rate.latest()
+	if n, last := st.bitrateAlarms(); n > 0 {
+		as.BitrateAlarms = n
+		as.LastBitrateAlarm = last.at.UTC().Format(time.RFC3339) + " " + last.reason
+	}
+	if st.feed != nil && st.feed.health != nil {
+		as.Quarantined = st.feed.health.quarantined()
+	}
+	return as
+}
+
+type adminListener struct {
+	Remote  string  `json:"remote"`
+	ID      string  `json:"id,omitempty"`
+	Since   string  `json:"since"`
+	Seconds float64 `json:"seconds"`
+	Bytes   int64   `json:"bytes"`
+}
+
+type adminNow struct {
+	Mount    string  `json:"mount"`
+	File     string  `json:"file"`
+	Started  string  `json:"started,omitempty"`
+	Elapsed  float64 `json:"elapsed_seconds"`
+	Duration float64 `json:"duration_seconds,omitempty"`
+}
+
+func (srv *server) handleAdmin(w io.Writer, remote string, req *request, body []byte) {
+	if srv.admin == nil || !srv.admin.enabled() {
+		fmt.Fprintf(w, "4 not found\r\n")
+		return
+	}
+	// The signature covers the request exactly as the client sent it.
+	payload, who, err := srv.admin.verify(req.host, req.target, body, time.Now())
+	if err != nil {
+		fmt.Fprintf(w, "4 admin: %v\r\n", err)
+		return
+	}
+
+	cmd := strings.TrimPrefix(req.path, "/admin/")
+	if !who.role.may(cmd) {
+		log.Printf("admin: refused %s to %s (%s) from %s", cmd, who.name, who.role, remote)
+		srv.audit(auditEntry{By: who.name, Role: who.role.String(), Action: cmd, Remote: remote, Refused: true})
+		fmt.Fprintf(w, "4 admin: a %s may not %s\r\n", who.role, cmd)
+		return
+	}
+	record := func(action, detail string) {
+		srv.audit(auditEntry{By: who.name, Role: who.role.String(), Action: action, Detail: detail, Remote: remote})
+	}
+	query, _ := url.ParseQuery(req.query)
+	st := srv.stations[0]
+	if m := query.Get("mount"); m != "" {
+		if st = srv.station(m); st == nil {
+			fmt.Fprintf(w, "4 unknown mount\r\n")
+			return
+		}
+	}
+
+	var resp any
+	switch cmd {
+	case "status":
+		var stations []adminStation
+		for _, st := range srv.stations {
+			stations = append(stations, st.status())
+		}
+		status := map[string]any{
+			"uptime_seconds": time.Since(srv.started).Seconds(),
+			"stations":       stations,
+		}
+		if srv.limit != nil {
+			status["listener_limit"] = srv.limit.current()
+		}
+		if srv.auditLog != nil {
+			if recent, err := srv.auditLog.recent(auditRecent); err == nil {
+				status["recent_actions"] = recent
+			}
+		}
+		resp = status
+
+	case "listeners":
+		list := []adminListener{}
+		for _, l := range st.listenerList() {
+			list = append(list, adminListener{
+				Remote:  l.remote,
+				ID:      l.id,
+				Since:   l.since.UTC().Format(time.RFC3339),
+				Seconds: time.Since(l.since).Seconds(),
+				Bytes:   l.bytes.Load(),
+			})
+		}
+		resp = list
+
+	case "now":
+		file, since := st.feed.nowPlaying()
+		now := adminNow{Mount: st.mount, File: file}
+		if file != "" {
+			elapsed, length := st.feed.progress()
+			now.Started = since.UTC().Format(time.RFC3339)
+			now.Elapsed = elapsed.Seconds()
+			now.Duration = length.Seconds()
+		}
+		resp = now
+
+	case "skip":
+		if !st.feed.skip() {
+			fmt.Fprintf(w, "4 nothing to skip\r\n")
+			return
+		}
+		log.Printf("admin: %s skipped current track on %s", who.name, st.mount)
+		record("skip", st.mount)
+		resp = map[string]bool{"skipped": true}
+
+	case "queue":
+		resp = append([]string{}, st.feed.queued()...)
+
+	case "quarantine":
+		list := []quarantinedFile{}
+		if st.feed.health != nil {
+			list = append(list, st.feed.health.quarantined()...)
+		}
+		resp = list
+
+	case "quarantine/release":
+		p := strings.TrimSpace(string(payload))
+		if st.feed.health == nil || !st.feed.health.release(p) {
+			fmt.Fprintf(w, "4 not quarantined: %s\r\n", p)
+			return
+		}
+		log.Printf("admin: %s released %s from quarantine", who.name, p)
+		record("quarantine/release", p)
+		resp = map[string]string{"released": p}
+
+	case "queue/add":
+		p, err := st.feed.resolve(strings.TrimSpace(string(payload)))
+		if err != nil {
+			fmt.Fprintf(w, "4 %v\r\n", err)
+			return
+		}
+		st.feed.enqueue(p)
+		log.Printf("admin: %s queued %s on %s", who.name, p, st.mount)
+		record("queue/add", st.mount+" "+p)
+		resp = map[string]string{"queued": p}
+
+	case "maintenance":
+		m, err := parseMaintenance(string(payload), time.Now())
+		if err != nil {
+			fmt.Fprintf(w, "4 maintenance: %v\r\n", err)
+			return
+		}
+		srv.setMaintenance(m)
+		log.Printf("admin: %s turned maintenance mode on, %s", who.name, m.window())
+		record("maintenance", m.window())
+		resp = map[string]any{"maintenance": true, "window": m.window()}
+
+	case "maintenance/off":
+		srv.setMaintenance(nil)
+		log.Printf("admin: %s turned maintenance mode off", who.name)
+		record("maintenance/off", "")
+		resp = map[string]any{"maintenance": false}
+
+	case "upgrade":
+		if srv.upgrade == nil {
+			fmt.Fprintf(w, "4 upgrade unavailable\r\n")
+			return
+		}
+		// The old process exits once the upgrade is done, so answer first;
+		// the outcome is in the log.
+		record("upgrade", "")
+		go func() {
+			if err := srv.upgrade.upgrade(); err != nil {
+				log.Printf("Upgrade failed: %v", err)
+			}
+		}()
+		resp = map[string]any{"upgrading": true}
+
+	case "report":
+		if st.feed.report == nil {
+			fmt.Fprintf(w, "4 play reports are off\r\n")
+			return
+		}
+		period := query.Get("period")
+		if period == "" {
+			period = time.Now().In(st.feed.report.loc).Format("2006-01-02")
+		}
+		var csv bytes.Buffer
+		if err := st.feed.report.write(&csv, period); err != nil {
+			fmt.Fprintf(w, "4 report: %v\r\n", err)
+			return
+		}
+		fmt.Fprintf(w, "2 text/csv\r\n")
+		_, _ = w.Write(csv.Bytes())
+		return
+
+	case "polls":
+		if srv.polls == nil {
+			fmt.Fprintf(w, "4 no polls\r\n")
+			return
+		}
+		polls, err := srv.polls.adminPolls()
+		if err != nil {
+			fmt.Fprintf(w, "5 polls: %v\r\n", err)
+			return
+		}
+		resp = polls
+
+	case "audit":
+		if srv.auditLog == nil {
+			fmt.Fprintf(w, "4 no audit log\r\n")
+			return
+		}
+		n, err := strconv.Atoi(query.Get("n"))
+		if err != nil || n <= 0 {
+			n = 50
+		}
+		entries, err := srv.auditLog.recent(min(n, 1000))
+		if err != nil {
+			fmt.Fprintf(w, "5 audit: %v\r\n", err)
+			return
+		}
+		resp = entries
+
+	case "reload":
+		if srv.reload == nil {
+			fmt.Fprintf(w, "4 no config file\r\n")
+			return
+		}
+		changes, err := srv.reload()
+		record("reload", reloadDetail(changes, err))
+		if err != nil {
+			fmt.Fprintf(w, "4 reload: %v\r\n", err)
+			return
+		}
+		resp = map[string]any{"changes": changes}
+
+	default:
+		fmt.Fprintf(w, "4 unknown admin command\r\n")
+		return
+	}
+
+	out, err := json.Marshal(resp)
+	if err != nil {
+		fmt.Fprintf(w, "5 %v\r\n", err)
+		return
+	}
+	fmt.Fprintf(w, "2 application/json\r\n%s\n", out)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Each token is recognized by its own signature, and its role decides which
+// commands it may run.
+func TestAdminRoles(t *testing.T) {
+	var list adminTokenList
+	if err := list.Set("wall:viewer:w, dj1:dj:d:with:colons"); err != nil {
+		t.Fatal(err)
+	}
+	a := newAdminAuth(adminTokens("root", &list), 30*time.Second)
+	now := time.Now()
+	sign := func(secret, path, nonce string) []byte {
+		ts := fmt.Sprint(now.Unix())
+		return []byte(fmt.Sprintf("%s %s %s\n", ts, nonce, adminSignature([]byte(secret), "h", path, ts, nonce, nil)))
+	}
+
+	for i, tc := range []struct {
+		secret, cmd string
+		name        string
+		may         bool
+	}{
+		{"w", "status", "wall", true},
+		{"w", "skip", "wall", false},
+		{"d:with:colons", "skip", "dj1", true},
+		{"d:with:colons", "maintenance", "dj1", false},
+		{"root", "upgrade", "admin", true},
+	} {
+		path := "/admin/" + tc.cmd
+		_, who, err := a.verify("h", path, sign(tc.secret, path, fmt.Sprint(i)), now)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if who.name != tc.name || who.role.may(tc.cmd) != tc.may {
+			t.Errorf("%s signed by %s, may = %v; want %s, %v", tc.cmd, who.name, who.role.may(tc.cmd), tc.name, tc.may)
+		}
+	}
+
+	if _, _, err := a.verify("h", "/admin/status", sign("nope", "/admin/status", "x"), now); !errors.Is(err, errAdminBadSig) {
+		t.Errorf("unknown secret: err = %v, want %v", err, errAdminBadSig)
+	}
+	a.setTokens(nil)
+	if _, _, err := a.verify("h", "/admin/status", sign("w", "/admin/status", "y"), now); !errors.Is(err, errAdminBadSig) {
+		t.Errorf("revoked token: err = %v, want %v", err, errAdminBadSig)
+	}
+
+	for _, bad := range []string{"a:root:SECRET", "a:SECRET", "a:dj:SECRET,a:viewer:SECRET", "a:dj:x,SECRET"} {
+		err := list.Set(bad)
+		if err == nil {
+			t.Errorf("Set(%q) succeeded", bad)
+		} else if strings.Contains(err.Error(), "SECRET") {
+			t.Errorf("Set(%q) error shows the secret: %v", bad, err)
+		}
+	}
+}
+
+// recent reads back across days, newest first.
+func TestAuditRecent(t *testing.T) {
+	a := &auditLog{db: newMemStore(), loc: time.UTC}
+	for i, at := range []string{"2026-10-15T23:59:00Z", "2026-10-16T00:01:00Z", "2026-10-16T03:00:00Z"} {
+		a.add(auditEntry{Time: at, By: "ani", Action: fmt.Sprint("skip", i), Remote: "192.0.2.1:1"})
+	}
+	got, err := a.recent(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Action != "skip2" || got[1].Action != "skip1" {
+		t.Errorf("recent(2) = %+v, want skip2, skip1", got)
+	}
+	if all, _ := a.recent(10); len(all) != 3 || all[2].Time != "2026-10-15T23:59:00Z" {
+		t.Errorf("recent(10) = %+v, want all three, oldest last", all)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ---------------- album mode ----------------
+
+// With -group-by=album the rotation is made of albums rather than tracks:
+// the shuffle orders whole albums, and each album plays through in track
+// order. An album is the files sharing an album tag under one parent
+// directory (so discs in subdirectories of the album's directory stay
+// together, and two artists' "Greatest Hits" don't mix), or, for untagged
+// files, a directory. Tracks play in disc and track number order, by file
+// name where the tags don't say.
+
+const (
+	groupByTrack = "track"
+	groupByAlbum = "album"
+)
+
+func checkGroupBy(s string) error {
+	switch s {
+	case groupByTrack, groupByAlbum:
+		return nil
+	}
+	return fmt.Errorf("unknown grouping %q (want track or album)", s)
+}
+
+// groupAlbums splits files into albums, in the order each album first
+// appears in files, and puts every album's tracks in play order.
+func groupAlbums(files []string, tags func(p string) trackTags) [][]string {
+	type entry struct {
+		path string
+		t    trackTags
+	}
+	index := map[string]int{}
+	var albums [][]entry
+	for _, p := range files {
+		t := tags(p)
+		key := filepath.Dir(p)
+		if t.album != "" {
+			key = filepath.Dir(key) + "\x00" + strings.ToLower(t.album)
+		}
+		i, ok := index[key]
+		if !ok {
+			i = len(albums)
+			index[key] = i
+			albums = append(albums, nil)
+		}
+		albums[i] = append(albums[i], entry{p, t})
+	}
+	out := make([][]string, len(albums))
+	for i, a := range albums {
+		sort.SliceStable(a, func(i, j int) bool {
+			x, y := a[i].t, a[j].t
+			if x.disc != y.disc {
+				return x.disc < y.disc
+			}
+			if tx, ty := trackOrder(x), trackOrder(y); tx != ty {
+				return tx < ty
+			}
+			return a[i].path < a[j].path
+		})
+		for _, e := range a {
+			out[i] = append(out[i], e.path)
+		}
+	}
+	return out
+}
+
+// trackOrder puts unnumbered tracks after the numbered ones.
+func trackOrder(t trackTags) int {
+	if t.track <= 0 {
+		return math.MaxInt
+	}
+	return t.track
+}
+
+// albumTags reads the tags groupAlbums needs; a file without them is
+// grouped by its directory.
+func albumTags(p string) trackTags {
+	t, _ := readTags(p)
+	return t
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGroupAlbums(t *testing.T) {
+	tags := map[string]trackTags{
+		"/m/a/Hits/01.flac":   {album: "Greatest Hits", track: 2},
+		"/m/a/Hits/02.flac":   {album: "Greatest Hits", track: 1},
+		"/m/b/Hits/01.flac":   {album: "Greatest Hits", track: 1},
+		"/m/c/Box/CD2/1.flac": {album: "Box", disc: 2, track: 1},
+		"/m/c/Box/CD1/1.flac": {album: "box", disc: 1, track: 1},
+		"/m/c/Box/CD1/2.flac": {album: "Box", disc: 1},
+		"/m/loose/x.wav":      {},
+		"/m/loose/y.wav":      {},
+	}
+	files := []string{
+		"/m/a/Hits/01.flac", "/m/a/Hits/02.flac", "/m/b/Hits/01.flac",
+		"/m/c/Box/CD1/1.flac", "/m/c/Box/CD1/2.flac", "/m/c/Box/CD2/1.flac",
+		"/m/loose/y.wav", "/m/loose/x.wav",
+	}
+	got := groupAlbums(files, func(p string) trackTags { return tags[p] })
+	want := [][]string{
+		{"/m/a/Hits/02.flac", "/m/a/Hits/01.flac"},
+		{"/m/b/Hits/01.flac"},
+		{"/m/c/Box/CD1/1.flac", "/m/c/Box/CD1/2.flac", "/m/c/Box/CD2/1.flac"},
+		{"/m/loose/x.wav", "/m/loose/y.wav"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("albums\n%q\nwant\n%q", got, want)
+	}
+}
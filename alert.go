@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ---------------- alerts ----------------
+
+// Conditions an operator should act on are logged and, with -alert-webhook,
+// POSTed as JSON to that URL. Delivery is best effort: one attempt, in the
+// background, with a short timeout.
+
+type alert struct {
+	Time    string `json:"time"`
+	Station string `json:"station"`
+	Mount   string `json:"mount"`
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+	// Measurement details, if any.
+	Value  float64 `json:"value,omitempty"`
+	Target float64 `json:"target,omitempty"`
+}
+
+type alerter struct {
+	webhook string // empty = log only
+	client  *http.Client
+}
+
+func newAlerter(webhook string) *alerter {
+	return &alerter{webhook: webhook, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (a *alerter) send(st *station, kind, message string, value, target float64) {
+	log.Printf("%s: ALERT %s: %s", st.name, kind, message)
+	if a == nil || a.webhook == "" {
+		return
+	}
+	body, err := json.Marshal(alert{
+		Time:    time.Now().UTC().Format(time.RFC3339),
+		Station: st.name,
+		Mount:   st.mount,
+		Kind:    kind,
+		Message: message,
+		Value:   value,
+		Target:  target,
+	})
+	if err != nil {
+		log.Printf("alert webhook: %v", err)
+		return
+	}
+	go func() {
+		if err := a.post(body); err != nil {
+			log.Printf("alert webhook: %v", err)
+		}
+	}()
+}
+
+func (a *alerter) post(body []byte) error {
+	resp, err := a.client.Post(a.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", a.webhook, resp.Status)
+	}
+	return nil
+}
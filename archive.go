@@ -0,0 +1,653 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------- archive ----------------
+
+// With -archive-dir the broadcast is also written to disk as it goes out,
+// one Ogg file per hour (or per day, -archive-every day) in the station
+// time zone: DIR/2006-01-02/150000.ogg, named for when the segment started.
+// Each segment opens with the stream headers, carrying Vorbis comments for
+// the station name and the segment start, and a sidecar .cue lists the
+// tracks that played in it as chapters; the .cue is rewritten as each track
+// starts, so it is current even for the segment being recorded. A new
+// stream from the encoder (a pipeline restart) starts a new segment.
+
+type archiver struct {
+	dir   string
+	daily bool
+	loc   *time.Location
+	b     *Broadcaster
+
+	mu  sync.Mutex
+	cur *archiveTrack // on air
+	seg *archiveSegment
+}
+
+type archiveTrack struct {
+	performer, title string
+	at               time.Time
+}
+
+type archiveSegment struct {
+	path    string // the .ogg
+	station string
+	start   time.Time
+	end     time.Time // when the next segment is due
+	f       *os.File
+	tracks  []archiveTrack
+	seq     uint32   // next page sequence number
+	base    int64    // stream granule at the segment start
+	last    *oggPage // held back to be marked end-of-stream on close
+}
+
+func newArchiver(dir, every string, loc *time.Location, b *Broadcaster) (*archiver, error) {
+	if every != "hour" && every != "day" {
+		return nil, fmt.Errorf("bad -archive-every %q: want hour or day", every)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &archiver{dir: dir, daily: every == "day", loc: loc, b: b}, nil
+}
+
+// track notes that p has gone on air.
+func (a *archiver) track(p string) {
+	t, _ := readTags(p)
+	if t.title == "" {
+		t.title = newTrackInfo(p).title
+	}
+	at := &archiveTrack{performer: t.artist, title: t.title, at: time.Now()}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.cur = at
+	if a.seg != nil {
+		a.seg.tracks = append(a.seg.tracks, *at)
+		a.writeCue(a.seg)
+	}
+}
+
+// boundary returns the start of the segment period holding t and the start
+// of the next one.
+func (a *archiver) boundary(t time.Time) (time.Time, time.Time) {
+	t = t.In(a.loc)
+	y, m, d := t.Date()
+	if a.daily {
+		return time.Date(y, m, d, 0, 0, 0, 0, a.loc), time.Date(y, m, d+1, 0, 0, 0, 0, a.loc)
+	}
+	h := t.Hour()
+	return time.Date(y, m, d, h, 0, 0, 0, a.loc), time.Date(y, m, d, h+1, 0, 0, 0, a.loc)
+}
+
+// run records the broadcast until the process exits; title names the
+// station in each new segment.
+func (a *archiver) run(title func() string) {
+	for {
+		a.record(title)
+		a.closeSegment()
+		// Dropped for falling behind, most likely a slow disk.
+		log.Printf("Archive: fell behind the broadcast; starting a new segment")
+		time.Sleep(time.Second)
+	}
+}
+
+// record writes segments from one subscription until it is dropped.
+func (a *archiver) record(title func() string) {
+	sub, cancel := a.b.Subscribe(context.Background())
+	defer cancel()
+
+	header := a.b.GetHeaderCopy() // nil: wait for a stream to begin
+	var vh *headerFinder
+	var collected []byte
+	var audio uint32
+	var granule int64 // latest stream granule; -1 until known
+	if header != nil {
+		if pages, ok := parseOggPages(header); ok && len(pages) > 0 {
+			audio = pages[0].serial
+		}
+		granule = -1 // joined mid-stream
+	}
+
+	for raw := range sub {
+		p, ok := parseOggPage(raw)
+		if !ok {
+			continue
+		}
+		if p.flags&0x02 != 0 && granuleRate(p.body) > 0 {
+			a.closeSegment()
+			header, collected, granule = nil, nil, 0
+			vh, audio = &headerFinder{}, p.serial
+		}
+		if header == nil {
+			if vh == nil {
+				continue
+			}
+			vh.feedPage(raw)
+			collected = append(collected, raw...)
+			if vh.done() {
+				header, vh = collected, nil
+			}
+			continue
+		}
+		if p.serial != audio {
+			continue // track signaling has no place in a file
+		}
+
+		now := time.Now()
+		a.mu.Lock()
+		seg := a.seg
+		a.mu.Unlock()
+		if seg == nil || !now.Before(seg.end) {
+			a.closeSegment()
+			base := granule
+			if base < 0 {
+				base = max(0, p.granule) // the first page's samples are lost
+			}
+			if seg, ok = a.openSegment(now, header, title(), base); !ok {
+				return
+			}
+		}
+		if p.granule != -1 {
+			granule = p.granule
+		}
+		if err := seg.write(p); err != nil {
+			log.Printf("Archive: %s: %v", seg.path, err)
+			return
+		}
+	}
+}
+
+// openSegment starts a segment at now with the stream header, the stream
+// having reached granule.
+func (a *archiver) openSegment(now time.Time, header []byte, station string, granule int64) (*archiveSegment, bool) {
+	_, end := a.boundary(now)
+	local := now.In(a.loc)
+	path := filepath.Join(a.dir, local.Format("2006-01-02"), local.Format("150405")+".ogg")
+	hdr, err := archiveHeader(header, station, local)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0o755)
+	}
+	var f *os.File
+	if err == nil {
+		f, err = os.Create(path)
+	}
+	if err == nil {
+		_, err = f.Write(hdr.data)
+	}
+	if err != nil {
+		log.Printf("Archive: %s: %v", path, err)
+		if f != nil {
+			f.Close()
+		}
+		return nil, false
+	}
+
+	seg := &archiveSegment{path: path, station: station, start: local, end: end, f: f, seq: hdr.seq, base: granule}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.cur != nil {
+		seg.tracks = append(seg.tracks, *a.cur)
+	}
+	a.seg = seg
+	a.writeCue(seg)
+	log.Printf("Archive: recording %s", path)
+	return seg, true
+}
+
+func (a *archiver) closeSegment() {
+	a.mu.Lock()
+	seg := a.seg
+	a.seg = nil
+	a.mu.Unlock()
+	if seg == nil {
+		return
+	}
+	var err error
+	if seg.last != nil {
+		seg.last.flags |= 0x04
+		_, err = seg.f.Write(seg.last.bytes())
+	}
+	if cerr := seg.f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Printf("Archive: %s: %v", seg.path, err)
+	}
+}
+
+// write appends an audio page, renumbered and with its granule position
+// counted from the start of the segment. Each page is written when the
+// next one comes in.
+func (seg *archiveSegment) write(p *oggPage) error {
+	q := *p
+	q.flags &^= 0x02 | 0x04
+	q.seq = seg.seq
+	seg.seq++
+	if q.granule != -1 {
+		q.granule = max(0, q.granule-seg.base)
+	}
+	last := seg.last
+	seg.last = &q
+	if last == nil {
+		return nil
+	}
+	_, err := seg.f.Write(last.bytes())
+	return err
+}
+
+// segmentHeader is a segment's header pages and the next page number.
+type segmentHeader struct {
+	data []byte
+	seq  uint32
+}
+
+// archiveHeader rebuilds the Vorbis header pages of a stream header for a
+// segment of station starting at start, dropping other logical streams.
+func archiveHeader(header []byte, station string, start time.Time) (segmentHeader, error) {
+	pages, ok := parseOggPages(header)
+	if !ok || len(pages) == 0 {
+		return segmentHeader{}, errors.New("bad stream header")
+	}
+	first := pages[0]
+	var audio []*oggPage
+	for _, p := range pages {
+		if p.serial == first.serial {
+			audio = append(audio, p)
+		}
+	}
+	packets := oggPackets(audio)
+	if len(packets) < 3 {
+		return segmentHeader{}, errors.New("incomplete stream header")
+	}
+	comment, err := setVorbisComments(packets[1],
+		"TITLE="+station+" "+start.Format("2006-01-02 15:04"),
+		"ORGANIZATION="+station,
+		"DATE="+start.Format(time.RFC3339),
+	)
+	if err != nil {
+		return segmentHeader{}, err
+	}
+	out := first.bytes()
+	rest := paginate(first.serial, first.seq+1, [][]byte{comment, packets[2]})
+	for _, p := range rest {
+		out = append(out, p...)
+	}
+	return segmentHeader{out, first.seq + 1 + uint32(len(rest))}, nil
+}
+
+// setVorbisComments sets comments (FIELD=value) in a Vorbis comment
+// packet, replacing any already there with the same field names.
+func setVorbisComments(pkt []byte, comments ...string) ([]byte, error) {
+	bad := errors.New("bad Vorbis comment packet")
+	if len(pkt) < 7+4 || pkt[0] != 0x03 || !bytes.Equal(pkt[1:7], []byte("vorbis")) {
+		return nil, bad
+	}
+	field := func(c string) string {
+		f, _, _ := strings.Cut(c, "=")
+		return strings.ToUpper(f)
+	}
+	set := make(map[string]bool)
+	for _, c := range comments {
+		set[field(c)] = true
+	}
+
+	off := 7
+	vendorLen := int(binary.LittleEndian.Uint32(pkt[off:]))
+	off += 4 + vendorLen
+	if off+4 > len(pkt) {
+		return nil, bad
+	}
+	vendor := pkt[7:off]
+	count := binary.LittleEndian.Uint32(pkt[off:])
+	off += 4
+	var kept []string
+	for i := uint32(0); i < count; i++ {
+		if off+4 > len(pkt) {
+			return nil, bad
+		}
+		n := int(binary.LittleEndian.Uint32(pkt[off:]))
+		off += 4
+		if off+n > len(pkt) {
+			return nil, bad
+		}
+		if c := string(pkt[off : off+n]); !set[field(c)] {
+			kept = append(kept, c)
+		}
+		off += n
+	}
+	if off > len(pkt) {
+		return nil, bad
+	}
+
+	out := append([]byte{}, pkt[:7]...)
+	out = append(out, vendor...)
+	all := append(kept, comments...)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(all)))
+	for _, c := range all {
+		out = binary.LittleEndian.AppendUint32(out, uint32(len(c)))
+		out = append(out, c...)
+	}
+	return append(out, pkt[off:]...), nil // framing bit
+}
+
+// writeCue writes seg's tracklist next to it. Called with mu held.
+func (a *archiver) writeCue(seg *archiveSegment) {
+	quote := func(s string) string {
+		return `"` + strings.ReplaceAll(oneLine(s), `"`, "'") + `"`
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "REM DATE %s\n", seg.start.Format(time.RFC3339))
+	fmt.Fprintf(&b, "PERFORMER %s\n", quote(seg.station))
+	fmt.Fprintf(&b, "TITLE %s\n", quote(seg.station+" "+seg.start.Format("2006-01-02 15:04")))
+	fmt.Fprintf(&b, "FILE %s WAVE\n", quote(filepath.Base(seg.path)))
+	tracks := seg.tracks
+	if len(tracks) == 0 {
+		tracks = []archiveTrack{{title: seg.station}}
+	}
+	for i, t := range tracks {
+		at := max(0, t.at.Sub(seg.start))
+		if i == 0 {
+			at = 0
+		}
+		frames := int64(at.Seconds() * 75)
+		fmt.Fprintf(&b, "  TRACK %02d AUDIO\n", i+1)
+		fmt.Fprintf(&b, "    TITLE %s\n", quote(t.title))
+		if t.performer != "" {
+			fmt.Fprintf(&b, "    PERFORMER %s\n", quote(t.performer))
+		}
+		fmt.Fprintf(&b, "    INDEX 01 %02d:%02d:%02d\n", frames/75/60, frames/75%60, frames%75)
+	}
+	cue := strings.TrimSuffix(seg.path, ".ogg") + ".cue"
+	tmp := cue + ".tmp"
+	err := os.WriteFile(tmp, []byte(b.String()), 0o644)
+	if err == nil {
+		err = os.Rename(tmp, cue)
+	}
+	if err != nil {
+		log.Printf("Archive: %v", err)
+	}
+}
+
+// ---------------- /archive ----------------
+
+// /archive lists the archived days, newest first; /archive/<day> the
+// segments of a day with their lengths and sizes, and each segment and its
+// .cue download from /archive/<day>/<file>. With -archive-key the archive is
+// private: every request must carry ?key=KEY, which the links then keep.
+
+const archiveDaysPerPage = 31
+
+// archiveFile is one segment on disk.
+type archiveFile struct {
+	name      string // 150000.ogg
+	start     time.Time
+	size      int64
+	length    time.Duration
+	cue       bool // has a tracklist
+	recording bool
+}
+
+// days returns the archived days, newest first.
+func (a *archiver) days() ([]string, error) {
+	entries, err := os.ReadDir(a.dir)
+	if err != nil {
+		return nil, err
+	}
+	var days []string
+	for i := len(entries) - 1; i >= 0; i-- {
+		if _, err := time.Parse("2006-01-02", entries[i].Name()); err == nil && entries[i].IsDir() {
+			days = append(days, entries[i].Name())
+		}
+	}
+	return days, nil
+}
+
+// segments returns the segments of day in time order.
+func (a *archiver) segments(day string) ([]archiveFile, error) {
+	entries, err := os.ReadDir(filepath.Join(a.dir, day))
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	var recording string
+	if a.seg != nil {
+		recording = a.seg.path
+	}
+	a.mu.Unlock()
+
+	var files []archiveFile
+	for _, e := range entries {
+		name := e.Name()
+		start, err := time.ParseInLocation("2006-01-02 150405.ogg", day+" "+name, a.loc)
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(a.dir, day, name)
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		length, _ := oggDuration(path)
+		_, cerr := os.Stat(strings.TrimSuffix(path, ".ogg") + ".cue")
+		files = append(files, archiveFile{name, start, info.Size(), length, cerr == nil, path == recording})
+	}
+	return files, nil
+}
+
+// oggDuration reads the length of an Ogg/Vorbis or Ogg/Opus file from the
+// sample rate in its first page and the granule position of the last.
+func oggDuration(path string) (time.Duration, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	head := make([]byte, 64)
+	if _, err := f.ReadAt(head, 0); err != nil {
+		return 0, err
+	}
+	p, ok := parseOggPage(head)
+	if !ok || len(p.body) < 16 {
+		return 0, errors.New("not Ogg")
+	}
+	// Opus granules count 48 kHz samples from before the pre-skip.
+	var rate, skip int64
+	switch {
+	case p.body[0] == 0x01 && bytes.Equal(p.body[1:7], []byte("vorbis")):
+		rate = int64(binary.LittleEndian.Uint32(p.body[12:16]))
+	case bytes.HasPrefix(p.body, []byte("OpusHead")):
+		rate, skip = 48000, int64(binary.LittleEndian.Uint16(p.body[10:12]))
+	default:
+		return 0, errors.New("not Ogg/Vorbis or Ogg/Opus")
+	}
+	if rate == 0 {
+		return 0, errors.New("no sample rate")
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	off := max(0, info.Size()-64*1024)
+	tail := make([]byte, info.Size()-off)
+	if _, err := f.ReadAt(tail, off); err != nil {
+		return 0, err
+	}
+	for i := bytes.LastIndex(tail, []byte("OggS")); i >= 0; i = bytes.LastIndex(tail[:i], []byte("OggS")) {
+		if p, ok := parseOggPage(tail[i:]); ok && p.granule > skip {
+			return time.Duration((p.granule - skip) * int64(time.Second) / rate), nil
+		}
+	}
+	return 0, nil
+}
+
+// sizeText formats a byte count for listings.
+func sizeText(n int64) string {
+	switch {
+	case n >= 1e9:
+		return fmt.Sprintf("%.1f GB", float64(n)/1e9)
+	case n >= 1e6:
+		return fmt.Sprintf("%.1f MB", float64(n)/1e6)
+	default:
+		return fmt.Sprintf("%d kB", (n+999)/1000)
+	}
+}
+
+// archiveAllowed checks the key of an archive request.
+func (srv *server) archiveAllowed(rawQuery string) bool {
+	if srv.archiveKey == "" {
+		return true
+	}
+	q, _ := url.ParseQuery(rawQuery)
+	return subtle.ConstantTimeCompare([]byte(q.Get("key")), []byte(srv.archiveKey)) == 1
+}
+
+// archiveLink is the link to path, keeping the key of a private archive.
+func (srv *server) archiveLink(path string, params url.Values) string {
+	if srv.archiveKey != "" {
+		if params == nil {
+			params = url.Values{}
+		}
+		params.Set("key", srv.archiveKey)
+	}
+	if len(params) == 0 {
+		return path
+	}
+	return path + "?" + params.Encode()
+}
+
+// handleArchive serves /archive and everything under it.
+func (srv *server) handleArchive(conn net.Conn, path, rawQuery string) {
+	w := conn
+	if !srv.archiveAllowed(rawQuery) {
+		fmt.Fprintf(w, "4 this archive is private\r\n")
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(path, "/archive"), "/"), "/")
+	switch {
+	case parts[0] == "":
+		srv.writeArchive(w, rawQuery)
+	case len(parts) == 1:
+		srv.writeArchiveDay(w, parts[0])
+	case len(parts) == 2:
+		srv.serveArchiveFile(w, parts[0], parts[1])
+	default:
+		fmt.Fprintf(w, "4 not found\r\n")
+	}
+}
+
+func (srv *server) writeArchive(w io.Writer, rawQuery string) {
+	days, err := srv.archive.days()
+	if err != nil {
+		log.Printf("Archive: %v", err)
+		fmt.Fprintf(w, "5 archive unavailable\r\n")
+		return
+	}
+	q, _ := url.ParseQuery(rawQuery)
+	page, _ := strconv.Atoi(q.Get("page"))
+	start, end, page, pages := pageBounds(len(days), page, archiveDaysPerPage)
+
+	fmt.Fprintf(w, "2 text/gemini; charset=utf-8\r\n")
+	fmt.Fprintf(w, "# %s: archive\n\n", srv.title())
+	if len(days) == 0 {
+		fmt.Fprintf(w, "Nothing has been archived yet.\n")
+		return
+	}
+	for _, day := range days[start:end] {
+		segs, _ := srv.archive.segments(day)
+		var size int64
+		var length time.Duration
+		for _, s := range segs {
+			size += s.size
+			length += s.length
+		}
+		t, _ := time.Parse("2006-01-02", day)
+		count := fmt.Sprintf("%d segments", len(segs))
+		if len(segs) == 1 {
+			count = "1 segment"
+		}
+		fmt.Fprintf(w, "=> %s %s, %s: %s, %s, %s\n", srv.archiveLink("/archive/"+day, nil),
+			day, t.Format("Monday"), count, lengthText(length), sizeText(size))
+	}
+	var params url.Values
+	if srv.archiveKey != "" {
+		params = url.Values{"key": {srv.archiveKey}}
+	}
+	writePager(w, "/archive", params, page, pages)
+}
+
+func (srv *server) writeArchiveDay(w io.Writer, day string) {
+	if _, err := time.Parse("2006-01-02", day); err != nil {
+		fmt.Fprintf(w, "4 not found\r\n")
+		return
+	}
+	segs, err := srv.archive.segments(day)
+	if err != nil {
+		fmt.Fprintf(w, "4 nothing archived on %s\r\n", day)
+		return
+	}
+	fmt.Fprintf(w, "2 text/gemini; charset=utf-8\r\n")
+	fmt.Fprintf(w, "# %s: archive, %s\n\n", srv.title(), day)
+	for _, s := range segs {
+		label := fmt.Sprintf("%s, %s, %s", s.start.Format("15:04:05"), lengthText(s.length), sizeText(s.size))
+		if s.recording {
+			label += " (recording)"
+		}
+		fmt.Fprintf(w, "=> %s %s\n", srv.archiveLink("/archive/"+day+"/"+s.name, nil), label)
+		if s.cue {
+			cue := strings.TrimSuffix(s.name, ".ogg") + ".cue"
+			fmt.Fprintf(w, "=> %s Tracklist\n", srv.archiveLink("/archive/"+day+"/"+cue, nil))
+		}
+	}
+	fmt.Fprintf(w, "\n=> %s All days\n", srv.archiveLink("/archive", nil))
+}
+
+// serveArchiveFile sends a segment or its tracklist. A segment still being
+// recorded is sent as far as it has got.
+func (srv *server) serveArchiveFile(conn net.Conn, day, name string) {
+	stem, ext, _ := strings.Cut(name, ".")
+	_, derr := time.Parse("2006-01-02", day)
+	_, serr := time.Parse("150405", stem)
+	mime := map[string]string{"ogg": "audio/ogg", "cue": "text/plain; charset=utf-8"}[ext]
+	if derr != nil || serr != nil || mime == "" {
+		fmt.Fprintf(conn, "4 not found\r\n")
+		return
+	}
+	f, err := os.Open(filepath.Join(srv.archive.dir, day, name))
+	if err != nil {
+		fmt.Fprintf(conn, "4 not found\r\n")
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(conn, "2 %s\r\n", mime)
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := f.Read(buf)
+		if n > 0 {
+			_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		if rerr != nil {
+			return
+		}
+	}
+}
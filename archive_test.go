@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestArchiveHeader(t *testing.T) {
+	comment := []byte("\x03vorbis\x04\x00\x00\x00test\x02\x00\x00\x00\x0b\x00\x00\x00title=Live!\x07\x00\x00\x00GENRE=x\x01")
+	var header []byte
+	for _, p := range paginate(7, 0, [][]byte{[]byte("\x01vorbis ident")}) {
+		header = append(header, p...)
+	}
+	for _, p := range paginate(7, 1, [][]byte{comment, []byte("\x05vorbis setup")}) {
+		header = append(header, p...)
+	}
+	// A track signaling stream, which segments leave out.
+	header = append(header, (&oggPage{flags: 0x02, serial: 9, segs: []byte{7}, body: []byte("SPTRACK")}).bytes()...)
+
+	start := time.Date(2026, 10, 16, 14, 0, 5, 0, time.UTC)
+	hdr, err := archiveHeader(header, "Test FM", start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages, ok := parseOggPages(hdr.data)
+	if !ok || len(pages) != 2 || hdr.seq != 2 {
+		t.Fatalf("got %d pages, next seq %d; want 2 and 2", len(pages), hdr.seq)
+	}
+	for _, p := range pages {
+		if p.serial != 7 {
+			t.Errorf("page of stream %d in the segment header", p.serial)
+		}
+	}
+	packets := oggPackets(pages)
+	want := "\x03vorbis\x04\x00\x00\x00test\x04\x00\x00\x00" +
+		"\x07\x00\x00\x00GENRE=x" +
+		"\x1e\x00\x00\x00TITLE=Test FM 2026-10-16 14:00" +
+		"\x14\x00\x00\x00ORGANIZATION=Test FM" +
+		"\x19\x00\x00\x00DATE=2026-10-16T14:00:05Z\x01"
+	if len(packets) != 3 || !bytes.Equal(packets[1], []byte(want)) {
+		t.Errorf("comment packet = %q, want %q", packets[1], want)
+	}
+}
+
+func TestArchiveBoundary(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, tc := range []struct {
+		every      string
+		at         string
+		start, end string
+	}{
+		{"hour", "2026-10-16T14:59:59+02:00", "2026-10-16T14:00:00+02:00", "2026-10-16T15:00:00+02:00"},
+		{"day", "2026-10-16T00:00:00+02:00", "2026-10-16T00:00:00+02:00", "2026-10-17T00:00:00+02:00"},
+		// The day clocks go back is 25 hours long.
+		{"day", "2026-10-25T12:00:00+01:00", "2026-10-25T00:00:00+02:00", "2026-10-26T00:00:00+01:00"},
+	} {
+		a := &archiver{daily: tc.every == "day", loc: loc}
+		at, _ := time.Parse(time.RFC3339, tc.at)
+		start, end := a.boundary(at)
+		if got := start.Format(time.RFC3339) + " " + end.Format(time.RFC3339); got != tc.start+" "+tc.end {
+			t.Errorf("%s boundary of %s = %s, want %s %s", tc.every, tc.at, got, tc.start, tc.end)
+		}
+	}
+}
+
+func TestNeedsTranscode(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, head []byte) string {
+		path := filepath.Join(dir, name)
+		var data []byte
+		for _, p := range paginate(1, 0, [][]byte{head}) {
+			data = append(data, p...)
+		}
+		if err := os.WriteFile(path, append(data, make([]byte, 64)...), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	ident := func(nominal uint32) []byte {
+		b := []byte("\x01vorbis\x00\x00\x00\x00\x02\x44\xac\x00\x00\x00\x00\x00\x00")
+		b = binary.LittleEndian.AppendUint32(b, nominal)
+		return append(b, 0, 0, 0, 0, 0xb8, 1)
+	}
+	v192 := write("v192.ogg", ident(192000))
+	v64 := write("v64.ogg", ident(64000))
+	opus := write("opus.ogg", []byte("OpusHead\x01\x02\x38\x01\x44\xac\x00\x00\x00\x00\x00"))
+	for _, tc := range []struct {
+		path, codec string
+		kbps        int
+		want        bool
+	}{
+		{v192, "vorbis", 96, true},
+		{v64, "vorbis", 96, false},
+		{v64, "opus", 96, true},
+		{opus, "opus", 32, false},
+		{opus, "vorbis", 32, false},
+	} {
+		if got := needsTranscode(tc.path, tc.codec, tc.kbps); got != tc.want {
+			t.Errorf("needsTranscode(%s, %s, %d) = %v, want %v", filepath.Base(tc.path), tc.codec, tc.kbps, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ---------------- admin audit log ----------------
+
+// Every admin action that changes something, and every command refused for
+// lack of a role, is recorded with who (the admin token), what, when and
+// from where. Entries are kept in the store as JSON lines, one key per day
+// in the station time zone; /admin/status carries the latest few and
+// /admin/audit lists more. Actions are also written to the broadcast log,
+// if there is one; refusals are not, as nothing went out.
+
+const (
+	auditBucket = "audit"
+	auditRecent = 5 // entries in /admin/status
+)
+
+type auditEntry struct {
+	Time    string `json:"time"`
+	By      string `json:"by,omitempty"` // token name; empty for signals
+	Role    string `json:"role,omitempty"`
+	Action  string `json:"action"`
+	Detail  string `json:"detail,omitempty"`
+	Remote  string `json:"remote"`
+	Refused bool   `json:"refused,omitempty"`
+}
+
+type auditLog struct {
+	db  store
+	loc *time.Location
+
+	mu sync.Mutex // serializes read-modify-write of a day's entries
+}
+
+func (a *auditLog) add(e auditEntry) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("audit: %v", err)
+		return
+	}
+	at, _ := time.Parse(time.RFC3339, e.Time)
+	day := at.In(a.loc).Format("2006-01-02")
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	data, err := a.db.Get(auditBucket, day)
+	if err != nil && !errors.Is(err, errNotFound) {
+		log.Printf("audit: %v", err)
+		return
+	}
+	if err := a.db.Put(auditBucket, day, append(append(data, line...), '\n')); err != nil {
+		log.Printf("audit: %v", err)
+	}
+}
+
+// recent returns up to n entries, newest first.
+func (a *auditLog) recent(n int) ([]auditEntry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	days, err := a.db.Keys(auditBucket)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(days)))
+	out := []auditEntry{}
+	for _, day := range days {
+		data, err := a.db.Get(auditBucket, day)
+		if err != nil {
+			return nil, err
+		}
+		lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+		for i := len(lines) - 1; i >= 0 && len(out) < n; i-- {
+			var e auditEntry
+			if err := json.Unmarshal(lines[i], &e); err == nil {
+				out = append(out, e)
+			}
+		}
+		if len(out) >= n {
+			break
+		}
+	}
+	return out, nil
+}
+
+// audit records an admin action, or a refused one.
+func (srv *server) audit(e auditEntry) {
+	e.Time = time.Now().UTC().Format(time.RFC3339)
+	if srv.auditLog != nil {
+		srv.auditLog.add(e)
+	}
+	if srv.blog != nil && !e.Refused {
+		srv.blog.admin(e.Action, e.Detail, e.By, e.Remote)
+	}
+}
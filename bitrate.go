@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// ---------------- encoder bitrate monitoring ----------------
+
+// The broadcaster measures the bitrate the encoder actually produces: the
+// bytes of its Ogg pages over bitrateWindow of audio, timed by granule
+// position rather than the wall clock so that pacing jitter doesn't show up
+// as drift. With a target bitrate set (-bitrate-kbps), a measurement more than
+// -bitrate-drift percent away from it raises an alert; the station is not
+// touched. Quality mode (-vorbis-q) has no target and is only measured.
+
+const bitrateWindow = 30 * time.Second
+
+type bitrateMeter struct {
+	mu     sync.Mutex
+	bytes  int64
+	start  int64 // granule at the start of the window, -1 = none yet
+	serial uint32
+	rate   int // granules a second, from the stream's ident header
+
+	kbps float64 // latest complete window
+	at   time.Time
+}
+
+// page accounts one page of the encoder's stream.
+func (m *bitrateMeter) page(page []byte) {
+	if len(page) < 27 {
+		return
+	}
+	granule := int64(binary.LittleEndian.Uint64(page[6:14]))
+	serial := binary.LittleEndian.Uint32(page[14:18])
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// A new logical stream (pipeline restart) starts a new window.
+	if page[5]&0x02 != 0 || serial != m.serial {
+		m.serial, m.bytes, m.start, m.rate = serial, 0, -1, 0
+		if p, ok := parseOggPage(page); ok {
+			m.rate = granuleRate(p.body)
+		}
+	}
+	m.bytes += int64(len(page))
+	if granule < 0 {
+		return // no packet ends on this page
+	}
+	if m.start < 0 {
+		m.start, m.bytes = granule, 0
+		return
+	}
+	rate := m.rate
+	if rate == 0 {
+		rate = pcmRate
+	}
+	secs := float64(granule-m.start) / float64(rate)
+	if secs < bitrateWindow.Seconds() {
+		return
+	}
+	m.kbps = float64(m.bytes) * 8 / secs / 1000
+	m.at = time.Now()
+	m.start, m.bytes = granule, 0
+}
+
+// latest returns the most recent measurement; at is zero before the first.
+func (m *bitrateMeter) latest() (kbps float64, at time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.kbps, m.at
+}
+
+// watchBitrate compares each new measurement against the configured target
+// and alerts once when the bitrate drifts off it and once when it returns.
+func (st *station) watchBitrate(driftPct float64, alerts *alerter) {
+	var seen time.Time
+	drifting := false
+	tick := time.NewTicker(bitrateWindow / 3)
+	defer tick.Stop()
+	for range tick.C {
+		kbps, at := st.b.rate.latest()
+		if !at.After(seen) {
+			continue
+		}
+		seen = at
+		target := float64(st.onAirEncoder().bitrateKbps)
+		if target <= 0 {
+			drifting = false
+			continue
+		}
+		off := (kbps - target) / target * 100
+		switch {
+		case math.Abs(off) > driftPct && !drifting:
+			drifting = true
+			msg := fmt.Sprintf("encoder produces %.0f kbps, %+.0f%% off the %.0f kbps target", kbps, off, target)
+			st.wmu.Lock()
+			st.drifts++
+			st.lastDrift = incident{at: at, reason: msg}
+			st.wmu.Unlock()
+			alerts.send(st, "bitrate_drift", msg, kbps, target)
+		case math.Abs(off) <= driftPct && drifting:
+			drifting = false
+			log.Printf("%s: encoder bitrate back to %.0f kbps (target %.0f)", st.name, kbps, target)
+		}
+	}
+}
+
+// bitrateAlarms returns how often the bitrate drifted and the latest incident.
+func (st *station) bitrateAlarms() (int, incident) {
+	st.wmu.Lock()
+	defer st.wmu.Unlock()
+	return st.drifts, st.lastDrift
+}
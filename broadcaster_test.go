@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestBroadcasterSubscribe(t *testing.T) {
+	b := NewBroadcaster(bufferLimits{})
+
+	// No hub running: cancelling must neither block nor panic when repeated.
+	_, cancel := b.Subscribe(context.Background())
+	cancel()
+	cancel()
+	if n := b.Listeners(); n != 0 {
+		t.Fatalf("listeners after cancel: %d", n)
+	}
+
+	go b.Run()
+
+	ctx, done := context.WithCancel(context.Background())
+	sub, cancel := b.Subscribe(ctx)
+	defer cancel()
+	b.Publish([]byte("page"))
+	select {
+	case p := <-sub:
+		if string(p) != "page" {
+			t.Fatalf("got %q", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("page not delivered")
+	}
+
+	done()
+	select {
+	case _, ok := <-sub:
+		if ok {
+			t.Fatal("channel still open after ctx was cancelled")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ctx cancel did not close the channel")
+	}
+
+	// A subscriber that never reads is dropped once its queue is full.
+	slow, cancel := b.Subscribe(context.Background())
+	defer cancel()
+	for i := 0; i <= subscriberQueue; i++ {
+		b.Publish([]byte{byte(i)})
+	}
+	for deadline := time.Now().Add(time.Second); b.Listeners() > 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("slow subscriber was not dropped")
+		}
+	}
+	n := 0
+	for range slow {
+		n++
+	}
+	if n != subscriberQueue {
+		t.Fatalf("dropped after %d pages, want %d", n, subscriberQueue)
+	}
+}
+
+func TestBroadcasterBurst(t *testing.T) {
+	b := NewBroadcaster(bufferLimits{})
+	b.SetBurst(time.Minute)
+	go b.Run()
+
+	bos := []byte("OggS\x00\x02")
+	settle := func(n int64) {
+		for deadline := time.Now().Add(time.Second); b.pagesOut.Load() < n; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("hub did not take the pages")
+			}
+		}
+	}
+	b.Publish(bos)
+	b.PublishAudio([]byte("a"))
+	b.PublishAudio([]byte("b"))
+	settle(3)
+
+	backlogFrom := func(since time.Time) [][]byte {
+		backlog, _, cancel := b.SubscribeFrom(context.Background(), since)
+		cancel()
+		return backlog
+	}
+	if backlog := backlogFrom(time.Now().Add(-time.Second)); len(backlog) != 2 || string(backlog[0]) != "a" || string(backlog[1]) != "b" {
+		t.Fatalf("backlog %q", backlog)
+	}
+	if backlog := backlogFrom(time.Now().Add(time.Second)); len(backlog) != 0 {
+		t.Fatalf("backlog from the future: %q", backlog)
+	}
+
+	// A new stream makes the buffered pages useless.
+	b.Publish(bos)
+	settle(4)
+	if backlog := backlogFrom(time.Now().Add(-time.Minute)); len(backlog) != 0 {
+		t.Fatalf("backlog after a new stream: %q", backlog)
+	}
+}
+
+// However long -burst is, the buffer holds no more than its byte limit.
+func TestBroadcasterBurstLimit(t *testing.T) {
+	b := NewBroadcaster(bufferLimits{burst: 10})
+	b.SetBurst(24 * time.Hour)
+	now := time.Now()
+	for _, page := range []string{"aaaa", "bbbb", "cccc"} {
+		b.fanOut(hubFrame{page: []byte(page), audio: true})
+	}
+	backlog, _, cancel := b.SubscribeFrom(context.Background(), now.Add(-time.Hour))
+	cancel()
+	if len(backlog) != 2 || string(backlog[0]) != "bbbb" || string(backlog[1]) != "cccc" {
+		t.Fatalf("backlog %q", backlog)
+	}
+	if u := b.Buffers()[1]; u.name != "Burst buffer" || u.bytes != 8 || u.limit != 10 {
+		t.Fatalf("burst buffer usage %+v", u)
+	}
+}
+
+func TestBroadcasterConnectBurst(t *testing.T) {
+	b := NewBroadcaster(bufferLimits{})
+	b.SetConnectBurst(50 * time.Millisecond)
+	go b.Run()
+
+	b.PublishAudio([]byte("old"))
+	for deadline := time.Now().Add(time.Second); b.pagesOut.Load() < 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("hub did not take the page")
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	b.PublishAudio([]byte("new"))
+	for deadline := time.Now().Add(time.Second); b.pagesOut.Load() < 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("hub did not take the page")
+		}
+	}
+
+	// Without -burst the buffer still holds the connect burst, and no more.
+	backlog, _, cancel := b.SubscribeFrom(context.Background(), time.Now().Add(-b.ConnectBurst()))
+	cancel()
+	if len(backlog) != 1 || string(backlog[0]) != "new" {
+		t.Fatalf("backlog %q", backlog)
+	}
+}
+
+func TestBroadcastClosesCutStream(t *testing.T) {
+	b := NewBroadcaster(bufferLimits{})
+	go b.Run()
+	_, sub, cancel := b.SubscribeFrom(context.Background(), time.Time{})
+	defer cancel()
+
+	audio, _ := parseOggPage(paginate(0x0b05, 2, [][]byte{[]byte("audio")})[0])
+	audio.granule = 960
+	// The encoder dies after one audio page, without an EOS page.
+	stream := append(opusHeader(), audio.bytes()...)
+	if err := broadcastFromEncoder(bytes.NewReader(stream), b, 0); err == nil {
+		t.Fatal("no error at the end of the output")
+	}
+
+	var last []byte
+	for n := 0; n < 4; n++ {
+		select {
+		case last = <-sub:
+		case <-time.After(time.Second):
+			t.Fatalf("got %d pages, want 4", n)
+		}
+	}
+	p, ok := parseOggPage(last)
+	if !ok || p.flags != 0x04 || p.serial != 0x0b05 || p.seq != 3 || p.granule != 960 || len(p.segs) != 0 {
+		t.Fatalf("closing page %+v", p)
+	}
+}
+
+func TestBroadcastCachesEachLink(t *testing.T) {
+	b := NewBroadcaster(bufferLimits{})
+	go b.Run()
+
+	link := func(serial uint32) []byte {
+		pages, _ := parseOggPages(opusHeader())
+		var out []byte
+		for _, p := range pages {
+			p.serial = serial
+			out = append(out, p.bytes()...)
+		}
+		end, _ := parseOggPage(paginate(serial, 2, [][]byte{[]byte("audio")})[0])
+		end.granule, end.flags = 960, 0x04
+		return append(out, end.bytes()...)
+	}
+	second := link(0x0c06)
+	stream := append(link(0x0b05), second...)
+	_ = broadcastFromEncoder(bytes.NewReader(stream), b, 0)
+
+	if got, want := b.GetHeaderCopy(), second[:len(opusHeader())]; !bytes.Equal(got, want) {
+		t.Fatalf("cached header is not the second link's")
+	}
+}
+
+// Listeners who joined on a header saved by the previous process get its
+// streams ended before the new encoder's begin.
+func TestBroadcastEndsRestoredHeader(t *testing.T) {
+	b := NewBroadcaster(bufferLimits{})
+	go b.Run()
+	old, _ := parseOggPages(opusHeader())
+	var saved []byte
+	for _, p := range old {
+		p.serial = 0x0a01
+		saved = append(saved, p.bytes()...)
+	}
+	b.restoreHeader(saved, nil, time.Now())
+	if !bytes.Equal(b.GetHeaderCopy(), saved) {
+		t.Fatal("restored header not cached")
+	}
+	_, sub, cancel := b.SubscribeFrom(context.Background(), time.Time{})
+	defer cancel()
+
+	_ = broadcastFromEncoder(bytes.NewReader(opusHeader()), b, 0)
+	var got []*oggPage
+	for len(got) < 2 {
+		select {
+		case page := <-sub:
+			p, _ := parseOggPage(page)
+			got = append(got, p)
+		case <-time.After(time.Second):
+			t.Fatalf("got %d pages, want 2", len(got))
+		}
+	}
+	if p := got[0]; p.flags != 0x04 || p.serial != 0x0a01 || p.seq != uint32(len(old)) {
+		t.Errorf("first page %+v, want the restored stream's EOS", p)
+	}
+	if p := got[1]; p.flags&0x02 == 0 || p.serial == 0x0a01 {
+		t.Errorf("second page %+v, want the new encoder's BOS", p)
+	}
+	if !bytes.Equal(b.GetHeaderCopy(), opusHeader()) {
+		t.Error("the new encoder's header is not cached")
+	}
+}
+
+// A restart keeps the burst buffer's pages of the saved streams, so
+// reconnecting listeners get their connect burst from the saved audio.
+func TestWarmRestartKeepsBurst(t *testing.T) {
+	dir := t.TempDir()
+	old := &station{name: "radio", b: NewBroadcaster(bufferLimits{})}
+	old.b.SetHeader(opusHeader())
+	old.b.SetConnectBurst(time.Minute)
+	now := time.Now()
+	for i, serial := range []uint32{0x0b05, 0x0b05, 0x0c06} {
+		p, _ := parseOggPage(paginate(serial, uint32(2+i), [][]byte{[]byte("audio")})[0])
+		p.granule = int64(960 * (i + 1))
+		old.b.remember(hubFrame{p.bytes(), true}, now.Add(time.Duration(i)*time.Second), 0)
+	}
+	if err := old.saveHeader(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	st := &station{name: "radio", b: NewBroadcaster(bufferLimits{})}
+	st.b.SetConnectBurst(time.Minute)
+	st.loadHeader(dir)
+	backlog, _, cancel := st.b.SubscribeFrom(context.Background(), time.Now().Add(-st.b.ConnectBurst()))
+	cancel()
+	// The page of a stream the header doesn't begin is not kept.
+	if len(backlog) != 2 {
+		t.Fatalf("restored %d burst pages, want 2", len(backlog))
+	}
+	if p, _ := parseOggPage(backlog[1]); p.serial != 0x0b05 || p.seq != 3 {
+		t.Fatalf("last restored page %+v", p)
+	}
+
+	_, sub, cancel := st.b.SubscribeFrom(context.Background(), time.Time{})
+	defer cancel()
+	go st.b.Run()
+	st.b.endRestored()
+	select {
+	case page := <-sub:
+		if p, _ := parseOggPage(page); p.flags != 0x04 || p.seq != 4 || p.granule != 1920 {
+			t.Errorf("EOS page %+v, want one after the restored audio", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no EOS page")
+	}
+	if pages := st.b.burstPages(); len(pages) != 0 {
+		t.Errorf("%d restored pages left in the burst buffer", len(pages))
+	}
+}
+
+// A panic while fanning out a page must not leave the subscriber lock held
+// for the restarted hub.
+func TestBroadcasterFanOutPanicUnlocks(t *testing.T) {
+	b := NewBroadcaster(bufferLimits{})
+	closed := make(chan []byte)
+	close(closed)
+	b.subs[closed] = struct{}{}
+	func() {
+		defer func() { recover() }()
+		b.fanOut(hubFrame{page: []byte("page")})
+	}()
+	delete(b.subs, closed)
+
+	done := make(chan struct{})
+	go func() {
+		_, cancel := b.Subscribe(context.Background())
+		cancel()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Subscribe blocked after a panic in the hub")
+	}
+}
+
+func TestJoinPoint(t *testing.T) {
+	st := &station{b: NewBroadcaster(bufferLimits{})}
+	st.b.SetBurst(time.Minute)
+	now := time.Now()
+	tests := []struct {
+		offset string
+		want   time.Time
+		bad    bool
+	}{
+		{"", time.Time{}, false},
+		{"0", time.Time{}, false},
+		{"30", now.Add(-30 * time.Second), false},
+		{"1.5", now.Add(-1500 * time.Millisecond), false},
+		// Past the buffer, and far past what a Duration holds.
+		{"600", now.Add(-time.Minute), false},
+		{"1e300", now.Add(-time.Minute), false},
+		{"-5", time.Time{}, true},
+		{"NaN", time.Time{}, true},
+		{"Inf", time.Time{}, true},
+		{"-Inf", time.Time{}, true},
+		{"soon", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := joinPoint(st, url.Values{"offset": {tt.offset}}, now)
+		if (err != nil) != tt.bad || !got.Equal(tt.want) {
+			t.Errorf("offset=%s: %v, %v", tt.offset, got, err)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------- broadcast log ----------------
+
+// With -broadcast-log PATH the server appends a line of JSON to PATH for
+// every file that goes on air and every operator action, for stations that
+// must account for what they broadcast. Each entry carries the SHA-256 of
+// the line before it, so editing, inserting or deleting an entry breaks the
+// chain from there on, which "spartan-radio verify-log PATH" finds. Cutting
+// entries off the end leaves a valid chain; to catch that, keep the head
+// hash that verify-log prints somewhere the station does not control.
+
+// blogGenesis is the prev of the first entry.
+var blogGenesis = strings.Repeat("0", 64)
+
+type blogEntry struct {
+	Seq    int64  `json:"seq"`
+	Time   string `json:"time"`
+	Event  string `json:"event"` // start, track or admin
+	Mount  string `json:"mount,omitempty"`
+	File   string `json:"file,omitempty"`
+	Artist string `json:"artist,omitempty"`
+	Title  string `json:"title,omitempty"`
+	Action string `json:"action,omitempty"`
+	Detail string `json:"detail,omitempty"`
+	By     string `json:"by,omitempty"` // admin token name
+	Remote string `json:"remote,omitempty"`
+	Prev   string `json:"prev"`
+}
+
+type broadcastLog struct {
+	mu   sync.Mutex
+	f    *os.File
+	seq  int64
+	prev string
+}
+
+// openBroadcastLog opens the log at path for appending, continuing the
+// chain already in it.
+func openBroadcastLog(path string) (*broadcastLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	bl := &broadcastLog{f: f, prev: blogGenesis}
+	last, err := lastLine(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if last != nil {
+		var e blogEntry
+		if err := json.Unmarshal(last, &e); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("last entry unreadable (check with verify-log): %v", err)
+		}
+		bl.seq = e.Seq + 1
+		bl.prev = blogHash(last)
+	}
+	return bl, nil
+}
+
+// lastLine returns the last line of f, without its newline.
+func lastLine(f *os.File) ([]byte, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	for n := int64(4096); ; n *= 2 {
+		off := max(0, info.Size()-n)
+		buf := make([]byte, info.Size()-off)
+		if _, err := f.ReadAt(buf, off); err != nil && err != io.EOF {
+			return nil, err
+		}
+		buf = bytes.TrimRight(buf, "\n")
+		if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+			return buf[i+1:], nil
+		}
+		if off == 0 {
+			if len(buf) == 0 {
+				return nil, nil
+			}
+			return buf, nil
+		}
+	}
+}
+
+func blogHash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// add appends e, filling in its sequence number, time and chain hash.
+func (bl *broadcastLog) add(e blogEntry) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	e.Seq, e.Prev = bl.seq, bl.prev
+	e.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	line, err := json.Marshal(e)
+	if err == nil {
+		_, err = bl.f.Write(append(line, '\n'))
+	}
+	if err == nil {
+		err = bl.f.Sync()
+	}
+	if err != nil {
+		log.Printf("broadcast log: %v", err)
+		return
+	}
+	bl.seq++
+	bl.prev = blogHash(line)
+}
+
+// track logs p going on air on mount.
+func (bl *broadcastLog) track(mount, p string) {
+	t, _ := readTags(p)
+	bl.add(blogEntry{Event: "track", Mount: mount, File: p, Artist: t.artist, Title: t.title})
+}
+
+// admin logs an operator action.
+func (bl *broadcastLog) admin(action, detail, by, remote string) {
+	bl.add(blogEntry{Event: "admin", Action: action, Detail: detail, By: by, Remote: remote})
+}
+
+// reloadDetail describes the outcome of a config reload for admin entries.
+func reloadDetail(changes []configChange, err error) string {
+	if err != nil {
+		return "failed: " + err.Error()
+	}
+	var parts []string
+	for _, c := range changes {
+		parts = append(parts, c.Name+"="+c.New)
+	}
+	return strings.Join(parts, " ")
+}
+
+// verifyBroadcastLog checks the chain in r, returning the number of entries
+// and the hash of the last one.
+func verifyBroadcastLog(r io.Reader) (n int64, head string, err error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	head = blogGenesis
+	for sc.Scan() {
+		var e blogEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return n, head, fmt.Errorf("line %d: %v", n+1, err)
+		}
+		switch {
+		case e.Seq != n:
+			return n, head, fmt.Errorf("line %d: entry %d where %d was expected; entries were removed or inserted", n+1, e.Seq, n)
+		case e.Prev != head && n == 0:
+			return n, head, errors.New("line 1: does not start a chain")
+		case e.Prev != head:
+			return n, head, fmt.Errorf("line %d: hash of line %d does not match; it was altered", n+1, n)
+		}
+		head = blogHash(sc.Bytes())
+		n++
+	}
+	return n, head, sc.Err()
+}
+
+// verifyLog runs the verify-log subcommand with args.
+func verifyLog(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: verify-log FILE")
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, head, err := verifyBroadcastLog(f)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("ok: %d entries, head %s\n", n, head)
+	return nil
+}
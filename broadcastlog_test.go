@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The chain survives a reopen, and editing or removing an entry is found.
+func TestBroadcastLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broadcast.log")
+	bl, err := openBroadcastLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl.add(blogEntry{Event: "start"})
+	bl.track("/radio", "a.wav")
+	bl.f.Close()
+	if bl, err = openBroadcastLog(path); err != nil {
+		t.Fatal(err)
+	}
+	bl.admin("skip", "/radio", "alice", "192.0.2.1:4000")
+	bl.track("/radio", "b.wav")
+	bl.f.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, head, err := verifyBroadcastLog(bytes.NewReader(data))
+	if err != nil || n != 4 {
+		t.Fatalf("verify = %d entries, %v; want 4, nil", n, err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	if head != blogHash([]byte(strings.TrimSpace(lines[3]))) {
+		t.Errorf("head %s is not the hash of the last entry", head)
+	}
+
+	for name, tampered := range map[string]string{
+		"edited":  lines[0] + strings.Replace(lines[1], "a.wav", "c.wav", 1) + lines[2] + lines[3],
+		"removed": lines[0] + lines[1] + lines[3],
+	} {
+		if _, _, err := verifyBroadcastLog(strings.NewReader(tampered)); err == nil {
+			t.Errorf("%s entry not detected", name)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// ---------------- listener limit ----------------
+
+// -max-listeners caps the listeners across all stations. With
+// -adaptive-listeners the server also measures what each listener actually
+// receives against what the station sent. A listener on a poor connection
+// falls behind on its own; when the uplink saturates, a good share of them
+// fall behind at once. The limit then drops to the number of listeners the
+// uplink carried at full rate, and new listeners are turned away instead of
+// degrading everyone already connected. While the server is at the limit
+// and everyone keeps up, the limit is raised a step at a time, up to
+// -max-listeners if that is set.
+
+const (
+	capacityEvery     = 10 * time.Second
+	capacitySettle    = 30 * time.Second // the join backlog arrives faster than the stream
+	capacityBehind    = 0.9              // a listener receiving less than this share of the stream falls behind
+	capacitySaturated = 0.25             // share of listeners behind that means the uplink is full
+)
+
+type listenerLimit struct {
+	max      int // static cap; 0 = none
+	adaptive bool
+
+	mu      sync.Mutex
+	limit   int                 // current cap; 0 = none
+	changes int                 // adaptive changes
+	last    incident            // the latest of them
+	prev    map[*listener]int64 // bytes each listener had at the previous sample
+	sent    map[*station]int64  // bytes each station had sent then
+}
+
+func newListenerLimit(max int, adaptive bool) *listenerLimit {
+	return &listenerLimit{max: max, adaptive: adaptive, limit: max}
+}
+
+// current returns the limit in force; 0 = none.
+func (ll *listenerLimit) current() int {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	return ll.limit
+}
+
+func (srv *server) listenerCount() int {
+	n := 0
+	for _, st := range srv.stations {
+		st.lmu.Lock()
+		n += len(st.listeners)
+		st.lmu.Unlock()
+	}
+	return n
+}
+
+// admitListener answers a stream request with "5" and returns false when
+// the server is full.
+func (srv *server) admitListener(w io.Writer) bool {
+	if srv.limit == nil {
+		return true
+	}
+	if limit := srv.limit.current(); limit > 0 && srv.listenerCount() >= limit {
+		fmt.Fprintf(w, "5 station is full; try again later\r\n")
+		return false
+	}
+	return true
+}
+
+func (ll *listenerLimit) run(stations []*station) {
+	for now := range time.Tick(capacityEvery) {
+		ll.sample(stations, now)
+	}
+}
+
+// sample compares what each settled listener received since the previous
+// sample with what its station sent, and adjusts the limit.
+func (ll *listenerLimit) sample(stations []*station, now time.Time) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	prev, sent := ll.prev, ll.sent
+	ll.prev, ll.sent = make(map[*listener]int64), make(map[*station]int64)
+	total, settled, behind := 0, 0, 0
+	carried := 0.0 // listeners the uplink served at full rate, in shares of a stream
+	for _, st := range stations {
+		out := st.b.bytesOut.Load()
+		ll.sent[st] = out
+		was, ok := sent[st]
+		stream := out - was
+		for _, l := range st.listenerList() {
+			total++
+			n := l.bytes.Load()
+			ll.prev[l] = n
+			had, seen := prev[l]
+			if !ok || !seen || stream <= 0 || now.Sub(l.since) < capacitySettle {
+				continue
+			}
+			settled++
+			share := float64(n-had) / float64(stream)
+			if share < capacityBehind {
+				behind++
+			}
+			carried += math.Min(share, 1)
+		}
+	}
+	if !ll.adaptive {
+		return
+	}
+
+	limit, reason := ll.limit, ""
+	switch {
+	case settled > 1 && float64(behind) >= capacitySaturated*float64(settled):
+		if n := max(int(carried), 1); ll.limit == 0 || n < ll.limit {
+			limit = n
+			reason = fmt.Sprintf("%d of %d listeners fell behind; the uplink carries about %.0f streams", behind, settled, carried)
+		}
+	case behind == 0 && ll.limit > 0 && ll.limit != ll.max && total >= ll.limit:
+		limit = ll.limit + max(ll.limit/10, 1)
+		if ll.max > 0 && limit > ll.max {
+			limit = ll.max
+		}
+		reason = fmt.Sprintf("all %d listeners keep up", total)
+	}
+	if limit == ll.limit {
+		return
+	}
+	log.Printf("listener limit: %s -> %d: %s", limitText(ll.limit), limit, reason)
+	ll.limit = limit
+	ll.changes++
+	ll.last = incident{at: now, reason: reason}
+}
+
+func limitText(n int) string {
+	if n == 0 {
+		return "none"
+	}
+	return fmt.Sprint(n)
+}
+
+// writeStats adds the listener limit to /stats.
+func (ll *listenerLimit) writeStats(w io.Writer, listeners int) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	fmt.Fprintf(w, "\n## Listener limit\n\n")
+	fmt.Fprintf(w, "* Listeners: %d of %s\n", listeners, limitText(ll.limit))
+	if ll.adaptive && ll.changes > 0 {
+		fmt.Fprintf(w, "* Adaptive changes: %d (last %s ago: %s)\n", ll.changes, time.Since(ll.last.at).Round(time.Second), ll.last.reason)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// The limit drops to what the uplink carried when many listeners fall
+// behind, and climbs back to -max-listeners while everyone keeps up.
+func TestListenerLimit(t *testing.T) {
+	st := &station{b: NewBroadcaster(bufferLimits{})}
+	var ls []*listener
+	for i := 0; i < 4; i++ {
+		l := st.addListener("192.0.2.1:1", "h")
+		l.since = time.Now().Add(-time.Hour)
+		ls = append(ls, l)
+	}
+	ll := newListenerLimit(3, true)
+	step := func(got ...int64) {
+		st.b.bytesOut.Add(1000)
+		for i, n := range got {
+			ls[i].bytes.Add(n)
+		}
+		ll.sample([]*station{st}, time.Now())
+	}
+
+	step(0, 0, 0, 0) // baseline
+	if ll.current() != 3 {
+		t.Fatalf("limit = %d before any measurement, want 3", ll.current())
+	}
+	step(1000, 1000, 1000, 950) // one slow listener is not a full uplink
+	if ll.current() != 3 {
+		t.Errorf("limit = %d with one listener behind, want 3", ll.current())
+	}
+	step(1000, 1000, 300, 300)
+	if ll.current() != 2 {
+		t.Errorf("limit = %d with half behind, want 2", ll.current())
+	}
+	step(1000, 1000, 1000, 1000)
+	step(1000, 1000, 1000, 1000)
+	if ll.current() != 3 {
+		t.Errorf("limit = %d after recovering, want -max-listeners 3", ll.current())
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+)
+
+// ---------------- per-track comments ----------------
+
+// With -track-comments the encoder runs one track at a time. When a track
+// starts, the running ffmpeg gets end of input, finishes its logical stream
+// with an EOS page, and a new one starts with the track's TITLE, ARTIST and
+// ALBUM in its comment header. The output is one chained Ogg stream, so
+// players such as mpv show each track as it starts. The broadcaster caches
+// each link's headers in turn (see broadcastFromEncoder). -track-encode
+// uses the same links for tracks with encoder settings of their own (see
+// trackenc.go).
+//
+// The switch happens at a PCM frame boundary between two writes, as the
+// feeder starts the next file, so it may land a fraction of a second early.
+// Each link starts a fresh encoder, which costs a few milliseconds of audio
+// at the join.
+
+const pcmFrame = 4 // bytes per frame of pipeline PCM: s16le stereo
+
+// chainEncoder is the encoder of a pipeline with -track-comments or
+// -track-encode. PCM is written to it like to an encoder's stdin; output
+// reads the Ogg links one after another. A link that ends other than by a
+// switch or Close is an encoder failure: output then fails with
+// errEncoderExited.
+type chainEncoder struct {
+	cfg encoderConfig
+	pr  *io.PipeReader
+	pw  *io.PipeWriter
+
+	// mu serializes writes and link switches. A write may block for as
+	// long as the encoder does, so kill only takes lmu, which guards link.
+	mu      sync.Mutex
+	lmu     sync.Mutex
+	link    *chainLink
+	linkCfg encoderConfig // link's settings; guarded by lmu for current
+	pending *chainNext    // the next link, switched to at the next write
+	odd     int           // bytes of an incomplete frame written to link
+	closed  bool
+
+	// onLink, if set, is told the settings of each link after the first
+	// as it starts.
+	onLink func(encoderConfig)
+
+	copiers sync.WaitGroup
+}
+
+// chainNext describes a link to start: its tags (nil for the stream's own
+// metadata) and encoder settings.
+type chainNext struct {
+	tags *trackTags
+	cfg  encoderConfig
+}
+
+type chainLink struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	copied chan struct{} // closed once its output is all in pw
+	ended  atomic.Bool   // stdin closed by us
+	last   atomic.Bool   // the final link; its end ends the output
+}
+
+func startChain(cfg encoderConfig) (*chainEncoder, error) {
+	c := &chainEncoder{cfg: cfg}
+	c.pr, c.pw = io.Pipe()
+	// The first link has no track yet and keeps the stream name.
+	if err := c.startLink(chainNext{cfg: cfg}); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// startLink starts the encoder for link n, queued behind the current
+// link's output. Called with mu held or before c is shared.
+func (c *chainEncoder) startLink(n chainNext) error {
+	cfg, t := n.cfg, n.tags
+	var meta []string
+	if t != nil {
+		cfg.streamName = ""
+		for _, kv := range [][2]string{{"title", t.title}, {"artist", t.artist}, {"album", t.album}} {
+			if kv[1] != "" {
+				meta = append(meta, "-metadata", kv[0]+"="+kv[1])
+			}
+		}
+	}
+	cmd, stdin, stdout, err := startEncoder(cfg, meta...)
+	if err != nil {
+		return err
+	}
+	l := &chainLink{cmd: cmd, stdin: stdin, copied: make(chan struct{})}
+	prev := c.link
+	c.lmu.Lock()
+	c.link, c.linkCfg, c.odd = l, n.cfg, 0
+	c.lmu.Unlock()
+	if c.onLink != nil {
+		c.onLink(n.cfg)
+	}
+
+	c.copiers.Add(1)
+	go func() {
+		defer c.copiers.Done()
+		if prev != nil {
+			<-prev.copied
+		}
+		_, copyErr := io.Copy(c.pw, stdout)
+		if copyErr != nil {
+			// Nobody reads the output any more; don't leave ffmpeg
+			// blocked writing it.
+			_ = cmd.Process.Kill()
+		}
+		waitErr := cmd.Wait()
+		close(l.copied)
+
+		switch {
+		case !l.ended.Load():
+			c.pw.CloseWithError(errEncoderExited)
+		case copyErr != nil:
+			c.pw.CloseWithError(copyErr)
+		case waitErr != nil:
+			c.pw.CloseWithError(fmt.Errorf("%w: %v", errEncoderExited, waitErr))
+		case l.last.Load():
+			c.pw.Close()
+		}
+	}()
+	return nil
+}
+
+// linkTags reads the tags of the link for path; a file without a title
+// is named after the file, as on the track signaling stream.
+func linkTags(path string) trackTags {
+	t, _ := readTags(path)
+	if t.title == "" {
+		t.title = newTrackInfo(path).title
+	}
+	return t
+}
+
+// nextTrack makes the next write start a new link tagged with t and
+// encoded with o's settings. With no tags the link on air carries on if
+// its settings are already those.
+func (c *chainEncoder) nextTrack(t *trackTags, o trackEncode) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := chainNext{tags: t, cfg: o.apply(c.cfg)}
+	if t == nil && n.cfg == c.linkCfg {
+		c.pending = nil
+		return
+	}
+	c.pending = &n
+}
+
+// current returns the settings of the link on air.
+func (c *chainEncoder) current() encoderConfig {
+	c.lmu.Lock()
+	defer c.lmu.Unlock()
+	return c.linkCfg
+}
+
+func (c *chainEncoder) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, errors.New("encoder closed")
+	}
+	n := 0
+	if c.pending != nil && c.odd > 0 {
+		// Finish the frame in flight first.
+		m, err := c.write(p[:min(pcmFrame-c.odd, len(p))])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[m:]
+	}
+	if c.pending != nil && c.odd == 0 {
+		next := *c.pending
+		c.pending = nil
+		old := c.link
+		old.ended.Store(true)
+		_ = old.stdin.Close()
+		if err := c.startLink(next); err != nil {
+			c.closed = true
+			c.pw.CloseWithError(fmt.Errorf("%w: %v", errEncoderExited, err))
+			return n, err
+		}
+	}
+	m, err := c.write(p)
+	return n + m, err
+}
+
+func (c *chainEncoder) write(p []byte) (int, error) {
+	n, err := c.link.stdin.Write(p)
+	c.odd = (c.odd + n) % pcmFrame
+	return n, err
+}
+
+// Close ends the input: the current link flushes, and output ends after it.
+func (c *chainEncoder) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.link.last.Store(true)
+	c.link.ended.Store(true)
+	return c.link.stdin.Close()
+}
+
+// output reads the links' Ogg pages in order.
+func (c *chainEncoder) output() io.ReadCloser { return c.pr }
+
+// kill stops the current link's encoder; output then fails.
+func (c *chainEncoder) kill() {
+	c.lmu.Lock()
+	l := c.link
+	c.lmu.Unlock()
+	c.pw.CloseWithError(errEncoderExited)
+	_ = l.stdin.Close()
+	_ = l.cmd.Process.Kill()
+}
+
+// wait reaps the links' encoders.
+func (c *chainEncoder) wait() {
+	c.copiers.Wait()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChainEncoder(t *testing.T) {
+	// The fake encoder echoes its input after a mark naming its title.
+	ffmpeg := filepath.Join(t.TempDir(), "ffmpeg")
+	script := "#!/bin/sh\nt=\nfor a; do case \"$a\" in title=*) t=$a;; esac; done\nprintf '<%s>' \"$t\"\nexec cat\n"
+	if err := os.WriteFile(ffmpeg, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	c, err := startChain(encoderConfig{ffmpegPath: ffmpeg, codecName: "vorbis", bitrateKbps: 128})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(c.output())
+		got <- string(b)
+	}()
+
+	write := func(s string) {
+		if _, err := c.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("aaaa")
+	write("bb")
+	c.nextTrack(&trackTags{title: "Two"}, trackEncode{})
+	write("bbcccc") // the frame in flight ends in the first link
+	c.nextTrack(&trackTags{title: "Three"}, trackEncode{})
+	write("dddd")
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if out, want := <-got, "<>aaaabbbb<title=Two>cccc<title=Three>dddd"; out != want {
+		t.Errorf("output %q, want %q", out, want)
+	}
+	c.wait()
+}
+
+func TestChainEncoderOverrides(t *testing.T) {
+	// The fake encoder echoes its input after a mark naming its bitrate
+	// and channels.
+	ffmpeg := filepath.Join(t.TempDir(), "ffmpeg")
+	script := "#!/bin/sh\nb= ac= prev=\nfor a; do case \"$prev\" in -b:a) b=$a;; -ac) ac=$a;; esac; prev=$a; done\nprintf '<%s/%s>' \"$b\" \"$ac\"\nexec cat\n"
+	if err := os.WriteFile(ffmpeg, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	c, err := startChain(encoderConfig{ffmpegPath: ffmpeg, codecName: "opus", bitrateKbps: 96})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(c.output())
+		got <- string(b)
+	}()
+	write := func(s string) {
+		if _, err := c.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	speech := trackEncode{bitrateKbps: 24, mono: true}
+
+	write("aaaa")
+	c.nextTrack(nil, trackEncode{}) // same settings: same link
+	write("bbbb")
+	c.nextTrack(nil, speech)
+	write("cccc")
+	if cur := c.current(); cur.bitrateKbps != 24 || !cur.mono {
+		t.Errorf("current link %+v", cur)
+	}
+	c.nextTrack(nil, speech) // the next talk shares the link
+	write("dddd")
+	c.nextTrack(nil, trackEncode{bitrateKbps: 320}) // never above the station's
+	write("eeee")
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if out, want := <-got, "<96k/2>aaaabbbb<24k/1>ccccdddd<96k/2>eeee"; out != want {
+		t.Errorf("output %q, want %q", out, want)
+	}
+	c.wait()
+}
+
+func TestReadTrackEncode(t *testing.T) {
+	dir := t.TempDir()
+	track := filepath.Join(dir, "talk.wav")
+	if o, err := readTrackEncode(track); err != nil || o != (trackEncode{}) {
+		t.Fatalf("no sidecar: %+v, %v", o, err)
+	}
+	for sidecar, want := range map[string]*trackEncode{
+		"# speech\nbitrate-kbps = 32\nchannels = 1 # mono\n": {bitrateKbps: 32, mono: true},
+		"channels = 2\n":     {},
+		"bitrate-kbps = 0\n": nil,
+		"channels = 6\n":     nil,
+		"quality = 3\n":      nil,
+		"bitrate-kbps\n":     nil,
+	} {
+		if err := os.WriteFile(track+trackEncodeExt, []byte(sidecar), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		o, err := readTrackEncode(track)
+		switch {
+		case want == nil && err == nil:
+			t.Errorf("%q accepted", sidecar)
+		case want != nil && (err != nil || o != *want):
+			t.Errorf("%q: %+v, %v", sidecar, o, err)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ---------------- tag channels ----------------
+
+// -channels names a file of virtual channels cut from the library by tag:
+// one per line, a name and a library query (see /search), e.g.
+//
+//	jazz     genre:jazz
+//	ambient  genre:ambient
+//	nina     artist:"nina simone"
+//
+// Each channel is a station of its own at /radio/<name>, with its own
+// rotation of the matching tracks, encoder and listeners. The query is run
+// again at every cycle, so the channel follows the library as it is
+// rescanned. Channels share the main station's encoder settings, shuffle,
+// album mode, file health and rotation rules (timed by each channel's own
+// plays); requests, skips and station IDs are the main
+// station's alone.
+
+var channelName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+type channelDef struct {
+	name  string
+	query string
+}
+
+func readChannels(path string) ([]channelDef, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var defs []channelDef
+	seen := map[string]bool{}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, query, _ := strings.Cut(line, " ")
+		def := channelDef{name: name, query: strings.TrimSpace(query)}
+		switch {
+		case !channelName.MatchString(def.name):
+			return nil, fmt.Errorf("%s:%d: bad channel name %q (lower-case letters, digits, - and _)", path, n, def.name)
+		case seen[def.name]:
+			return nil, fmt.Errorf("%s:%d: channel %s defined twice", path, n, def.name)
+		case def.query == "":
+			return nil, fmt.Errorf("%s:%d: expected name query", path, n)
+		}
+		if _, err := parseQuery(def.query); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		seen[def.name] = true
+		defs = append(defs, def)
+	}
+	return defs, sc.Err()
+}
+
+// newChannel returns the station for def, playing the tracks of lib that
+// match its query with st's settings.
+func newChannel(def channelDef, st *station, lib *library) *station {
+	shuffle, rescan := st.feed.rotation()
+	fd := &feeder{
+		ffmpegPath: st.feed.ffmpegPath,
+		loadList: func() ([]string, error) {
+			tracks, err := lib.search(def.query)
+			if err != nil {
+				return nil, err
+			}
+			files := make([]string, len(tracks))
+			for i, t := range tracks {
+				files[i] = t.Path
+			}
+			sort.Strings(files)
+			return files, nil
+		},
+		shuffle: shuffle,
+		rescan:  rescan,
+		baseDir: st.feed.baseDir,
+		albums:  st.feed.albums,
+		health:  st.feed.health,
+	}
+	if st.feed.rules != nil {
+		fd.rules = st.feed.rules.fresh()
+	}
+	ch := &station{
+		name:    "channel-" + def.name,
+		mount:   "/radio/" + def.name,
+		b:       NewBroadcaster(st.b.Limits()),
+		cfg:     st.settings(),
+		feed:    fd,
+		meter:   &levelMeter{},
+		restart: make(chan struct{}, 1),
+		filter:  def.query,
+
+		onEncoderFailure: st.onEncoderFailure,
+	}
+	fd.onTrack = func(path string) {
+		cfg := ch.settings()
+		var tags *trackTags
+		if cfg.trackComments {
+			t := linkTags(path)
+			tags = &t
+		}
+		var enc trackEncode
+		if cfg.trackEncode {
+			var err error
+			if enc, err = readTrackEncode(path); err != nil {
+				log.Printf("%s: -track-encode: %v; using the station's settings", ch.name, err)
+			}
+		}
+		ch.nextLink(tags, enc)
+		ch.b.TrackStarted()
+		if ch.b.tracks != nil {
+			select {
+			case ch.b.tracks <- newTrackInfo(path):
+			default:
+			}
+		}
+	}
+	return ch
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadChannels(t *testing.T) {
+	dir := t.TempDir()
+	write := func(s string) string {
+		p := filepath.Join(dir, "channels")
+		if err := os.WriteFile(p, []byte(s), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	defs, err := readChannels(write("# tag channels\njazz  genre:jazz\n\nnina artist:\"nina simone\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []channelDef{{"jazz", "genre:jazz"}, {"nina", `artist:"nina simone"`}}
+	if !reflect.DeepEqual(defs, want) {
+		t.Fatalf("channels %+v", defs)
+	}
+	for _, bad := range []string{
+		"Jazz genre:jazz\n",
+		"jazz genre:jazz\njazz genre:bebop\n",
+		"jazz\n",
+		"jazz year:1959\n",
+	} {
+		if _, err := readChannels(write(bad)); err == nil {
+			t.Errorf("%q: no error", bad)
+		}
+	}
+}
+
+func TestChannelRotation(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"b.flac": flacWithComments("TITLE=So What", "GENRE=Jazz"),
+		"a.flac": flacWithComments("TITLE=Sinnerman", "GENRE=Jazz"),
+		"c.flac": flacWithComments("TITLE=Windowlicker", "GENRE=Electronic"),
+	}
+	var paths []string
+	for name, data := range files {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, p)
+	}
+	lib := newLibrary(newMemStore())
+	lib.scan(paths)
+
+	st := &station{b: NewBroadcaster(bufferLimits{}), feed: &feeder{rescan: 1}}
+	ch := newChannel(channelDef{"jazz", "genre:jazz"}, st, lib)
+	if ch.mount != "/radio/jazz" {
+		t.Errorf("mount %s", ch.mount)
+	}
+	got, err := ch.feed.loadList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, p := range got {
+		names = append(names, filepath.Base(p))
+	}
+	if strings.Join(names, " ") != "a.flac b.flac" {
+		t.Fatalf("rotation %v", names)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+)
+
+// ---------------- fault injection ----------------
+
+// The -chaos-* flags inject faults so that the recovery paths can be
+// exercised in integration tests and staging:
+//
+//	-chaos-kill-encoder D     kill the encoder at random, on average every D
+//	-chaos-corrupt-pages F    flip a byte in fraction F of the encoder's pages
+//	-chaos-slow-listeners D   sleep D before every write to a listener
+//	-chaos-vanish F           list fraction F of the rotation under a name
+//	                          that does not exist, as if deleted mid-cycle
+//
+// They are never meant for a real station and are left out of -help.
+
+type chaosConfig struct {
+	killEncoder  time.Duration
+	corruptPages float64
+	slowWrites   time.Duration
+	vanish       float64
+}
+
+var chaos chaosConfig
+
+func (c chaosConfig) enabled() bool { return c != chaosConfig{} }
+
+// killer kills cmd's process at random intervals until stop is closed.
+func (c chaosConfig) killer(p *pipeline, stop <-chan struct{}) {
+	if c.killEncoder <= 0 || (p.cmd == nil && p.chain == nil) {
+		return
+	}
+	wait := time.Duration(rand.ExpFloat64() * float64(c.killEncoder))
+	select {
+	case <-stop:
+	case <-time.After(wait):
+		log.Printf("chaos: killing the encoder")
+		if p.chain != nil {
+			p.chain.kill()
+		} else {
+			_ = p.cmd.Process.Kill()
+		}
+	}
+}
+
+// corrupt damages page with probability corruptPages. The page is copied,
+// so the caller's buffer stays intact.
+func (c chaosConfig) corrupt(page []byte) []byte {
+	if c.corruptPages <= 0 || rand.Float64() >= c.corruptPages || len(page) <= 27 {
+		return page
+	}
+	bad := append([]byte(nil), page...)
+	bad[27+rand.Intn(len(bad)-27)] ^= 0xff
+	return bad
+}
+
+// stall slows a listener write down.
+func (c chaosConfig) stall() {
+	if c.slowWrites > 0 {
+		time.Sleep(c.slowWrites)
+	}
+}
+
+// vanishing wraps loadList so that some files seem to disappear.
+func (c chaosConfig) vanishing(loadList func() ([]string, error)) func() ([]string, error) {
+	if c.vanish <= 0 {
+		return loadList
+	}
+	return func() ([]string, error) {
+		files, err := loadList()
+		for i := range files {
+			if rand.Float64() < c.vanish {
+				files[i] += ".chaos-vanished"
+			}
+		}
+		return files, err
+	}
+}
+
+// hideChaosFlags replaces flag.Usage with one that leaves out -chaos-*.
+func hideChaosFlags() {
+	flag.Usage = func() {
+		visible := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+		flag.VisitAll(func(f *flag.Flag) {
+			if !strings.HasPrefix(f.Name, "chaos-") {
+				visible.Var(f.Value, f.Name, f.Usage)
+			}
+		})
+		visible.SetOutput(flag.CommandLine.Output())
+		visible.Usage()
+	}
+}
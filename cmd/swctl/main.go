@@ -0,0 +1,338 @@
+// Command swctl controls a running spartan-waves server through its signed
+// /admin/ endpoints.
+//
+//	swctl [flags] status
+//	swctl [flags] now
+//	swctl [flags] listeners
+//	swctl [flags] skip
+//	swctl [flags] queue
+//	swctl [flags] queue add <path>
+//	swctl [flags] reload
+//	swctl [flags] audit [N]
+//	swctl [flags] maintenance <start|now> <end> [message...]
+//	swctl [flags] maintenance off
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func main() {
+	host := flag.String("host", "localhost", "server host")
+	port := flag.Int("port", 300, "server port")
+	secret := flag.String("secret", os.Getenv("SW_ADMIN_SECRET"), "admin secret (default $SW_ADMIN_SECRET)")
+	mount := flag.String("mount", "", "station mount to act on (default: the server's first station)")
+	asJSON := flag.Bool("json", false, "print the raw JSON response instead of a table")
+	timeout := flag.Duration("timeout", 10*time.Second, "connection timeout")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, `usage: swctl [flags] <command>
+
+commands:
+  status | now | listeners | skip | reload | polls
+  queue [add <path>]
+  quarantine [release <path>]      files kept out of the rotation
+  report [YYYY-MM-DD | YYYY-MM]    play report as CSV (default: today)
+  audit [N]                        the last N admin actions (default 50)
+  maintenance <start|now> <end> [message...]
+  maintenance off
+
+flags:
+`)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *secret == "" {
+		fatalf("no admin secret: use -secret or $SW_ADMIN_SECRET")
+	}
+
+	var cmd, payload string
+	query := url.Values{}
+	if *mount != "" {
+		query.Set("mount", *mount)
+	}
+	args := flag.Args()
+	switch {
+	case len(args) == 1:
+		cmd = args[0]
+	case len(args) == 2 && args[0] == "report":
+		cmd = "report"
+		query.Set("period", args[1])
+	case len(args) == 2 && args[0] == "audit":
+		cmd = "audit"
+		query.Set("n", args[1])
+	case len(args) == 3 && args[0] == "queue" && args[1] == "add":
+		cmd, payload = "queue/add", args[2]
+	case len(args) == 3 && args[0] == "quarantine" && args[1] == "release":
+		cmd, payload = "quarantine/release", args[2]
+	case len(args) == 2 && args[0] == "maintenance" && args[1] == "off":
+		cmd = "maintenance/off"
+	case len(args) >= 3 && args[0] == "maintenance":
+		cmd, payload = "maintenance", args[1]+" "+args[2]+"\n"+strings.Join(args[3:], " ")
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	path := "/admin/" + cmd
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	resp, err := request(*host, *port, *secret, path, payload, *timeout)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if *asJSON || cmd == "report" {
+		os.Stdout.Write(resp)
+		return
+	}
+	if err := printTable(cmd, resp); err != nil {
+		fatalf("%v", err)
+	}
+}
+
+func fatalf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "swctl: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+// request sends one signed admin request and returns the response body.
+func request(host string, port int, secret, path, payload string, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	var n [8]byte
+	_, _ = rand.Read(n[:])
+	nonce := hex.EncodeToString(n[:])
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n", host, path, ts, nonce)
+	mac.Write([]byte(payload))
+	body := fmt.Sprintf("%s %s %s\n%s", ts, nonce, hex.EncodeToString(mac.Sum(nil)), payload)
+
+	if _, err := fmt.Fprintf(conn, "%s %s %d\r\n%s", host, path, len(body), body); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	status, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	status = strings.TrimRight(status, "\r\n")
+	if !strings.HasPrefix(status, "2 ") {
+		return nil, fmt.Errorf("server replied: %s", status)
+	}
+	return io.ReadAll(br)
+}
+
+func printTable(cmd string, resp []byte) error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer tw.Flush()
+
+	switch cmd {
+	case "status":
+		var st struct {
+			Uptime   float64 `json:"uptime_seconds"`
+			Stations []struct {
+				Mount       string `json:"mount"`
+				Listeners   int    `json:"listeners"`
+				HeaderBytes int    `json:"header_bytes"`
+				Resets      int    `json:"watchdog_resets"`
+			} `json:"stations"`
+			Recent []auditEntry `json:"recent_actions"`
+		}
+		if err := json.Unmarshal(resp, &st); err != nil {
+			return err
+		}
+		fmt.Fprintf(tw, "uptime\t%s\n\n", duration(st.Uptime))
+		fmt.Fprintln(tw, "MOUNT\tLISTENERS\tHEADER\tRESETS")
+		for _, s := range st.Stations {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\n", s.Mount, s.Listeners, s.HeaderBytes, s.Resets)
+		}
+		if len(st.Recent) > 0 {
+			fmt.Fprintln(tw)
+			printAudit(tw, st.Recent)
+		}
+
+	case "audit":
+		var entries []auditEntry
+		if err := json.Unmarshal(resp, &entries); err != nil {
+			return err
+		}
+		printAudit(tw, entries)
+
+	case "listeners":
+		var ls []struct {
+			Remote  string  `json:"remote"`
+			Since   string  `json:"since"`
+			Seconds float64 `json:"seconds"`
+			Bytes   int64   `json:"bytes"`
+		}
+		if err := json.Unmarshal(resp, &ls); err != nil {
+			return err
+		}
+		fmt.Fprintln(tw, "REMOTE\tSINCE\tCONNECTED\tBYTES")
+		for _, l := range ls {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\n", l.Remote, l.Since, duration(l.Seconds), l.Bytes)
+		}
+
+	case "now":
+		var now struct {
+			Mount   string  `json:"mount"`
+			File    string  `json:"file"`
+			Started string  `json:"started"`
+			Elapsed float64 `json:"elapsed_seconds"`
+		}
+		if err := json.Unmarshal(resp, &now); err != nil {
+			return err
+		}
+		if now.File == "" {
+			fmt.Fprintf(tw, "%s\tnothing playing\n", now.Mount)
+			return nil
+		}
+		fmt.Fprintf(tw, "mount\t%s\nfile\t%s\nstarted\t%s\nelapsed\t%s\n", now.Mount, now.File, now.Started, duration(now.Elapsed))
+
+	case "quarantine":
+		var q []struct {
+			Path     string `json:"path"`
+			Failures int    `json:"failures"`
+			Error    string `json:"error"`
+			Corrupt  bool   `json:"corrupt"`
+			Retry    string `json:"retry"`
+		}
+		if err := json.Unmarshal(resp, &q); err != nil {
+			return err
+		}
+		fmt.Fprintln(tw, "FILE	FAILURES	UNTIL	LAST ERROR")
+		for _, f := range q {
+			until := f.Retry
+			if f.Corrupt {
+				until = "changed"
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", f.Path, f.Failures, until, f.Error)
+		}
+
+	case "queue":
+		var q []string
+		if err := json.Unmarshal(resp, &q); err != nil {
+			return err
+		}
+		if len(q) == 0 {
+			fmt.Fprintln(tw, "queue is empty")
+		}
+		for i, p := range q {
+			fmt.Fprintf(tw, "%d\t%s\n", i+1, p)
+		}
+
+	case "polls":
+		var ps []struct {
+			ID      string         `json:"id"`
+			Kind    string         `json:"kind"`
+			Results map[string]int `json:"results"`
+			Answers []struct {
+				Time   string `json:"time"`
+				Answer string `json:"answer"`
+			} `json:"answers"`
+		}
+		if err := json.Unmarshal(resp, &ps); err != nil {
+			return err
+		}
+		fmt.Fprintln(tw, "POLL	ANSWER	COUNT / TIME")
+		for _, p := range ps {
+			options := make([]string, 0, len(p.Results))
+			for o := range p.Results {
+				options = append(options, o)
+			}
+			sort.Slice(options, func(i, j int) bool { return p.Results[options[i]] > p.Results[options[j]] })
+			for _, o := range options {
+				fmt.Fprintf(tw, "%s\t%s\t%d\n", p.ID, o, p.Results[o])
+			}
+			for _, a := range p.Answers {
+				fmt.Fprintf(tw, "%s\t%q\t%s\n", p.ID, a.Answer, a.Time)
+			}
+		}
+
+	case "reload":
+		var r struct {
+			Changes []struct {
+				Name    string `json:"name"`
+				Old     string `json:"old"`
+				New     string `json:"new"`
+				Applied string `json:"applied"`
+			} `json:"changes"`
+		}
+		if err := json.Unmarshal(resp, &r); err != nil {
+			return err
+		}
+		if len(r.Changes) == 0 {
+			fmt.Fprintln(tw, "no changes")
+			return nil
+		}
+		fmt.Fprintln(tw, "SETTING\tOLD\tNEW\tAPPLIED")
+		for _, c := range r.Changes {
+			fmt.Fprintf(tw, "%s\t%q\t%q\t%s\n", c.Name, c.Old, c.New, c.Applied)
+		}
+
+	default:
+		var m map[string]any
+		if err := json.Unmarshal(resp, &m); err != nil {
+			return err
+		}
+		for k, v := range m {
+			fmt.Fprintf(tw, "%s\t%v\n", k, v)
+		}
+	}
+	return nil
+}
+
+type auditEntry struct {
+	Time    string `json:"time"`
+	By      string `json:"by"`
+	Role    string `json:"role"`
+	Action  string `json:"action"`
+	Detail  string `json:"detail"`
+	Remote  string `json:"remote"`
+	Refused bool   `json:"refused"`
+}
+
+func printAudit(w io.Writer, entries []auditEntry) {
+	fmt.Fprintln(w, "TIME\tBY\tACTION\tDETAIL\tFROM")
+	for _, e := range entries {
+		by := e.By
+		if e.Role != "" {
+			by += " (" + e.Role + ")"
+		}
+		action := e.Action
+		if e.Refused {
+			action += " REFUSED"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", e.Time, by, action, e.Detail, e.Remote)
+	}
+}
+
+func duration(sec float64) string {
+	return (time.Duration(sec) * time.Second).String()
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// ---------------- output codecs ----------------
+
+// -codec picks what the encoder produces: Ogg/Vorbis, the default, or
+// Ogg/Opus. Everything downstream of the encoder (header caching, bitrate
+// measurement, track signaling, watermarks, the archive) finds the codec in
+// the stream's identification header rather than in the settings, so it
+// follows a pipeline restart. The codec itself can't change in a running
+// process: listeners were told it in the success line.
+
+// checkCodec validates -codec against the rate settings: Opus has no
+// quality scale, so it needs a bitrate, and libopus takes 6 to 510 kbps.
+func checkCodec(codec string, bitrateKbps int) error {
+	switch codec {
+	case "vorbis":
+		return nil
+	case "opus":
+		if bitrateKbps < 6 || bitrateKbps > 510 {
+			return fmt.Errorf("opus needs -bitrate-kbps between 6 and 510, not %d", bitrateKbps)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown codec %q: want vorbis or opus", codec)
+}
+
+// granuleRate returns the granule positions per second of the stream whose
+// identification header is pkt: the sample rate for Vorbis, always 48 kHz
+// for Opus. It is 0 if pkt is neither.
+func granuleRate(pkt []byte) int {
+	switch {
+	case len(pkt) >= 16 && pkt[0] == 0x01 && bytes.Equal(pkt[1:7], []byte("vorbis")):
+		return int(binary.LittleEndian.Uint32(pkt[12:16]))
+	case bytes.HasPrefix(pkt, []byte("OpusHead")):
+		return 48000
+	}
+	return 0
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// opusHeader returns the header pages of an Ogg/Opus stream.
+func opusHeader() []byte {
+	head := []byte("OpusHead\x01\x02\x38\x01\x80\xbb\x00\x00\x00\x00\x00")
+	tags := []byte("OpusTags")
+	tags = binary.LittleEndian.AppendUint32(tags, 4)
+	tags = append(tags, "test"...)
+	tags = binary.LittleEndian.AppendUint32(tags, 0)
+	pages := paginate(0x0b05, 0, [][]byte{head})
+	pages = append(pages, paginate(0x0b05, 1, [][]byte{tags})...)
+	pages[0][5] |= 0x02 // beginning of stream
+	return bytes.Join(pages, nil)
+}
+
+func TestOpusHeaders(t *testing.T) {
+	hdr := opusHeader()
+	pages, _ := parseOggPages(hdr)
+	vh := &headerFinder{}
+	for i, p := range pages {
+		if vh.done() {
+			t.Fatalf("done after %d of %d pages", i, len(pages))
+		}
+		vh.feedPage(p.bytes())
+	}
+	if !vh.done() || vh.codec != "opus" {
+		t.Fatalf("finder: done=%v codec=%q", vh.done(), vh.codec)
+	}
+	if r := granuleRate(pages[0].body); r != 48000 {
+		t.Errorf("granule rate %d, want 48000", r)
+	}
+
+	marked, err := commentHeader(hdr, watermarkTag+"=abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp, _ := parseOggPages(marked)
+	packets := oggPackets(mp)
+	if len(packets) != 2 || !bytes.Contains(packets[1], []byte(watermarkTag+"=abc")) {
+		t.Fatalf("watermarked header: %q", packets)
+	}
+	if n := binary.LittleEndian.Uint32(packets[1][8+4+4:]); n != 1 {
+		t.Errorf("comment count %d, want 1", n)
+	}
+}
+
+func TestCodecSettings(t *testing.T) {
+	for _, tc := range []struct {
+		codec string
+		kbps  int
+		ok    bool
+	}{
+		{"vorbis", 0, true},
+		{"vorbis", 192, true},
+		{"opus", 96, true},
+		{"opus", 0, false},
+		{"opus", 600, false},
+		{"mp3", 128, false},
+	} {
+		if err := checkCodec(tc.codec, tc.kbps); (err == nil) != tc.ok {
+			t.Errorf("checkCodec(%q, %d) = %v", tc.codec, tc.kbps, err)
+		}
+	}
+
+	enc := encoderConfig{codecName: "opus", bitrateKbps: 64}
+	args := strings.Join(enc.outputArgs(), " ")
+	if !strings.Contains(args, "-ar 48000") || !strings.Contains(args, "-c:a libopus -b:a 64k") {
+		t.Errorf("opus args: %s", args)
+	}
+	if ct := enc.contentType(); ct != "audio/ogg; codecs=opus" {
+		t.Errorf("opus content type %q", ct)
+	}
+	if ct := (encoderConfig{}).contentType(); ct != "audio/ogg" {
+		t.Errorf("vorbis content type %q", ct)
+	}
+	if args := (encoderConfig{vorbisQ: 5}).outputArgs(); !slices.Contains(args, "libvorbis") {
+		t.Errorf("vorbis args: %v", args)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// ---------------- codec comparison ----------------
+
+// "spartan-radio codec-compare" helps pick -bitrate-kbps. It cuts a clip
+// from a few tracks of the library, runs each through the encoder at every
+// candidate codec and bitrate, and reports what an hour of the stream costs
+// in bytes against a quality proxy: the signal-to-noise ratio of the decoded
+// result against the PCM that went in. SNR is no perceptual measure, and
+// Opus in particular scores low for how good it sounds, but within one codec
+// it shows where more bits stop buying much.
+
+// compareCandidate is one codec at one bitrate.
+type compareCandidate struct {
+	codec string // vorbis or opus
+	kbps  int
+}
+
+func (c compareCandidate) String() string { return fmt.Sprintf("%s %dk", c.codec, c.kbps) }
+
+// compareClip is the reference PCM cut from one track.
+type compareClip struct {
+	name string
+	pcm  []byte // pipeline PCM, as the encoder gets it
+}
+
+type compareResult struct {
+	bytes int64   // encoded size
+	snr   float64 // dB
+	err   error
+}
+
+// compareCodecs runs the codec-compare subcommand with args.
+func compareCodecs(args []string) error {
+	fs := flag.NewFlagSet("codec-compare", flag.ExitOnError)
+	musicDir := fs.String("music-dir", "", "library to take the sample from")
+	tracks := fs.Int("tracks", 5, "tracks in the sample, spread over the library")
+	offset := fs.Duration("offset", time.Minute, "where in each track the clip starts; tracks shorter than that are clipped from the start")
+	length := fs.Duration("length", 30*time.Second, "length of each clip")
+	vorbis := fs.String("vorbis-kbps", "64,96,128,160,192", "Vorbis bitrates to try, comma separated; empty skips Vorbis")
+	opus := fs.String("opus-kbps", "32,48,64,96,128", "Opus bitrates to try, comma separated; empty skips Opus")
+	rate := fs.Int("sample-rate", 44100, "pipeline sample rate, as given to the server: 44100 or 48000")
+	workers := fs.Int("workers", runtime.NumCPU(), "encodes to run at once")
+	ffmpegPath := fs.String("ffmpeg", "ffmpeg", "path to ffmpeg binary")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s codec-compare -music-dir DIR [flags]\n\nflags:\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	var cands []compareCandidate
+	for _, c := range []struct{ codec, list string }{{"vorbis", *vorbis}, {"opus", *opus}} {
+		for _, f := range strings.Split(c.list, ",") {
+			if f = strings.TrimSpace(f); f == "" {
+				continue
+			}
+			kbps, err := strconv.Atoi(f)
+			if err != nil || kbps <= 0 {
+				return fmt.Errorf("bad %s bitrate %q", c.codec, f)
+			}
+			cands = append(cands, compareCandidate{c.codec, kbps})
+		}
+	}
+	switch {
+	case *musicDir == "":
+		return errors.New("-music-dir is required")
+	case len(cands) == 0:
+		return errors.New("no bitrates to try")
+	case *tracks < 1:
+		return errors.New("-tracks must be at least 1")
+	case *length < time.Second:
+		return errors.New("-length must be at least 1s")
+	case *workers < 1:
+		return errors.New("-workers must be at least 1")
+	}
+	if err := setPCMRate(*rate); err != nil {
+		return err
+	}
+
+	files, err := buildWavListFromDir(*musicDir)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no audio files in %s", *musicDir)
+	}
+	var clips []compareClip
+	for _, p := range sampleTracks(files, *tracks) {
+		pcm, err := compareDecode(*ffmpegPath, p, *offset, *length)
+		if err != nil {
+			return fmt.Errorf("%s: %v", p, err)
+		}
+		clips = append(clips, compareClip{filepath.Base(p), pcm})
+	}
+	var seconds float64
+	for _, c := range clips {
+		seconds += float64(len(c.pcm)) / float64(pcmBytesPerSecond)
+	}
+	fmt.Printf("%d clips, %.0fs of audio, %d encodes\n", len(clips), seconds, len(clips)*len(cands))
+
+	type job struct{ cand, clip int }
+	results := make([][]compareResult, len(cands))
+	for i := range results {
+		results[i] = make([]compareResult, len(clips))
+	}
+	queue := make(chan job)
+	var wg sync.WaitGroup
+	for i := 0; i < min(*workers, len(cands)*len(clips)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range queue {
+				results[j.cand][j.clip] = compareEncode(*ffmpegPath, cands[j.cand], clips[j.clip].pcm)
+			}
+		}()
+	}
+	for c := range cands {
+		for k := range clips {
+			queue <- job{c, k}
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "codec\tkbps\tactual kbps\tper hour\tSNR dB\tworst clip dB\tgain dB\t\n")
+	var failed int
+	prev := map[string]float64{} // codec -> SNR at the previous bitrate
+	for c, cand := range cands {
+		var size int64
+		var sum, secs float64
+		worst := math.Inf(1)
+		ok := 0
+		for k, r := range results[c] {
+			if r.err != nil {
+				failed++
+				fmt.Fprintf(os.Stderr, "%s, %s: %v\n", cand, clips[k].name, r.err)
+				continue
+			}
+			ok++
+			size += r.bytes
+			secs += float64(len(clips[k].pcm)) / float64(pcmBytesPerSecond)
+			sum += r.snr
+			worst = math.Min(worst, r.snr)
+		}
+		if ok == 0 {
+			continue
+		}
+		snr := sum / float64(ok)
+		rate := float64(size) / secs // bytes a second
+		gain := "-"
+		if p, seen := prev[cand.codec]; seen {
+			gain = fmt.Sprintf("%+.1f", snr-p)
+		}
+		prev[cand.codec] = snr
+		fmt.Fprintf(tw, "%s\t%d\t%.0f\t%s\t%.1f\t%.1f\t%s\t\n", cand.codec, cand.kbps, rate*8/1000, sizeText(int64(rate*3600)), snr, worst, gain)
+	}
+	tw.Flush()
+	fmt.Printf("\nPer hour is for one listener; multiply by listener hours for bandwidth.\n")
+	fmt.Printf("Gain is the SNR over the next lower bitrate of the same codec; where it flattens, more bits buy little.\n")
+	if failed > 0 {
+		return fmt.Errorf("%d of %d encodes failed", failed, len(cands)*len(clips))
+	}
+	return nil
+}
+
+// sampleTracks picks n of files, evenly spread, so the sample covers more
+// than one corner of a library sorted by path.
+func sampleTracks(files []string, n int) []string {
+	if n >= len(files) {
+		return files
+	}
+	out := make([]string, n)
+	for i := range out {
+		out[i] = files[i*len(files)/n]
+	}
+	return out
+}
+
+// compareDecode cuts length of audio from path at offset, or from the start
+// if the track is shorter than that, as encoder input PCM.
+func compareDecode(ffmpegPath, path string, offset, length time.Duration) ([]byte, error) {
+	for _, at := range []time.Duration{offset, 0} {
+		args := []string{"-ss", fmt.Sprintf("%.3f", at.Seconds()), "-t", fmt.Sprintf("%.3f", length.Seconds()), "-i", path, "-vn"}
+		pcm, err := runFFmpeg(ffmpegPath, nil, append(args, pcmOutputArgs(path)...)...)
+		if err != nil {
+			return nil, err
+		}
+		if len(pcm) >= pcmBytesPerSecond { // at least a second
+			return pcm, nil
+		}
+	}
+	return nil, errors.New("less than a second of audio")
+}
+
+// compareEncode encodes pcm as cand, decodes the result and scores it
+// against pcm.
+func compareEncode(ffmpegPath string, cand compareCandidate, pcm []byte) compareResult {
+	enc := map[string]string{"opus": "libopus", "vorbis": "libvorbis"}[cand.codec]
+	args := append(pcmArgs(), "-i", "pipe:0", "-c:a", enc, "-b:a", fmt.Sprintf("%dk", cand.kbps), "-f", "ogg", "pipe:1")
+	ogg, err := runFFmpeg(ffmpegPath, pcm, args...)
+	if err != nil {
+		return compareResult{err: err}
+	}
+	dec, err := runFFmpeg(ffmpegPath, ogg, append([]string{"-i", "pipe:0"}, append(pcmArgs(), "pipe:1")...)...)
+	if err != nil {
+		return compareResult{err: err}
+	}
+	return compareResult{bytes: int64(len(ogg)), snr: pcmSNR(pcmSamples(pcm), pcmSamples(dec))}
+}
+
+// runFFmpeg runs ffmpeg with args, stdin as its input, and returns its output.
+func runFFmpeg(ffmpegPath string, stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command(ffmpegPath, append([]string{"-hide_banner", "-nostdin", "-loglevel", "error"}, args...)...)
+	if stdin != nil {
+		// -nostdin only stops ffmpeg reading commands; pipe:0 still works.
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("ffmpeg: %v: %s", err, msg)
+		}
+		return nil, fmt.Errorf("ffmpeg: %v", err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// pcmSamples reads s16le PCM as interleaved samples.
+func pcmSamples(pcm []byte) []int16 {
+	out := make([]int16, len(pcm)/2)
+	for i := range out {
+		out[i] = int16(binary.LittleEndian.Uint16(pcm[2*i:]))
+	}
+	return out
+}
+
+// compareMaxLag is the largest delay between the reference and the decoded
+// audio that pcmSNR looks for, in frames. Decoders trim the encoder delay,
+// but resampling (Opus runs at 48 kHz) can leave a few samples.
+const compareMaxLag = 1024
+
+// pcmSNR returns the signal-to-noise ratio of dec against ref in dB, after
+// lining dec up with ref. Both are interleaved stereo.
+func pcmSNR(ref, dec []int16) float64 {
+	lag := pcmLag(ref, dec)
+	var sig, noise float64
+	for i := range ref {
+		j := i + 2*lag
+		if j < 0 || j >= len(dec) {
+			continue
+		}
+		s, d := float64(ref[i]), float64(ref[i])-float64(dec[j])
+		sig += s * s
+		noise += d * d
+	}
+	switch {
+	case sig == 0:
+		return 0
+	case noise == 0:
+		return math.Inf(1)
+	}
+	return 10 * math.Log10(sig/noise)
+}
+
+// pcmLag finds the offset of dec against ref, in frames, that correlates
+// best over a stretch from the middle of ref.
+func pcmLag(ref, dec []int16) int {
+	frames := len(ref) / 2
+	window := min(frames/2, pcmRate/2) // half a second
+	start := (frames - window) / 2
+	best, bestLag := math.Inf(-1), 0
+	for lag := -compareMaxLag; lag <= compareMaxLag; lag++ {
+		if start+lag < 0 || 2*(start+lag+window) > len(dec) {
+			continue
+		}
+		var c float64
+		for i := 2 * start; i < 2*(start+window); i++ {
+			// Both channels: a mono sum cancels out audio out of phase.
+			c += float64(ref[i]) * float64(dec[i+2*lag])
+		}
+		if c > best {
+			best, bestLag = c, lag
+		}
+	}
+	return bestLag
+}
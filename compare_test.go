@@ -0,0 +1,34 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// pcmSNR lines the decoded audio up with the reference before comparing.
+func TestPCMSNR(t *testing.T) {
+	const frames, delay = 44100, 37
+	ref := make([]int16, 2*frames)
+	for i := 0; i < frames; i++ {
+		v := int16(8000 * math.Sin(float64(i)*0.05+math.Sin(float64(i)*0.001)))
+		ref[2*i], ref[2*i+1] = v, -v
+	}
+	// The decoder's output starts late and carries noise about 40 dB down.
+	dec := make([]int16, 2*delay, 2*(frames+delay))
+	for i, v := range ref {
+		noise := int16(57)
+		if i%4 < 2 {
+			noise = -noise
+		}
+		dec = append(dec, v+noise)
+	}
+	if lag := pcmLag(ref, dec); lag != delay {
+		t.Errorf("lag = %d, want %d", lag, delay)
+	}
+	if snr := pcmSNR(ref, dec); snr < 38 || snr > 42 {
+		t.Errorf("SNR = %.1f dB, want about 40", snr)
+	}
+	if snr := pcmSNR(ref, ref); !math.IsInf(snr, 1) {
+		t.Errorf("SNR of identical audio = %.1f dB, want +Inf", snr)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ---------------- config file ----------------
+
+// -config names a file of "name = value" lines, one per command-line flag
+// (without the dash). Blank lines, "[section]" headers and comments from #
+// are ignored, and values may be double-quoted, so a file with the strings
+// and durations quoted is also valid TOML. Flags given on the command line
+// win over the file.
+//
+// On SIGHUP or /admin/reload the file is read again and every setting that
+// changed is logged with how it was applied. Settings missing from
+// reloadClass (ports, sources, paths) cannot change in a running process;
+// they are reported on every reload until the process is restarted.
+
+const (
+	applyHot     = "hot-applied"
+	applyRestart = "pipeline restarted"
+	applyFixed   = "needs process restart"
+)
+
+var reloadClass = map[string]string{
+	"shuffle":       applyHot,
+	"rescan":        applyHot,
+	"watermark":     applyHot,
+	"preroll":       applyHot,
+	"max-header-kb": applyHot,
+	"max-burst-kb":  applyHot,
+	"admin-skew":    applyHot,
+	"stream-mime":   applyHot,
+	"join-at-track": applyHot,
+	"admin-tokens":  applyHot,
+	"playlist":      applyHot,
+	"music-dir":     applyHot,
+
+	"bitrate-kbps": applyRestart,
+	"vorbis-q":     applyRestart,
+	"stream-name":  applyRestart,
+	"max-page-ms":  applyRestart,
+	"crossfade":    applyRestart,
+}
+
+// secretSettings are shown as "(redacted)" in reload diffs.
+var secretSettings = map[string]bool{
+	"admin-secret": true,
+	"admin-tokens": true,
+}
+
+// configChange is one line of a reload diff.
+type configChange struct {
+	Name    string `json:"name"`
+	Old     string `json:"old"`
+	New     string `json:"new"`
+	Applied string `json:"applied"`
+}
+
+type configFile struct {
+	path    string
+	cmdline map[string]bool // flags given on the command line
+
+	// apply pushes the (already updated) flag variables into the running
+	// server, restarting the pipeline if restart is set.
+	apply func(restart bool)
+
+	mu      sync.Mutex
+	current map[string]string // effective value of every flag
+}
+
+// loadConfigFile reads path once at startup and sets the flags it names.
+func loadConfigFile(path string) (*configFile, error) {
+	cf := &configFile{path: path, cmdline: make(map[string]bool), current: make(map[string]string)}
+	flag.Visit(func(f *flag.Flag) {
+		cf.cmdline[f.Name] = true
+		cf.current[f.Name] = f.Value.String()
+	})
+
+	next, err := cf.read()
+	if err != nil {
+		return nil, err
+	}
+	for name, v := range next {
+		if !cf.cmdline[name] {
+			if err := flag.Set(name, v); err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", path, name, err)
+			}
+		}
+	}
+	cf.current = next
+	return cf, nil
+}
+
+// read parses the file and returns the effective value of every flag.
+func (cf *configFile) read() (map[string]string, error) {
+	data, err := os.ReadFile(cf.path)
+	if err != nil {
+		return nil, err
+	}
+	file := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected name = value", cf.path, i+1)
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if strings.HasPrefix(value, `"`) {
+			q, err := strconv.QuotedPrefix(value)
+			if rest := strings.TrimSpace(value[len(q):]); err != nil || rest != "" && !strings.HasPrefix(rest, "#") {
+				return nil, fmt.Errorf("%s:%d: bad quoted value", cf.path, i+1)
+			}
+			value, _ = strconv.Unquote(q)
+		} else if v, _, ok := strings.Cut(value, " #"); ok {
+			value = strings.TrimSpace(v)
+		}
+		if name == "config" || flag.Lookup(name) == nil {
+			return nil, fmt.Errorf("%s:%d: unknown setting %q", cf.path, i+1, name)
+		}
+		file[name] = value
+	}
+
+	out := make(map[string]string)
+	var bad error
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || bad != nil {
+			return
+		}
+		v, inFile := file[f.Name]
+		switch {
+		case cf.cmdline[f.Name]:
+			out[f.Name] = cf.current[f.Name]
+		case inFile:
+			v, err := canonical(f, v)
+			if err != nil {
+				bad = fmt.Errorf("%s: %v", cf.path, err)
+				return
+			}
+			out[f.Name] = v
+		default:
+			out[f.Name] = f.DefValue
+		}
+	})
+	return out, bad
+}
+
+// canonical validates v for f and returns it as f would print it, so that
+// "120s" and "2m0s" compare equal.
+func canonical(f *flag.Flag, v string) (string, error) {
+	old := f.Value.String()
+	if err := f.Value.Set(v); err != nil {
+		return "", fmt.Errorf("%s: %v", f.Name, err)
+	}
+	v = f.Value.String()
+	_ = f.Value.Set(old)
+	return v, nil
+}
+
+// reload re-reads the file, applies what can be applied and logs the diff.
+func (cf *configFile) reload() ([]configChange, error) {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	next, err := cf.read()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(next))
+	for name := range next {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	changes := []configChange{}
+	applied, restart := false, false
+	for _, name := range names {
+		old, v := cf.current[name], next[name]
+		if old == v {
+			continue
+		}
+		c := configChange{Name: name, Old: old, New: v, Applied: reloadClass[name]}
+		if secretSettings[name] {
+			c.Old, c.New = "(redacted)", "(redacted)"
+		}
+		if c.Applied == "" {
+			c.Applied = applyFixed
+		} else {
+			_ = flag.Set(name, v) // validated by read
+			cf.current[name] = v
+			applied = true
+			restart = restart || c.Applied == applyRestart
+		}
+		changes = append(changes, c)
+	}
+	if applied {
+		cf.apply(restart)
+	}
+	logConfigDiff(changes)
+	return changes, nil
+}
+
+func logConfigDiff(changes []configChange) {
+	counts := make(map[string]int)
+	for _, c := range changes {
+		counts[c.Applied]++
+	}
+	log.Printf("Config reload: %d changed (%d %s, %d %s, %d %s)", len(changes),
+		counts[applyHot], applyHot, counts[applyRestart], applyRestart, counts[applyFixed], applyFixed)
+	for _, c := range changes {
+		log.Printf("Config reload: %s: %q -> %q (%s)", c.Name, c.Old, c.New, c.Applied)
+	}
+}
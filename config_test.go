@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var (
+	_ = flag.String("cfgtest-name", "", "")
+	_ = flag.Duration("cfgtest-rescan", 0, "")
+)
+
+func TestConfigFileSyntax(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "radio.toml")
+	write := func(s string) {
+		if err := os.WriteFile(path, []byte(s), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cf := &configFile{path: path, cmdline: map[string]bool{}, current: map[string]string{}}
+
+	write("# radio.toml\n[stream]\ncfgtest-name = \"Night # Shift\" # the title\n\n[rotation]\ncfgtest-rescan = 2m # between scans\n")
+	got, err := cf.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["cfgtest-name"] != "Night # Shift" || got["cfgtest-rescan"] != "2m0s" {
+		t.Errorf("read name %q, rescan %q", got["cfgtest-name"], got["cfgtest-rescan"])
+	}
+
+	for _, bad := range []string{
+		"cfgtest-name = \"open\n",
+		"cfgtest-name = \"a\" b\n",
+		"cfgtest-rescan\n",
+		"cfgtest-unknown = 1\n",
+	} {
+		write(bad)
+		if _, err := cf.read(); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
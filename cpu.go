@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---------------- CPU pressure ----------------
+
+// With -cpu-pressure L the host's one-minute load average, per CPU, is
+// sampled every ten seconds. Once it has stayed above L for
+// -cpu-pressure-for, every station's encoder steps down to
+// -cpu-pressure-kbps (Opus also to its cheapest complexity) and the
+// pipelines restart, which listeners hear as a new link of a chained stream.
+// Once the load has stayed below three quarters of L for five times as long,
+// the encoders step back up the same way. The long way back keeps a station
+// that only just fits from flapping between the two. The low-bitrate mount
+// is already cheap and is left alone.
+
+const (
+	cpuEvery   = 10 * time.Second
+	cpuRecover = 0.75 // share of the threshold the load must fall below
+	cpuBackOff = 5    // times -cpu-pressure-for the load must stay down
+)
+
+// readLoad returns the one-minute load average per CPU.
+func readLoad() (float64, error) {
+	b, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+	first, _, _ := strings.Cut(string(b), " ")
+	load, err := strconv.ParseFloat(first, 64)
+	if err != nil {
+		return 0, fmt.Errorf("/proc/loadavg: %v", err)
+	}
+	return load / float64(runtime.NumCPU()), nil
+}
+
+// cpuGovernor decides when to step the encoders down and back up.
+type cpuGovernor struct {
+	threshold float64
+	hold      time.Duration
+	kbps      int
+	stations  []*station
+
+	stepped bool
+	since   time.Time // start of the current run above (or below) the mark
+}
+
+// sample takes the load at now and steps the stations if it is time.
+func (g *cpuGovernor) sample(load float64, now time.Time) {
+	var past bool // the load is past the mark for the next step
+	var hold time.Duration
+	if g.stepped {
+		past, hold = load < g.threshold*cpuRecover, g.hold*cpuBackOff
+	} else {
+		past, hold = load > g.threshold, g.hold
+	}
+	switch {
+	case !past:
+		g.since = time.Time{}
+		return
+	case g.since.IsZero():
+		g.since = now
+	}
+	if now.Sub(g.since) < hold {
+		return
+	}
+	g.stepped, g.since = !g.stepped, time.Time{}
+	kbps := 0
+	if g.stepped {
+		kbps = g.kbps
+		log.Printf("CPU load %.2f per CPU above %.2f for %s: stepping the encoders down to %d kbps", load, g.threshold, hold, kbps)
+	} else {
+		log.Printf("CPU load %.2f per CPU for %s: stepping the encoders back up", load, hold)
+	}
+	for _, st := range g.stations {
+		st.economy.Store(int32(kbps))
+		st.requestRestart()
+	}
+}
+
+// run samples the load until the process exits.
+func (g *cpuGovernor) run() {
+	for range time.Tick(cpuEvery) {
+		load, err := readLoad()
+		if err != nil {
+			log.Printf("-cpu-pressure: %v; no longer watching the load", err)
+			return
+		}
+		g.sample(load, time.Now())
+	}
+}
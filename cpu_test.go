@@ -0,0 +1,59 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCPUGovernor(t *testing.T) {
+	st := &station{cfg: stationConfig{enc: encoderConfig{codecName: "opus", bitrateKbps: 128}}, restart: make(chan struct{}, 1)}
+	g := &cpuGovernor{threshold: 1, hold: time.Minute, kbps: 48, stations: []*station{st}}
+	start := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration, load float64) {
+		g.sample(load, start.Add(d))
+	}
+	restarted := func() bool {
+		select {
+		case <-st.restart:
+			return true
+		default:
+			return false
+		}
+	}
+
+	at(0, 1.5)
+	at(30*time.Second, 0.9) // a dip starts the count again
+	at(40*time.Second, 1.5)
+	at(90*time.Second, 1.5)
+	if st.economy.Load() != 0 || restarted() {
+		t.Fatal("stepped down before the load stayed high for a minute")
+	}
+	at(100*time.Second, 1.5)
+	if !restarted() {
+		t.Fatal("no restart after a minute of load")
+	}
+	enc := st.encoder()
+	if enc.bitrateKbps != 48 || !slices.Contains(enc.outputArgs(), "-compression_level") {
+		t.Fatalf("stepped-down encoder %+v", enc)
+	}
+	if st.settings().enc.bitrateKbps != 128 {
+		t.Fatal("configured bitrate changed")
+	}
+
+	// Back up only after five minutes well below the threshold.
+	at(2*time.Minute, 0.8)
+	at(8*time.Minute, 0.8)
+	if st.economy.Load() == 0 {
+		t.Fatal("stepped up at a load just below the threshold")
+	}
+	at(9*time.Minute, 0.5)
+	at(13*time.Minute, 0.5)
+	if st.economy.Load() == 0 {
+		t.Fatal("stepped up after four minutes")
+	}
+	at(14*time.Minute, 0.5)
+	if st.economy.Load() != 0 || !restarted() {
+		t.Fatal("not stepped up after five minutes")
+	}
+}
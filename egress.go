@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ---------------- egress accounting ----------------
+
+// Every byte sent to a client counts towards the month, in the station time
+// zone. The month's total is kept in the store under egress/<2006-01> and
+// saved every minute, so a restart loses at most a minute of it. /stats
+// shows the total and a projection for the whole month.
+//
+// With -egress-cap-gb the month has a hard cap, for servers on metered
+// plans. From 95% of it on, new listeners, on-demand plays and archive
+// downloads get a page saying why instead of audio; at 100% the streams
+// still running are cut. Pages and the index keep working, as they cost
+// next to nothing.
+
+const (
+	egressBucket   = "egress"
+	egressRefuseAt = 0.95 // share of the cap at which bulk requests are refused
+)
+
+var errEgressCap = errors.New("monthly bandwidth cap reached")
+
+type egressMeter struct {
+	db  store
+	loc *time.Location
+	cap int64 // bytes a month; 0 = none
+
+	pending atomic.Int64 // bytes sent since the last save
+	saved   atomic.Int64 // the month's total at the last save
+	capped  atomic.Bool  // the cap has been reached this month
+
+	mu    sync.Mutex // serializes saves
+	month string     // 2006-01
+}
+
+func newEgressMeter(db store, loc *time.Location, capBytes int64) *egressMeter {
+	m := &egressMeter{db: db, loc: loc, cap: capBytes}
+	m.start(time.Now().In(loc).Format("2006-01"))
+	return m
+}
+
+// start makes month current, picking up its total from the store.
+func (m *egressMeter) start(month string) {
+	var n int64
+	data, err := m.db.Get(egressBucket, month)
+	if err == nil {
+		n, _ = strconv.ParseInt(string(data), 10, 64)
+	} else if !errors.Is(err, errNotFound) {
+		log.Printf("egress: %v", err)
+	}
+	m.month = month
+	m.saved.Store(n)
+	m.capped.Store(m.cap > 0 && n >= m.cap)
+}
+
+func (m *egressMeter) add(n int) {
+	total := m.pending.Add(int64(n)) + m.saved.Load()
+	if m.cap > 0 && total >= m.cap && m.capped.CompareAndSwap(false, true) {
+		log.Printf("egress: monthly cap of %s reached; cutting streams until next month", sizeText(m.cap))
+	}
+}
+
+// used returns the month and the bytes sent in it so far.
+func (m *egressMeter) used() (string, int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.month, m.saved.Load() + m.pending.Load()
+}
+
+// refuse reports whether bulk requests are to be turned away.
+func (m *egressMeter) refuse() bool {
+	if m.cap <= 0 {
+		return false
+	}
+	_, n := m.used()
+	return float64(n) >= egressRefuseAt*float64(m.cap)
+}
+
+// save writes the month's total to the store, starting a new month first
+// if one has begun.
+func (m *egressMeter) save(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := m.saved.Add(m.pending.Swap(0))
+	if err := m.db.Put(egressBucket, m.month, []byte(strconv.FormatInt(n, 10))); err != nil {
+		log.Printf("egress: %v", err)
+	}
+	if month := now.In(m.loc).Format("2006-01"); month != m.month {
+		m.start(month)
+	}
+}
+
+func (m *egressMeter) run() {
+	for now := range time.Tick(time.Minute) {
+		m.save(now)
+	}
+}
+
+// monthBounds returns the start and end of the month holding now.
+func monthBounds(now time.Time) (time.Time, time.Time) {
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	return start, start.AddDate(0, 1, 0)
+}
+
+// projection extrapolates the month's total from its average so far.
+func (m *egressMeter) projection(now time.Time) int64 {
+	_, n := m.used()
+	start, end := monthBounds(now.In(m.loc))
+	elapsed := now.Sub(start)
+	if elapsed < time.Hour {
+		return 0 // too early to say
+	}
+	return int64(float64(n) * float64(end.Sub(start)) / float64(elapsed))
+}
+
+// writeStats adds the bandwidth section to /stats.
+func (m *egressMeter) writeStats(w io.Writer, now time.Time) {
+	month, n := m.used()
+	fmt.Fprintf(w, "\n## Bandwidth\n\n")
+	if m.cap > 0 {
+		fmt.Fprintf(w, "* Sent in %s: %s of %s (%.0f%%)\n", month, sizeText(n), sizeText(m.cap), 100*float64(n)/float64(m.cap))
+	} else {
+		fmt.Fprintf(w, "* Sent in %s: %s\n", month, sizeText(n))
+	}
+	p := m.projection(now)
+	if p == 0 {
+		return
+	}
+	fmt.Fprintf(w, "* Projected for the month: %s\n", sizeText(p))
+	if m.cap > 0 && p > m.cap && n < m.cap {
+		start, end := monthBounds(now.In(m.loc))
+		rate := float64(n) / float64(now.Sub(start))
+		at := now.Add(time.Duration(float64(m.cap-n) / rate))
+		if at.Before(end) {
+			fmt.Fprintf(w, "* At this rate the cap is reached on %s\n", at.In(m.loc).Format("Jan 2, 15:04"))
+		}
+	}
+}
+
+// writeCapPage answers a bulk request refused for the cap.
+func (m *egressMeter) writeCapPage(w io.Writer, title string, now time.Time) {
+	_, end := monthBounds(now.In(m.loc))
+	fmt.Fprintf(w, "2 text/gemini; charset=utf-8\r\n")
+	fmt.Fprintf(w, "# %s: off air until next month\n\n", title)
+	fmt.Fprintf(w, "This station has used up its bandwidth allowance for the month, so it cannot take new listeners now.\n\n")
+	fmt.Fprintf(w, "Streaming resumes on %s.\n", end.Format("January 2"))
+}
+
+// egressConn counts what is written to a client. Writes on a bulk
+// connection (a stream or a download) fail once the cap is reached.
+type egressConn struct {
+	net.Conn
+	m    *egressMeter
+	bulk bool
+}
+
+func (c *egressConn) Write(p []byte) (int, error) {
+	if c.bulk && c.m.capped.Load() {
+		return 0, errEgressCap
+	}
+	n, err := c.Conn.Write(p)
+	c.m.add(n)
+	return n, err
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// The meter refuses bulk requests near the cap, cuts streams at it, and
+// starts over with the next month while keeping the old total.
+func TestEgressCap(t *testing.T) {
+	db := newMemStore()
+	oct := time.Date(2026, 10, 31, 23, 0, 0, 0, time.UTC)
+	m := &egressMeter{db: db, loc: time.UTC, cap: 1000}
+	m.start("2026-10")
+
+	m.add(900)
+	if m.refuse() {
+		t.Errorf("refused at 90%%")
+	}
+	m.add(60)
+	if !m.refuse() || m.capped.Load() {
+		t.Errorf("at 96%%: refuse = %v, capped = %v; want true, false", m.refuse(), m.capped.Load())
+	}
+	m.add(40)
+	if !m.capped.Load() {
+		t.Errorf("not capped at 100%%")
+	}
+	m.save(oct)
+
+	m = &egressMeter{db: db, loc: time.UTC, cap: 1000}
+	m.start("2026-10")
+	if _, n := m.used(); n != 1000 || !m.capped.Load() {
+		t.Errorf("after restart: used = %d, capped = %v; want 1000, true", n, m.capped.Load())
+	}
+	m.add(5)
+	m.save(oct.Add(2 * time.Hour))
+	if month, n := m.used(); month != "2026-11" || n != 0 || m.refuse() || m.capped.Load() {
+		t.Errorf("new month: %s used %d, refuse = %v, capped = %v", month, n, m.refuse(), m.capped.Load())
+	}
+	if data, _ := db.Get(egressBucket, "2026-10"); string(data) != "1005" {
+		t.Errorf("October total = %q, want 1005", data)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ---------------- environment ----------------
+
+// Every flag can also be given as an environment variable: SW_ followed by
+// the flag name upper-cased with dashes as underscores, so -music-dir is
+// SW_MUSIC_DIR and -port is SW_PORT. The command line wins over the
+// environment, and both win over -config (which can itself be SW_CONFIG).
+//
+// SW_CONTAINER=1, set by the container image, swaps a few defaults for ones
+// that suit a container: music from /music and state under /state. When
+// /state is not writable (a read-only root file system with no volume
+// there) state is kept in memory instead, so the image starts either way.
+
+const envPrefix = "SW_"
+
+// containerStateDir holds the header cache and the store in a container.
+const containerStateDir = "/state"
+
+// envName is the variable that sets flag name.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyEnv sets every flag that was not given on the command line but has a
+// variable in environ ("NAME=value" pairs). Variables with the prefix that
+// name no flag are logged, so a typo does not go unnoticed, and otherwise
+// ignored.
+func applyEnv(environ []string) error {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	byEnv := make(map[string]*flag.Flag)
+	flag.VisitAll(func(f *flag.Flag) { byEnv[envName(f.Name)] = f })
+
+	var unknown []string
+	for _, kv := range environ {
+		name, v, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(name, envPrefix) || name == envPrefix+"CONTAINER" {
+			continue
+		}
+		f := byEnv[name]
+		switch {
+		case f == nil:
+			unknown = append(unknown, name)
+		case given[f.Name]:
+		default:
+			if err := flag.Set(f.Name, v); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		log.Printf("Environment: ignoring %s: no such option", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// containerDefaults replaces the defaults of the flags that name paths.
+// It changes the defaults rather than setting the flags, so the command
+// line, the environment and -config all still win over them.
+func containerDefaults(stateDir string) {
+	defaults := map[string]string{"music-dir": "/music"}
+	if err := writable(stateDir); err != nil {
+		log.Printf("Container: %v; keeping state in memory", err)
+	} else {
+		defaults["state-dir"] = stateDir
+		defaults["store"] = "dir:" + filepath.Join(stateDir, "store")
+	}
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for name, v := range defaults {
+		f := flag.Lookup(name)
+		if !given[name] {
+			_ = f.Value.Set(v)
+		}
+		f.DefValue = v
+	}
+}
+
+// writable reports whether files can be created in dir.
+func writable(dir string) error {
+	f, err := os.CreateTemp(dir, ".probe-*")
+	if err != nil {
+		return fmt.Errorf("%s not writable", dir)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"testing"
+)
+
+var (
+	envtestPort  = flag.Int("envtest-port", 300, "")
+	envtestDir   = flag.String("envtest-music-dir", "", "")
+	envtestGiven = flag.String("envtest-given", "", "")
+)
+
+func TestApplyEnv(t *testing.T) {
+	if envName("envtest-music-dir") != "SW_ENVTEST_MUSIC_DIR" {
+		t.Fatalf("envName = %q", envName("envtest-music-dir"))
+	}
+	if err := applyEnv([]string{"SW_ENVTEST_PORT=many"}); err == nil {
+		t.Error("bad port accepted")
+	}
+
+	_ = flag.Set("envtest-given", "cmdline")
+	err := applyEnv([]string{
+		"HOME=/root",
+		"SW_CONTAINER=1",
+		"SW_ENVTEST_PORT=1300",
+		"SW_ENVTEST_MUSIC_DIR=/music=old",
+		"SW_ENVTEST_GIVEN=env",
+		"SW_ENVTEST_PROT=1301",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *envtestPort != 1300 || *envtestDir != "/music=old" || *envtestGiven != "cmdline" {
+		t.Errorf("port %d, dir %q, given %q", *envtestPort, *envtestDir, *envtestGiven)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---------------- stats export ----------------
+
+// With -stats-export PATH the server appends a snapshot of every station to
+// PATH each -stats-every, for operators who build their own dashboards
+// without a metrics server. Nothing leaves the machine. A PATH ending in
+// .csv gets CSV, with a header row when the file is new; anything else gets
+// JSON Lines, one object per station and snapshot with the fields of
+// /admin/status. Rotating the file is left to the operator: the server
+// reopens it for every snapshot.
+
+type exportRow struct {
+	Time   string  `json:"time"`
+	Uptime float64 `json:"uptime_seconds"`
+	adminStation
+	NowPlaying string `json:"now_playing,omitempty"`
+}
+
+var exportColumns = []string{
+	"time", "uptime_seconds", "mount", "listeners", "unique_today", "on_air",
+	"now_playing", "watchdog_resets", "bitrate_kbps", "bitrate_alarms",
+}
+
+func (r exportRow) csv() []string {
+	unique := ""
+	if r.UniqueToday != nil {
+		unique = strconv.Itoa(*r.UniqueToday)
+	}
+	return []string{
+		r.Time, strconv.FormatFloat(r.Uptime, 'f', 0, 64), r.Mount,
+		strconv.Itoa(r.Listeners), unique, r.OnAir, r.NowPlaying,
+		strconv.Itoa(r.WatchdogResets), strconv.FormatFloat(r.BitrateKbps, 'f', 1, 64),
+		strconv.Itoa(r.BitrateAlarms),
+	}
+}
+
+// exportStats appends one snapshot to path.
+func (srv *server) exportStats(path string, now time.Time) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var rows []exportRow
+	for _, st := range srv.stations {
+		row := exportRow{
+			Time:         now.UTC().Format(time.RFC3339),
+			Uptime:       now.Sub(srv.started).Seconds(),
+			adminStation: st.status(),
+		}
+		if st.feed != nil {
+			row.NowPlaying, _ = st.feed.nowPlaying()
+		}
+		rows = append(rows, row)
+	}
+
+	if !strings.EqualFold(filepath.Ext(path), ".csv") {
+		enc := json.NewEncoder(f)
+		for _, row := range rows {
+			if err := enc.Encode(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	cw := csv.NewWriter(f)
+	if fi.Size() == 0 {
+		_ = cw.Write(exportColumns)
+	}
+	for _, row := range rows {
+		_ = cw.Write(row.csv())
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// runStatsExport writes a snapshot every interval.
+func (srv *server) runStatsExport(path string, every time.Duration) {
+	for now := range time.Tick(every) {
+		if err := srv.exportStats(path, now); err != nil {
+			log.Printf("stats export: %v", err)
+		}
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// ---------------- source arbitration ----------------
+
+// The arbiter owns the encoder's stdin. It is given the station's sources as
+// levels in priority order, highest first:
+//
+//	emergency   -emergency, e.g. a FIFO fed by an alerting system
+//	live        -source (a live DJ on a sound card, FIFO or stdin)
+//	rotation    the playlist, with scheduled events and then listener
+//	            requests played at track boundaries
+//	fallback    the -fallback chain
+//	warm-up     -warmup tone or silence, only until another level has data
+//
+// It plays the highest level that is producing data: when the active level
+// goes quiet it moves down, and whenever a higher level produces data again
+// it moves back up. Every level above the active one keeps running so its
+// return is noticed; levels below it are only started when needed. Moving up
+// crossfades from the old source to the new one; moving down fades the new
+// source in. A level whose source is exhausted (stdin at EOF) drops out; when
+// none are left the arbiter returns errSourceEnded.
+//
+// A warm-up level is on air from the start, with every level above it
+// running, so that the encoder has audio, and listeners a stream, before
+// the first track is decoded. It drops out as soon as anything else plays.
+//
+// The arbiter also keeps a pipeline clock: the audio written so far against
+// the wall clock. When the active source underruns, say a decoder that can't
+// keep up with a slow network share or a huge FLAC, and the written audio
+// falls more than underrunSlack behind, silence fills the gap, so the
+// encoder and the broadcast timeline keep moving instead of stalling. A
+// fallback level still takes over after fallbackGap. Each underrun is logged
+// when it starts and ends, and reported to onUnderrun.
+
+// Priority classes of arbiter levels.
+const (
+	levelEmergency = "emergency"
+	levelLive      = "live"
+	levelRotation  = "rotation"
+	levelFallback  = "fallback"
+	levelWarmup    = "warm-up"
+)
+
+// feedLevel is one source in the arbiter with its priority class.
+type feedLevel struct {
+	class string
+	src   pcmSource
+}
+
+func (fl feedLevel) String() string { return fl.class + ": " + fl.src.String() }
+
+// How long the active source may stay silent before the chain moves down.
+const fallbackGap = 500 * time.Millisecond
+
+// How far the written audio may fall behind the pipeline clock before
+// silence is inserted, and how often that is checked.
+const (
+	underrunSlack = 250 * time.Millisecond
+	underrunTick  = 50 * time.Millisecond
+)
+
+// parseSourceSpec turns one -fallback entry into a source.
+func parseSourceSpec(spec, ffmpegPath string, playlist pcmSource) (pcmSource, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "silence":
+		return silenceSource{}, nil
+	case "playlist", "files":
+		if playlist == nil {
+			return nil, errors.New("fallback: no playlist or music-dir configured")
+		}
+		return playlist, nil
+	case "fifo":
+		return &fifoSource{path: arg}, nil
+	case "alsa", "pulse", "pipewire", "jack":
+		return newCaptureSource(ffmpegPath, kind, arg)
+	}
+	return &loopFileSource{ffmpegPath: ffmpegPath, path: spec}, nil
+}
+
+// playlistSource exposes the regular file rotation as a pcmSource, so the
+// library can take part in a fallback chain.
+type playlistSource struct {
+	feed *feeder
+}
+
+func (ps *playlistSource) String() string { return "playlist" }
+
+func (ps *playlistSource) Open() (io.ReadCloser, error) {
+	pr, pw := io.Pipe()
+	stop := make(chan struct{})
+	go func() {
+		ps.feed.feedWavForever(pw, stop)
+		_ = pw.CloseWithError(errFeederStopped)
+	}()
+	return &playlistReader{PipeReader: pr, stop: stop}, nil
+}
+
+type playlistReader struct {
+	*io.PipeReader
+	stop chan struct{}
+}
+
+func (r *playlistReader) Close() error {
+	close(r.stop)
+	return r.PipeReader.Close()
+}
+
+// chainLevel is one running source in a chain.
+type chainLevel struct {
+	idx  int
+	src  pcmSource
+	quit chan struct{}
+}
+
+type chainChunk struct {
+	l     *chainLevel
+	data  []byte // whole frames only
+	ended bool   // the source is exhausted; no more chunks follow
+}
+
+// run reads l.src into out, reopening it after failures, until quit.
+func (l *chainLevel) run(out chan<- chainChunk, retryDelay time.Duration) {
+	var carry []byte
+	for {
+		r, err := l.src.Open()
+		if errors.Is(err, io.EOF) {
+			log.Printf("Source %s ended", l.src)
+			select {
+			case out <- chainChunk{l: l, ended: true}:
+			case <-l.quit:
+			}
+			return
+		}
+		if err == nil {
+			for {
+				buf := make([]byte, len(carry), 16*1024)
+				copy(buf, carry)
+				n, rerr := r.Read(buf[len(carry):cap(buf)])
+				buf = buf[:len(carry)+n]
+				whole := len(buf) &^ 3
+				carry = append(carry[:0], buf[whole:]...)
+				if whole > 0 {
+					select {
+					case out <- chainChunk{l: l, data: buf[:whole]}:
+					case <-l.quit:
+						_ = r.Close()
+						return
+					}
+				}
+				if rerr != nil {
+					err = rerr
+					break
+				}
+			}
+			_ = r.Close()
+			carry = carry[:0]
+		}
+		log.Printf("Source %s failed: %v; retrying in %s", l.src, err, retryDelay)
+		select {
+		case <-l.quit:
+			return
+		case <-time.After(retryDelay):
+		}
+	}
+}
+
+// arbitrate copies the best available level into encoder stdin, reporting
+// each change of level to onAir and each underrun, with the silence that
+// filled it, to onUnderrun (either may be nil). It returns when encoder
+// stdin breaks, stop is closed, or every level has ended.
+func arbitrate(levels []feedLevel, stdin io.Writer, retryDelay, fade time.Duration, stop <-chan struct{}, onAir func(feedLevel), onUnderrun func(feedLevel, time.Duration)) error {
+	in := make(chan chainChunk, 16)
+	running := make([]*chainLevel, len(levels))
+	ended := make([]bool, len(levels))
+	start := func(i int) {
+		if running[i] == nil && !ended[i] {
+			running[i] = &chainLevel{idx: i, src: levels[i].src, quit: make(chan struct{})}
+			go running[i].run(in, retryDelay)
+		}
+	}
+	halt := func(i int) {
+		if running[i] != nil {
+			close(running[i].quit)
+			running[i] = nil
+		}
+	}
+	defer func() {
+		for i := range running {
+			halt(i)
+		}
+	}()
+	announce := func(i int) {
+		if onAir != nil {
+			onAir(levels[i])
+		}
+	}
+
+	fadeBytes := pcmBytes(fade)
+
+	active := 0
+	if last := len(levels) - 1; levels[last].class == levelWarmup {
+		active = last
+		for i := range levels {
+			start(i)
+		}
+	}
+	start(active)
+	announce(active)
+
+	// Transition state: bytes of the current fade already played, and the
+	// level being faded out (-1 when fading in from silence).
+	fading, fadePos, fadeFrom := false, 0, -1
+	var older []byte
+
+	endFade := func() {
+		if fadeFrom >= 0 {
+			halt(fadeFrom)
+		}
+		fading, fadeFrom, older = false, -1, nil
+	}
+	beginFade := func(from int) {
+		if fading {
+			endFade()
+		}
+		if fadeBytes == 0 {
+			if from >= 0 {
+				halt(from)
+			}
+			return
+		}
+		fading, fadePos, fadeFrom, older = true, 0, from, nil
+	}
+	// moveDown makes the next level below active that hasn't ended active.
+	moveDown := func() bool {
+		next := active + 1
+		for next < len(levels) && ended[next] {
+			next++
+		}
+		if next >= len(levels) {
+			return false
+		}
+		log.Printf("No data from %s; falling back to %s", levels[active].src, levels[next].src)
+		if fading {
+			endFade()
+		}
+		active = next
+		start(active)
+		beginFade(-1)
+		announce(active)
+		return true
+	}
+
+	// The pipeline clock. anchor is when the audio written so far would
+	// have started playing; it moves up whenever a source runs ahead, so
+	// the clock follows the sources rather than the other way round.
+	anchor, sent := time.Now(), int64(0)
+	var underrun time.Time // start of the current underrun; zero = none
+	var underrunLevel feedLevel
+	var filled int64
+	write := func(p []byte) error {
+		if _, err := stdin.Write(p); err != nil {
+			log.Printf("encoder write failed: %v", err)
+			return &sinkError{err}
+		}
+		sent += int64(len(p))
+		if played := time.Duration(float64(sent) / float64(pcmBytesPerSecond) * float64(time.Second)); time.Since(anchor) < played {
+			anchor = time.Now().Add(-played)
+		}
+		return nil
+	}
+	clock := time.NewTicker(underrunTick)
+	defer clock.Stop()
+
+	gap := time.NewTimer(fallbackGap)
+	defer gap.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return errFeederStopped
+
+		case <-gap.C:
+			gap.Reset(fallbackGap)
+			moveDown()
+
+		case now := <-clock.C:
+			// Nothing runs behind before the first audio; starting up is
+			// the warm-up level's business.
+			due := int64(now.Sub(anchor).Seconds() * float64(pcmBytesPerSecond))
+			if sent == 0 || due-sent <= int64(pcmBytes(underrunSlack)) {
+				continue
+			}
+			if underrun.IsZero() {
+				underrun, underrunLevel, filled = now, levels[active], 0
+				log.Printf("Underrun: %s fell %s behind; inserting silence", levels[active].src, underrunSlack)
+			}
+			n := int(due-sent) &^ 3
+			filled += int64(n)
+			if err := write(make([]byte, n)); err != nil {
+				return err
+			}
+
+		case c := <-in:
+			i := c.l.idx
+			if running[i] != c.l {
+				continue // stale chunk from a stopped level
+			}
+			if c.ended {
+				ended[i], running[i] = true, nil
+				if i == active && !moveDown() && allTrue(ended) {
+					return errSourceEnded
+				}
+				// Otherwise a level above may still come back.
+				continue
+			}
+			switch {
+			case i < active:
+				if levels[active].class == levelWarmup {
+					log.Printf("Source %s is ready; ending the warm-up", levels[i].src)
+					ended[active] = true
+				} else {
+					log.Printf("Source %s is back", levels[i].src)
+				}
+				from := active
+				if fading {
+					endFade()
+				}
+				for j := i + 1; j < len(running); j++ {
+					if j != from {
+						halt(j)
+					}
+				}
+				active = i
+				beginFade(from)
+				announce(active)
+				fallthrough
+
+			case i == active:
+				gap.Reset(fallbackGap)
+				if !underrun.IsZero() {
+					silence := time.Duration(float64(filled) / float64(pcmBytesPerSecond) * float64(time.Second))
+					log.Printf("Underrun over: %s of silence inserted for %s", silence.Round(time.Millisecond), underrunLevel.src)
+					if onUnderrun != nil {
+						onUnderrun(underrunLevel, silence)
+					}
+					underrun = time.Time{}
+				}
+				out := c.data
+				if fading {
+					out, older = crossfade(out, older, fadePos, fadeBytes)
+					fadePos += len(out)
+					if fadePos >= fadeBytes {
+						endFade()
+					}
+				}
+				if err := write(out); err != nil {
+					return err
+				}
+
+			case i == fadeFrom:
+				older = append(older, c.data...)
+			}
+		}
+	}
+}
+
+// crossfade mixes newer (fading in) with the buffered older audio (fading
+// out) at position pos of a total-byte transition. It returns the mixed
+// audio and whatever older audio was not consumed.
+func crossfade(newer, older []byte, pos, total int) ([]byte, []byte) {
+	out := make([]byte, len(newer))
+	for k := 0; k+1 < len(newer); k += 2 {
+		g := float64(pos+k) / float64(total)
+		if g > 1 {
+			g = 1
+		}
+		v := float64(int16(binary.LittleEndian.Uint16(newer[k:]))) * g
+		if k+1 < len(older) {
+			v += float64(int16(binary.LittleEndian.Uint16(older[k:]))) * (1 - g)
+		}
+		binary.LittleEndian.PutUint16(out[k:], uint16(clamp16(v)))
+	}
+	if len(older) > len(newer) {
+		return out, older[len(newer):]
+	}
+	return out, nil
+}
+
+func clamp16(v float64) int16 {
+	switch {
+	case v > 32767:
+		return 32767
+	case v < -32768:
+		return -32768
+	}
+	return int16(v)
+}
+
+func allTrue(v []bool) bool {
+	for _, b := range v {
+		if !b {
+			return false
+		}
+	}
+	return true
+}
+
+// describeLevels is used in startup logs.
+func describeLevels(levels []feedLevel) string {
+	names := make([]string, len(levels))
+	for i, l := range levels {
+		names[i] = fmt.Sprint(l)
+	}
+	return strings.Join(names, " -> ")
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// stallSource plays a tone, goes quiet for a while, then plays again.
+type stallSource struct {
+	stall time.Duration
+}
+
+func (s stallSource) String() string { return "stall" }
+
+func (s stallSource) Open() (io.ReadCloser, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		r := &silenceReader{start: time.Now(), hz: 440}
+		buf := make([]byte, pcmBytes(50*time.Millisecond))
+		for i := 0; ; i++ {
+			if i == 4 {
+				time.Sleep(s.stall)
+				r = &silenceReader{start: time.Now(), hz: 440}
+			}
+			n, _ := r.Read(buf)
+			if _, err := pw.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+	return pr, nil
+}
+
+type syncBuffer struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	b.n += len(p)
+	b.mu.Unlock()
+	return len(p), nil
+}
+
+func (b *syncBuffer) len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.n
+}
+
+// A source that stalls without a fallback is covered with silence, so the
+// encoder keeps getting audio at the pipeline rate.
+func TestArbitrateUnderrun(t *testing.T) {
+	var out syncBuffer
+	var mu sync.Mutex
+	var gaps []time.Duration
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- arbitrate([]feedLevel{{levelRotation, stallSource{stall: time.Second}}}, &out, time.Second, 0, stop,
+			nil, func(_ feedLevel, d time.Duration) {
+				mu.Lock()
+				gaps = append(gaps, d)
+				mu.Unlock()
+			})
+	}()
+
+	time.Sleep(900 * time.Millisecond) // into the stall
+	if got, want := out.len(), pcmBytes(600*time.Millisecond); got < want {
+		t.Errorf("%d bytes written 900ms in, mid-stall; want at least %d", got, want)
+	}
+	time.Sleep(700 * time.Millisecond) // past it
+	close(stop)
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(gaps) != 1 || gaps[0] < 500*time.Millisecond || gaps[0] > time.Second {
+		t.Errorf("underruns = %v, want one of about 750ms", gaps)
+	}
+}
+
+// Closing the rotation level must end its decoder too, not leave it blocked
+// writing to a pipe nobody reads.
+func TestPlaylistSourceCloseStopsDecoder(t *testing.T) {
+	dir := t.TempDir()
+	ffmpeg, track := filepath.Join(dir, "ffmpeg"), filepath.Join(dir, "a.wav")
+	pidFile := filepath.Join(dir, "pid")
+	script := "#!/bin/sh\necho $$ >" + pidFile + "\nexec cat /dev/zero\n"
+	if err := os.WriteFile(ffmpeg, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(track, []byte("RIFF"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f := &feeder{
+		ffmpegPath: ffmpeg,
+		loadList:   func() ([]string, error) { return []string{track}, nil },
+		rescan:     time.Second,
+	}
+
+	pr, pw := io.Pipe()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		f.feedWavForever(pw, stop)
+		close(done)
+	}()
+	if _, err := io.ReadFull(pr, make([]byte, 4096)); err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	pr.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("feeder still running after stop")
+	}
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err := syscall.Kill(pid, 0); err == nil {
+		t.Errorf("decoder %d still running", pid)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ---------------- ffmpeg check ----------------
+
+// The check-ffmpeg subcommand finds the ffmpeg the server would run and
+// makes sure it can do the job: the encoder for -codec is compiled in and
+// actually produces Ogg, and there is a decoder for every extension in
+// -input-exts. An ffmpeg that exists but lacks libvorbis is the most common
+// reason a new station does not start; distribution "free" builds and some
+// minimal static builds leave it out. Each problem is printed with what to
+// do about it, and the command exits 1 if the station could not run.
+
+// ffmpegSearchPath lists where ffmpeg is often installed outside $PATH.
+var ffmpegSearchPath = []string{
+	"/usr/bin/ffmpeg",
+	"/usr/local/bin/ffmpeg",
+	"/opt/homebrew/bin/ffmpeg",
+	"/snap/bin/ffmpeg",
+	"/opt/ffmpeg/bin/ffmpeg",
+}
+
+// ffmpegDecoders maps a source extension to the decoders that read it; any
+// one of them will do.
+var ffmpegDecoders = map[string][]string{
+	".flac": {"flac"},
+	".mp3":  {"mp3float", "mp3"},
+	".ogg":  {"vorbis", "libvorbis"},
+	".opus": {"opus", "libopus"},
+}
+
+const ffmpegInstallHint = "install a full build (apt install ffmpeg, apk add ffmpeg, brew install ffmpeg;\n" +
+	"    on Fedora the ffmpeg package from RPM Fusion) or download a static build from\n" +
+	"    https://ffmpeg.org/download.html and pass its path with -ffmpeg"
+
+func checkFFmpeg(args []string) error {
+	fs := flag.NewFlagSet("check-ffmpeg", flag.ExitOnError)
+	ffmpegPath := fs.String("ffmpeg", "ffmpeg", "path to ffmpeg binary, as given to the server")
+	codec := fs.String("codec", "vorbis", "output codec the station will use: vorbis or opus")
+	exts := fs.String("input-exts", "wav,wave,flac,mp3,ogg,opus", "source file extensions, as given to the server")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s check-ffmpeg [flags]\n\nflags:\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	return runFFmpegCheck(os.Stdout, *ffmpegPath, *codec, *exts)
+}
+
+// runFFmpegCheck writes the report to w and returns an error if the station
+// could not run with this ffmpeg.
+func runFFmpegCheck(w io.Writer, ffmpegPath, codec, exts string) error {
+	encoderFor := map[string]string{"opus": "libopus", "vorbis": "libvorbis"}
+	enc := encoderFor[codec]
+	if enc == "" {
+		return fmt.Errorf("unknown -codec %q (use vorbis or opus)", codec)
+	}
+	inputs, err := parseInputExts(exts)
+	if err != nil {
+		return fmt.Errorf("-input-exts: %v", err)
+	}
+
+	path, err := exec.LookPath(ffmpegPath)
+	if err != nil {
+		fmt.Fprintf(w, "MISSING  ffmpeg: %s not found\n", ffmpegPath)
+		for _, p := range ffmpegSearchPath {
+			if p == ffmpegPath {
+				continue
+			}
+			if fi, err := os.Stat(p); err == nil && !fi.IsDir() {
+				fmt.Fprintf(w, "    found %s; run this check again with -ffmpeg %s\n", p, p)
+			}
+		}
+		fmt.Fprintf(w, "    %s\n", ffmpegInstallHint)
+		return errors.New("no ffmpeg")
+	}
+	out, err := runFFmpeg(path, nil, "-version")
+	if err != nil {
+		fmt.Fprintf(w, "BROKEN   ffmpeg %s: %v\n", path, err)
+		fmt.Fprintf(w, "    %s\n", ffmpegInstallHint)
+		return errors.New("ffmpeg does not run")
+	}
+	version, _, _ := strings.Cut(string(out), "\n")
+	fmt.Fprintf(w, "ok       %s: %s\n", path, version)
+
+	encoders, err := ffmpegCodecs(path, "-encoders")
+	if err != nil {
+		return err
+	}
+	decoders, err := ffmpegCodecs(path, "-decoders")
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+	switch {
+	case !encoders[enc]:
+		fmt.Fprintf(w, "MISSING  encoder %s, needed for -codec %s\n", enc, codec)
+		if codec == "vorbis" && encoders["vorbis"] {
+			fmt.Fprintf(w, "    this build only has ffmpeg's own experimental vorbis encoder, which the server does not use\n")
+		}
+		if other := map[string]string{"vorbis": "opus", "opus": "vorbis"}[codec]; encoders[encoderFor[other]] {
+			fmt.Fprintf(w, "    it can encode %s: run the server with -codec %s\n", other, other)
+		}
+		fmt.Fprintf(w, "    %s\n", ffmpegInstallHint)
+		problems = append(problems, "no "+enc)
+	default:
+		if err := ffmpegTestEncode(path, enc); err != nil {
+			fmt.Fprintf(w, "BROKEN   encoder %s: %v\n", enc, err)
+			problems = append(problems, enc+" fails")
+		} else {
+			fmt.Fprintf(w, "ok       encoder %s\n", enc)
+		}
+	}
+
+	sorted := make([]string, 0, len(inputs))
+	for e := range inputs {
+		sorted = append(sorted, e)
+	}
+	sort.Strings(sorted)
+	for _, e := range sorted {
+		want := ffmpegDecoders[e]
+		if want == nil {
+			continue // WAV, and extensions this check knows nothing about
+		}
+		found := ""
+		for _, d := range want {
+			if decoders[d] {
+				found = d
+				break
+			}
+		}
+		if found == "" {
+			fmt.Fprintf(w, "MISSING  decoder for %s files (%s)\n", e, strings.Join(want, " or "))
+			fmt.Fprintf(w, "    remove %s from -input-exts or %s\n", strings.TrimPrefix(e, "."), ffmpegInstallHint)
+			problems = append(problems, "no "+e+" decoder")
+			continue
+		}
+		fmt.Fprintf(w, "ok       decoder %s for %s files\n", found, e)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("ffmpeg at %s is not usable: %s", path, strings.Join(problems, ", "))
+	}
+	fmt.Fprintf(w, "ffmpeg at %s is usable; start the server with -ffmpeg %s\n", path, path)
+	return nil
+}
+
+// ffmpegCodecs lists the audio codecs from "ffmpeg -encoders" or
+// "ffmpeg -decoders". Each line after the "------" rule is the capability
+// flags, the name and a description; audio codecs have flags starting
+// with A.
+func ffmpegCodecs(path, which string) (map[string]bool, error) {
+	out, err := runFFmpeg(path, nil, which)
+	if err != nil {
+		return nil, err
+	}
+	codecs := make(map[string]bool)
+	listed := false
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		switch {
+		case len(f) > 0 && strings.HasPrefix(f[0], "---"):
+			listed = true
+		case listed && len(f) >= 2 && strings.HasPrefix(f[0], "A"):
+			codecs[f[1]] = true
+		}
+	}
+	return codecs, nil
+}
+
+// ffmpegTestEncode encodes a second of silence with enc and checks that
+// the result is an Ogg stream.
+func ffmpegTestEncode(path, enc string) error {
+	silence := make([]byte, 44100*4)
+	out, err := runFFmpeg(path, silence, "-f", "s16le", "-ar", "44100", "-ac", "2", "-i", "pipe:0",
+		"-c:a", enc, "-f", "ogg", "pipe:1")
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(out, []byte("OggS")) {
+		return errors.New("output is not Ogg")
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// listingFFmpeg writes a script that lists the given audio encoders and
+// decoders and answers any encode with an Ogg capture pattern.
+func listingFFmpeg(t *testing.T, encoders, decoders string) string {
+	path := filepath.Join(t.TempDir(), "ffmpeg")
+	list := func(names string) string {
+		s := "Codecs:\\n A..... = Audio\\n ------\\n V....D h264 H.264\\n"
+		for _, n := range strings.Fields(names) {
+			s += " A....D " + n + " " + n + "\\n"
+		}
+		return s
+	}
+	script := "#!/bin/sh\nfor a; do case \"$a\" in\n" +
+		"-version) echo 'ffmpeg version 6.1-fake'; exit 0;;\n" +
+		"-encoders) printf '" + list(encoders) + "'; exit 0;;\n" +
+		"-decoders) printf '" + list(decoders) + "'; exit 0;;\n" +
+		"esac; done\ncat >/dev/null\nprintf OggS\n"
+	if err := os.WriteFile(path, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFFmpegCheck(t *testing.T) {
+	var out strings.Builder
+	good := listingFFmpeg(t, "libvorbis libopus", "flac mp3float vorbis")
+	if err := runFFmpegCheck(&out, good, "vorbis", "wav,flac,mp3,ogg"); err != nil {
+		t.Fatalf("%v\n%s", err, out.String())
+	}
+	for _, want := range []string{"ffmpeg version 6.1-fake", "ok       encoder libvorbis", "decoder mp3float for .mp3"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report lacks %q:\n%s", want, out.String())
+		}
+	}
+
+	out.Reset()
+	free := listingFFmpeg(t, "vorbis libopus", "flac vorbis")
+	err := runFFmpegCheck(&out, free, "vorbis", "flac,mp3")
+	if err == nil || !strings.Contains(err.Error(), "no libvorbis") || !strings.Contains(err.Error(), "no .mp3 decoder") {
+		t.Errorf("error %v", err)
+	}
+	for _, want := range []string{"experimental vorbis encoder", "-codec opus", "remove mp3 from -input-exts"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report lacks %q:\n%s", want, out.String())
+		}
+	}
+
+	out.Reset()
+	if err := runFFmpegCheck(&out, filepath.Join(t.TempDir(), "none"), "vorbis", "wav"); err == nil {
+		t.Error("missing ffmpeg accepted")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// ---------------- stream format ----------------
+
+// The encoder settings can change while the server runs: a config reload,
+// CPU pressure, failover to safe settings, or a -track-encode sidecar. Every
+// change starts a new link of the chained stream, with an EOS page ending
+// the old one and a fresh header set. A planned restart lets the encoders
+// flush first (see runPipeline), so the old link ends with its last audio
+// rather than a cut. The station keeps the format on air and when it
+// started; /nowplaying.json carries both, so relays and players that poll
+// it know when to expect the new headers.
+
+// streamFormat is what a station's encoder produces.
+type streamFormat struct {
+	codec       string
+	contentType string
+	bitrateKbps int // 0 in Vorbis quality mode
+	vorbisQ     int // quality mode only
+	sampleRate  int
+	channels    int
+}
+
+func (cfg encoderConfig) format() streamFormat {
+	f := streamFormat{
+		codec:       cfg.codec(),
+		contentType: cfg.contentType(),
+		bitrateKbps: cfg.bitrateKbps,
+		sampleRate:  pcmRate,
+		channels:    2,
+	}
+	if f.codec == "opus" {
+		f.sampleRate = 48000
+	} else if f.bitrateKbps <= 0 {
+		f.bitrateKbps, f.vorbisQ = 0, cfg.vorbisQ
+	}
+	if cfg.mono {
+		f.channels = 1
+	}
+	return f
+}
+
+func (f streamFormat) String() string {
+	rate := fmt.Sprintf("%d kbps", f.bitrateKbps)
+	if f.bitrateKbps == 0 {
+		rate = fmt.Sprintf("quality %d", f.vorbisQ)
+	}
+	layout := "stereo"
+	if f.channels == 1 {
+		layout = "mono"
+	}
+	return fmt.Sprintf("%s %s, %s, %g kHz", f.codec, rate, layout, float64(f.sampleRate)/1000)
+}
+
+// noteFormat records that st's encoder now produces enc's format.
+func (st *station) noteFormat(enc encoderConfig) {
+	f := enc.format()
+	st.fmu.Lock()
+	defer st.fmu.Unlock()
+	if f == st.onAirFormat {
+		return
+	}
+	if !st.formatSince.IsZero() {
+		log.Printf("%s: stream format now %s (was %s)", st.name, f, st.onAirFormat)
+	}
+	st.onAirFormat, st.formatSince = f, time.Now()
+}
+
+// format returns the format on air and when it started; ok is false before
+// the first encoder starts and with Ogg input, which is not re-encoded.
+func (st *station) format() (f streamFormat, since time.Time, ok bool) {
+	st.fmu.Lock()
+	defer st.fmu.Unlock()
+	return st.onAirFormat, st.formatSince, !st.formatSince.IsZero()
+}
+
+// formatJSON is the format object of /nowplaying.json.
+type formatJSON struct {
+	Codec         string `json:"codec"`
+	ContentType   string `json:"content_type"`
+	BitrateKbps   int    `json:"bitrate_kbps,omitempty"`
+	VorbisQuality *int   `json:"vorbis_quality,omitempty"` // quality mode only
+	SampleRate    int    `json:"sample_rate"`
+	Channels      int    `json:"channels"`
+	Since         string `json:"since"`
+}
+
+func (f streamFormat) json(since time.Time) *formatJSON {
+	out := &formatJSON{
+		Codec:       f.codec,
+		ContentType: f.contentType,
+		BitrateKbps: f.bitrateKbps,
+		SampleRate:  f.sampleRate,
+		Channels:    f.channels,
+		Since:       since.UTC().Format(time.RFC3339),
+	}
+	if f.bitrateKbps == 0 {
+		q := f.vorbisQ
+		out.VorbisQuality = &q
+	}
+	return out
+}
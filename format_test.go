@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestStreamFormat(t *testing.T) {
+	st := &station{name: "radio"}
+	if _, _, ok := st.format(); ok {
+		t.Fatal("format before the first encoder")
+	}
+	vorbis := encoderConfig{codecName: "vorbis", bitrateKbps: 192}
+	st.noteFormat(vorbis)
+	f, since, ok := st.format()
+	if !ok || f.String() != "vorbis 192 kbps, stereo, 44.1 kHz" {
+		t.Fatalf("format %q, %v", f, ok)
+	}
+	st.noteFormat(vorbis)
+	if _, again, _ := st.format(); !again.Equal(since) {
+		t.Error("same settings moved the format's start")
+	}
+
+	speech := trackEncode{bitrateKbps: 32, mono: true}.apply(encoderConfig{codecName: "opus", bitrateKbps: 96})
+	st.noteFormat(speech)
+	f, _, _ = st.format()
+	b, _ := json.Marshal(f.json(since))
+	for _, want := range []string{`"codec":"opus"`, `"bitrate_kbps":32`, `"sample_rate":48000`, `"channels":1`, `"content_type":"audio/ogg; codecs=opus"`} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("%s lacks %s", b, want)
+		}
+	}
+	if strings.Contains(string(b), "vorbis_quality") {
+		t.Errorf("%s has a quality", b)
+	}
+
+	b, _ = json.Marshal(encoderConfig{vorbisQ: 0}.format().json(since))
+	if !strings.Contains(string(b), `"vorbis_quality":0`) || strings.Contains(string(b), "bitrate_kbps") {
+		t.Errorf("quality mode: %s", b)
+	}
+}
+
+func TestPipelineFlush(t *testing.T) {
+	// The broadcaster finishes once the encoder's input is closed.
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var drained sync.WaitGroup
+	drained.Add(1)
+	go func() {
+		defer drained.Done()
+		_, _ = io.Copy(io.Discard, pr)
+	}()
+	if !(&pipeline{stdin: pw}).flush(&drained) {
+		t.Error("flush timed out")
+	}
+}
@@ -1,3 +1,10 @@
 module sujoyan/spartan-waves
 
 go 1.21.6
+
+require (
+	github.com/mattn/go-sqlite3 v1.14.22
+	go.etcd.io/bbolt v1.3.10
+)
+
+require golang.org/x/sys v0.7.0 // indirect
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ---------------- unreadable files ----------------
+
+// Libraries on NFS or SMB shares have transient I/O errors: a stale file
+// handle, a server that is briefly away. Before a file is decoded it is
+// opened and its first bytes read (see read-ahead), retried a few times with
+// a growing delay (silence covers the wait; see the pipeline clock in the
+// arbiter). A file that still fails, or whose decode fails, is skipped and
+// left out of the rotation for a while, doubling each time it fails again.
+// After a few failures in a row it counts as quarantined and is listed in
+// /stats and /admin/status until it plays again. A file that no longer
+// exists is just skipped; the next scan drops it.
+//
+// A file that ffmpeg fails to decode quarantineAfter times in a row is
+// corrupt rather than unlucky: it is quarantined for good, in the store so
+// it stays out across restarts, until it is replaced (its size or
+// modification time changes) or released with /admin/quarantine/release.
+
+const (
+	openAttempts      = 3           // tries to read a file before skipping it
+	openRetryDelay    = time.Second // before the second try, doubled after each
+	quarantineAfter   = 3           // failures in a row that make a file quarantined
+	failureBackoff    = time.Minute // a failed file is skipped this long, doubled per failure
+	maxFailureBackoff = time.Hour
+
+	quarantineBucket = "quarantine"
+)
+
+type fileHealth struct {
+	db store
+
+	mu sync.Mutex
+	m  map[string]*fileTrouble
+}
+
+type fileTrouble struct {
+	Failures int       `json:"failures"` // in a row
+	Decodes  int       `json:"decodes"`  // of them, ffmpeg failures in a row
+	Err      string    `json:"error"`
+	Last     time.Time `json:"last"`
+	Retry    time.Time `json:"-"` // skipped until then
+
+	// Corrupt files are persisted and skipped until the file changes.
+	Corrupt bool  `json:"corrupt"`
+	Size    int64 `json:"size"`
+	MTime   int64 `json:"mtime"`
+}
+
+// loadFileHealth reads the corrupt files quarantined in db.
+func loadFileHealth(db store) (*fileHealth, error) {
+	h := &fileHealth{db: db, m: make(map[string]*fileTrouble)}
+	keys, err := db.Keys(quarantineBucket)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range keys {
+		v, err := db.Get(quarantineBucket, p)
+		if err != nil {
+			return nil, err
+		}
+		var t fileTrouble
+		if err := json.Unmarshal(v, &t); err != nil {
+			log.Printf("quarantine: %s: %v", p, err)
+			continue
+		}
+		h.m[p] = &t
+	}
+	if len(h.m) > 0 {
+		log.Printf("Quarantine: %d corrupt files kept out of the rotation", len(h.m))
+	}
+	return h, nil
+}
+
+// ok reports whether p may be played at now. A corrupt file that has
+// changed since it was quarantined is released.
+func (h *fileHealth) ok(p string, now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	t := h.m[p]
+	switch {
+	case t == nil:
+		return true
+	case !t.Corrupt:
+		return !now.Before(t.Retry)
+	}
+	fi, err := os.Stat(p)
+	if err != nil || (fi.Size() == t.Size && fi.ModTime().UnixNano() == t.MTime) {
+		return false
+	}
+	log.Printf("%s has changed; out of quarantine", p)
+	h.forget(p)
+	return true
+}
+
+func (h *fileHealth) failed(p string, err error, now time.Time) {
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("Skipping %s: %v", p, err)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	t := h.m[p]
+	if t == nil {
+		t = &fileTrouble{}
+		h.m[p] = t
+	}
+	t.Failures++
+	var fe *sourceError
+	if errors.As(err, &fe) && fe.decode {
+		t.Decodes++
+	}
+	t.Err, t.Last = err.Error(), now
+	backoff := failureBackoff << min(t.Failures-1, 10)
+	backoff = min(backoff, maxFailureBackoff)
+	t.Retry = now.Add(backoff)
+	switch {
+	case t.Decodes >= quarantineAfter && !t.Corrupt:
+		t.Corrupt = true
+		if fi, err := os.Stat(p); err == nil {
+			t.Size, t.MTime = fi.Size(), fi.ModTime().UnixNano()
+		}
+		log.Printf("Quarantined %s: failed to decode %d times in a row: %v", p, t.Decodes, err)
+		if v, err := json.Marshal(t); err == nil {
+			if err := h.db.Put(quarantineBucket, p, v); err != nil {
+				log.Printf("quarantine: %v", err)
+			}
+		}
+	case t.Failures == quarantineAfter:
+		log.Printf("Quarantined %s after %d failures: %v", p, t.Failures, err)
+	default:
+		log.Printf("Skipping %s for %s: %v", p, backoff, err)
+	}
+}
+
+func (h *fileHealth) succeeded(p string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if t := h.m[p]; t != nil {
+		if t.Failures >= quarantineAfter {
+			log.Printf("%s plays again; out of quarantine", p)
+		}
+		h.forget(p)
+	}
+}
+
+// release takes p out of quarantine, reporting whether it was in.
+func (h *fileHealth) release(p string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.m[p] == nil {
+		return false
+	}
+	h.forget(p)
+	return true
+}
+
+// forget drops p; h.mu is held.
+func (h *fileHealth) forget(p string) {
+	if t := h.m[p]; t != nil && t.Corrupt {
+		if err := h.db.Delete(quarantineBucket, p); err != nil && !errors.Is(err, errNotFound) {
+			log.Printf("quarantine: %v", err)
+		}
+	}
+	delete(h.m, p)
+}
+
+type quarantinedFile struct {
+	Path     string `json:"path"`
+	Failures int    `json:"failures"`
+	Error    string `json:"error"`
+	Corrupt  bool   `json:"corrupt,omitempty"`
+	Retry    string `json:"retry,omitempty"` // not for corrupt files
+}
+
+// quarantined lists the files that failed quarantineAfter times or more.
+func (h *fileHealth) quarantined() []quarantinedFile {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var out []quarantinedFile
+	for p, t := range h.m {
+		if t.Failures < quarantineAfter && !t.Corrupt {
+			continue
+		}
+		q := quarantinedFile{Path: p, Failures: t.Failures, Error: t.Err, Corrupt: t.Corrupt}
+		if !t.Corrupt {
+			q.Retry = t.Retry.UTC().Format(time.RFC3339)
+		}
+		out = append(out, q)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out
+}
+
+// openReadable opens p and reads up to n bytes from its start, retrying
+// transient failures. It returns the file, positioned after what was read.
+func openReadable(p string, n int) (*os.File, []byte, error) {
+	delay := openRetryDelay
+	var err error
+	for i := 0; i < openAttempts; i++ {
+		if i > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		var f *os.File
+		var head []byte
+		if f, head, err = readHead(p, n); err == nil {
+			return f, head, nil
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil, err
+		}
+		log.Printf("Reading %s: %v (attempt %d of %d)", p, err, i+1, openAttempts)
+	}
+	return nil, nil, err
+}
+
+func readHead(p string, n int) (*os.File, []byte, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	head := make([]byte, n)
+	m, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, head[:m], nil
+}
+
+// writeStats lists the quarantined files in /stats.
+func (h *fileHealth) writeStats(w io.Writer) {
+	for _, f := range h.quarantined() {
+		if f.Corrupt {
+			fmt.Fprintf(w, "* Quarantined, corrupt: %s (%d failures, last: %s)\n", f.Path, f.Failures, f.Error)
+			continue
+		}
+		fmt.Fprintf(w, "* Quarantined: %s (%d failures, last: %s; next try %s)\n", f.Path, f.Failures, f.Error, f.Retry)
+	}
+}
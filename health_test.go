@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileHealth(t *testing.T) {
+	h, _ := loadFileHealth(newMemStore())
+	now := time.Now()
+	eio := errors.New("input/output error")
+
+	h.failed("a.wav", eio, now)
+	if h.ok("a.wav", now.Add(failureBackoff-time.Second)) {
+		t.Error("failed file not backed off")
+	}
+	if !h.ok("a.wav", now.Add(failureBackoff)) {
+		t.Error("failed file still backed off after its backoff")
+	}
+	h.failed("a.wav", eio, now)
+	if h.ok("a.wav", now.Add(failureBackoff)) {
+		t.Error("backoff did not double on the second failure")
+	}
+	if q := h.quarantined(); len(q) != 0 {
+		t.Fatalf("quarantined after 2 failures: %v", q)
+	}
+	h.failed("a.wav", eio, now)
+	q := h.quarantined()
+	if len(q) != 1 || q[0].Path != "a.wav" || q[0].Failures != 3 || q[0].Error != eio.Error() {
+		t.Fatalf("quarantined = %+v", q)
+	}
+	h.succeeded("a.wav")
+	if len(h.quarantined()) != 0 || !h.ok("a.wav", now) {
+		t.Error("success did not clear the file")
+	}
+
+	h.failed("gone.wav", os.ErrNotExist, now)
+	if !h.ok("gone.wav", now) {
+		t.Error("a missing file counted as a failure")
+	}
+}
+
+func TestCorruptQuarantine(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "bad.wav")
+	if err := os.WriteFile(p, []byte("RIFF"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	db := newMemStore()
+	h, _ := loadFileHealth(db)
+	now := time.Now()
+	bad := &sourceError{errors.New("ffmpeg: exit status 1"), true}
+	for i := 0; i < quarantineAfter; i++ {
+		h.failed(p, bad, now)
+	}
+	later := now.Add(2 * maxFailureBackoff)
+	if h.ok(p, later) {
+		t.Error("corrupt file let back in after its backoff")
+	}
+
+	// The quarantine outlives a restart.
+	h, _ = loadFileHealth(db)
+	q := h.quarantined()
+	if len(q) != 1 || !q[0].Corrupt || q[0].Path != p {
+		t.Fatalf("after reload: %+v", q)
+	}
+	if h.ok(p, later) {
+		t.Error("corrupt file let back in after a restart")
+	}
+
+	// A replaced file gets another go, and leaves the store.
+	if err := os.WriteFile(p, []byte("RIFF....WAVE"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if !h.ok(p, later) {
+		t.Error("replaced file still quarantined")
+	}
+	if keys, _ := db.Keys(quarantineBucket); len(keys) != 0 {
+		t.Errorf("store still holds %v", keys)
+	}
+
+	for i := 0; i < quarantineAfter; i++ {
+		h.failed(p, bad, now)
+	}
+	if !h.release(p) || !h.ok(p, now) {
+		t.Error("release did not let the file back in")
+	}
+	if h.release(p) {
+		t.Error("released a file twice")
+	}
+}
+
+func TestOpenReadable(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "a.wav")
+	if err := os.WriteFile(p, []byte("RIFF....WAVE"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, head, err := openReadable(p, 4)
+	if err != nil {
+		t.Fatalf("readable file: %v", err)
+	}
+	rest, _ := io.ReadAll(f)
+	f.Close()
+	if string(head) != "RIFF" || string(rest) != "....WAVE" {
+		t.Errorf("head %q, rest %q", head, rest)
+	}
+	f, head, err = openReadable(p, 64)
+	if err != nil || string(head) != "RIFF....WAVE" {
+		t.Errorf("short file: %q, %v", head, err)
+	}
+	f.Close()
+
+	start := time.Now()
+	if _, _, err := openReadable(filepath.Join(dir, "gone.wav"), 4); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing file: %v", err)
+	}
+	if time.Since(start) >= openRetryDelay {
+		t.Error("a missing file was retried")
+	}
+}
+
+// brokenPipe takes one write and fails the rest, like an encoder that died.
+type brokenPipe struct{ n int }
+
+func (b *brokenPipe) Write(p []byte) (int, error) {
+	if b.n > 0 {
+		return 0, errors.New("broken pipe")
+	}
+	b.n += len(p)
+	return len(p), nil
+}
+
+// fakeDecoder writes an ffmpeg stand-in that decodes a file piped to it to
+// 4 KiB of silence, or fails if the file starts with BAD, and one file of
+// each kind.
+func fakeDecoder(t *testing.T) (ffmpeg, bad, good string) {
+	dir := t.TempDir()
+	ffmpeg = filepath.Join(dir, "ffmpeg")
+	script := "#!/bin/sh\n[ \"$(head -c 3)\" = BAD ] && exit 1\nhead -c 4096 /dev/zero\n"
+	if err := os.WriteFile(ffmpeg, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	bad, good = filepath.Join(dir, "bad.wav"), filepath.Join(dir, "good.wav")
+	for p, data := range map[string]string{bad: "BAD", good: "RIFF"} {
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ffmpeg, bad, good
+}
+
+func TestDecodeErrors(t *testing.T) {
+	ffmpeg, bad, good := fakeDecoder(t)
+	decode := func(p string, w io.Writer) error {
+		f, err := os.Open(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		return decodeWavToPCMAndWrite(ffmpeg, p, f, w, nil, nil)
+	}
+
+	if err := decode(good, io.Discard); err != nil {
+		t.Errorf("good file: %v", err)
+	}
+	var src *sourceError
+	if err := decode(bad, io.Discard); !errors.As(err, &src) || !src.decode {
+		t.Errorf("bad file: %v, want a decode sourceError", err)
+	}
+	var sink *sinkError
+	if err := decode(good, &brokenPipe{n: 1}); !errors.As(err, &sink) {
+		t.Errorf("broken encoder input: %v, want a sinkError", err)
+	}
+	if err := decodeWavToPCMAndWrite(filepath.Join(t.TempDir(), "none"), good, nil, io.Discard, nil, nil); errors.As(err, &src) || errors.As(err, &sink) {
+		t.Errorf("missing ffmpeg: %T, want neither kind", err)
+	}
+
+	// A decoder with more to write when the encoder dies is killed, not
+	// waited on while it blocks on its full output pipe.
+	endless := filepath.Join(t.TempDir(), "ffmpeg")
+	if err := os.WriteFile(endless, []byte("#!/bin/sh\nexec cat /dev/zero\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- decodeWavToPCMAndWrite(endless, good, nil, &brokenPipe{}, nil, nil) }()
+	select {
+	case err := <-done:
+		if !errors.As(err, &sink) {
+			t.Errorf("encoder died under a live decoder: %v, want a sinkError", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("decode hung after the encoder died")
+	}
+}
+
+func TestFeederSkipsBadFile(t *testing.T) {
+	ffmpeg, bad, good := fakeDecoder(t)
+	h, _ := loadFileHealth(newMemStore())
+	f := &feeder{
+		ffmpegPath: ffmpeg,
+		loadList:   func() ([]string, error) { return []string{bad, good}, nil },
+		rescan:     time.Second,
+		health:     h,
+	}
+
+	// The feeder only returns once the encoder side breaks: after good.wav.
+	out := &brokenPipe{}
+	done := make(chan struct{})
+	go func() {
+		f.feedWavForever(out, nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("feeder did not return")
+	}
+	if out.n == 0 {
+		t.Error("the feed stopped at the bad file")
+	}
+	if h.ok(bad, time.Now()) {
+		t.Error("bad file not backed off")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ---------------- play history ----------------
+
+// playHistory is the window of recently played files. When shuffling, files
+// in the window are moved to the end of the new cycle, least recently played
+// first, so a track that just played does not come round again straight
+// away. With persistent storage the window survives restarts: a crash loop
+// or a series of redeploys does not keep opening with the same tracks.
+type playHistory struct {
+	db          store
+	bucket, key string
+	size        int
+
+	mu     sync.Mutex
+	recent []string // oldest first
+}
+
+// loadPlayHistory reads the window stored under bucket/key, one path per line.
+func loadPlayHistory(db store, bucket, key string, size int) (*playHistory, error) {
+	h := &playHistory{db: db, bucket: bucket, key: key, size: size}
+	v, err := db.Get(bucket, key)
+	if errors.Is(err, errNotFound) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(v), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			h.recent = append(h.recent, line)
+		}
+	}
+	if len(h.recent) > size {
+		h.recent = h.recent[len(h.recent)-size:]
+	}
+	return h, nil
+}
+
+// add records p as just played.
+func (h *playHistory) add(p string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, r := range h.recent {
+		if r == p {
+			h.recent = append(h.recent[:i], h.recent[i+1:]...)
+			break
+		}
+	}
+	h.recent = append(h.recent, p)
+	if len(h.recent) > h.size {
+		h.recent = h.recent[len(h.recent)-h.size:]
+	}
+	if err := h.db.Put(h.bucket, h.key, []byte(strings.Join(h.recent, "\n")+"\n")); err != nil {
+		log.Printf("history: %v", err)
+	}
+}
+
+// spread moves recently played files to the end of files, keeping the order
+// of everything else.
+func (h *playHistory) spread(files []string) []string {
+	h.mu.Lock()
+	age := make(map[string]int, len(h.recent))
+	for i, r := range h.recent {
+		age[r] = i + 1
+	}
+	h.mu.Unlock()
+
+	out := make([]string, 0, len(files))
+	var played []string
+	for _, p := range files {
+		if age[p] > 0 {
+			played = append(played, p)
+		} else {
+			out = append(out, p)
+		}
+	}
+	sort.Slice(played, func(i, j int) bool { return age[played[i]] < age[played[j]] })
+	return append(out, played...)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---------------- HTTP output ----------------
+
+// With -http-port the stations are also served over plain HTTP, for web
+// players and stream directories that know Icecast but not Spartan. A GET
+// of a mount (/radio, /radio-low, /radio/<name>) gets the same Ogg pages as
+// a Spartan listener, after an HTTP/1.0 header with the Icecast-style icy-*
+// fields; the body ends when the connection does. The query takes the same
+// options as on Spartan (offset, join). Listener limits, the egress cap,
+// maintenance mode, sessions and watermarks apply as on Spartan, and HTTP
+// listeners are counted with the others. Everything else, including the
+// index, stays on Spartan.
+
+// httpReply writes handleRadio's replies as HTTP/1.0 responses.
+type httpReply struct {
+	name string // the station title, for icy-name
+	url  string // the Spartan front door, for icy-url
+}
+
+func (r httpReply) ok(st *station, contentType string) string {
+	var b strings.Builder
+	b.WriteString("HTTP/1.0 200 OK\r\n")
+	fmt.Fprintf(&b, "Content-Type: %s\r\n", contentType)
+	b.WriteString("Cache-Control: no-cache, no-store\r\n")
+	b.WriteString("Access-Control-Allow-Origin: *\r\n")
+	fmt.Fprintf(&b, "icy-name: %s\r\n", headerSafe(r.name))
+	fmt.Fprintf(&b, "icy-url: %s\r\n", r.url)
+	b.WriteString("icy-pub: 0\r\n")
+	if f, _, ok := st.format(); ok {
+		info := fmt.Sprintf("samplerate=%d;channels=%d", f.sampleRate, f.channels)
+		if f.bitrateKbps > 0 {
+			fmt.Fprintf(&b, "icy-br: %d\r\n", f.bitrateKbps)
+			info += ";bitrate=" + strconv.Itoa(f.bitrateKbps)
+		}
+		fmt.Fprintf(&b, "ice-audio-info: %s\r\n", info)
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+func (httpReply) refuse(temporary bool, msg string) string {
+	status := "400 Bad Request"
+	if temporary {
+		status = "503 Service Unavailable"
+	}
+	return fmt.Sprintf("HTTP/1.0 %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\n", status, msg)
+}
+
+// headerSafe keeps s on one header line.
+func headerSafe(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
+
+// serveHTTP serves the stations on ln until it is closed.
+func (srv *server) serveHTTP(ln net.Listener) {
+	hs := &http.Server{
+		Handler:           http.HandlerFunc(srv.handleHTTP),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if err := hs.Serve(ln); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("HTTP: %v", err)
+	}
+}
+
+func (srv *server) handleHTTP(w http.ResponseWriter, r *http.Request) {
+	verbose := srv.reqlog.request("http "+srv.route(r.URL.Path), r.RemoteAddr, r.URL.RequestURI())
+	st := srv.station(r.URL.Path)
+	switch {
+	case st == nil:
+		http.NotFound(w, r)
+		return
+	case r.Method != http.MethodGet && r.Method != http.MethodHead:
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if m := srv.maintenance(); m != nil {
+		http.Error(w, "down for maintenance: "+m.window(), http.StatusServiceUnavailable)
+		return
+	}
+	if limit := srv.limit; limit != nil {
+		if n := limit.current(); n > 0 && srv.listenerCount() >= n {
+			http.Error(w, "station is full; try again later", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	if srv.egress.refuse() {
+		http.Error(w, "off air until next month: bandwidth allowance used up", http.StatusServiceUnavailable)
+		return
+	}
+	reply := httpReply{name: srv.title(), url: fmt.Sprintf("spartan://%s:%d%s", srv.host, srv.port, st.mount)}
+	if r.Method == http.MethodHead {
+		w.Header().Set("Content-Type", st.settings().enc.contentType())
+		w.Header().Set("icy-name", headerSafe(reply.name))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	ec := &egressConn{Conn: conn, m: srv.egress, bulk: true}
+	defer ec.Close()
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	handleRadio(ec, reply, st, srv.sessions, host, r.URL.RawQuery, verbose)
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The integration tests run the real server as a child process: the test
+// binary re-executes itself with SW_TEST_ROLE=server to run main(), and
+// with SW_TEST_ROLE=ffmpeg to stand in for ffmpeg. The fake encoder drains
+// its stdin and produces a paced Ogg stream with minimal Vorbis headers; the
+// fake decoder writes a second of silence per file.
+
+func TestMain(m *testing.M) {
+	switch os.Getenv("SW_TEST_ROLE") {
+	case "server":
+		os.Args = append([]string{os.Args[0]}, strings.Fields(os.Getenv("SW_TEST_ARGS"))...)
+		main()
+		os.Exit(0)
+	case "ffmpeg":
+		fakeFFmpeg(os.Args[1:])
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func fakeFFmpeg(args []string) {
+	// The live encoder reads PCM from stdin and writes Ogg; decoders may
+	// read a file from stdin too.
+	var stdin, ogg bool
+	for _, a := range args {
+		switch a {
+		case "pipe:0":
+			stdin = true
+		case "ogg":
+			ogg = true
+		}
+	}
+	if !stdin || !ogg {
+		_, _ = os.Stdout.Write(make([]byte, pcmBytesPerSecond))
+		return
+	}
+	go func() { _, _ = io.Copy(io.Discard, os.Stdin) }()
+
+	const serial = 0x5157
+	var ident bytes.Buffer
+	ident.WriteString("\x01vorbis")
+	_ = binary.Write(&ident, binary.LittleEndian, struct {
+		Version  uint32
+		Channels uint8
+		Rate     uint32
+		Max, Nom int32
+		Min      int32
+	}{0, 2, 44100, 0, 192000, 0})
+	ident.Write([]byte{0xb8, 1})
+	comment := []byte("\x03vorbis\x04\x00\x00\x00test\x00\x00\x00\x00\x01")
+	setup := append([]byte("\x05vorbis"), make([]byte, 40)...)
+
+	seq := uint32(0)
+	write := func(flags byte, granule int64, pkt []byte) bool {
+		p := &oggPage{flags: flags, granule: granule, serial: serial, seq: seq}
+		for n := len(pkt); ; n -= 255 {
+			p.segs = append(p.segs, byte(min(n, 255)))
+			if n < 255 {
+				break
+			}
+		}
+		p.body = pkt
+		seq++
+		_, err := os.Stdout.Write(p.bytes())
+		return err == nil
+	}
+	write(0x02, 0, ident.Bytes())
+	write(0, 0, comment)
+	write(0, 0, setup)
+	for granule := int64(1024); write(0, granule, make([]byte, 300)); granule += 1024 {
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// startServer runs the server with args and returns its address.
+func startServer(t *testing.T, args ...string) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("integration test")
+	}
+	dir := t.TempDir()
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ffmpeg := filepath.Join(dir, "ffmpeg")
+	script := fmt.Sprintf("#!/bin/sh\nSW_TEST_ROLE=ffmpeg exec %q \"$@\"\n", self)
+	if err := os.WriteFile(ffmpeg, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	music := filepath.Join(dir, "music")
+	if err := os.Mkdir(music, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.wav", "b.wav"} {
+		if err := os.WriteFile(filepath.Join(music, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	args = append([]string{"-port", fmt.Sprint(port), "-ffmpeg", ffmpeg, "-music-dir", music}, args...)
+	cmd := exec.Command(self)
+	cmd.Env = append(os.Environ(), "SW_TEST_ROLE=server", "SW_TEST_ARGS="+strings.Join(args, " "))
+	var logs bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &logs, &logs
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		if t.Failed() {
+			t.Logf("server log:\n%s", logs.String())
+		}
+	})
+
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		c, err := net.Dial("tcp", addr)
+		if err == nil {
+			c.Close()
+			return addr
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server did not start: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// spartan sends one request and returns the connection and its status line.
+func spartan(t *testing.T, addr, path string) (net.Conn, *bufio.Reader, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	fmt.Fprintf(conn, "localhost %s 0\r\n", path)
+	br := bufio.NewReader(conn)
+	status, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return conn, br, strings.TrimRight(status, "\r\n")
+}
+
+func get(t *testing.T, addr, path string) (string, string) {
+	t.Helper()
+	_, br, status := spartan(t, addr, path)
+	body, err := io.ReadAll(br)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return status, string(body)
+}
+
+func TestIntegrationStream(t *testing.T) {
+	addr := startServer(t)
+
+	// Wait for the headers to be cached, as a client tuning in later would.
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		if _, body := get(t, addr, "/stats"); !strings.Contains(body, "Header cache: 0/") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("headers never cached")
+		}
+	}
+
+	_, br, status := spartan(t, addr, "/radio")
+	if status != "2 audio/ogg" {
+		t.Fatalf("status %q", status)
+	}
+	vh := &headerFinder{}
+	var last int64 = -1
+	for i := 0; i < 50; i++ {
+		raw, err := readNextOggPage(br)
+		if err != nil {
+			t.Fatalf("page %d: %v", i, err)
+		}
+		p, ok := parseOggPage(raw)
+		if !ok {
+			t.Fatalf("page %d: unparseable", i)
+		}
+		if !bytes.Equal(p.bytes(), raw) {
+			t.Fatalf("page %d: bad CRC", i)
+		}
+		if !vh.done() {
+			vh.feedPage(raw)
+			if i == 0 && p.flags&0x02 == 0 {
+				t.Fatal("stream does not start with a BOS page")
+			}
+			continue
+		}
+		if p.granule < last {
+			t.Fatalf("page %d: granule went back from %d to %d", i, last, p.granule)
+		}
+		last = p.granule
+	}
+	if !vh.done() {
+		t.Fatal("no complete Vorbis header")
+	}
+
+	_, body := get(t, addr, "/stats")
+	if !strings.Contains(body, "* Listeners: 1") {
+		t.Errorf("/stats while listening:\n%s", body)
+	}
+}
+
+func TestIntegrationEndpoints(t *testing.T) {
+	addr := startServer(t)
+
+	status, body := get(t, addr, "/")
+	if !strings.HasPrefix(status, "2 text/gemini") || !strings.Contains(body, "/radio") {
+		t.Errorf("/: %q\n%s", status, body)
+	}
+	status, body = get(t, addr, "/stats")
+	if !strings.HasPrefix(status, "2 text/gemini") || !strings.Contains(body, "## /radio") {
+		t.Errorf("/stats: %q\n%s", status, body)
+	}
+	if status, _ := get(t, addr, "/nope"); !strings.HasPrefix(status, "4") {
+		t.Errorf("/nope: %q", status)
+	}
+}
+
+func TestIntegrationHTTP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	addr := startServer(t, "-http-port", fmt.Sprint(port), "-stream-name", "Test")
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		if _, body := get(t, addr, "/stats"); !strings.Contains(body, "Header cache: 0/") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("headers never cached")
+		}
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	base := fmt.Sprintf("http://127.0.0.1:%d", port)
+	resp, err := client.Get(base + "/radio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "audio/ogg" || resp.Header.Get("icy-name") != "Test" {
+		t.Fatalf("/radio: %s %v", resp.Status, resp.Header)
+	}
+	raw, err := readNextOggPage(bufio.NewReader(resp.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := parseOggPage(raw); !ok || p.flags&0x02 == 0 {
+		t.Fatal("stream does not start with a BOS page")
+	}
+
+	nope, err := client.Get(base + "/nope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nope.Body.Close()
+	if nope.StatusCode != http.StatusNotFound {
+		t.Errorf("/nope: %s", nope.Status)
+	}
+}
+
+func TestIntegrationArchive(t *testing.T) {
+	dir := t.TempDir()
+	addr := startServer(t, "-archive-dir", dir, "-archive-key", "k", "-stream-name", "Test")
+
+	if status, _ := get(t, addr, "/archive"); status != "4 this archive is private" {
+		t.Errorf("/archive without the key: %q", status)
+	}
+	day := time.Now().Format("2006-01-02")
+	var link string
+	for deadline := time.Now().Add(10 * time.Second); link == ""; time.Sleep(50 * time.Millisecond) {
+		_, body := get(t, addr, "/archive/"+day+"?key=k")
+		for _, line := range strings.Split(body, "\n") {
+			if f := strings.Fields(line); len(f) > 1 && f[0] == "=>" && strings.Contains(f[1], ".ogg?") {
+				link = f[1]
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no segment listed:\n%s", body)
+		}
+	}
+
+	status, body := get(t, addr, link)
+	if status != "2 audio/ogg" {
+		t.Fatalf("%s: %q", link, status)
+	}
+	pages, ok := parseOggPages([]byte(body))
+	if !ok || len(pages) < 3 || pages[0].flags&0x02 == 0 {
+		t.Fatalf("%s: not an Ogg stream from its start", link)
+	}
+	if packets := oggPackets(pages[:2]); len(packets) < 2 || !strings.Contains(string(packets[1]), "ORGANIZATION=Test") {
+		t.Errorf("%s: no station comment in %q", link, packets)
+	}
+}
+
+func TestIntegrationSlowReaderDropped(t *testing.T) {
+	// Every write to a listener takes 20ms while pages arrive every 5ms,
+	// so the listener's queue overflows and it is dropped.
+	addr := startServer(t, "-chaos-slow-listeners", "20ms")
+
+	_, br, status := spartan(t, addr, "/radio")
+	if status != "2 audio/ogg" {
+		t.Fatalf("status %q", status)
+	}
+	go func() { _, _ = io.Copy(io.Discard, br) }()
+
+	seen := false
+	for deadline := time.Now().Add(20 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		_, body := get(t, addr, "/stats")
+		switch {
+		case strings.Contains(body, "* Listeners: 1"):
+			seen = true
+		case seen && strings.Contains(body, "* Listeners: 0"):
+			return
+		}
+	}
+	t.Fatalf("slow listener was not dropped (seen connected: %v)", seen)
+}
@@ -0,0 +1,812 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// ---------------- music library ----------------
+
+// The library indexes the tags of every file in the rotation for searching.
+// Tags are cached in the store's "library" bucket, keyed by path, together
+// with the file's size and modification time; a rescan only reads files that
+// are new or changed, so a large library is searchable again right after a
+// restart.
+//
+// Searching uses an inverted index of lower-cased words per field: the
+// store's full-text index where it has one (sqlite), else one kept in
+// memory. A query is a list of words that must all match:
+//
+//	word           in any field
+//	artist:word    only in that field (artist, title, album, genre or file)
+//	field:"a b"    every word of the phrase in that field
+//	wor*           any word starting with "wor"
+
+type libTrack struct {
+	Path   string `json:"path"`
+	Artist string `json:"artist,omitempty"`
+	Title  string `json:"title"`
+	Album  string `json:"album,omitempty"`
+	Genre  string `json:"genre,omitempty"`
+	Size   int64  `json:"size"`
+	MTime  int64  `json:"mtime"` // unix nanoseconds
+	Added  int64  `json:"added"` // unix seconds; file mtime at first indexing
+	Plays  int    `json:"plays,omitempty"`
+	// Which tags the entry holds; older entries are read again.
+	Tags int `json:"tags,omitempty"`
+}
+
+// libraryTags is the current Tags: 1 added the genre.
+const libraryTags = 1
+
+var libraryFields = []string{"artist", "title", "album", "genre", "file"}
+
+func (t *libTrack) field(name string) string {
+	switch name {
+	case "artist":
+		return t.Artist
+	case "title":
+		return t.Title
+	case "album":
+		return t.Album
+	case "genre":
+		return t.Genre
+	case "file":
+		return filepath.Base(t.Path)
+	}
+	return ""
+}
+
+// doc is t's text for the full-text index, per field.
+func (t *libTrack) doc() map[string]string {
+	d := make(map[string]string, len(libraryFields))
+	for _, f := range libraryFields {
+		d[f] = t.field(f)
+	}
+	return d
+}
+
+// id is a short stable identifier for links, derived from the path.
+func (t *libTrack) id() string {
+	sum := sha256.Sum256([]byte(t.Path))
+	return hex.EncodeToString(sum[:6])
+}
+
+// String is the display form, "Artist – Title (Album)".
+func (t *libTrack) String() string {
+	s := t.Title
+	if t.Artist != "" {
+		s = t.Artist + " – " + s
+	}
+	if t.Album != "" {
+		s += " (" + t.Album + ")"
+	}
+	return s
+}
+
+const (
+	libraryBucket = "library"
+	libraryRescan = 10 * time.Minute // how often the rotation is reindexed
+)
+
+type library struct {
+	db        store
+	newWithin time.Duration // tracks added this recently are new
+
+	mu     sync.RWMutex
+	tracks []*libTrack      // sorted by artist, album, title
+	terms  map[string][]int // "field:word" -> indexes into tracks, ascending
+	byID   map[string]*libTrack
+	byPath map[string]*libTrack
+	ready  bool // first scan finished
+
+	noIndex bool // -low-memory: no terms; match reads every track
+
+	// The store's full-text index, used instead of terms; nil if the store
+	// has none. pos maps paths to indexes into tracks.
+	fts      textIndex
+	pos      map[string]int
+	ftsStale bool // an update failed; scan rebuilds the index
+}
+
+func newLibrary(db store) *library {
+	l := &library{db: db, terms: map[string][]int{}}
+	if ti, ok := db.(textIndexer); ok {
+		ix, err := ti.TextIndex(libraryBucket, libraryFields)
+		if err != nil {
+			log.Printf("library: %v; indexing in memory", err)
+		} else {
+			l.fts = ix
+		}
+	}
+	return l
+}
+
+// run indexes the rotation now and then every interval.
+func (l *library) run(loadList func() ([]string, error), interval time.Duration) {
+	for {
+		files, err := loadList()
+		if err != nil {
+			log.Printf("library: %v", err)
+		} else {
+			l.scan(files)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// scan reindexes files, reading tags only for files that changed.
+func (l *library) scan(files []string) {
+	start := time.Now()
+	read := 0
+	tracks := make([]*libTrack, 0, len(files))
+	seen := make(map[string]bool, len(files))
+	docs := map[string]map[string]string{} // changed, for the full-text index
+	for _, p := range files {
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		fi, err := os.Stat(p)
+		if err != nil {
+			continue
+		}
+		var t libTrack
+		if v, err := l.db.Get(libraryBucket, p); err == nil && json.Unmarshal(v, &t) == nil &&
+			t.Size == fi.Size() && t.MTime == fi.ModTime().UnixNano() && t.Tags == libraryTags {
+			tracks = append(tracks, &t)
+			continue
+		}
+		tags, err := readTags(p)
+		if err != nil {
+			debugf("library: %s: %v", p, err)
+		}
+		if t.Added == 0 {
+			// Files already there when the library is first indexed count
+			// as added when they were last written.
+			t.Added = min(fi.ModTime().Unix(), time.Now().Unix())
+		}
+		t = libTrack{
+			Path: p, Artist: tags.artist, Title: tags.title, Album: tags.album, Genre: tags.genre,
+			Size: fi.Size(), MTime: fi.ModTime().UnixNano(), Added: t.Added, Plays: t.Plays,
+			Tags: libraryTags,
+		}
+		if v, err := json.Marshal(&t); err == nil {
+			if err := l.db.Put(libraryBucket, p, v); err != nil {
+				log.Printf("library: %v", err)
+			}
+		}
+		tracks = append(tracks, &t)
+		docs[p] = t.doc()
+		read++
+	}
+	if keys, err := l.db.Keys(libraryBucket); err == nil {
+		for _, k := range keys {
+			if !seen[k] {
+				_ = l.db.Delete(libraryBucket, k)
+				docs[k] = nil
+			}
+		}
+	}
+	if l.fts != nil {
+		// The index is rebuilt at startup, in case the store's copy is
+		// out of date, and then only updated.
+		all := !l.ready || l.ftsStale
+		if all {
+			docs = make(map[string]map[string]string, len(tracks))
+			for _, t := range tracks {
+				docs[t.Path] = t.doc()
+			}
+		}
+		err := l.fts.Replace(docs, all)
+		if err != nil {
+			log.Printf("library: index: %v", err)
+		}
+		l.ftsStale = err != nil
+	}
+
+	sort.SliceStable(tracks, func(i, j int) bool {
+		a, b := tracks[i], tracks[j]
+		if a.Artist != b.Artist {
+			return strings.ToLower(a.Artist) < strings.ToLower(b.Artist)
+		}
+		if a.Album != b.Album {
+			return strings.ToLower(a.Album) < strings.ToLower(b.Album)
+		}
+		return strings.ToLower(a.Title) < strings.ToLower(b.Title)
+	})
+	terms := map[string][]int{}
+	byID := make(map[string]*libTrack, len(tracks))
+	byPath := make(map[string]*libTrack, len(tracks))
+	var pos map[string]int
+	if l.fts != nil {
+		pos = make(map[string]int, len(tracks))
+	}
+	for i, t := range tracks {
+		byID[t.id()] = t
+		byPath[t.Path] = t
+		if l.fts != nil {
+			pos[t.Path] = i
+			continue
+		}
+		if l.noIndex {
+			continue
+		}
+		for _, f := range libraryFields {
+			for _, w := range words(t.field(f)) {
+				key := f + ":" + w
+				if ids := terms[key]; len(ids) == 0 || ids[len(ids)-1] != i {
+					terms[key] = append(ids, i)
+				}
+			}
+		}
+	}
+
+	l.mu.Lock()
+	first := !l.ready
+	l.tracks, l.terms, l.byID, l.byPath, l.pos, l.ready = tracks, terms, byID, byPath, pos, true
+	l.mu.Unlock()
+	if first || read > 0 {
+		log.Printf("Library: %d tracks indexed (%d read, %d cached) in %s",
+			len(tracks), read, len(tracks)-read, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// words splits s into lower-cased letter and digit runs.
+func words(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+var errBadQuery = errors.New("bad query")
+
+// queryTerm is one word of a query, restricted to field ("" = any field).
+type queryTerm struct {
+	field  string
+	word   string
+	prefix bool
+}
+
+func parseQuery(q string) ([]queryTerm, error) {
+	var terms []queryTerm
+	for q = strings.TrimSpace(q); q != ""; q = strings.TrimSpace(q) {
+		var field, value string
+		if name, rest, ok := strings.Cut(q, ":"); ok && !strings.ContainsAny(name, " \t\"") {
+			field, q = strings.ToLower(name), rest
+			if !validField(field) {
+				return nil, fmt.Errorf("%w: unknown field %q (use %s)", errBadQuery, name, strings.Join(libraryFields, ", "))
+			}
+		}
+		if strings.HasPrefix(q, `"`) {
+			end := strings.Index(q[1:], `"`)
+			if end < 0 {
+				return nil, fmt.Errorf("%w: unterminated quote", errBadQuery)
+			}
+			value, q = q[1:1+end], q[2+end:]
+		} else {
+			end := strings.IndexAny(q, " \t")
+			if end < 0 {
+				end = len(q)
+			}
+			value, q = q[:end], q[end:]
+		}
+		prefix := strings.HasSuffix(value, "*")
+		ws := words(value)
+		for i, w := range ws {
+			terms = append(terms, queryTerm{field: field, word: w, prefix: prefix && i == len(ws)-1})
+		}
+	}
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("%w: empty", errBadQuery)
+	}
+	return terms, nil
+}
+
+func validField(f string) bool {
+	for _, name := range libraryFields {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// search returns the tracks matching every term of q, in library order.
+func (l *library) search(q string) ([]*libTrack, error) {
+	scores, err := l.match(q)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, 0, len(scores))
+	for i := range scores {
+		ids = append(ids, i)
+	}
+	sort.Ints(ids)
+	return l.pick(ids), nil
+}
+
+// rank returns the tracks matching every term of q, best match first.
+func (l *library) rank(q string) ([]*libTrack, error) {
+	scores, err := l.match(q)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, 0, len(scores))
+	for i := range scores {
+		ids = append(ids, i)
+	}
+	sort.Slice(ids, func(a, b int) bool {
+		if sa, sb := scores[ids[a]], scores[ids[b]]; sa != sb {
+			return sa > sb
+		}
+		return ids[a] < ids[b]
+	})
+	return l.pick(ids), nil
+}
+
+func (l *library) pick(ids []int) []*libTrack {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	out := make([]*libTrack, len(ids))
+	for n, i := range ids {
+		out[n] = l.tracks[i]
+	}
+	return out
+}
+
+// Relevance weights: where a word matches, and how.
+var fieldWeight = map[string]float64{"title": 3, "artist": 2, "album": 1.5, "genre": 1, "file": 0.5}
+
+const prefixWeight = 0.5 // a prefix match counts half a whole word
+
+// match scores the tracks matching every term of q. A term scores the best
+// field weight it matches in, times its rarity in the library, so "nina
+// sinnerman" ranks the track titled Sinnerman above Nina's other tracks.
+func (l *library) match(q string) (map[int]float64, error) {
+	terms, err := parseQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var hits map[int]float64
+	for _, qt := range terms {
+		match := map[int]float64{}
+		add := func(ids []int, w float64) {
+			for _, i := range ids {
+				match[i] = max(match[i], w)
+			}
+		}
+		fields := libraryFields
+		if qt.field != "" {
+			fields = []string{qt.field}
+		}
+		for _, f := range fields {
+			if l.fts != nil {
+				if err := l.ftsTerm(f, qt, add); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if l.noIndex {
+				l.scanTerm(f, qt, add)
+				continue
+			}
+			add(l.terms[f+":"+qt.word], fieldWeight[f])
+			if !qt.prefix {
+				continue
+			}
+			for key, ids := range l.terms {
+				if strings.HasPrefix(key, f+":"+qt.word) && key != f+":"+qt.word {
+					add(ids, fieldWeight[f]*prefixWeight)
+				}
+			}
+		}
+		idf := math.Log(1 + float64(len(l.tracks))/float64(max(len(match), 1)))
+		if hits == nil {
+			hits = make(map[int]float64, len(match))
+			for i, w := range match {
+				hits[i] = w * idf
+			}
+		} else {
+			for i := range hits {
+				if w, ok := match[i]; ok {
+					hits[i] += w * idf
+				} else {
+					delete(hits, i)
+				}
+			}
+		}
+		if len(hits) == 0 {
+			break
+		}
+	}
+	return hits, nil
+}
+
+// scanTerm is match's lookup of qt in field f without the index: it reads
+// the field of every track. Called with mu held.
+func (l *library) scanTerm(f string, qt queryTerm, add func(ids []int, w float64)) {
+	for i, t := range l.tracks {
+		for _, w := range words(t.field(f)) {
+			switch {
+			case w == qt.word:
+				add([]int{i}, fieldWeight[f])
+			case qt.prefix && strings.HasPrefix(w, qt.word):
+				add([]int{i}, fieldWeight[f]*prefixWeight)
+			}
+		}
+	}
+}
+
+// ftsTerm is match's lookup of qt in field f through the store's full-text
+// index. Called with mu held.
+func (l *library) ftsTerm(f string, qt queryTerm, add func(ids []int, w float64)) error {
+	for _, prefix := range []bool{false, true} {
+		if prefix && !qt.prefix {
+			break
+		}
+		keys, err := l.fts.Match(f, qt.word, prefix)
+		if err != nil {
+			return err
+		}
+		ids := make([]int, 0, len(keys))
+		for _, k := range keys {
+			if i, ok := l.pos[k]; ok {
+				ids = append(ids, i)
+			}
+		}
+		w := fieldWeight[f]
+		if prefix {
+			w *= prefixWeight
+		}
+		add(ids, w)
+	}
+	return nil
+}
+
+// track finds a track by its id.
+func (l *library) track(id string) *libTrack {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.byID[id]
+}
+
+// lookup finds a track by its path.
+func (l *library) lookup(path string) *libTrack {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.byPath[path]
+}
+
+// played counts a play of p on air.
+func (l *library) played(p string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t := l.byPath[p]
+	if t == nil {
+		return
+	}
+	t.Plays++
+	if v, err := json.Marshal(t); err == nil {
+		if err := l.db.Put(libraryBucket, p, v); err != nil {
+			log.Printf("library: %v", err)
+		}
+	}
+}
+
+// newTracks returns the tracks added within newWithin, newest first.
+func (l *library) newTracks() []libTrack {
+	cutoff := time.Now().Add(-l.newWithin).Unix()
+	l.mu.RLock()
+	var out []libTrack
+	for _, t := range l.tracks {
+		if t.Added >= cutoff {
+			out = append(out, *t)
+		}
+	}
+	l.mu.RUnlock()
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Added > out[j].Added })
+	return out
+}
+
+// newPaths returns the set of paths of newTracks.
+func (l *library) newPaths() map[string]bool {
+	out := map[string]bool{}
+	for _, t := range l.newTracks() {
+		out[t.Path] = true
+	}
+	return out
+}
+
+// boostNew repeats each file in isNew boost times in total, the copies
+// spread evenly through the cycle, so new music comes round more often.
+func boostNew(files []string, isNew map[string]bool, boost int) []string {
+	if boost <= 1 || len(isNew) == 0 {
+		return files
+	}
+	type slot struct {
+		key float64
+		p   string
+	}
+	n := len(files)
+	slots := make([]slot, 0, n)
+	for i, p := range files {
+		slots = append(slots, slot{float64(i), p})
+		if !isNew[p] {
+			continue
+		}
+		for k := 1; k < boost; k++ {
+			pos := (i + k*n/boost) % n
+			slots = append(slots, slot{float64(pos) + 0.5, p})
+		}
+	}
+	sort.SliceStable(slots, func(a, b int) bool { return slots[a].key < slots[b].key })
+	out := make([]string, len(slots))
+	for i, s := range slots {
+		out[i] = s.p
+	}
+	return out
+}
+
+// Orders for browsing the library.
+var librarySorts = []struct{ name, label string }{
+	{"artist", "artist"},
+	{"title", "title"},
+	{"added", "recently added"},
+	{"plays", "most played"},
+}
+
+// browse returns a copy of the library in the given order ("" = artist).
+func (l *library) browse(order string) ([]libTrack, error) {
+	l.mu.RLock()
+	out := make([]libTrack, len(l.tracks))
+	for i, t := range l.tracks {
+		out[i] = *t
+	}
+	l.mu.RUnlock()
+
+	switch order {
+	case "", "artist":
+	case "title":
+		sort.SliceStable(out, func(i, j int) bool { return strings.ToLower(out[i].Title) < strings.ToLower(out[j].Title) })
+	case "added":
+		sort.SliceStable(out, func(i, j int) bool { return out[i].Added > out[j].Added })
+	case "plays":
+		sort.SliceStable(out, func(i, j int) bool { return out[i].Plays > out[j].Plays })
+	default:
+		return nil, fmt.Errorf("unknown sort %q", order)
+	}
+	return out, nil
+}
+
+// all returns every track in library order and whether the first scan is done.
+func (l *library) all() ([]*libTrack, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.tracks, l.ready
+}
+
+// ---------------- /library ----------------
+
+// Tracks listed on one /library page.
+const libraryPageSize = 100
+
+// writeLibrary serves /library. rawQuery carries page=N, sort=ORDER and
+// q=SEARCH; a bare ?words is a search too. A search sent as Spartan input
+// in the body takes precedence.
+func (srv *server) writeLibrary(w io.Writer, rawQuery, input string) {
+	params, _ := url.ParseQuery(rawQuery)
+	if rawQuery != "" && !strings.Contains(rawQuery, "=") {
+		q, _ := url.QueryUnescape(rawQuery)
+		params = url.Values{"q": {q}}
+	}
+	query := strings.TrimSpace(input)
+	if query == "" {
+		query = strings.TrimSpace(params.Get("q"))
+	}
+	order := params.Get("sort")
+	if order == "" {
+		order = "artist"
+	}
+	page, _ := strconv.Atoi(params.Get("page"))
+
+	tracks, err := srv.library.browse(order)
+	if err != nil {
+		fmt.Fprintf(w, "4 %v\r\n", err)
+		return
+	}
+	all, ready := srv.library.all()
+	fmt.Fprintf(w, "2 text/gemini; charset=utf-8\r\n")
+	fmt.Fprintf(w, "# Library\n\n")
+	if !ready {
+		fmt.Fprintf(w, "The library is still being indexed.\n\n")
+	} else {
+		fmt.Fprintf(w, "%d tracks.\n\n", len(all))
+	}
+	fmt.Fprintf(w, "=: /library Search, e.g. artist:simone title:\"feeling good\"\n")
+
+	heading := "All tracks"
+	if query != "" {
+		hits, err := srv.library.search(query)
+		if err != nil {
+			fmt.Fprintf(w, "\n%v\n", err)
+			return
+		}
+		match := make(map[string]bool, len(hits))
+		for _, t := range hits {
+			match[t.Path] = true
+		}
+		found := tracks[:0]
+		for _, t := range tracks {
+			if match[t.Path] {
+				found = append(found, t)
+			}
+		}
+		tracks = found
+		noun := "results"
+		if len(tracks) == 1 {
+			noun = "result"
+		}
+		heading = fmt.Sprintf("%d %s for %q", len(tracks), noun, query)
+	}
+	for _, s := range librarySorts {
+		if s.name == order {
+			heading += ", by " + s.label
+		}
+	}
+	fmt.Fprintf(w, "\n## %s\n\n", heading)
+
+	link := url.Values{"sort": {order}}
+	if query != "" {
+		link.Set("q", query)
+	}
+	start, end, page, pages := pageBounds(len(tracks), page, libraryPageSize)
+	if pages > 1 {
+		fmt.Fprintf(w, "Page %d of %d.\n\n", page, pages)
+	}
+	for i := start; i < end; i++ {
+		t := &tracks[i]
+		note := ""
+		switch order {
+		case "added":
+			note = "added " + time.Unix(t.Added, 0).Format("2006-01-02")
+		case "plays":
+			note = fmt.Sprintf("%d plays", t.Plays)
+		}
+		srv.writeTrackLine(w, t, note)
+	}
+	writePager(w, "/library", link, page, pages)
+
+	fmt.Fprintf(w, "\n## Sort by\n\n")
+	for _, s := range librarySorts {
+		if s.name == order {
+			continue
+		}
+		link.Set("sort", s.name)
+		fmt.Fprintf(w, "=> /library?%s %s\n", link.Encode(), s.label)
+	}
+}
+
+// pageBounds returns the slice bounds of page (1-based, clamped) of n items
+// and the number of pages, at least 1.
+func pageBounds(n, page, size int) (start, end, clamped, pages int) {
+	pages = max((n+size-1)/size, 1)
+	page = min(max(page, 1), pages)
+	start = (page - 1) * size
+	return start, min(start+size, n), page, pages
+}
+
+// writePager links to the previous and next page of a listing at path;
+// params are kept in the links.
+func writePager(w io.Writer, path string, params url.Values, page, pages int) {
+	if pages <= 1 {
+		return
+	}
+	link := func(p int) string {
+		q := url.Values{}
+		for k, v := range params {
+			q[k] = v
+		}
+		q.Set("page", strconv.Itoa(p))
+		return path + "?" + q.Encode()
+	}
+	fmt.Fprintf(w, "\n")
+	if page > 1 {
+		fmt.Fprintf(w, "=> %s Previous page\n", link(page-1))
+	}
+	if page < pages {
+		fmt.Fprintf(w, "=> %s Next page (%d of %d)\n", link(page+1), page+1, pages)
+	}
+}
+
+// ---------------- /new ----------------
+
+// writeNew serves /new: the tracks added within -new-days, newest first, in
+// the Gemini subscription format (a heading, then one dated link per entry)
+// so that feed readers can follow it.
+func (srv *server) writeNew(w io.Writer, rawQuery string) {
+	params, _ := url.ParseQuery(rawQuery)
+	page, _ := strconv.Atoi(params.Get("page"))
+	tracks := srv.library.newTracks()
+	days := int(srv.library.newWithin.Hours() / 24)
+
+	fmt.Fprintf(w, "2 text/gemini; charset=utf-8\r\n")
+	fmt.Fprintf(w, "# %s: new music\n\n", srv.title())
+	fmt.Fprintf(w, "## Tracks added in the last %d days\n\n", days)
+	if len(tracks) == 0 {
+		fmt.Fprintf(w, "Nothing new.\n")
+		return
+	}
+	start, end, page, pages := pageBounds(len(tracks), page, libraryPageSize)
+	for _, t := range tracks[start:end] {
+		link := "/play/" + t.id()
+		if srv.onDemand == nil {
+			name := strings.ReplaceAll(filepath.Base(t.Path), `"`, " ")
+			link = "/library?" + url.Values{"q": {`file:"` + name + `"`}}.Encode()
+		}
+		fmt.Fprintf(w, "=> %s %s %s\n", link, time.Unix(t.Added, 0).Format("2006-01-02"), t.String())
+	}
+	writePager(w, "/new", nil, page, pages)
+}
+
+// ---------------- /search ----------------
+
+// Most results listed for one search.
+const searchResults = 50
+
+func (srv *server) writeSearch(w io.Writer, query string) {
+	fmt.Fprintf(w, "2 text/gemini; charset=utf-8\r\n")
+	fmt.Fprintf(w, "# Search\n\n")
+	fmt.Fprintf(w, "=: /search Search the library, e.g. artist:simone title:\"feeling good\"\n")
+	if query = strings.TrimSpace(query); query == "" {
+		return
+	}
+	tracks, err := srv.library.rank(query)
+	if err != nil {
+		fmt.Fprintf(w, "\n%v\n", err)
+		return
+	}
+	noun := "results"
+	if len(tracks) == 1 {
+		noun = "result"
+	}
+	fmt.Fprintf(w, "\n## %d %s for %q\n\n", len(tracks), noun, query)
+	for i, t := range tracks {
+		if i == searchResults {
+			fmt.Fprintf(w, "\n(best %d of %d shown; narrow the search with field:word)\n", searchResults, len(tracks))
+			break
+		}
+		srv.writeTrackLine(w, t, "")
+	}
+}
+
+// writeTrackLine lists t, as a link to play it when on-demand play is on,
+// with an optional note after it.
+func (srv *server) writeTrackLine(w io.Writer, t *libTrack, note string) {
+	label := t.String()
+	if note != "" {
+		label += " · " + note
+	}
+	if srv.onDemand != nil {
+		fmt.Fprintf(w, "=> /play/%s %s\n", t.id(), label)
+	} else {
+		fmt.Fprintf(w, "* %s\n", label)
+	}
+}
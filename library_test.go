@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func flacWithComments(comments ...string) []byte {
+	var vc bytes.Buffer
+	le := func(n int) { _ = binary.Write(&vc, binary.LittleEndian, uint32(n)) }
+	le(len("vendor"))
+	vc.WriteString("vendor")
+	le(len(comments))
+	for _, c := range comments {
+		le(len(c))
+		vc.WriteString(c)
+	}
+	b := []byte("fLaC")
+	b = append(b, 0, 0, 0, 34) // STREAMINFO, not last
+	b = append(b, make([]byte, 34)...)
+	n := vc.Len()
+	b = append(b, 0x80|4, byte(n>>16), byte(n>>8), byte(n))
+	return append(b, vc.Bytes()...)
+}
+
+func wavWithInfo(tags map[string]string) []byte {
+	var info bytes.Buffer
+	info.WriteString("INFO")
+	for _, id := range []string{"IART", "INAM", "IPRD", "ITRK"} {
+		v, ok := tags[id]
+		if !ok {
+			continue
+		}
+		v += "\x00"
+		info.WriteString(id)
+		_ = binary.Write(&info, binary.LittleEndian, uint32(len(v)))
+		info.WriteString(v)
+		if len(v)%2 == 1 {
+			info.WriteByte(0)
+		}
+	}
+	var b bytes.Buffer
+	chunk := func(id string, data []byte) {
+		b.WriteString(id)
+		_ = binary.Write(&b, binary.LittleEndian, uint32(len(data)))
+		b.Write(data)
+	}
+	b.WriteString("RIFF\x00\x00\x00\x00WAVE")
+	chunk("fmt ", make([]byte, 16))
+	chunk("data", make([]byte, 1000))
+	chunk("LIST", info.Bytes())
+	return b.Bytes()
+}
+
+func opusWithComments(comments ...string) []byte {
+	tags := []byte("OpusTags")
+	tags = binary.LittleEndian.AppendUint32(tags, 4)
+	tags = append(tags, "test"...)
+	tags = binary.LittleEndian.AppendUint32(tags, uint32(len(comments)))
+	for _, c := range comments {
+		tags = binary.LittleEndian.AppendUint32(tags, uint32(len(c)))
+		tags = append(tags, c...)
+	}
+	head := []byte("OpusHead\x01\x02\x38\x01\x80\xbb\x00\x00\x00\x00\x00")
+	pages := paginate(7, 0, [][]byte{head, tags})
+	pages[0][5] |= 0x02
+	return bytes.Join(pages, nil)
+}
+
+// mp3WithID3 is an ID3v2.4 tag of text frames followed by a bit of MPEG
+// audio. Each value is given with its encoding byte.
+func mp3WithID3(frames map[string]string) []byte {
+	syncsafe := func(n int) []byte {
+		return []byte{byte(n >> 21 & 0x7f), byte(n >> 14 & 0x7f), byte(n >> 7 & 0x7f), byte(n & 0x7f)}
+	}
+	var body []byte
+	for _, id := range []string{"TPE1", "TIT2", "TALB", "TRCK"} {
+		v, ok := frames[id]
+		if !ok {
+			continue
+		}
+		body = append(body, id...)
+		body = append(body, syncsafe(len(v))...)
+		body = append(body, 0, 0)
+		body = append(body, v...)
+	}
+	b := append([]byte("ID3\x04\x00\x00"), syncsafe(len(body))...)
+	b = append(b, body...)
+	return append(b, 0xff, 0xfb, 0x90, 0x00)
+}
+
+func TestReadTags(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"c.opus": opusWithComments("ARTIST=Björk", "TITLE=Jóga", "GENRE=Pop"),
+		"d.mp3": mp3WithID3(map[string]string{
+			"TPE1": "\x01\xff\xfeN\x00i\x00n\x00a\x00\x00\x00", // UTF-16 with BOM
+			"TIT2": "\x03Sinnerman",
+			"TALB": "\x00Pastel Blues\x00",
+			"TRCK": "\x002/9",
+		}),
+		"untitled.mp3": append([]byte("ID3\x03\x00\x00\x00\x00\x00\x00"), 0xff, 0xfb),
+		"a.flac":       flacWithComments("artist=Nina Simone", "TITLE=Feeling Good", "ALBUM=I Put a Spell on You", "TITLE=ignored", "TRACKNUMBER=3/12", "discnumber=1"),
+		"b.wav":        wavWithInfo(map[string]string{"IART": "Miles Davis", "INAM": "So What", "IPRD": "Kind of Blue", "ITRK": "1"}),
+		"untitled.wav": wavWithInfo(nil),
+	}
+	want := map[string]trackTags{
+		"a.flac":       {artist: "Nina Simone", title: "Feeling Good", album: "I Put a Spell on You", disc: 1, track: 3},
+		"b.wav":        {artist: "Miles Davis", title: "So What", album: "Kind of Blue", track: 1},
+		"untitled.wav": {title: "untitled"},
+		"c.opus":       {artist: "Björk", title: "Jóga", genre: "Pop"},
+		"d.mp3":        {artist: "Nina", title: "Sinnerman", album: "Pastel Blues", track: 2},
+		"untitled.mp3": {title: "untitled"},
+	}
+	for name, data := range files {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readTags(p)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if got != want[name] {
+			t.Errorf("%s: tags = %+v, want %+v", name, got, want[name])
+		}
+	}
+}
+
+func TestLibrarySearch(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"1.flac": flacWithComments("ARTIST=Nina Simone", "TITLE=Feeling Good", "ALBUM=I Put a Spell on You"),
+		"2.flac": flacWithComments("ARTIST=Nina Simone", "TITLE=Sinnerman", "ALBUM=Pastel Blues", "GENRE=Jazz"),
+		"3.flac": flacWithComments("ARTIST=Muse", "TITLE=Feeling Good", "ALBUM=Origin of Symmetry"),
+		"4.wav":  wavWithInfo(map[string]string{"IART": "Miles Davis", "INAM": "So What", "IPRD": "Kind of Blue"}),
+	}
+	var paths []string
+	for name, data := range files {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, p)
+	}
+	db := newMemStore()
+	lib := newLibrary(db)
+	lib.scan(paths)
+
+	tests := []struct {
+		query string
+		want  []string // titles, in library order
+		err   error
+	}{
+		{query: "feeling good", want: []string{"Feeling Good", "Feeling Good"}},
+		{query: "artist:nina feeling", want: []string{"Feeling Good"}},
+		{query: `artist:"nina simone"`, want: []string{"Feeling Good", "Sinnerman"}},
+		{query: "ARTIST:Simone album:blues", want: []string{"Sinnerman"}},
+		{query: "sinner*", want: []string{"Sinnerman"}},
+		{query: "title:blue", want: nil},
+		{query: "blue", want: []string{"So What"}},
+		{query: "file:4", want: []string{"So What"}},
+		{query: "symmetry", want: []string{"Feeling Good"}},
+		{query: "nothing", want: nil},
+		{query: "genre:jazz", want: []string{"Sinnerman"}},
+		{query: "year:1965", err: errBadQuery},
+		{query: `title:"open`, err: errBadQuery},
+		{query: "  ", err: errBadQuery},
+	}
+	for _, tt := range tests {
+		got, err := lib.search(tt.query)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("search(%q): err = %v, want %v", tt.query, err, tt.err)
+			continue
+		}
+		var titles []string
+		for _, tr := range got {
+			titles = append(titles, tr.Title)
+		}
+		if !reflect.DeepEqual(titles, tt.want) {
+			t.Errorf("search(%q) = %q, want %q", tt.query, titles, tt.want)
+		}
+	}
+
+	// Ranking: title matches beat album and artist matches, rare words beat
+	// common ones.
+	for _, tt := range []struct {
+		query string
+		want  []string
+	}{
+		{query: "good", want: []string{"Feeling Good", "Feeling Good"}},
+		{query: "nina sinnerman", want: []string{"Sinnerman"}},
+		{query: "nina", want: []string{"Feeling Good", "Sinnerman"}},
+		{query: "s*", want: []string{"So What", "Sinnerman", "Feeling Good", "Feeling Good"}}, // ties keep library order
+	} {
+		got, err := lib.rank(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var titles []string
+		for _, tr := range got {
+			titles = append(titles, tr.Title)
+		}
+		if !reflect.DeepEqual(titles, tt.want) {
+			t.Errorf("rank(%q) = %q, want %q", tt.query, titles, tt.want)
+		}
+	}
+	// Without the index (-low-memory) searches find the same, in the same order.
+	plain := newLibrary(db)
+	plain.noIndex = true
+	plain.scan(paths)
+	for _, q := range []string{"feeling good", "ARTIST:Simone album:blues", "sinner*", "s*", "nina", "nothing"} {
+		a, _ := lib.rank(q)
+		b, _ := plain.rank(q)
+		if !reflect.DeepEqual(a, b) {
+			t.Errorf("rank(%q) without the index = %v, want %v", q, b, a)
+		}
+	}
+	if len(plain.terms) != 0 {
+		t.Errorf("unindexed library has %d terms", len(plain.terms))
+	}
+	// So do searches through SQLite's full-text index.
+	sdb, err := openSQLiteStore(filepath.Join(dir, "library.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sdb.Close()
+	fts := newLibrary(sdb)
+	if fts.fts == nil {
+		t.Fatal("sqlite store gives no text index")
+	}
+	fts.scan(paths)
+	for _, q := range []string{"feeling good", "ARTIST:Simone album:blues", "sinner*", "s*", "nina", "file:4", "nothing"} {
+		a, _ := lib.rank(q)
+		b, err := fts.rank(q)
+		if err != nil || !reflect.DeepEqual(a, b) {
+			t.Errorf("rank(%q) through FTS = %v, %v; want %v", q, b, err, a)
+		}
+	}
+	if len(fts.terms) != 0 {
+		t.Errorf("FTS library has %d terms in memory", len(fts.terms))
+	}
+	if tracks, _ := lib.all(); lib.track(tracks[0].id()) != tracks[0] || lib.track("nope") != nil {
+		t.Error("track(id) lookup broken")
+	}
+
+	// Unchanged files come from the store; removed ones leave it.
+	if err := os.WriteFile(paths[0], []byte("not audio"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	lib.scan(paths[1:])
+	if keys, _ := db.Keys(libraryBucket); len(keys) != 3 {
+		t.Errorf("store keeps %d tracks, want 3", len(keys))
+	}
+	if tracks, _ := lib.all(); len(tracks) != 3 {
+		t.Errorf("library has %d tracks, want 3", len(tracks))
+	}
+	fts.scan(paths[1:])
+	for _, q := range []string{"feeling", "muse", "s*", "wav"} {
+		a, _ := lib.rank(q)
+		b, _ := fts.rank(q)
+		if !reflect.DeepEqual(a, b) {
+			t.Errorf("rank(%q) through FTS after a rescan = %v, want %v", q, b, a)
+		}
+	}
+}
+
+func TestPageBounds(t *testing.T) {
+	for _, tt := range []struct {
+		n, page, size          int
+		start, end, got, pages int
+	}{
+		{n: 0, page: 1, size: 10, start: 0, end: 0, got: 1, pages: 1},
+		{n: 25, page: 0, size: 10, start: 0, end: 10, got: 1, pages: 3},
+		{n: 25, page: 3, size: 10, start: 20, end: 25, got: 3, pages: 3},
+		{n: 25, page: 9, size: 10, start: 20, end: 25, got: 3, pages: 3},
+		{n: 30, page: 2, size: 10, start: 10, end: 20, got: 2, pages: 3},
+	} {
+		start, end, got, pages := pageBounds(tt.n, tt.page, tt.size)
+		if start != tt.start || end != tt.end || got != tt.got || pages != tt.pages {
+			t.Errorf("pageBounds(%d, %d, %d) = %d, %d, %d, %d; want %d, %d, %d, %d",
+				tt.n, tt.page, tt.size, start, end, got, pages, tt.start, tt.end, tt.got, tt.pages)
+		}
+	}
+}
+
+func TestLibraryBrowse(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	for i, title := range []string{"b", "c", "a"} {
+		p := filepath.Join(dir, title+".flac")
+		if err := os.WriteFile(p, flacWithComments("TITLE="+title, "ARTIST="+string(rune('z'-i))), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, p)
+	}
+	db := newMemStore()
+	lib := newLibrary(db)
+	lib.scan(paths)
+	lib.played(paths[1])
+	lib.played(paths[1])
+	lib.played(paths[2])
+
+	titles := func(order string) []string {
+		tracks, err := lib.browse(order)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []string
+		for _, tr := range tracks {
+			out = append(out, tr.Title)
+		}
+		return out
+	}
+	if got := titles("artist"); !reflect.DeepEqual(got, []string{"a", "c", "b"}) {
+		t.Errorf("by artist: %q", got)
+	}
+	if got := titles("title"); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("by title: %q", got)
+	}
+	if got := titles("plays"); !reflect.DeepEqual(got, []string{"c", "a", "b"}) {
+		t.Errorf("by plays: %q", got)
+	}
+	if _, err := lib.browse("size"); err == nil {
+		t.Error("unknown sort accepted")
+	}
+
+	// Play counts survive a rescan from the store.
+	lib = newLibrary(db)
+	lib.scan(paths)
+	if got := titles("plays"); !reflect.DeepEqual(got, []string{"c", "a", "b"}) {
+		t.Errorf("by plays after rescan: %q", got)
+	}
+}
+
+func TestBoostNew(t *testing.T) {
+	files := []string{"a", "b", "c", "d", "e", "f"}
+	got := boostNew(files, map[string]bool{"a": true, "d": true}, 2)
+	// Copies land half a cycle on, wrapping round to the start.
+	want := []string{"a", "d", "b", "c", "d", "a", "e", "f"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("boostNew = %q, want %q", got, want)
+	}
+	got = boostNew(files, map[string]bool{"b": true}, 3)
+	want = []string{"a", "b", "c", "d", "b", "e", "f", "b"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("boostNew x3 = %q, want %q", got, want)
+	}
+	if got := boostNew(files, map[string]bool{"a": true}, 1); !reflect.DeepEqual(got, files) {
+		t.Errorf("boost 1 changed the cycle: %q", got)
+	}
+}
+
+// readAudioFormat finds deep and float sources, which get the dithered
+// decode, and multichannel WAVs that don't say where the speakers are.
+func TestReadAudioFormat(t *testing.T) {
+	wav := func(format, bits, channels uint16, mask uint32, sub uint16) []byte {
+		var f bytes.Buffer
+		for _, v := range []any{format, channels, uint32(48000), uint32(48000) * uint32(channels*bits/8), channels * bits / 8, bits} {
+			_ = binary.Write(&f, binary.LittleEndian, v)
+		}
+		if format == wavFormatExtensible {
+			for _, v := range []any{uint16(22), bits, mask, sub} {
+				_ = binary.Write(&f, binary.LittleEndian, v)
+			}
+			f.Write(make([]byte, 14)) // rest of the subformat GUID
+		}
+		var b bytes.Buffer
+		b.WriteString("RIFF\x00\x00\x00\x00WAVE")
+		b.WriteString("fmt ")
+		_ = binary.Write(&b, binary.LittleEndian, uint32(f.Len()))
+		b.Write(f.Bytes())
+		b.WriteString("data\x00\x00\x00\x00")
+		return b.Bytes()
+	}
+	flac := flacWithComments()
+	flac[8+12] |= 0x01 // bits per sample - 1 = 0b10111
+	flac[8+13] |= 0x70
+	flac[8+12] |= 5 << 1 // 6 channels
+
+	dir := t.TempDir()
+	for name, tc := range map[string]struct {
+		data []byte
+		want audioFormat
+		af   string // the -af argument, if any
+	}{
+		"cd.wav":       {wav(1, 16, 2, 0, 0), audioFormat{16, false, 2, true}, ""},
+		"float.wav":    {wav(wavFormatFloat, 32, 2, 0, 0), audioFormat{32, true, 2, true}, "aresample"},
+		"ext24.wav":    {wav(wavFormatExtensible, 24, 2, 3, 1), audioFormat{24, false, 2, true}, "aresample"},
+		"extfloat.wav": {wav(wavFormatExtensible, 32, 2, 3, wavFormatFloat), audioFormat{32, true, 2, true}, "aresample"},
+		"surround.wav": {wav(wavFormatExtensible, 16, 6, 0x3f, 1), audioFormat{16, false, 6, true}, ""},
+		"tracks.wav":   {wav(1, 24, 4, 0, 0), audioFormat{24, false, 4, false}, "pan=stereo|c0=0.25*c0+0.25*c1+0.25*c2+0.25*c3|c1=0.25*c0+0.25*c1+0.25*c2+0.25*c3,aresample"},
+		"hires.flac":   {flac, audioFormat{24, false, 6, true}, "aresample"},
+	} {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, tc.data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readAudioFormat(p)
+		if err != nil || got != tc.want {
+			t.Errorf("%s: readAudioFormat = %+v, %v; want %+v", name, got, err, tc.want)
+		}
+		af := ""
+		if args := pcmOutputArgs(p); args[0] == "-af" {
+			af = args[1]
+		}
+		if !strings.HasPrefix(af, tc.af) || (af == "") != (tc.af == "") {
+			t.Errorf("%s: -af %q, want %q...", name, af, tc.af)
+		}
+	}
+}
+
+func TestParseInputExts(t *testing.T) {
+	exts, err := parseInputExts(" WAV, .flac,mp3,,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]bool{".wav": true, ".flac": true, ".mp3": true}; !reflect.DeepEqual(exts, want) {
+		t.Errorf("exts %v, want %v", exts, want)
+	}
+	for _, bad := range []string{"", ",", "tar.gz", "../wav"} {
+		if _, err := parseInputExts(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
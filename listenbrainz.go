@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------- ListenBrainz playlog ----------------
+
+// With -listenbrainz-token every file the feeder puts on air is submitted
+// as a listen to that ListenBrainz account, making the account the
+// station's public playlog. The same files go in as the play report: no
+// station IDs, and only files with an artist tag, which ListenBrainz
+// requires. Listens wait in the -store until the server takes them, so an
+// outage or a restart only delays them.
+
+const (
+	listenBrainzBucket = "listenbrainz"
+	listenBrainzKey    = "pending"
+	listenBrainzBatch  = 100   // most listens per submission
+	listenBrainzKeep   = 10000 // most listens kept waiting
+)
+
+// lbListen is one ListenBrainz listen, in its JSON payload form.
+type lbListen struct {
+	ListenedAt int64   `json:"listened_at"`
+	Track      lbTrack `json:"track_metadata"`
+}
+
+type lbTrack struct {
+	Artist  string `json:"artist_name"`
+	Title   string `json:"track_name"`
+	Release string `json:"release_name,omitempty"`
+	Info    lbInfo `json:"additional_info"`
+}
+
+type lbInfo struct {
+	DurationMS int    `json:"duration_ms,omitempty"`
+	ISRC       string `json:"isrc,omitempty"`
+	Client     string `json:"submission_client"`
+}
+
+type listenBrainz struct {
+	url    string // submit-listens endpoint
+	token  string
+	db     store
+	client *http.Client
+	kick   chan struct{}
+	fmu    sync.Mutex // one flush at a time
+
+	mu      sync.Mutex
+	pending []lbListen
+	dropped int // listens trimmed off the front while a batch was out
+}
+
+// newListenBrainz starts submitting to the ListenBrainz server at base,
+// picking up listens left in db by an earlier run.
+func newListenBrainz(base, token string, db store) *listenBrainz {
+	lb := loadListenBrainz(base, token, db)
+	go lb.run()
+	lb.wake()
+	return lb
+}
+
+// loadListenBrainz sets up a submitter with the queue left in db, without
+// starting it.
+func loadListenBrainz(base, token string, db store) *listenBrainz {
+	lb := &listenBrainz{
+		url:    strings.TrimRight(base, "/") + "/1/submit-listens",
+		token:  token,
+		db:     db,
+		client: &http.Client{Timeout: 20 * time.Second},
+		kick:   make(chan struct{}, 1),
+	}
+	data, err := db.Get(listenBrainzBucket, listenBrainzKey)
+	if err != nil && !errors.Is(err, errNotFound) {
+		log.Printf("listenbrainz: %v", err)
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &lb.pending); err != nil {
+			log.Printf("listenbrainz: dropping unreadable queue: %v", err)
+		}
+	}
+	return lb
+}
+
+// add queues p, which started at start and played for d.
+func (lb *listenBrainz) add(start time.Time, p string, d time.Duration) {
+	t, _ := readTags(p)
+	if t.artist == "" || t.title == "" {
+		return
+	}
+	l := lbListen{
+		ListenedAt: start.Unix(),
+		Track: lbTrack{
+			Artist:  t.artist,
+			Title:   t.title,
+			Release: t.album,
+			Info:    lbInfo{DurationMS: int(d.Milliseconds()), ISRC: t.isrc, Client: "spartan-waves"},
+		},
+	}
+	lb.mu.Lock()
+	lb.pending = append(lb.pending, l)
+	if n := len(lb.pending) - listenBrainzKeep; n > 0 {
+		log.Printf("listenbrainz: queue full, dropping %d oldest listens", n)
+		lb.pending = lb.pending[n:]
+		lb.dropped += n
+	}
+	lb.save()
+	lb.mu.Unlock()
+	lb.wake()
+}
+
+func (lb *listenBrainz) wake() {
+	select {
+	case lb.kick <- struct{}{}:
+	default:
+	}
+}
+
+// save writes the queue to the store. Called with mu held.
+func (lb *listenBrainz) save() {
+	data, err := json.Marshal(lb.pending)
+	if err == nil {
+		err = lb.db.Put(listenBrainzBucket, listenBrainzKey, data)
+	}
+	if err != nil {
+		log.Printf("listenbrainz: %v", err)
+	}
+}
+
+// run submits the queue whenever something is added, backing off from a
+// minute up to an hour while the server is failing.
+func (lb *listenBrainz) run() {
+	const minRetry, maxRetry = time.Minute, time.Hour
+	retry := minRetry
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-lb.kick:
+		case <-timer:
+		}
+		timer = nil
+		if err := lb.flush(); err != nil {
+			log.Printf("listenbrainz: %v; retrying in %v", err, retry)
+			timer = time.After(retry)
+			retry = min(2*retry, maxRetry)
+			continue
+		}
+		retry = minRetry
+	}
+}
+
+// flush submits pending listens a batch at a time until the queue is empty
+// or a submission fails.
+func (lb *listenBrainz) flush() error {
+	lb.fmu.Lock()
+	defer lb.fmu.Unlock()
+	for {
+		lb.mu.Lock()
+		batch := lb.pending[:min(len(lb.pending), listenBrainzBatch)]
+		lb.dropped = 0
+		lb.mu.Unlock()
+		if len(batch) == 0 {
+			return nil
+		}
+		done, err := lb.submit(batch)
+		if done {
+			lb.mu.Lock()
+			lb.pending = lb.pending[max(0, len(batch)-lb.dropped):]
+			lb.save()
+			lb.mu.Unlock()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// submit sends ls. done is true when they should leave the queue, which
+// includes ones the server refused as malformed.
+func (lb *listenBrainz) submit(ls []lbListen) (done bool, err error) {
+	body := struct {
+		Type    string     `json:"listen_type"`
+		Payload []lbListen `json:"payload"`
+	}{"single", ls}
+	if len(ls) > 1 {
+		body.Type = "import"
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest("POST", lb.url, bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", "Token "+lb.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := lb.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusBadRequest:
+		log.Printf("listenbrainz: dropping %d listens: %s: %s", len(ls), resp.Status, bytes.TrimSpace(msg))
+		return true, nil
+	default:
+		return false, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+}
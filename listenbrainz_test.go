@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Listens queue while ListenBrainz is down, survive a restart, and go out
+// once it is back; untagged files are not submitted.
+func TestListenBrainz(t *testing.T) {
+	var mu sync.Mutex
+	up := false
+	var got []lbListen
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path != "/1/submit-listens" || r.Header.Get("Authorization") != "Token tok" {
+			http.Error(w, "bad request", http.StatusUnauthorized)
+			return
+		}
+		if !up {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		var body struct {
+			Payload []lbListen `json:"payload"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		got = append(got, body.Payload...)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	tagged := filepath.Join(dir, "a.wav")
+	untagged := filepath.Join(dir, "b.wav")
+	if err := os.WriteFile(tagged, wavWithInfo(map[string]string{"IART": "Komitas", "INAM": "Krunk", "IPRD": "Songs"}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(untagged, wavWithInfo(nil), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	db := newMemStore()
+	start := time.Unix(1700000000, 0)
+	lb := loadListenBrainz(srv.URL+"/", "tok", db)
+	lb.add(start, tagged, 3*time.Minute)
+	lb.add(start, untagged, 3*time.Minute)
+	if err := lb.flush(); err == nil {
+		t.Fatal("flush with the server down succeeded")
+	}
+
+	mu.Lock()
+	up = true
+	mu.Unlock()
+	lb = loadListenBrainz(srv.URL, "tok", db) // a restart
+	if err := lb.flush(); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 1 {
+		t.Fatalf("submitted %d listens, want 1", len(got))
+	}
+	want := lbListen{start.Unix(), lbTrack{"Komitas", "Krunk", "Songs", lbInfo{180000, "", "spartan-waves"}}}
+	if got[0] != want {
+		t.Errorf("listen = %+v, want %+v", got[0], want)
+	}
+	if data, _ := db.Get(listenBrainzBucket, listenBrainzKey); string(data) != "[]" {
+		t.Errorf("queue after submitting = %s, want []", data)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// ---------------- low-memory mode ----------------
+
+// -low-memory fits the server into a Raspberry Pi Zero class board with
+// 512 MB shared with the ffmpeg processes. It shrinks the buffers that are
+// sized for a server: the hub queue, each listener's queue, the encoder
+// output buffer and the read-ahead. The library keeps no inverted index
+// and searches by reading every track's tags, which is slower on a large
+// library but costs no memory beyond the tags themselves. The library check
+// probes one file at a time. Settings that size buffers are held to the
+// limits below, whatever the command line or config file says.
+
+const (
+	lowMemHubQueue        = 256       // pages; 4096 otherwise
+	lowMemSubscriberQueue = 64        // pages; 512 otherwise
+	lowMemEncoderBuffer   = 32 << 10  // bytes; 256 KiB otherwise
+	lowMemReadAhead       = 512 << 10 // bytes; 4 MiB otherwise
+
+	lowMemBurst        = 30 * time.Second
+	lowMemConnectBurst = 2 * time.Second
+	lowMemHeaderKB     = 64
+	lowMemBurstKB      = 1024 // 30s at up to 270 kbps
+)
+
+// useLowMemory shrinks the package's buffers. It must run before any
+// broadcaster is made.
+func useLowMemory() {
+	hubQueue = lowMemHubQueue
+	subscriberQueue = lowMemSubscriberQueue
+	encoderBuffer = lowMemEncoderBuffer
+	readAheadBytes = lowMemReadAhead
+}
+
+// capLowMemory holds the settings that size buffers to the -low-memory
+// limits, logging each one it lowers.
+func capLowMemory(maxHeaderKB, maxBurstKB *int, burst, connectBurst *time.Duration) {
+	if *maxHeaderKB == 0 || *maxHeaderKB > lowMemHeaderKB {
+		log.Printf("-low-memory: -max-header-kb %d lowered to %d", *maxHeaderKB, lowMemHeaderKB)
+		*maxHeaderKB = lowMemHeaderKB
+	}
+	if *maxBurstKB == 0 || *maxBurstKB > lowMemBurstKB {
+		log.Printf("-low-memory: -max-burst-kb %d lowered to %d", *maxBurstKB, lowMemBurstKB)
+		*maxBurstKB = lowMemBurstKB
+	}
+	if *burst > lowMemBurst {
+		log.Printf("-low-memory: -burst %s lowered to %s", *burst, lowMemBurst)
+		*burst = lowMemBurst
+	}
+	if *connectBurst > lowMemConnectBurst {
+		log.Printf("-low-memory: -connect-burst %s lowered to %s", *connectBurst, lowMemConnectBurst)
+		*connectBurst = lowMemConnectBurst
+	}
+}
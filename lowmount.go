@@ -0,0 +1,43 @@
+package main
+
+// ---------------- low-bitrate mount ----------------
+
+// With -low-bitrate-kbps the station's audio is encoded a second time at
+// that bitrate and served at /radio-low, for listeners on slow links. The
+// second encoder gets the same PCM as the first (after the arbiter and the
+// mixer) and belongs to the same pipeline: the two start, restart and stop
+// together, and a failure of either counts as an encoder failure. To
+// listeners, the stats and the admin interface /radio-low is a station of
+// its own, sharing the rotation with /radio.
+
+const lowMount = "/radio-low"
+
+// newLowStation returns the low-bitrate station for st.
+func newLowStation(st *station, kbps int) *station {
+	low := &station{
+		name:  "radio-low",
+		mount: lowMount,
+		b:     NewBroadcaster(st.b.Limits()),
+		feed:  st.feed,
+		meter: st.meter,
+		of:    st,
+
+		onEncoderFailure: st.onEncoderFailure,
+	}
+	low.cfg = lowConfig(st.settings(), kbps, nil)
+	return low
+}
+
+// lowConfig derives the low mount's settings from the main station's cfg,
+// keeping prev, the low mount's current preroll, if it still fits.
+func lowConfig(cfg stationConfig, kbps int, prev *preroll) stationConfig {
+	cfg.enc.bitrateKbps = kbps
+	if cfg.preroll != nil {
+		if prev != nil && prev.path == cfg.preroll.path && prev.enc == cfg.enc {
+			cfg.preroll = prev
+		} else {
+			cfg.preroll = &preroll{path: cfg.preroll.path, enc: cfg.enc}
+		}
+	}
+	return cfg
+}
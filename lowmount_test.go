@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestLowConfig(t *testing.T) {
+	cfg := stationConfig{enc: encoderConfig{codecName: "opus", bitrateKbps: 192}}
+	cfg.preroll = &preroll{path: "jingle.wav", enc: cfg.enc}
+
+	low := lowConfig(cfg, 64, nil)
+	if low.enc.bitrateKbps != 64 || low.enc.codec() != "opus" {
+		t.Fatalf("low encoder %+v", low.enc)
+	}
+	if cfg.enc.bitrateKbps != 192 {
+		t.Fatalf("main encoder changed to %d kbps", cfg.enc.bitrateKbps)
+	}
+	if low.preroll == cfg.preroll || low.preroll.enc != low.enc {
+		t.Fatalf("preroll not encoded for the low mount: %+v", low.preroll)
+	}
+
+	// A reload that leaves the preroll alone keeps its encoded copy.
+	if again := lowConfig(cfg, 64, low.preroll); again.preroll != low.preroll {
+		t.Error("unchanged preroll re-encoded")
+	}
+	cfg.preroll = &preroll{path: "other.wav", enc: cfg.enc}
+	if again := lowConfig(cfg, 64, low.preroll); again.preroll == low.preroll || again.preroll.path != "other.wav" {
+		t.Errorf("new preroll not picked up: %+v", again.preroll)
+	}
+}
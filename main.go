@@ -3,84 +3,346 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"math/rand"
+	"mime"
 	"net"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-type Subscriber chan []byte
+// subscriberQueue is how many pages a listener may fall behind before it
+// is dropped; hubQueue is how many published pages may wait for the hub.
+// -low-memory shrinks both.
+var (
+	subscriberQueue = 512
+	hubQueue        = 4096
+)
 
+// Broadcaster fans encoder pages out to listeners. Publish queues a page;
+// Run, the hub, hands each page to every subscriber. Subscribing and
+// unsubscribing take the subscriber lock instead of going through the hub,
+// so they work, and never block, whether or not the hub is running.
 type Broadcaster struct {
-	subs      map[Subscriber]bool
-	addSub    chan Subscriber
-	removeSub chan Subscriber
-	broadcast chan []byte
+	smu       sync.Mutex
+	subs      map[chan []byte]struct{}
+	broadcast chan hubFrame
+
+	// Recent audio pages, kept for burstLen so that listeners can start a
+	// little in the past (smu). Emptied whenever a new stream begins.
+	burst      []burstPage
+	burstBytes int // the pages' total size (smu)
+	burstLen   time.Duration
+	// How much of it a listener who asked for no offset gets on connect,
+	// so their decoder has audio at once (smu).
+	connectBurst time.Duration
 
 	// Cached Ogg/Vorbis headers as raw Ogg pages bytes (Pattern A).
 	hmu      sync.RWMutex
 	header   []byte
-	subCount int
+	hready   chan struct{} // closed while a header is cached (hmu)
+	tnext    chan struct{} // closed, and replaced, as each track starts (hmu)
+	subCount atomic.Int64
+	pagesOut atomic.Int64 // pages fanned out to listeners, for the watchdog
+	bytesOut atomic.Int64 // their bytes, counted once, for the listener limit
+	rate     bitrateMeter // encoder output, fed by broadcastFromEncoder
+
+	// Caps on the cached buffers (hmu); see bufferLimits.
+	limits bufferLimits
+
+	// Track changes for the signaling stream; nil when -track-signals is off.
+	tracks    chan trackInfo
+	lastTrack []byte // latest signaling page, replayed to late joiners (hmu)
+
+	// A header saved by the previous process, served until the encoder's
+	// first page (hmu); see endRestored.
+	restored []byte
+}
+
+// hubFrame is a published page on its way to the hub.
+type hubFrame struct {
+	page  []byte
+	audio bool // past the headers, so worth keeping for the burst buffer
+}
+
+type burstPage struct {
+	at   time.Time
+	page []byte
+}
+
+// bufferLimits caps the buffers a Broadcaster keeps in memory, in bytes
+// (0 = unlimited). Each cached buffer has a limit here and a line in
+// Buffers, which /stats lists.
+type bufferLimits struct {
+	// The header set cached for late joiners. Encoders that emit a larger
+	// one are not cached at all rather than growing without limit.
+	header int
+	// The burst buffer, trimmed from its oldest page to stay within it
+	// whatever -burst asks for.
+	burst int
+}
+
+// bufferUsage is one cached buffer's size against its limit.
+type bufferUsage struct {
+	name         string
+	bytes, limit int
 }
 
-func NewBroadcaster() *Broadcaster {
+func NewBroadcaster(limits bufferLimits) *Broadcaster {
 	return &Broadcaster{
-		subs:      make(map[Subscriber]bool),
-		addSub:    make(chan Subscriber),
-		removeSub: make(chan Subscriber),
-		broadcast: make(chan []byte, 4096),
+		subs:      make(map[chan []byte]struct{}),
+		broadcast: make(chan hubFrame, hubQueue),
+		hready:    make(chan struct{}),
+		tnext:     make(chan struct{}),
+		limits:    limits,
+	}
+}
+
+func (b *Broadcaster) Limits() bufferLimits {
+	b.hmu.RLock()
+	defer b.hmu.RUnlock()
+	return b.limits
+}
+
+func (b *Broadcaster) SetLimits(limits bufferLimits) {
+	b.hmu.Lock()
+	b.limits = limits
+	b.hmu.Unlock()
+}
+
+// Buffers reports every cached buffer's size and limit.
+func (b *Broadcaster) Buffers() []bufferUsage {
+	limits := b.Limits()
+	b.smu.Lock()
+	burst := b.burstBytes
+	b.smu.Unlock()
+	return []bufferUsage{
+		{"Header cache", len(b.GetHeaderCopy()), limits.header},
+		{"Burst buffer", burst, limits.burst},
+	}
+}
+
+// SetBurst sets how much recent audio is kept for SubscribeFrom.
+func (b *Broadcaster) SetBurst(d time.Duration) {
+	b.smu.Lock()
+	b.burstLen = d
+	b.smu.Unlock()
+}
+
+// SetConnectBurst sets how much recent audio ConnectBurst hands new
+// listeners; the buffer is kept at least that long.
+func (b *Broadcaster) SetConnectBurst(d time.Duration) {
+	b.smu.Lock()
+	b.connectBurst = d
+	b.smu.Unlock()
+}
+
+// BurstLen reports how much recent audio the burst buffer keeps.
+func (b *Broadcaster) BurstLen() time.Duration {
+	b.smu.Lock()
+	defer b.smu.Unlock()
+	return max(b.burstLen, b.connectBurst)
+}
+
+// ConnectBurst reports how far back a listener without an offset starts.
+func (b *Broadcaster) ConnectBurst() time.Duration {
+	b.smu.Lock()
+	defer b.smu.Unlock()
+	return b.connectBurst
+}
+
+// Subscribe registers a listener. Pages arrive on the returned channel
+// until cancel is called, ctx is done, or the listener falls more than
+// subscriberQueue pages behind; then the channel is closed. cancel may be
+// called any number of times.
+func (b *Broadcaster) Subscribe(ctx context.Context) (<-chan []byte, func()) {
+	_, sub, cancel := b.SubscribeFrom(ctx, time.Time{})
+	return sub, cancel
+}
+
+// SubscribeFrom is Subscribe for a listener that starts at since: it also
+// returns the buffered audio pages that reached the hub at or after since,
+// which come right before the first page on the channel.
+func (b *Broadcaster) SubscribeFrom(ctx context.Context, since time.Time) ([][]byte, <-chan []byte, func()) {
+	sub := make(chan []byte, subscriberQueue)
+	var backlog [][]byte
+	b.smu.Lock()
+	if !since.IsZero() {
+		for _, bp := range b.burst {
+			if !bp.at.Before(since) {
+				backlog = append(backlog, bp.page)
+			}
+		}
+	}
+	b.subs[sub] = struct{}{}
+	b.smu.Unlock()
+	debugf("Listeners: %d", b.subCount.Add(1))
+
+	stop := context.AfterFunc(ctx, func() { b.drop(sub) })
+	return backlog, sub, func() {
+		stop()
+		b.drop(sub)
 	}
 }
 
-func (b *Broadcaster) dropSub(sub Subscriber) {
+// drop closes sub once.
+func (b *Broadcaster) drop(sub chan []byte) {
+	b.smu.Lock()
+	defer b.smu.Unlock()
 	if _, ok := b.subs[sub]; ok {
 		delete(b.subs, sub)
 		close(sub)
-		b.subCount--
-		log.Printf("Listeners: %d", b.subCount)
+		debugf("Listeners: %d", b.subCount.Add(-1))
 	}
 }
 
+// Publish queues page for all subscribers, waiting while the queue is full.
+func (b *Broadcaster) Publish(page []byte) {
+	b.broadcast <- hubFrame{page: page}
+}
+
+// PublishAudio is Publish for a page after the stream headers.
+func (b *Broadcaster) PublishAudio(page []byte) {
+	b.broadcast <- hubFrame{page: page, audio: true}
+}
+
+// Queued reports how many published pages wait for the hub, and the limit.
+func (b *Broadcaster) Queued() (int, int) {
+	return len(b.broadcast), cap(b.broadcast)
+}
+
+// Run is the hub. A subscriber whose queue is full is dropped.
 func (b *Broadcaster) Run() {
-	for {
-		select {
-		case sub := <-b.addSub:
-			b.subs[sub] = true
-			b.subCount++
-			log.Printf("Listeners: %d", b.subCount)
+	for f := range b.broadcast {
+		b.pagesOut.Add(1)
+		b.bytesOut.Add(int64(len(f.page)))
+		b.fanOut(f)
+	}
+}
 
-		case sub := <-b.removeSub:
-			b.dropSub(sub)
+// fanOut buffers f and hands it to every subscriber. The deferred unlock
+// keeps smu usable if anything here panics and protect restarts the hub.
+func (b *Broadcaster) fanOut(f hubFrame) {
+	maxBytes := b.Limits().burst
+	b.smu.Lock()
+	defer b.smu.Unlock()
+	b.remember(f, time.Now(), maxBytes)
+	for sub := range b.subs {
+		select {
+		case sub <- f.page:
+		default:
+			delete(b.subs, sub)
+			close(sub)
+			debugf("Listeners: %d", b.subCount.Add(-1))
+		}
+	}
+}
 
-		case frame := <-b.broadcast:
-			for sub := range b.subs {
-				select {
-				case sub <- frame:
-				default:
-					b.dropSub(sub)
-				}
-			}
+// remember keeps audio pages for burstLen, or connectBurst if that is
+// longer, in at most maxBytes (0 = unlimited). A beginning-of-stream page
+// means new headers, which the buffered pages don't belong to. Called with
+// smu held.
+func (b *Broadcaster) remember(f hubFrame, now time.Time, maxBytes int) {
+	if !f.audio {
+		if len(f.page) > 5 && f.page[5]&0x02 != 0 {
+			b.setBurst(nil)
 		}
+		return
+	}
+	keep := max(b.burstLen, b.connectBurst)
+	if keep <= 0 {
+		b.setBurst(nil)
+		return
+	}
+	b.burst = append(b.burst, burstPage{now, f.page})
+	b.burstBytes += len(f.page)
+	n := 0
+	for n < len(b.burst) && (now.Sub(b.burst[n].at) > keep || maxBytes > 0 && b.burstBytes > maxBytes) {
+		b.burstBytes -= len(b.burst[n].page)
+		n++
+	}
+	b.burst = b.burst[n:]
+}
+
+// setBurst replaces the burst buffer. Called with smu held.
+func (b *Broadcaster) setBurst(pages []burstPage) {
+	b.burst = pages
+	b.burstBytes = 0
+	for _, bp := range pages {
+		b.burstBytes += len(bp.page)
 	}
 }
 
+// Listeners is safe to call from any goroutine.
+func (b *Broadcaster) Listeners() int { return int(b.subCount.Load()) }
+
 func (b *Broadcaster) SetHeader(h []byte) {
 	b.hmu.Lock()
+	defer b.hmu.Unlock()
 	b.header = h
+	select {
+	case <-b.hready:
+		if len(h) == 0 {
+			b.hready = make(chan struct{})
+		}
+	default:
+		if len(h) > 0 {
+			close(b.hready)
+		}
+	}
+}
+
+// HeaderReady returns a channel that is closed once a header is cached.
+func (b *Broadcaster) HeaderReady() <-chan struct{} {
+	b.hmu.RLock()
+	defer b.hmu.RUnlock()
+	return b.hready
+}
+
+// TrackStarted wakes everyone waiting on NextTrack.
+func (b *Broadcaster) TrackStarted() {
+	b.hmu.Lock()
+	close(b.tnext)
+	b.tnext = make(chan struct{})
+	b.hmu.Unlock()
+}
+
+// NextTrack returns a channel that is closed when the next track starts.
+func (b *Broadcaster) NextTrack() <-chan struct{} {
+	b.hmu.RLock()
+	defer b.hmu.RUnlock()
+	return b.tnext
+}
+
+func (b *Broadcaster) setLastTrack(page []byte) {
+	b.hmu.Lock()
+	b.lastTrack = page
 	b.hmu.Unlock()
 }
 
+func (b *Broadcaster) getLastTrack() []byte {
+	b.hmu.RLock()
+	defer b.hmu.RUnlock()
+	return b.lastTrack
+}
+
 func (b *Broadcaster) GetHeaderCopy() []byte {
 	b.hmu.RLock()
 	defer b.hmu.RUnlock()
@@ -139,12 +401,30 @@ func resolveExistingFile(p string, baseDir string) (string, bool) {
 	return "", false
 }
 
-func wavExts() map[string]bool {
-	return map[string]bool{
-		".wav":  true,
-		".wave": true,
-		".flac": true,
+// inputExts are the file name extensions the scanner, the playlist loader
+// and requests accept, lower-cased with the dot (see -input-exts). ffmpeg
+// decodes them all; only WAV and FLAC headers give the length and sample
+// format up front.
+var inputExts = map[string]bool{".wav": true, ".wave": true, ".flac": true, ".mp3": true, ".ogg": true, ".opus": true}
+
+// parseInputExts turns -input-exts, a comma-separated list such as
+// "wav,flac,mp3", into an extension set.
+func parseInputExts(s string) (map[string]bool, error) {
+	exts := map[string]bool{}
+	for _, e := range strings.Split(s, ",") {
+		e = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(e), "."))
+		if e == "" {
+			continue
+		}
+		if strings.ContainsAny(e, `./\`) {
+			return nil, fmt.Errorf("bad extension %q", e)
+		}
+		exts["."+e] = true
 	}
+	if len(exts) == 0 {
+		return nil, errors.New("no extensions")
+	}
+	return exts, nil
 }
 
 func readPlaylistFile(listPath string) ([]string, error) {
@@ -155,7 +435,6 @@ func readPlaylistFile(listPath string) ([]string, error) {
 	defer f.Close()
 
 	baseDir := filepath.Dir(listPath)
-	exts := wavExts()
 
 	var out []string
 	sc := bufio.NewScanner(f)
@@ -171,8 +450,8 @@ func readPlaylistFile(listPath string) ([]string, error) {
 			continue
 		}
 		ext := strings.ToLower(filepath.Ext(p))
-		if !exts[ext] {
-			log.Printf("playlist: skipping non-wav file: %s", p)
+		if !inputExts[ext] {
+			log.Printf("playlist: skipping file of a type not in -input-exts: %s", p)
 			continue
 		}
 		out = append(out, p)
@@ -187,7 +466,6 @@ func readPlaylistFile(listPath string) ([]string, error) {
 // resolved real paths of visited directories.
 func buildWavListFromDir(root string) ([]string, error) {
 	root = filepath.Clean(root)
-	exts := wavExts()
 
 	seenDirs := map[string]bool{}
 	var out []string
@@ -227,7 +505,7 @@ func buildWavListFromDir(root string) ([]string, error) {
 					continue
 				}
 				ext := strings.ToLower(filepath.Ext(e.Name()))
-				if exts[ext] {
+				if inputExts[ext] {
 					out = append(out, full)
 				}
 				continue
@@ -239,7 +517,7 @@ func buildWavListFromDir(root string) ([]string, error) {
 			}
 
 			ext := strings.ToLower(filepath.Ext(e.Name()))
-			if exts[ext] {
+			if inputExts[ext] {
 				out = append(out, full)
 			}
 		}
@@ -296,13 +574,15 @@ func readNextOggPage(r *bufio.Reader) ([]byte, error) {
 	return page, nil
 }
 
-// Collects enough Ogg pages to include the 3 Vorbis header packets.
-type vorbisHeaderFinder struct {
+// Collects enough Ogg pages to include the codec's header packets: the 3
+// Vorbis headers, or OpusHead and OpusTags.
+type headerFinder struct {
+	codec      string // vorbis or opus, from the first header packet
 	gotPackets int
 	packetBuf  []byte
 }
 
-func (vh *vorbisHeaderFinder) feedPage(page []byte) {
+func (vh *headerFinder) feedPage(page []byte) {
 	if len(page) < 27 {
 		return
 	}
@@ -336,58 +616,144 @@ func (vh *vorbisHeaderFinder) feedPage(page []byte) {
 	}
 }
 
-func (vh *vorbisHeaderFinder) checkPacket(pkt []byte) {
-	if vh.gotPackets >= 3 {
+func (vh *headerFinder) checkPacket(pkt []byte) {
+	if vh.done() {
 		return
 	}
+	switch {
 	// Vorbis header packet: [type]["vorbis"...]
-	if len(pkt) >= 7 &&
+	case len(pkt) >= 7 &&
 		(pkt[0] == 0x01 || pkt[0] == 0x03 || pkt[0] == 0x05) &&
-		bytes.Equal(pkt[1:7], []byte("vorbis")) {
+		bytes.Equal(pkt[1:7], []byte("vorbis")):
+		vh.codec = "vorbis"
+		vh.gotPackets++
+	case bytes.HasPrefix(pkt, []byte("OpusHead")), bytes.HasPrefix(pkt, []byte("OpusTags")):
+		vh.codec = "opus"
 		vh.gotPackets++
 	}
 }
 
-func (vh *vorbisHeaderFinder) done() bool { return vh.gotPackets >= 3 }
+func (vh *headerFinder) done() bool {
+	switch vh.codec {
+	case "vorbis":
+		return vh.gotPackets >= 3
+	case "opus":
+		return vh.gotPackets >= 2
+	}
+	return false
+}
 
 // ---------------- ffmpeg encoder (single process) ----------------
 
 type encoderConfig struct {
 	ffmpegPath  string
+	codecName   string // -codec: vorbis or opus; empty = vorbis
 	bitrateKbps int
 	vorbisQ     int
 	streamName  string
+	mime        string // -stream-mime override; empty = derived from the codec
+	cheap       bool   // Opus at its lowest complexity (see CPU pressure)
+	mono        bool   // downmix to one channel (a -track-encode sidecar)
+}
+
+// codec is the audio codec the encoder produces.
+func (cfg encoderConfig) codec() string {
+	if cfg.codecName == "" {
+		return "vorbis"
+	}
+	return cfg.codecName
+}
+
+// economy is cfg stepped down for a loaded host: at most kbps, and Opus at
+// its cheapest complexity. Vorbis in quality mode switches to the bitrate.
+func (cfg encoderConfig) economy(kbps int) encoderConfig {
+	if cfg.bitrateKbps <= 0 || cfg.bitrateKbps > kbps {
+		cfg.bitrateKbps = kbps
+	}
+	cfg.cheap = true
+	return cfg
+}
+
+// contentType is the MIME type sent in the stream's success line.
+func (cfg encoderConfig) contentType() string {
+	switch {
+	case cfg.mime != "":
+		return cfg.mime
+	case cfg.codec() == "opus":
+		return "audio/ogg; codecs=opus"
+	}
+	return "audio/ogg"
+}
+
+// checkStreamMIME validates a -stream-mime value against the codec: it must
+// parse, and any codecs parameter must name the codec actually encoded.
+func checkStreamMIME(s, codec string) error {
+	if s == "" {
+		return nil
+	}
+	if strings.ContainsAny(s, "\r\n") {
+		return fmt.Errorf("line break in %q", s)
+	}
+	mt, params, err := mime.ParseMediaType(s)
+	if err != nil {
+		return fmt.Errorf("%q: %v", s, err)
+	}
+	if !strings.HasPrefix(mt, "audio/") && mt != "application/ogg" {
+		return fmt.Errorf("%q is not an audio type", s)
+	}
+	if c, ok := params["codecs"]; ok && !strings.EqualFold(strings.Trim(c, `"`), codec) {
+		return fmt.Errorf("%q names codec %q, but the stream is %s", s, c, codec)
+	}
+	return nil
 }
 
-func startEncoder(cfg encoderConfig) (*exec.Cmd, io.WriteCloser, io.ReadCloser, error) {
+// outputArgs are the ffmpeg output options shared by the live encoder and
+// one-off encodes (such as the preroll) that must match it.
+func (cfg encoderConfig) outputArgs() []string {
+	rate := strconv.Itoa(pcmRate)
+	if cfg.codec() == "opus" {
+		rate = "48000" // Opus always runs at 48 kHz; ffmpeg resamples
+	}
+	channels := "2"
+	if cfg.mono {
+		channels = "1"
+	}
 	args := []string{
-		"-hide_banner",
-		"-loglevel", "warning",
-
-		// Continuous input is concatenated WAVs on stdin.
-		"-f", "s16le",
-		"-ar", "44100",
-		"-ac", "2",
-		"-i", "pipe:0",
 		"-vn",
-		"-c:a", "libvorbis",
+		"-ar", rate,
+		"-ac", channels,
 	}
 
-	if cfg.bitrateKbps > 0 {
-		args = append(args, "-b:a", fmt.Sprintf("%dk", cfg.bitrateKbps))
-	} else {
-		args = append(args, "-q:a", fmt.Sprintf("%d", cfg.vorbisQ))
+	switch {
+	case cfg.codec() == "opus":
+		args = append(args, "-c:a", "libopus", "-b:a", fmt.Sprintf("%dk", cfg.bitrateKbps))
+		if cfg.cheap {
+			args = append(args, "-compression_level", "0")
+		}
+	case cfg.bitrateKbps > 0:
+		args = append(args, "-c:a", "libvorbis", "-b:a", fmt.Sprintf("%dk", cfg.bitrateKbps))
+	default:
+		args = append(args, "-c:a", "libvorbis", "-q:a", fmt.Sprintf("%d", cfg.vorbisQ))
 	}
 
-	// Constant stream metadata (Vorbis comments in header)
+	// Constant stream metadata (comments in the stream header)
 	if cfg.streamName != "" {
 		args = append(args, "-metadata", fmt.Sprintf("title=%s", cfg.streamName))
 	}
 
-	args = append(args,
-		"-f", "ogg",
-		"pipe:1",
-	)
+	return append(args, "-f", "ogg")
+}
+
+// startEncoder starts the live encoder; extra output options, such as
+// per-track metadata, go after cfg's.
+func startEncoder(cfg encoderConfig, extra ...string) (*exec.Cmd, io.WriteCloser, io.ReadCloser, error) {
+	// Continuous input is pipeline PCM on stdin.
+	args := []string{"-hide_banner", "-loglevel", "warning"}
+	args = append(args, pcmArgs()...)
+	args = append(args, "-i", "pipe:0")
+	args = append(args, cfg.outputArgs()...)
+	args = append(args, extra...)
+	args = append(args, "pipe:1")
 
 	cmd := exec.Command(cfg.ffmpegPath, args...)
 	cmd.Stderr = os.Stderr
@@ -407,18 +773,84 @@ func startEncoder(cfg encoderConfig) (*exec.Cmd, io.WriteCloser, io.ReadCloser,
 	return cmd, stdin, stdout, nil
 }
 
-func decodeWavToPCMAndWrite(ffmpegPath string, wavPath string, encStdin io.Writer) error {
+// pcmOutputArgs are the ffmpeg output arguments that decode the file at path
+// to the pipeline's PCM on stdout.
+//
+// Sources with more than 16 bits, such as 24-bit or float field recordings,
+// are resampled in float, so nothing is clipped or truncated on the way, and
+// dithered once on the final step down to 16 bits. Float peaks above full
+// scale still clip there.
+//
+// Surround files with speaker positions are downmixed to stereo by ffmpeg
+// (centre and surrounds at -3 dB, LFE dropped). A multichannel WAV without
+// positions is more likely a recorder's separate tracks than surround, and
+// ffmpeg would guess a layout that drops or misplaces some of them, so all
+// its channels are mixed equally into both sides instead.
+func pcmOutputArgs(path string) []string {
+	args := append(pcmArgs(), "pipe:1")
+	af, err := readAudioFormat(path)
+	if err != nil {
+		return args
+	}
+	var filters []string
+	if af.channels > 2 {
+		if af.positioned {
+			logChannelsOnce(path, fmt.Sprintf("%d channels, downmixed to stereo", af.channels))
+		} else {
+			logChannelsOnce(path, fmt.Sprintf("%d channels without speaker positions, mixed equally into stereo", af.channels))
+			filters = append(filters, equalMix(af.channels))
+		}
+	}
+	if af.bits > 16 || af.float {
+		filters = append(filters, fmt.Sprintf("aresample=%d:osf=s16:internal_sample_fmt=fltp:dither_method=triangular", pcmRate))
+	}
+	if len(filters) > 0 {
+		args = append([]string{"-af", strings.Join(filters, ",")}, args...)
+	}
+	return args
+}
+
+// equalMix is a pan filter that mixes n channels equally into both sides.
+func equalMix(n int) string {
+	terms := make([]string, n)
+	for i := range terms {
+		terms[i] = fmt.Sprintf("%.4g*c%d", 1/float64(n), i)
+	}
+	mix := strings.Join(terms, "+")
+	return "pan=stereo|c0=" + mix + "|c1=" + mix
+}
+
+// channelNotes remembers the multichannel files already logged, as the
+// rotation decodes them again every cycle.
+var channelNotes sync.Map
+
+func logChannelsOnce(path, note string) {
+	if _, seen := channelNotes.LoadOrStore(path, true); !seen {
+		log.Printf("%s: %s", path, note)
+	}
+}
+
+// Decodes one file into encStdin. If src is not nil ffmpeg reads the file
+// from it rather than opening wavPath. Closing cancel stops the decode early
+// (a skip); that is not an error. Closing stop ends it for good, as the
+// feeder is shutting down, and returns errFeederStopped. Failures of the
+// file are *sourceErrors, failed writes to encStdin *sinkErrors, after which
+// the decoder is killed rather than left writing; anything else (ffmpeg
+// won't start) is neither.
+func decodeWavToPCMAndWrite(ffmpegPath string, wavPath string, src io.Reader, encStdin io.Writer, cancel, stop <-chan struct{}) error {
+	input := wavPath
+	if src != nil {
+		input = "pipe:0"
+	}
 	// Decode/resample to a stable PCM format that matches the encoder input.
 	cmd := exec.Command(ffmpegPath,
 		"-hide_banner", "-loglevel", "warning",
 		// optional: pace decoding in realtime; helps “radio” feel
 		"-re",
-		"-i", wavPath,
-		"-f", "s16le",
-		"-ar", "44100",
-		"-ac", "2",
-		"pipe:1",
+		"-i", input,
 	)
+	cmd.Args = append(cmd.Args, pcmOutputArgs(wavPath)...)
+	cmd.Stdin = src
 	cmd.Stderr = os.Stderr
 	out, err := cmd.StdoutPipe()
 	if err != nil {
@@ -428,261 +860,1722 @@ func decodeWavToPCMAndWrite(ffmpegPath string, wavPath string, encStdin io.Write
 		return err
 	}
 
-	_, copyErr := io.Copy(encStdin, out)
-	waitErr := cmd.Wait()
+	finished := make(chan struct{})
+	var skipped, stopped atomic.Bool
+	go func() {
+		select {
+		case <-cancel:
+			skipped.Store(true)
+			_ = cmd.Process.Kill()
+		case <-stop:
+			stopped.Store(true)
+			_ = cmd.Process.Kill()
+		case <-finished:
+		}
+	}()
 
+	_, copyErr := io.Copy(sinkWriter{encStdin}, out)
 	if copyErr != nil {
+		// Nobody reads ffmpeg's output any more: a -re decoder would block
+		// on it for good, and so would Wait.
+		_ = cmd.Process.Kill()
+	}
+	waitErr := cmd.Wait()
+	close(finished)
+
+	var se *sinkError
+	switch {
+	case stopped.Load():
+		return errFeederStopped
+	case errors.As(copyErr, &se):
 		return copyErr
+	case copyErr != nil:
+		return &sourceError{fmt.Errorf("reading ffmpeg: %v", copyErr), false}
+	}
+	if skipped.Load() || waitErr == nil {
+		return nil
 	}
-	return waitErr
+	return &sourceError{fmt.Errorf("ffmpeg: %v", waitErr), true}
 }
 
-// Feeds WAV files into encoder stdin forever (shuffle per cycle if enabled).
-// If encoder stdin breaks, returns.
-func feedWavForever(ffmpegPath string, stdin io.Writer, loadList func() ([]string, error), shuffle bool, rescanDelay time.Duration) {
-	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
-
-	for {
-		files, err := loadList()
-		if err != nil {
-			log.Printf("playlist load error: %v", err)
-			time.Sleep(rescanDelay)
-			continue
-		}
-		if len(files) == 0 {
-			time.Sleep(rescanDelay)
-			continue
-		}
+// feeder plays the file rotation (playlist or scanned music dir).
+type feeder struct {
+	ffmpegPath string
+	loadList   func() ([]string, error)
+
+	baseDir string            // relative queued paths resolve against this; see dir
+	onTrack func(path string) // called as each file starts; may be nil
+
+	// seed returns the shuffle seed for the programming at now, or
+	// ok=false for a fresh random order every run. May be nil.
+	seed func(now time.Time) (seed int64, ok bool)
+
+	history  *playHistory  // recently played window for shuffling; may be nil
+	recent   *recentPlays  // the plays listed on /history; may be nil
+	lib      *library      // counts plays for the library; may be nil
+	newBoost int           // plays per cycle of tracks new to lib; <= 1 is off
+	report   *playReport   // logs what went on air; may be nil
+	playlog  *listenBrainz // submits what went on air; may be nil
+
+	// Files that open and close every cycle, whatever the shuffle does.
+	pinFirst, pinLast []string
+
+	albums bool // -group-by=album: shuffle whole albums (see album mode)
+
+	ids *idScheduler // station IDs between tracks; may be nil
+
+	health *fileHealth    // files that failed to read or decode; may be nil
+	rules  *rotationRules // -rules for folders of the rotation; may be nil
+	ahead  *readAhead     // the next track, opened early; feedWavForever only
+
+	mu      sync.Mutex
+	shuffle bool
+	rescan  time.Duration
+	current string
+	since   time.Time
+	cancel  chan struct{}   // closed to skip the current file
+	fed     *countingWriter // PCM of the current file so far
+	length  time.Duration   // of the current file; 0 if unknown
+	events  []string        // scheduled items, played before requests
+	queue   []string        // requests, played before the rotation continues
+}
 
-		if shuffle {
-			rng.Shuffle(len(files), func(i, j int) { files[i], files[j] = files[j], files[i] })
-		}
+// parseShuffleSeed turns -shuffle-seed into a feeder seed function: empty
+// for a random order, "daily" for a seed derived from the local date, or a
+// fixed integer.
+func parseShuffleSeed(s string, loc *time.Location) (func(time.Time) (int64, bool), error) {
+	switch s {
+	case "":
+		return nil, nil
+	case "daily":
+		return func(now time.Time) (int64, bool) {
+			day, _ := strconv.ParseInt(now.In(loc).Format("20060102"), 10, 64)
+			return day, true
+		}, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad -shuffle-seed %q: want an integer or \"daily\"", s)
+	}
+	return func(time.Time) (int64, bool) { return n, true }, nil
+}
 
-		for _, p := range files {
-			log.Printf("Now playing: %s", p)
-			if err := decodeWavToPCMAndWrite(ffmpegPath, p, stdin); err != nil {
-				log.Printf("decode/write failed: %v", err)
-				return
-			}
+// pinTracks puts first at the start of files and last at the end, removing
+// them from wherever else they were.
+func pinTracks(files, first, last []string) []string {
+	if len(first) == 0 && len(last) == 0 {
+		return files
+	}
+	pinned := make(map[string]bool)
+	for _, p := range append(first, last...) {
+		pinned[p] = true
+	}
+	out := append([]string(nil), first...)
+	for _, p := range files {
+		if !pinned[p] {
+			out = append(out, p)
 		}
-
-		// loop again: rebuild list (so playlist edits take effect), reshuffle if enabled
 	}
+	return append(out, last...)
 }
 
-// Reads encoder stdout as Ogg pages, caches Vorbis headers once, broadcasts pages forever.
-func broadcastFromEncoder(stdout io.Reader, b *Broadcaster) error {
-	br := bufio.NewReaderSize(stdout, 256*1024)
-
-	vh := &vorbisHeaderFinder{}
-	var headerBuf bytes.Buffer
-	headerSet := false
+// rotation returns the shuffle and rescan settings.
+func (f *feeder) rotation() (bool, time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.shuffle, f.rescan
+}
 
-	for {
-		page, err := readNextOggPage(br)
-		if err != nil {
-			return err
-		}
+func (f *feeder) setRotation(shuffle bool, rescan time.Duration) {
+	f.mu.Lock()
+	f.shuffle, f.rescan = shuffle, rescan
+	f.mu.Unlock()
+}
 
-		if !headerSet {
-			vh.feedPage(page)
-			headerBuf.Write(page)
-			if vh.done() {
-				b.SetHeader(headerBuf.Bytes())
-				headerSet = true
-				log.Printf("Cached Vorbis headers: %d bytes", headerBuf.Len())
-			}
-		}
+// nowPlaying returns the file being decoded and when it started.
+func (f *feeder) nowPlaying() (string, time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.current, f.since
+}
 
-		b.broadcast <- page
+// progress returns how much of the current file has been played, by the
+// PCM fed so far, and its length, 0 if unknown.
+func (f *feeder) progress() (elapsed, length time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fed == nil {
+		return 0, 0
 	}
+	return pcmDuration(f.fed.n.Load()), f.length
 }
 
-// ---------------- Spartan handlers ----------------
-func handleRadio(conn net.Conn, b *Broadcaster) {
-	// TCP keepalive (kernel probes). Helps with half-open connections.
-	if tc, ok := conn.(*net.TCPConn); ok {
-		_ = tc.SetKeepAlive(true)
-		_ = tc.SetKeepAlivePeriod(30 * time.Second)
+// skip aborts the current file; the feeder moves on to the next one.
+func (f *feeder) skip() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cancel == nil {
+		return false
 	}
+	close(f.cancel)
+	f.cancel = nil
+	return true
+}
 
-	remote := conn.RemoteAddr().String()
-	log.Printf("Listener connected: %s", remote)
-	defer func() {
-		log.Printf("Listener disconnected: %s", remote)
-		_ = conn.Close()
-	}()
+// dir returns baseDir; setDir changes it when the rotation's source does.
+func (f *feeder) dir() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.baseDir
+}
 
-	// A helper: every write must make progress within this time.
-	const writeTimeout = 10 * time.Second
-	writeAll := func(p []byte) error {
-		_ = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
-		_, err := conn.Write(p)
-		return err
-	}
+func (f *feeder) setDir(dir string) {
+	f.mu.Lock()
+	f.baseDir = dir
+	f.mu.Unlock()
+}
 
-	// Spartan response header
-	if err := writeAll([]byte("2 audio/ogg\r\n")); err != nil {
-		return
+// resolve checks that p names a playable file, relative to baseDir.
+func (f *feeder) resolve(p string) (string, error) {
+	if p == "" {
+		return "", errors.New("no file given")
 	}
-
-	// Send cached Vorbis headers first (late join can decode).
-	if hdr := b.GetHeaderCopy(); len(hdr) > 0 {
-		if err := writeAll(hdr); err != nil {
-			return
-		}
+	abs, ok := resolveExistingFile(p, f.dir())
+	if !ok {
+		return "", fmt.Errorf("no such file: %s", p)
 	}
-
-	sub := make(Subscriber, 512)
-	b.addSub <- sub
-	defer func() { b.removeSub <- sub }()
-
-	for page := range sub {
-		if err := writeAll(page); err != nil {
-			return
-		}
+	if !inputExts[strings.ToLower(filepath.Ext(abs))] {
+		return "", fmt.Errorf("unsupported file type: %s", p)
 	}
+	return abs, nil
 }
 
-func handleRequest(conn net.Conn, b *Broadcaster, host string, port int, streamName string) {
-	defer conn.Close()
+// enqueue adds a request to be played at the next track boundary.
+func (f *feeder) enqueue(path string) {
+	f.mu.Lock()
+	f.queue = append(f.queue, path)
+	f.mu.Unlock()
+}
 
-	reader := bufio.NewReader(conn)
+// enqueueEvent adds a scheduled item; events go ahead of any requests.
+func (f *feeder) enqueueEvent(path string) {
+	f.mu.Lock()
+	f.events = append(f.events, path)
+	f.mu.Unlock()
+}
 
-	line, err := reader.ReadString('\n')
-	if err != nil {
-		return
-	}
-	line = strings.TrimRight(line, "\r\n")
+// queued lists what will play before the rotation continues, in order.
+func (f *feeder) queued() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append(append([]string(nil), f.events...), f.queue...)
+}
 
-	parts := strings.Split(line, " ")
-	if len(parts) != 3 {
-		fmt.Fprintf(conn, "4 malformed request line\r\n")
-		return
+func (f *feeder) popQueue() (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, q := range []*[]string{&f.events, &f.queue} {
+		if len(*q) > 0 {
+			p := (*q)[0]
+			*q = (*q)[1:]
+			return p, true
+		}
 	}
+	return "", false
+}
 
-	path := parts[1]
-	lenStr := parts[2]
-
-	contentLen, err := strconv.Atoi(lenStr)
-	if err != nil || contentLen < 0 {
-		fmt.Fprintf(conn, "4 invalid content-length\r\n")
-		return
+// play decodes one file into stdin, preceded by a station ID when one is due,
+// and reads next ahead, if not empty. A *sourceError means the file, or the
+// ID, could not be played; any other error, errFeederStopped once stop is
+// closed, stops the feeder.
+func (f *feeder) play(p, next string, stdin io.Writer, stop <-chan struct{}) error {
+	src, err := f.takeAhead(p).reader()
+	if next != "" {
+		f.readAhead(next)
 	}
-
-	if contentLen > 0 {
-		_, err = io.CopyN(io.Discard, reader, int64(contentLen))
-		if err != nil {
-			fmt.Fprintf(conn, "5 error reading request body\r\n")
-			return
+	if err != nil {
+		if f.health != nil {
+			f.health.failed(p, err, time.Now())
 		}
+		return &sourceError{err, false}
 	}
-
-	switch path {
-	case "/", "/index.gmi", "/index.txt":
-		base := fmt.Sprintf("spartan://%s:%d", host, port)
-		title := "Spartan Radio (Vorbis over Spartan)"
-		if streamName != "" {
-			title = streamName
+	defer src.Close()
+
+	if f.ids != nil {
+		if id, ok := f.ids.due(p); ok {
+			d, err := f.decode(id, nil, stdin, stop)
+			f.ids.played(d, true)
+			var fe *sourceError
+			if errors.As(err, &fe) {
+				log.Printf("Station ID %s: %v", id, err)
+			} else if err != nil {
+				return err
+			}
 		}
-		body := title + "\n\n" +
-			"=> " + base + "/radio Tune in\n"
-		fmt.Fprintf(conn, "2 text/gemini; charset=utf-8\r\n%s", body)
+	}
+	if f.history != nil {
+		f.history.add(p)
+	}
+	if f.rules != nil {
+		f.rules.played(p, time.Now())
+	}
+	if f.lib != nil {
+		f.lib.played(p)
+	}
+	start := time.Now()
+	if f.recent != nil {
+		f.recent.add(p, start)
+	}
+	d, err := f.decode(p, src, stdin, stop)
+	if f.ids != nil {
+		f.ids.played(d, false)
+	}
+	if f.report != nil && d > 0 {
+		f.report.add(start, p, d)
+	}
+	if f.playlog != nil && d > 0 {
+		f.playlog.add(start, p, d)
+	}
+	var fe *sourceError
+	switch {
+	case f.health == nil:
+	case errors.As(err, &fe):
+		f.health.failed(p, err, time.Now())
+	case err == nil:
+		f.health.succeeded(p)
+	}
+	return err
+}
 
-	case "/radio":
-		handleRadio(conn, b)
+// decode plays one file, read from src if not nil, tracking it as the
+// current file, and returns how much audio it fed.
+func (f *feeder) decode(p string, src io.Reader, stdin io.Writer, stop <-chan struct{}) (time.Duration, error) {
+	cancel := make(chan struct{})
+	cw := &countingWriter{w: stdin}
+	length, _ := audioDuration(p)
+	f.mu.Lock()
+	f.current, f.since, f.cancel = p, time.Now(), cancel
+	f.fed, f.length = cw, length
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		f.current, f.cancel, f.fed, f.length = "", nil, nil, 0
+		f.mu.Unlock()
+	}()
 
-	default:
-		fmt.Fprintf(conn, "4 not found\r\n")
+	log.Printf("Now playing: %s", p)
+	if f.onTrack != nil {
+		f.onTrack(p)
 	}
+	err := decodeWavToPCMAndWrite(f.ffmpegPath, p, src, cw, cancel, stop)
+	return pcmDuration(cw.n.Load()), err
 }
 
-func main() {
-	musicDirFlag := flag.String("music-dir", "./music", "directory with .wav/.wave/.flac files (can be a symlink)")
-	playlistFlag := flag.String("playlist", "", "path to playlist text file (plain paths OR ffmpeg concat format). If set, music-dir scanning is not used.")
-	shuffleFlag := flag.Bool("shuffle", false, "shuffle playlist each cycle")
+type countingWriter struct {
+	w io.Writer
+	n atomic.Int64
+}
 
-	port := flag.Int("port", 300, "TCP port to listen on (Spartan default is 300)")
-	host := flag.String("host", "localhost", "host name to advertise in index (spartan://HOST:PORT/...)")
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n.Add(int64(n))
+	return n, err
+}
+
+// pcmDuration is the playing time of n bytes of pipeline PCM.
+func pcmDuration(n int64) time.Duration {
+	return time.Duration(float64(n) / float64(pcmBytesPerSecond) * float64(time.Second))
+}
+
+// shuffleState carries the shuffle order from one cycle to the next.
+type shuffleState struct {
+	rng   *rand.Rand
+	seed  int64
+	cycle int64 // cycles played under seed
+}
+
+func newShuffleState() *shuffleState {
+	return &shuffleState{rng: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// nextCycle loads the rotation and puts it in play order for a cycle
+// starting at now: shuffled, spread against the history, new tracks
+// boosted and pinned tracks in place; or in album mode whole albums
+// shuffled.
+func (f *feeder) nextCycle(now time.Time, sh *shuffleState) ([]string, error) {
+	files, err := f.loadList()
+	if err != nil || len(files) == 0 {
+		return files, err
+	}
+	var groups [][]string
+	if f.albums {
+		groups = groupAlbums(files, albumTags)
+	}
+	if shuffle, _ := f.rotation(); shuffle {
+		r := sh.rng
+		if f.seed != nil {
+			if s, ok := f.seed(now); ok {
+				if s != sh.seed {
+					sh.seed, sh.cycle = s, 0
+				}
+				r = rand.New(rand.NewSource(sh.seed + sh.cycle))
+				sh.cycle++
+			}
+		}
+		if groups != nil {
+			r.Shuffle(len(groups), func(i, j int) { groups[i], groups[j] = groups[j], groups[i] })
+		} else {
+			r.Shuffle(len(files), func(i, j int) { files[i], files[j] = files[j], files[i] })
+			if f.history != nil {
+				files = f.history.spread(files)
+			}
+		}
+	}
+	if groups != nil {
+		// Albums play whole: no spreading or boosting of single tracks.
+		files = files[:0]
+		for _, g := range groups {
+			files = append(files, g...)
+		}
+	} else if f.lib != nil && f.newBoost > 1 {
+		files = boostNew(files, f.lib.newPaths(), f.newBoost)
+	}
+	return pinTracks(files, f.pinFirst, f.pinLast), nil
+}
+
+// playable reports whether the rotation may start p at now: it is not
+// waiting out a failure, and no rule holds it back.
+func (f *feeder) playable(p string, now time.Time) bool {
+	if f.health != nil && !f.health.ok(p, now) {
+		return false
+	}
+	return f.rules == nil || f.rules.allows(p, now)
+}
+
+// Feeds WAV files into encoder stdin forever (shuffle per cycle if enabled).
+// If encoder stdin breaks or stop is closed, returns.
+func (f *feeder) feedWavForever(stdin io.Writer, stop <-chan struct{}) {
+	sh := newShuffleState()
+	defer func() {
+		if f.ahead != nil {
+			f.ahead.drop()
+			f.ahead = nil
+		}
+	}()
+
+	wait := func() bool {
+		_, rescan := f.rotation()
+		select {
+		case <-stop:
+			return false
+		case <-time.After(rescan):
+			return true
+		}
+	}
+
+	for {
+		files, err := f.nextCycle(time.Now(), sh)
+		if err != nil {
+			log.Printf("playlist load error: %v", err)
+			if !wait() {
+				return
+			}
+			continue
+		}
+		if len(files) == 0 {
+			if !wait() {
+				return
+			}
+			continue
+		}
+
+		// A file that can't be played is skipped. Broken encoder input, or
+		// a decoder that won't start, stops the feeder.
+		played := 0
+		playOne := func(p, next string) bool {
+			err := f.play(p, next, stdin, stop)
+			var fe *sourceError
+			switch {
+			case errors.As(err, &fe):
+				return true
+			case errors.Is(err, errFeederStopped):
+				return false
+			case err != nil:
+				log.Printf("feeder stopped: %v", err)
+				return false
+			}
+			played++
+			return true
+		}
+		// upcoming guesses what plays once files[:i] are done: a queued
+		// item or the next playable file of this cycle.
+		upcoming := func(i int) string {
+			if q := f.queued(); len(q) > 0 {
+				return q[0]
+			}
+			for _, p := range files[i:] {
+				if f.playable(p, time.Now()) {
+					return p
+				}
+			}
+			return ""
+		}
+		for i, p := range files {
+			// Queued files go first.
+			for q, ok := f.popQueue(); ok; q, ok = f.popQueue() {
+				if !playOne(q, upcoming(i)) {
+					return
+				}
+			}
+			if !f.playable(p, time.Now()) {
+				continue
+			}
+			if !playOne(p, upcoming(i+1)) {
+				return
+			}
+		}
+		// Nothing played: every file failed or waits out its backoff.
+		if played == 0 && !wait() {
+			return
+		}
+
+		// loop again: rebuild list (so playlist edits take effect), reshuffle if enabled
+	}
+}
+
+// encoderBuffer is the read buffer on the encoder's output.
+var encoderBuffer = 256 * 1024
+
+// Reads encoder stdout as Ogg pages, caches the codec headers once, broadcasts pages forever.
+// When maxPageMs > 0, audio pages are first split so none is longer than that.
+// When the output ends, streams the encoder left open are ended with an empty
+// EOS page, so that listeners' players take the next encoder's headers as a
+// new link of a chained stream rather than as garbage in the old one.
+func broadcastFromEncoder(stdout io.Reader, b *Broadcaster, maxPageMs int) error {
+	br := bufio.NewReaderSize(stdout, encoderBuffer)
+	open := openStreams{}
+	defer func() {
+		for _, page := range open.eos() {
+			b.Publish(page)
+		}
+	}()
+
+	vh := &headerFinder{}
+	var headerBuf bytes.Buffer
+	headerSet := false
+
+	var rp *repaginator
+	if maxPageMs > 0 {
+		rp = newRepaginator(maxPageMs)
+	}
+	var sg *trackSignaler
+	if b.tracks != nil {
+		sg = &trackSignaler{b: b}
+	}
+
+	for first := true; ; first = false {
+		raw, err := readNextOggPage(br)
+		if err != nil {
+			return err
+		}
+		if first {
+			b.endRestored()
+		}
+		raw = chaos.corrupt(raw)
+
+		pages := [][]byte{raw}
+		if rp != nil {
+			pages = rp.feed(raw)
+		}
+		for _, page := range pages {
+			b.rate.page(page)
+		}
+		if sg != nil {
+			pages = sg.add(pages)
+		}
+
+		for _, page := range pages {
+			open.see(page)
+			if headerSet && len(page) > 27 && page[5]&0x02 != 0 {
+				// The next link of a chained stream (-track-comments):
+				// cache its headers instead.
+				if p, ok := parseOggPage(page); ok && granuleRate(p.body) > 0 {
+					vh, headerBuf, headerSet = &headerFinder{}, bytes.Buffer{}, false
+				}
+			}
+			if headerSet {
+				b.PublishAudio(page)
+				continue
+			}
+			vh.feedPage(page)
+			headerBuf.Write(page)
+			if vh.done() {
+				b.SetHeader(headerBuf.Bytes())
+				headerSet = true
+				debugf("Cached %s headers: %d bytes", vh.codec, headerBuf.Len())
+			} else if limit := b.Limits().header; limit > 0 && headerBuf.Len() > limit {
+				log.Printf("Stream headers exceed %d bytes; not caching them", limit)
+				headerBuf = bytes.Buffer{}
+				headerSet = true
+			}
+			b.Publish(page)
+		}
+	}
+}
+
+// ---------------- Spartan handlers ----------------
+
+// Longest a listener is held for the next track with join=track.
+const maxTrackWait = 10 * time.Minute
+
+// joinPoint parses the offset option of a /radio request (offset=SECONDS,
+// or offset=track for the start of the current track) into the time the
+// listener wants to start at; zero means live. An offset past the burst
+// buffer is held to its length, which starts at the oldest page all the
+// same.
+func joinPoint(st *station, q url.Values, now time.Time) (time.Time, error) {
+	switch off := q.Get("offset"); {
+	case off == "" || off == "0":
+		return time.Time{}, nil
+	case off == "track":
+		if st.feed == nil {
+			return time.Time{}, errors.New("offset=track needs the file rotation")
+		}
+		_, started := st.feed.nowPlaying()
+		return started, nil
+	default:
+		secs, err := strconv.ParseFloat(off, 64)
+		if err != nil || secs < 0 || math.IsNaN(secs) || math.IsInf(secs, 0) {
+			return time.Time{}, fmt.Errorf("bad offset %q", off)
+		}
+		back := st.b.BurstLen()
+		if secs < back.Seconds() {
+			back = time.Duration(secs * float64(time.Second))
+		}
+		return now.Add(-back), nil
+	}
+}
+
+// Every write to a listener must make progress within this time.
+const listenerWriteTimeout = 10 * time.Second
+
+// radioReply writes handleRadio's replies in the listener's protocol:
+// Spartan, or HTTP on -http-port.
+type radioReply interface {
+	// ok is the response header of a stream of contentType.
+	ok(st *station, contentType string) string
+	// refuse is a whole reply turning the listener away; temporary when
+	// trying again later may work.
+	refuse(temporary bool, msg string) string
+}
+
+// spartanReply is radioReply for Spartan listeners: a status line.
+type spartanReply struct{}
+
+func (spartanReply) ok(_ *station, contentType string) string { return "2 " + contentType + "\r\n" }
+
+func (spartanReply) refuse(temporary bool, msg string) string {
+	if temporary {
+		return "5 " + msg + "\r\n"
+	}
+	return "4 " + msg + "\r\n"
+}
+
+// handleRadio streams st to conn, with the replies written by reply;
+// verbose logs the connection's lifecycle. opts are the listener's options
+// from the request body or query.
+func handleRadio(conn net.Conn, reply radioReply, st *station, sessions *sessionTable, host, opts string, verbose bool) {
+	b := st.b
+
+	cfg := st.settings()
+	q, err := url.ParseQuery(opts)
+	var since time.Time
+	if err == nil {
+		since, err = joinPoint(st, q, time.Now())
+	}
+	atTrack := cfg.joinAtTrack
+	switch j := q.Get("join"); {
+	case err != nil:
+	case j == "track":
+		atTrack = true
+	case j == "now":
+		atTrack = false
+	case j != "":
+		err = fmt.Errorf("bad join %q", j)
+	}
+	if err == nil && atTrack && !since.IsZero() {
+		if q.Get("join") == "track" {
+			err = errors.New("offset and join=track don't mix")
+		}
+		atTrack = false // an explicit offset wins over the station default
+	}
+	if err != nil {
+		fmt.Fprint(conn, reply.refuse(false, err.Error()))
+		return
+	}
+	// Without an offset, start a little in the past so the decoder has
+	// audio to play before the next live page; offset=0 is strictly live.
+	if since.IsZero() && !atTrack && q.Get("offset") == "" {
+		if d := b.ConnectBurst(); d > 0 {
+			since = time.Now().Add(-d)
+		}
+	}
+
+	// TCP keepalive (kernel probes). Helps with half-open connections.
+	raw := conn
+	if ec, ok := conn.(*egressConn); ok {
+		raw = ec.Conn
+	}
+	if tc, ok := raw.(*net.TCPConn); ok {
+		_ = tc.SetKeepAlive(true)
+		_ = tc.SetKeepAlivePeriod(30 * time.Second)
+	}
+
+	// Nothing is decodable without the headers, which only exist once the
+	// encoder is running. Hold new listeners until then instead of sending
+	// them pages they can't use.
+	select {
+	case <-b.HeaderReady():
+	case <-time.After(cfg.headerWait):
+		fmt.Fprint(conn, reply.refuse(true, "stream is starting; try again in a few seconds"))
+		return
+	}
+
+	remote := conn.RemoteAddr().String()
+	if verbose {
+		log.Printf("Listener connected: %s", remote)
+	}
+	l := st.addListener(remote, host)
+	var sess *listenerSession
+	var sessComments []string
+	var writeErr error
+	if sessions != nil {
+		sess, sessComments = sessions.start(l, st.mount)
+	}
+	defer func() {
+		st.removeListener(l)
+		if sess != nil {
+			sessions.end(sess, writeErr)
+		}
+		if verbose {
+			log.Printf("Listener disconnected: %s", remote)
+		}
+		_ = conn.Close()
+	}()
+
+	writeAll := func(p []byte) error {
+		chaos.stall()
+		_ = conn.SetWriteDeadline(time.Now().Add(listenerWriteTimeout))
+		n, err := conn.Write(p)
+		l.bytes.Add(int64(n))
+		if err != nil {
+			writeErr = err
+		}
+		return err
+	}
+
+	// Response header
+	if err := writeAll([]byte(reply.ok(st, cfg.enc.contentType()))); err != nil {
+		return
+	}
+
+	// Optional preroll: a complete Ogg stream of its own (ending in EOS), so
+	// the live headers below start a new chain link.
+	if cfg.preroll != nil {
+		if pre, err := cfg.preroll.bytes(); err != nil {
+			log.Printf("preroll: %v", err)
+		} else if err := writeAll(pre); err != nil {
+			return
+		}
+	}
+
+	// Joining at a track boundary: hold the listener until the rotation
+	// starts its next track. Live sources have no tracks to wait for.
+	if atTrack && st.feed != nil && strings.HasPrefix(st.onAirLevel(), levelRotation+":") {
+		if verbose {
+			log.Printf("Listener %s waits for the next track", remote)
+		}
+		select {
+		case <-b.NextTrack():
+		case <-time.After(maxTrackWait):
+		}
+	}
+
+	// Send cached Vorbis headers first (late join can decode).
+	if hdr := b.GetHeaderCopy(); len(hdr) > 0 {
+		comments := sessComments
+		var id string
+		if cfg.watermark {
+			id = newListenerID()
+			comments = append(comments, watermarkTag+"="+id)
+		}
+		if len(comments) > 0 {
+			if marked, err := commentHeader(hdr, comments...); err != nil {
+				log.Printf("%v", err)
+			} else {
+				hdr = marked
+				if id != "" {
+					log.Printf("Listener %s watermark: %s=%s", remote, watermarkTag, id)
+				}
+			}
+		}
+		if err := writeAll(hdr); err != nil {
+			return
+		}
+		// Tell track-aware clients what is playing right now.
+		if last := b.getLastTrack(); len(last) > 0 {
+			if err := writeAll(last); err != nil {
+				return
+			}
+		}
+	}
+
+	backlog, sub, cancel := b.SubscribeFrom(context.Background(), since)
+	defer cancel()
+
+	// Join at a page that begins a fresh packet, so a strict decoder never
+	// sees the tail of a packet right after the cached headers.
+	aligned := false
+	send := func(page []byte) bool {
+		if !aligned {
+			if len(page) > 5 && page[5]&0x01 != 0 {
+				return true
+			}
+			aligned = true
+		}
+		return writeAll(page) == nil
+	}
+	for _, page := range backlog {
+		if !send(page) {
+			return
+		}
+	}
+	for page := range sub {
+		if !send(page) {
+			return
+		}
+	}
+}
+
+// Upper bound for Spartan request bodies; only admin commands use them.
+const maxRequestBody = 64 * 1024
+
+type server struct {
+	host     string
+	port     int
+	stations []*station
+	admin    *adminAuth // nil when admin endpoints are disabled
+	started  time.Time
+
+	reqlog   *requestLog
+	upgrade  *upgrader
+	library  *library       // nil without -library
+	schedule []voiceItem    // daily voice items for /schedule
+	loc      *time.Location // station time zone
+
+	// onDemand holds a token per running /play stream; nil when off.
+	onDemand chan struct{}
+
+	skipVotes *skipVotes        // nil without -skip-vote
+	requests  *listenerRequests // nil without -listener-requests
+	polls     *pollBox          // nil without -polls
+
+	archive    *archiver     // nil without -archive-dir
+	archiveKey string        // required on /archive requests; empty = public
+	blog       *broadcastLog // nil without -broadcast-log
+	auditLog   *auditLog     // nil while admin endpoints are off
+	sessions   *sessionTable // nil without -sessions
+	egress     *egressMeter
+	limit      *listenerLimit // nil without -max-listeners or -adaptive-listeners
+
+	// reload re-reads the config file; nil without -config.
+	reload func() ([]configChange, error)
+
+	mu         sync.Mutex
+	streamName string
+	maint      *maintenance // nil unless in maintenance mode
+}
+
+func (srv *server) title() string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.streamName == "" {
+		return "Spartan Radio (Vorbis over Spartan)"
+	}
+	return srv.streamName
+}
+
+func (srv *server) setStreamName(name string) {
+	srv.mu.Lock()
+	srv.streamName = name
+	srv.mu.Unlock()
+}
+
+func (srv *server) station(mount string) *station {
+	for _, st := range srv.stations {
+		if st.mount == mount {
+			return st
+		}
+	}
+	return nil
+}
+
+// bulk marks c as carrying audio, which the egress cap cuts off, or answers
+// it with the cap page and returns false when the cap is near.
+func (srv *server) bulk(c *egressConn) bool {
+	if srv.egress.refuse() {
+		srv.egress.writeCapPage(c, srv.title(), time.Now())
+		return false
+	}
+	c.bulk = true
+	return true
+}
+
+// route names the endpoint serving path, for request statistics.
+func (srv *server) route(path string) string {
+	switch {
+	case path == "/" || path == "/index.gmi" || path == "/index.txt":
+		return "/"
+	case path == "/now":
+		return "/nowplaying"
+	case path == "/stats" || path == "/schedule" || path == "/nowplaying" || path == "/nowplaying.json" || srv.station(path) != nil:
+		return path
+	case path == "/skipvote" && srv.skipVotes != nil:
+		return path
+	case (path == "/request" || path == "/queue") && srv.requests != nil:
+		return path
+	case path == "/history" && srv.stations[0].feed.recent != nil:
+		return path
+	case path == "/polls" && srv.polls != nil:
+		return path
+	case strings.HasPrefix(path, "/poll/") && srv.polls != nil:
+		return "/poll/"
+	case (path == "/library" || path == "/search" || path == "/new") && srv.library != nil:
+		return path
+	case strings.HasPrefix(path, "/play/") && srv.onDemand != nil:
+		return "/play/"
+	case (path == "/archive" || strings.HasPrefix(path, "/archive/")) && srv.archive != nil:
+		return "/archive"
+	case strings.HasPrefix(path, "/session/") && srv.sessions != nil:
+		return "/session/"
+	case strings.HasPrefix(path, "/admin/"):
+		return "/admin/"
+	}
+	return "not found"
+}
+
+func (srv *server) handleRequest(conn net.Conn) {
+	defer conn.Close()
+	ec := &egressConn{Conn: conn, m: srv.egress}
+	conn = ec
+
+	reader := bufio.NewReader(conn)
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return
+	}
+	line = strings.TrimRight(line, "\r\n")
+
+	req, err := parseRequestLine(line)
+	if err != nil {
+		fmt.Fprintf(conn, "4 %v\r\n", err)
+		return
+	}
+	path, contentLen := req.path, req.length
+	if contentLen > maxRequestBody {
+		fmt.Fprintf(conn, "4 request body too large\r\n")
+		return
+	}
+
+	var body []byte
+	if contentLen > 0 {
+		body = make([]byte, contentLen)
+		_, err = io.ReadFull(reader, body)
+		if err != nil {
+			fmt.Fprintf(conn, "5 error reading request body\r\n")
+			return
+		}
+	}
+
+	verbose := srv.reqlog.request(srv.route(path), conn.RemoteAddr().String(), req.target)
+
+	switch {
+	case path == "/" || path == "/index.gmi" || path == "/index.txt":
+		base := fmt.Sprintf("spartan://%s:%d", srv.host, srv.port)
+		index := srv.title() + "\n\n"
+		if m := srv.maintenance(); m != nil {
+			index += "Planned maintenance: " + m.window() + "\n\n"
+		}
+		for i, st := range srv.stations {
+			label := "Tune in"
+			if i > 0 {
+				label = "Tune in: " + st.name
+			}
+			index += "=> " + base + st.mount + " " + label + "\n"
+		}
+		index += "=> " + base + "/nowplaying Now playing\n"
+		if srv.stations[0].feed.recent != nil {
+			index += "=> " + base + "/history Recently played\n"
+		}
+		index += "=> " + base + "/schedule Schedule\n"
+		if srv.requests != nil {
+			index += "=> " + base + "/request Request a track\n"
+		}
+		if srv.library != nil {
+			index += "=> " + base + "/search Search\n"
+			index += "=> " + base + "/library Library\n"
+			index += "=> " + base + "/new New music\n"
+		}
+		if srv.polls != nil {
+			index += "=> " + base + "/polls Polls\n"
+		}
+		if srv.archive != nil && srv.archiveKey == "" {
+			index += "=> " + base + "/archive Archive\n"
+		}
+		fmt.Fprintf(conn, "2 text/gemini; charset=utf-8\r\n%s", index)
+
+	case path == "/stats":
+		srv.writeStats(conn)
+
+	case path == "/library" && srv.library != nil:
+		srv.writeLibrary(conn, req.query, string(body))
+
+	case path == "/new" && srv.library != nil:
+		srv.writeNew(conn, req.query)
+
+	case path == "/schedule":
+		srv.writeSchedule(conn, time.Now().In(srv.loc))
+
+	case path == "/nowplaying" || path == "/now":
+		srv.writeNowPlaying(conn, time.Now().In(srv.loc))
+
+	case path == "/nowplaying.json":
+		srv.writeNowPlayingJSON(conn)
+
+	case path == "/history" && srv.stations[0].feed.recent != nil:
+		srv.writeHistory(conn, time.Now().In(srv.loc))
+
+	case path == "/skipvote" && srv.skipVotes != nil:
+		srv.handleSkipVote(conn, conn.RemoteAddr().String())
+
+	case path == "/request" && srv.requests != nil:
+		input := string(body)
+		if input == "" {
+			input, _ = url.QueryUnescape(req.query)
+		}
+		srv.handleSongRequest(conn, conn.RemoteAddr().String(), input)
+
+	case path == "/queue" && srv.requests != nil:
+		srv.writeQueue(conn)
+
+	case path == "/polls" && srv.polls != nil:
+		srv.writePolls(conn)
+
+	case strings.HasPrefix(path, "/poll/") && srv.polls != nil:
+		input := string(body)
+		if input == "" {
+			input, _ = url.QueryUnescape(req.query)
+		}
+		srv.handlePoll(conn, strings.TrimPrefix(path, "/poll/"), conn.RemoteAddr().String(), input)
+
+	case path == "/search" && srv.library != nil:
+		query := string(body)
+		if query == "" {
+			query, _ = url.QueryUnescape(req.query)
+		}
+		srv.writeSearch(conn, query)
+
+	case strings.HasPrefix(path, "/play/") && srv.onDemand != nil:
+		if !srv.bulk(ec) {
+			return
+		}
+		srv.handlePlay(conn, strings.TrimPrefix(path, "/play/"))
+
+	case (path == "/archive" || strings.HasPrefix(path, "/archive/")) && srv.archive != nil:
+		if strings.HasSuffix(path, ".ogg") && !srv.bulk(ec) {
+			return
+		}
+		srv.handleArchive(conn, path, req.query)
+
+	case strings.HasPrefix(path, "/session/") && srv.sessions != nil:
+		srv.writeSession(conn, strings.TrimPrefix(path, "/session/"), time.Now().In(srv.loc))
+
+	case srv.station(path) != nil:
+		if m := srv.maintenance(); m != nil {
+			m.writePage(conn, srv.title())
+			return
+		}
+		if !srv.admitListener(conn) || !srv.bulk(ec) {
+			return
+		}
+		opts := string(body)
+		if opts == "" {
+			opts = req.query
+		}
+		handleRadio(conn, spartanReply{}, srv.station(path), srv.sessions, req.host, opts, verbose)
+
+	case strings.HasPrefix(path, "/admin/"):
+		srv.handleAdmin(conn, conn.RemoteAddr().String(), req, body)
+
+	default:
+		fmt.Fprintf(conn, "4 not found\r\n")
+	}
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		subcommands := map[string]func([]string) error{
+			"archive-transcode": archiveTranscode,
+			"check-ffmpeg":      checkFFmpeg,
+			"codec-compare":     compareCodecs,
+			"verify-log":        verifyLog,
+		}
+		if run := subcommands[os.Args[1]]; run != nil {
+			if err := run(os.Args[2:]); err != nil {
+				log.Fatalf("%s: %v", os.Args[1], err)
+			}
+			return
+		}
+	}
+
+	musicDirFlag := flag.String("music-dir", "./music", "directory with the music files, of the types in -input-exts (can be a symlink)")
+	inputExtsFlag := flag.String("input-exts", "wav,wave,flac,mp3,ogg,opus", "comma-separated file name extensions taken from -music-dir and playlists")
+	playlistFlag := flag.String("playlist", "", "path to playlist text file (plain paths OR ffmpeg concat format). If set, music-dir scanning is not used.")
+	shuffleFlag := flag.Bool("shuffle", false, "shuffle playlist each cycle")
+	groupBy := flag.String("group-by", groupByTrack, "unit of the rotation: track, or album to shuffle whole albums and play each in track order")
+	pinFirst := flag.String("pin-first", "", "comma-separated files that open every cycle, in this order (e.g. a station intro)")
+	pinLast := flag.String("pin-last", "", "comma-separated files that close every cycle, in this order (e.g. a sign-off)")
+	idsDir := flag.String("ids-dir", "", "directory of station IDs (jingles) inserted between tracks")
+	idEvery := flag.Duration("id-every", 20*time.Minute, "with -ids-dir, play a station ID at least this often (broadcast time)")
+	idMinGap := flag.Duration("id-min-gap", 10*time.Minute, "with -ids-dir, never play station IDs closer together than this")
+	timezone := flag.String("timezone", "", "station time zone (IANA name, e.g. Europe/Berlin) for schedules, /schedule and daily shuffle seeds; empty = the server's local time")
+	rulesFlag := flag.String("rules", "", "file of \"folder rule\" lines limiting when tracks from a folder may start: \"separate 1h\" or \"hours 02:00-05:00\"")
+	voiceSchedule := flag.String("voice-schedule", "", "file of \"HH:MM file\" lines: spoken items played every day at that time")
+	duckDB := flag.Float64("duck-db", 0, "play -voice-schedule items on time over the music, lowered by this many dB (e.g. -12); 0 = wait for the next track instead")
+	recentFlag := flag.Int("recent", 20, "tracks listed on /history (0 = no /history)")
+	historySize := flag.Int("history-size", 0, "with -shuffle, move the last N played files to the end of each new cycle (0 = off)")
+	historyFile := flag.String("history-file", "", "file that keeps the -history-size window across restarts, instead of the -store")
+	libraryFlag := flag.Bool("library", false, "index the tags of the files in rotation and serve a searchable /library")
+	pollsFlag := flag.String("polls", "", "file of polls and feedback forms listeners answer at /polls; answers go to the -store")
+	listenerReqs := flag.Int("listener-requests", 0, "let listeners queue tracks at /request, a search or a file name; at most this many waiting per address (0 = off)")
+	skipVote := flag.Float64("skip-vote", 0, "let listeners vote at /skipvote to skip the current track; skip when this fraction of listeners has voted (0 = off)")
+	onDemand := flag.Int("on-demand", 0, "with -library, let listeners play search results on demand, at most this many at once (0 = off)")
+	headerWait := flag.Duration("header-wait", 10*time.Second, "how long a listener who connects before the stream has headers waits for them before getting a \"try again\" reply")
+	statsExport := flag.String("stats-export", "", "append a snapshot of every station's stats to this local file each -stats-every: CSV for a .csv name, JSON Lines otherwise")
+	statsEvery := flag.Duration("stats-every", time.Minute, "interval of -stats-export snapshots")
+	uniqueListeners := flag.Bool("unique-listeners", true, "count distinct listeners per day with anonymous, daily-salted listener IDs; false = compute no IDs at all")
+	playReportFlag := flag.Bool("play-report", false, "log every file that goes on air (time, tags, ISRC, duration) in the -store for /admin/report")
+	broadcastLogFlag := flag.String("broadcast-log", "", "append every file that goes on air and every admin action to this hash-chained log (check it with verify-log)")
+	lbToken := flag.String("listenbrainz-token", "", "submit every file that goes on air to the ListenBrainz account with this user token, as the station's playlog")
+	lbURL := flag.String("listenbrainz-url", "https://api.listenbrainz.org", "ListenBrainz server for -listenbrainz-token")
+	archiveDir := flag.String("archive-dir", "", "record the broadcast here, one Ogg file per hour or day with a .cue tracklist (empty = off)")
+	archiveEvery := flag.String("archive-every", "hour", "archive segment length: hour or day, in the station time zone")
+	archiveKey := flag.String("archive-key", "", "make /archive private: every request must carry ?key=KEY (empty = public)")
+	newDays := flag.Int("new-days", 14, "with -library, tracks added within this many days are new: listed at /new and boosted by -new-boost")
+	newBoost := flag.Int("new-boost", 1, "with -library, play new tracks this many times per cycle, spread out (1 = like any other track)")
+	storeFlag := flag.String("store", "memory", "storage for state kept across restarts: memory, dir:PATH, bolt:PATH or sqlite:PATH")
+	shuffleSeed := flag.String("shuffle-seed", "", "make -shuffle reproducible: an integer seed, or \"daily\" for a seed from the local date (same order all day, new order each day)")
+	sourceFlag := flag.String("source", "files", "audio source: files (music-dir/playlist), stdin (raw PCM or Ogg), fifo (raw PCM), or live capture via alsa|pulse|pipewire|jack")
+	sourceDevice := flag.String("source-device", "default", "capture device for live sources (e.g. hw:1,0 for alsa, a JACK client name), or the FIFO path for -source fifo")
+	emergencyFlag := flag.String("emergency", "", "emergency input that takes over from every other source while it has data: fifo:PATH")
+	warmupFlag := flag.String("warmup", "", "play silence, tone or tone:HZ from startup until the first track has audio, so listeners get a stream at once")
+	fallbackFlag := flag.String("fallback", "", "comma-separated fallback chain used while the source has no data: silence, playlist, fifo:PATH, alsa:DEV, pulse:DEV, pipewire:DEV, jack:NAME, or a file path (looped); defaults to silence for -source fifo")
+	crossfadeFlag := flag.Duration("crossfade", 2*time.Second, "crossfade length when the fallback chain switches sources")
+
+	port := flag.Int("port", 300, "TCP port to listen on (Spartan default is 300)")
+	httpPort := flag.Int("http-port", 0, "also serve the streams over plain HTTP with Icecast-style headers on this port, for web players (0 = off)")
+	host := flag.String("host", "localhost", "host name to advertise in index (spartan://HOST:PORT/...)")
 
 	ffmpegFlag := flag.String("ffmpeg", "ffmpeg", "path to ffmpeg binary")
 
 	// Output encoding knobs (Vorbis)
-	bitrateKbps := flag.Int("bitrate-kbps", 192, "output Vorbis target bitrate kbps (ffmpeg -b:a). Set 0 to use -vorbis-q")
+	codecFlag := flag.String("codec", "vorbis", "output codec: vorbis or opus")
+	channelsFlag := flag.String("channels", "", "file of \"name query\" lines: tag channels served at /radio/<name>, each playing the library tracks matching the query (needs -library)")
+	lowKbps := flag.Int("low-bitrate-kbps", 0, "also serve "+lowMount+", the same audio encoded at this bitrate kbps; 0 = off")
+	bitrateKbps := flag.Int("bitrate-kbps", 192, "output target bitrate kbps (ffmpeg -b:a). Set 0 to use -vorbis-q (Vorbis only)")
+	sampleRate := flag.Int("sample-rate", 44100, "pipeline sample rate from decode to encode: 44100, or 48000 for libraries mastered at 48 kHz")
 	vorbisQ := flag.Int("vorbis-q", 4, "output Vorbis quality (ffmpeg -q:a), used when -bitrate-kbps=0")
 
 	streamName := flag.String("stream-name", "", "stream title metadata (Vorbis comment) and title shown in /")
+	streamMIME := flag.String("stream-mime", "", "MIME type in the /radio and /play success line, e.g. \"audio/ogg; codecs=vorbis\"; empty derives it from the codec")
 
 	rescan := flag.Duration("rescan", 10*time.Second, "delay when playlist is empty or reload fails")
 
+	trackSignals := flag.Bool("track-signals", false, "multiplex a track-change metadata stream into the Ogg output for track-aware clients")
+	maxListeners := flag.Int("max-listeners", 0, "most listeners across all stations; 0 = no limit")
+	adaptiveListeners := flag.Bool("adaptive-listeners", false, "lower the listener limit when the uplink cannot keep up with everyone, and raise it again while it can")
+	egressCapGB := flag.Float64("egress-cap-gb", 0, "monthly cap on bytes sent, in GB: from 95% new listeners and downloads get a page saying why, at 100% streams are cut; 0 = no cap")
+	sessionsFlag := flag.Bool("sessions", false, "give each listener a session token in the stream header and a /session/<token> page with their own connection stats")
+	watermarkFlag := flag.Bool("watermark", false, "give each listener a unique Vorbis comment in the stream header, logged with their address")
+	prerollFlag := flag.String("preroll", "", "audio file played to each listener before joining the live stream (station ID, welcome message)")
+	maxPageMs := flag.Int("max-page-ms", 0, "split encoder pages so none carries more than this much audio, in ms (0 = pass pages through)")
+	trackComments := flag.Bool("track-comments", false, "encode each track as a link of a chained Ogg stream whose comments carry its title, artist and album")
+	trackEncodeFlag := flag.Bool("track-encode", false, "read per-track encoder settings (bitrate-kbps, channels) from FILE.encode sidecars; such tracks are encoded as links of a chained Ogg stream")
+	joinAtTrack := flag.Bool("join-at-track", false, "hold new listeners until the next track starts instead of joining mid-song (per request: join=track or join=now)")
+	burstFlag := flag.Duration("burst", 0, "keep this much recent audio so that listeners can start in the past with offset=SECONDS or offset=track (0 = off)")
+	connectBurst := flag.Duration("connect-burst", 3*time.Second, "send new listeners this much recent audio right after the headers, so playback starts at once (0 = start live)")
+	maxHeaderKB := flag.Int("max-header-kb", 256, "largest Vorbis header set to cache for late joiners, in KiB (0 = unlimited)")
+	maxBurstKB := flag.Int("max-burst-kb", 16384, "most audio the -burst and -connect-burst buffer holds per mount, in KiB, whatever its length (0 = unlimited)")
+
+	adminSecret := flag.String("admin-secret", "", "shared secret for signed /admin/ requests; admin endpoints are disabled when empty and there are no -admin-tokens")
+	var adminTokenFlag adminTokenList
+	flag.Var(&adminTokenFlag, "admin-tokens", "comma-separated name:role:secret admin tokens, role viewer, dj or admin")
+	adminSkew := flag.Duration("admin-skew", 30*time.Second, "maximum clock skew accepted on signed admin requests")
+
+	simulateFlag := flag.Duration("simulate", 0, "print the programming the rotation, station IDs and voice schedule would produce over this long (e.g. 24h), without playing anything, and exit")
+	lowMemory := flag.Bool("low-memory", false, "shrink buffers and drop the library's search index for boards with little memory (see Low-memory mode)")
+	validateLib := flag.Bool("validate-library", false, "probe every file of the rotation before going on air and log the formats and the unplayable files")
+	validateMaxBad := flag.Float64("validate-max-bad", 0, "with -validate-library, refuse to start when more than this percentage of the library is unplayable (0 = never)")
+	selftestFlag := flag.Bool("selftest", false, "run the pipeline for a few seconds against an internal listener, check the stream, and exit 0 (ok) or 1")
+
+	onEncoderFailure := flag.String("on-encoder-failure", failRestart, "when the encoder exits: restart (the station, in process), failover (restart, then safe encoder settings after repeated failures), or exit (status 1, for a service manager; single station only)")
+	stallTimeout := flag.Duration("stall-timeout", 15*time.Second, "rebuild the pipeline when no audio leaves the server for this long while listeners are connected (0 = off)")
+
+	logLevel := flag.String("log-level", "info", "info: per-minute request counts plus sampled requests; debug: every request and listener change")
+	logSample := flag.Int("log-sample", 100, "at info level, log every Nth request in full (0 = none)")
+
+	upgradeDrain := flag.Duration("upgrade-drain", 30*time.Minute, "after handing over to an upgraded binary (SIGUSR2), keep serving existing listeners for at most this long")
+
+	cpuPressure := flag.Float64("cpu-pressure", 0, "step the encoders down when the one-minute load average per CPU stays above this (0 = off)")
+	cpuPressureFor := flag.Duration("cpu-pressure-for", time.Minute, "how long the load must stay high before the encoders step down")
+	cpuPressureKbps := flag.Int("cpu-pressure-kbps", 64, "bitrate of the stepped-down encoders under CPU pressure")
+	bitrateDrift := flag.Float64("bitrate-drift", 25, "alert when the measured encoder bitrate is more than this many percent off -bitrate-kbps (0 = off)")
+	alertWebhook := flag.String("alert-webhook", "", "URL to POST alerts to as JSON (empty = log only)")
+	stateDir := flag.String("state-dir", "", "directory for state kept across restarts (cached stream headers)")
+
+	configFlag := flag.String("config", "", "file of name = value settings (flag names without the dash); re-read on SIGHUP or /admin/reload")
+
+	// Fault injection for testing; not shown by -help.
+	flag.DurationVar(&chaos.killEncoder, "chaos-kill-encoder", 0, "kill the encoder at random, on average this often")
+	flag.Float64Var(&chaos.corruptPages, "chaos-corrupt-pages", 0, "corrupt this fraction of encoder pages")
+	flag.DurationVar(&chaos.slowWrites, "chaos-slow-listeners", 0, "delay every write to a listener by this much")
+	flag.Float64Var(&chaos.vanish, "chaos-vanish", 0, "make this fraction of the rotation's files vanish")
+	hideChaosFlags()
+
 	flag.Parse()
+	if os.Getenv(envPrefix+"CONTAINER") == "1" {
+		containerDefaults(containerStateDir)
+	}
+	if err := applyEnv(os.Environ()); err != nil {
+		log.Fatalf("environment: %v", err)
+	}
+	if chaos.enabled() {
+		log.Printf("chaos: fault injection enabled (kill-encoder=%s corrupt-pages=%g slow-listeners=%s vanish=%g)",
+			chaos.killEncoder, chaos.corruptPages, chaos.slowWrites, chaos.vanish)
+	}
+
+	switch *logLevel {
+	case "info":
+	case "debug":
+		logDebug = true
+	default:
+		log.Fatalf("bad -log-level %q: want info or debug", *logLevel)
+	}
+
+	var cf *configFile
+	if *configFlag != "" {
+		var err error
+		if cf, err = loadConfigFile(*configFlag); err != nil {
+			log.Fatalf("config: %v", err)
+		}
+	}
+
+	if err := setPCMRate(*sampleRate); err != nil {
+		log.Fatalf("-sample-rate: %v", err)
+	}
+	if *lowMemory {
+		useLowMemory()
+		capLowMemory(maxHeaderKB, maxBurstKB, burstFlag, connectBurst)
+		log.Printf("Low-memory mode")
+	}
+	// limits reads the buffer caps from the flags, which a reload changes.
+	limits := func() bufferLimits {
+		return bufferLimits{header: *maxHeaderKB * 1024, burst: *maxBurstKB * 1024}
+	}
+
+	var src pcmSource
+	var oggInput io.Reader
+	switch *sourceFlag {
+	case "files":
+	case "stdin":
+		// Ogg from stdin is broadcast as is; anything else is taken as PCM.
+		in := bufio.NewReaderSize(os.Stdin, 64*1024)
+		if magic, _ := in.Peek(4); bytes.Equal(magic, []byte("OggS")) {
+			oggInput = in
+		} else {
+			src = &stdinSource{r: in}
+		}
+	case "fifo":
+		src = &fifoSource{path: *sourceDevice}
+	default:
+		var err error
+		src, err = newCaptureSource(*ffmpegFlag, *sourceFlag, *sourceDevice)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	root := ""
 	var err error
-	if *playlistFlag == "" {
+	if inputExts, err = parseInputExts(*inputExtsFlag); err != nil {
+		log.Fatalf("-input-exts: %v", err)
+	}
+	root := ""
+	if src == nil && oggInput == nil && *playlistFlag == "" {
 		root, err = resolveRoot(*musicDirFlag)
 		if err != nil {
 			log.Fatalf("failed to resolve music-dir %q: %v", *musicDirFlag, err)
 		}
-	} else {
+	} else if *playlistFlag != "" {
 		// Resolve playlist path to absolute for stable base dir resolution.
 		if abs, e := filepath.Abs(*playlistFlag); e == nil {
 			*playlistFlag = abs
 		}
 	}
 
+	// The rotation's source; a config reload may point it elsewhere.
+	var smu sync.Mutex
+	listPath, musicDir := *playlistFlag, root
 	loadList := func() ([]string, error) {
-		if *playlistFlag != "" {
-			return readPlaylistFile(*playlistFlag)
+		smu.Lock()
+		list, dir := listPath, musicDir
+		smu.Unlock()
+		if list != "" {
+			return readPlaylistFile(list)
+		}
+		return buildWavListFromDir(dir)
+	}
+
+	// Any source can drop out; a FIFO without a writer always falls back,
+	// to silence unless something else is configured.
+	fd := &feeder{
+		ffmpegPath: *ffmpegFlag,
+		loadList:   chaos.vanishing(loadList),
+		shuffle:    *shuffleFlag,
+		rescan:     *rescan,
+		baseDir:    root,
+	}
+	if err := checkGroupBy(*groupBy); err != nil {
+		log.Fatalf("-group-by: %v", err)
+	}
+	if fd.albums = *groupBy == groupByAlbum; fd.albums {
+		log.Printf("Album mode: the rotation plays whole albums")
+	}
+	loc := time.Local
+	if *timezone != "" {
+		if loc, err = time.LoadLocation(*timezone); err != nil {
+			log.Fatalf("bad -timezone: %v", err)
+		}
+	}
+	if fd.seed, err = parseShuffleSeed(*shuffleSeed, loc); err != nil {
+		log.Fatal(err)
+	}
+	resolvePins := func(list string) []string {
+		var out []string
+		for _, p := range strings.Split(list, ",") {
+			if p = strings.TrimSpace(p); p == "" {
+				continue
+			}
+			abs, err := fd.resolve(p)
+			if err != nil {
+				log.Fatalf("pinned track: %v", err)
+			}
+			out = append(out, abs)
+		}
+		return out
+	}
+	fd.pinFirst, fd.pinLast = resolvePins(*pinFirst), resolvePins(*pinLast)
+	if *idsDir != "" {
+		dir, err := resolveRoot(*idsDir)
+		if err != nil {
+			log.Fatalf("failed to resolve ids-dir %q: %v", *idsDir, err)
+		}
+		if *idMinGap > *idEvery {
+			log.Fatalf("-id-min-gap (%s) is longer than -id-every (%s)", *idMinGap, *idEvery)
+		}
+		fd.ids = newIDScheduler(dir, *idEvery, *idMinGap)
+		log.Printf("Station IDs from %s: no more than %s apart, no less than %s apart", dir, *idEvery, *idMinGap)
+	}
+	var mix *mixer
+	var schedule []voiceItem
+	if *voiceSchedule != "" {
+		items, err := readVoiceSchedule(*voiceSchedule, loc, fd.resolve)
+		if err != nil {
+			log.Fatalf("voice schedule: %v", err)
+		}
+		fire := func(path string) {
+			log.Printf("Scheduled voice item: %s", path)
+			fd.enqueueEvent(path)
+		}
+		switch {
+		case *duckDB > 0:
+			log.Fatalf("-duck-db must be negative")
+		case *duckDB < 0:
+			mix = newMixer()
+			mix.channel("music", 0, 0)
+			voice := mix.channel("voice", 0, *duckDB)
+			fire = func(path string) {
+				log.Printf("Scheduled voice item: %s", path)
+				if err := voice.playFile(*ffmpegFlag, path); err != nil {
+					log.Printf("voice item %s: %v", path, err)
+				}
+			}
+		}
+		go runVoiceSchedule(items, fire)
+		schedule = items
+		log.Printf("Voice schedule: %d items from %s", len(items), *voiceSchedule)
+	}
+	db, err := openStore(*storeFlag)
+	if err != nil {
+		log.Fatalf("store: %v", err)
+	}
+	if fd.health, err = loadFileHealth(db); err != nil {
+		log.Fatalf("quarantine: %v", err)
+	}
+	if *validateLib && src == nil && oggInput == nil {
+		files, err := loadList()
+		if err != nil {
+			log.Fatalf("-validate-library: %v", err)
+		}
+		workers := runtime.NumCPU()
+		if *lowMemory {
+			workers = 1
+		}
+		rep := validateLibrary(*ffmpegFlag, files, workers)
+		rep.log()
+		if *validateMaxBad > 0 && rep.badPercent() > *validateMaxBad {
+			log.Fatalf("Library check: %.1f%% of the library is unplayable, more than -validate-max-bad %g%%", rep.badPercent(), *validateMaxBad)
+		}
+	}
+	if *recentFlag > 0 {
+		fd.recent = &recentPlays{size: *recentFlag}
+	}
+	if *historySize > 0 {
+		hdb, bucket, key := db, "history", "radio"
+		if *historyFile != "" {
+			// A single file of its own, as before -store existed.
+			if hdb, err = openDirStore(filepath.Dir(*historyFile)); err != nil {
+				log.Fatalf("history: %v", err)
+			}
+			bucket, key = "", filepath.Base(*historyFile)
+		}
+		if fd.history, err = loadPlayHistory(hdb, bucket, key, *historySize); err != nil {
+			log.Fatalf("history: %v", err)
+		}
+	}
+	if *libraryFlag && src == nil && oggInput == nil {
+		fd.lib = newLibrary(db)
+		fd.lib.noIndex = *lowMemory
+		fd.lib.newWithin = time.Duration(*newDays) * 24 * time.Hour
+		fd.newBoost = *newBoost
+	}
+	if *playReportFlag && src == nil && oggInput == nil {
+		fd.report = &playReport{db: db, loc: loc}
+	}
+	if *lbToken != "" && src == nil && oggInput == nil {
+		fd.playlog = newListenBrainz(*lbURL, *lbToken, db)
+		log.Printf("ListenBrainz playlog: %s", *lbURL)
+	}
+	if *playlistFlag != "" {
+		fd.baseDir = filepath.Dir(*playlistFlag)
+	}
+	if *rulesFlag != "" {
+		if fd.rules, err = readRules(*rulesFlag, fd.baseDir, loc); err != nil {
+			log.Fatalf("-rules: %v", err)
+		}
+		log.Printf("Rotation rules: %d from %s", len(fd.rules.rules), *rulesFlag)
+	}
+	if *simulateFlag > 0 {
+		if src != nil || oggInput != nil {
+			log.Fatalf("-simulate needs -source files")
+		}
+		if err := simulate(os.Stdout, fd, schedule, *duckDB < 0, time.Now().In(loc), *simulateFlag); err != nil {
+			log.Fatalf("simulate: %v", err)
+		}
+		os.Exit(0)
+	}
+	var playlist pcmSource
+	if src == nil && oggInput == nil {
+		playlist = &playlistSource{feed: fd}
+	}
+	var fallbacks []pcmSource
+	if *fallbackFlag == "" && *sourceFlag == "fifo" {
+		*fallbackFlag = "silence"
+	}
+	if *fallbackFlag != "" && oggInput == nil {
+		for _, spec := range strings.Split(*fallbackFlag, ",") {
+			fb, err := parseSourceSpec(strings.TrimSpace(spec), *ffmpegFlag, playlist)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fallbacks = append(fallbacks, fb)
+		}
+	}
+	var emergency pcmSource
+	if *emergencyFlag != "" && oggInput == nil {
+		path, ok := strings.CutPrefix(*emergencyFlag, "fifo:")
+		if !ok || path == "" {
+			log.Fatalf("-emergency: want fifo:PATH, got %q", *emergencyFlag)
+		}
+		emergency = &fifoSource{path: path}
+	}
+	if err := checkCodec(*codecFlag, *bitrateKbps); err != nil {
+		log.Fatalf("-codec: %v", err)
+	}
+	if err := checkStreamMIME(*streamMIME, *codecFlag); err != nil {
+		log.Fatalf("-stream-mime: %v", err)
+	}
+	var warmup pcmSource
+	if *warmupFlag != "" && oggInput == nil {
+		switch hz, isTone := strings.CutPrefix(*warmupFlag, "tone"); {
+		case *warmupFlag == "silence":
+			warmup = silenceSource{}
+		case isTone && hz == "":
+			warmup = toneSource{hz: 440}
+		case isTone && strings.HasPrefix(hz, ":"):
+			f, err := strconv.ParseFloat(hz[1:], 64)
+			if err != nil || f <= 0 || f >= 20000 {
+				log.Fatalf("-warmup: bad tone frequency %q", hz[1:])
+			}
+			warmup = toneSource{hz: f}
+		default:
+			log.Fatalf("-warmup: want silence, tone or tone:HZ, got %q", *warmupFlag)
 		}
-		return buildWavListFromDir(root)
 	}
 
-	b := NewBroadcaster()
-	go b.Run()
+	st := &station{
+		name:  "radio",
+		mount: "/radio",
+		b:     NewBroadcaster(limits()),
+		cfg: stationConfig{
+			enc: encoderConfig{
+				ffmpegPath:  *ffmpegFlag,
+				codecName:   *codecFlag,
+				bitrateKbps: *bitrateKbps,
+				vorbisQ:     *vorbisQ,
+				streamName:  *streamName,
+				mime:        *streamMIME,
+			},
+			rescan:     *rescan,
+			fade:       *crossfadeFlag,
+			maxPageMs:  *maxPageMs,
+			watermark:  *watermarkFlag,
+			headerWait: *headerWait,
+
+			joinAtTrack:   *joinAtTrack,
+			trackComments: *trackComments,
+			trackEncode:   *trackEncodeFlag,
+		},
+		feed:      fd,
+		source:    src,
+		emergency: emergency,
+		warmup:    warmup,
+		meter:     &levelMeter{},
+		fallbacks: fallbacks,
+		oggInput:  oggInput,
+		mix:       mix,
+		restart:   make(chan struct{}, 1),
+
+		onEncoderFailure: *onEncoderFailure,
+	}
+	if *uniqueListeners {
+		st.uniques = newUniqueCounter(loc)
+	}
+	st.b.SetBurst(*burstFlag)
+	st.b.SetConnectBurst(*connectBurst)
+	switch *onEncoderFailure {
+	case failExit, failRestart, failFailover:
+	default:
+		log.Fatalf("bad -on-encoder-failure %q: want exit, restart or failover", *onEncoderFailure)
+	}
+	if *trackSignals {
+		st.b.tracks = make(chan trackInfo, 16)
+	}
+	var arch *archiver
+	if *archiveDir != "" {
+		if arch, err = newArchiver(*archiveDir, *archiveEvery, loc, st.b); err != nil {
+			log.Fatalf("-archive-dir: %v", err)
+		}
+	}
+	var blog *broadcastLog
+	if *broadcastLogFlag != "" {
+		if blog, err = openBroadcastLog(*broadcastLogFlag); err != nil {
+			log.Fatalf("-broadcast-log: %v", err)
+		}
+		blog.add(blogEntry{Event: "start"})
+		log.Printf("Broadcast log: %s", *broadcastLogFlag)
+	}
+	fd.onTrack = func(path string) {
+		var tags *trackTags
+		if *trackComments {
+			t := linkTags(path)
+			tags = &t
+		}
+		var enc trackEncode
+		if *trackEncodeFlag {
+			var err error
+			if enc, err = readTrackEncode(path); err != nil {
+				log.Printf("-track-encode: %v; using the station's settings", err)
+			}
+		}
+		for _, t := range append([]*station{st}, st.tees...) {
+			t.nextLink(tags, enc)
+			t.b.TrackStarted()
+			if t.b.tracks != nil {
+				select {
+				case t.b.tracks <- newTrackInfo(path):
+				default:
+				}
+			}
+		}
+		if blog != nil {
+			blog.track(st.mount, path)
+		}
+		if arch != nil {
+			arch.track(path)
+		}
+	}
+	if *prerollFlag != "" {
+		st.cfg.preroll = &preroll{path: *prerollFlag, enc: st.cfg.enc}
+		log.Printf("Preroll: %s", *prerollFlag)
+	}
 
-	// Start one encoder ffmpeg and never restart it (unless it crashes).
-	encCfg := encoderConfig{
-		ffmpegPath:  *ffmpegFlag,
-		bitrateKbps: *bitrateKbps,
-		vorbisQ:     *vorbisQ,
-		streamName:  *streamName,
+	if *lowKbps > 0 && oggInput == nil {
+		if err := checkCodec(*codecFlag, *lowKbps); err != nil {
+			log.Fatalf("-low-bitrate-kbps: %v", err)
+		}
+		low := newLowStation(st, *lowKbps)
+		if *uniqueListeners {
+			low.uniques = newUniqueCounter(loc)
+		}
+		low.b.SetBurst(*burstFlag)
+		low.b.SetConnectBurst(*connectBurst)
+		if *trackSignals {
+			low.b.tracks = make(chan trackInfo, 16)
+		}
+		st.tees = append(st.tees, low)
+		log.Printf("Low-bitrate mount: %s at %dk", low.mount, *lowKbps)
 	}
 
-	cmd, stdin, stdout, err := startEncoder(encCfg)
-	if err != nil {
-		log.Fatalf("failed to start ffmpeg encoder: %v", err)
+	var channels []*station
+	if *channelsFlag != "" {
+		if fd.lib == nil {
+			log.Fatalf("-channels needs -library and the file rotation")
+		}
+		defs, err := readChannels(*channelsFlag)
+		if err != nil {
+			log.Fatalf("-channels: %v", err)
+		}
+		for _, def := range defs {
+			ch := newChannel(def, st, fd.lib)
+			if *uniqueListeners {
+				ch.uniques = newUniqueCounter(loc)
+			}
+			ch.b.SetBurst(*burstFlag)
+			ch.b.SetConnectBurst(*connectBurst)
+			if *trackSignals {
+				ch.b.tracks = make(chan trackInfo, 16)
+			}
+			channels = append(channels, ch)
+			log.Printf("Channel %s: %s", ch.mount, def.query)
+		}
+	}
+	// Every station with an encoder of its own.
+	pipelines := append([]*station{st}, channels...)
+	if *onEncoderFailure == failExit && (len(st.tees) > 0 || len(channels) > 0) {
+		log.Fatalf("-on-encoder-failure exit would take every station down with one encoder; use restart or failover with -low-bitrate-kbps or -channels")
 	}
 
-	// Feed WAVs into encoder stdin forever (in background).
-	go feedWavForever(*ffmpegFlag, stdin, loadList, *shuffleFlag, *rescan)
+	if *stateDir != "" && oggInput == nil {
+		for _, t := range append(append([]*station{st}, st.tees...), channels...) {
+			t.loadHeader(*stateDir)
+		}
+	}
 
-	// Broadcast encoder stdout (in background).
-	go func() {
-		err := broadcastFromEncoder(stdout, b)
-		if err != nil && !errors.Is(err, io.EOF) {
-			log.Printf("encoder stdout ended: %v", err)
+	// Start one encoder ffmpeg; the station supervisor only restarts the
+	// pipeline if one of its goroutines stops or panics.
+	for _, t := range pipelines {
+		p, err := t.startPipeline()
+		if err != nil {
+			log.Fatalf("failed to start ffmpeg encoder: %v", err)
 		}
-		// If encoder dies, exit the whole program (better than silently serving dead air).
-		_ = cmd.Process.Kill()
-		os.Exit(1)
-	}()
+		go t.run(p)
+		if *stallTimeout > 0 && oggInput == nil {
+			go t.watch(*stallTimeout)
+		}
+	}
+	if *cpuPressure > 0 && oggInput == nil {
+		if _, err := readLoad(); err != nil {
+			log.Fatalf("-cpu-pressure: %v", err)
+		}
+		if err := checkCodec(*codecFlag, *cpuPressureKbps); err != nil {
+			log.Fatalf("-cpu-pressure-kbps: %v", err)
+		}
+		g := &cpuGovernor{threshold: *cpuPressure, hold: *cpuPressureFor, kbps: *cpuPressureKbps, stations: pipelines}
+		go g.run()
+		log.Printf("CPU pressure: down to %d kbps above load %.2f per CPU", *cpuPressureKbps, *cpuPressure)
+	}
+	if *bitrateDrift > 0 && oggInput == nil {
+		alerts := newAlerter(*alertWebhook)
+		for _, t := range append(append([]*station{st}, st.tees...), channels...) {
+			go t.watchBitrate(*bitrateDrift, alerts)
+		}
+	}
+
+	if *selftestFlag {
+		if err := selftest(st, selftestDuration); err != nil {
+			log.Printf("Self-test failed: %v", err)
+			os.Exit(1)
+		}
+		log.Printf("Self-test passed")
+		os.Exit(0)
+	}
 
 	addr := fmt.Sprintf(":%d", *port)
-	ln, err := net.Listen("tcp", addr)
+	ln, err := inheritedListener()
 	if err != nil {
-		log.Fatalf("failed to listen on %s: %v", addr, err)
+		log.Fatalf("failed to take over listener: %v", err)
+	}
+	if ln == nil {
+		ln, err = net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatalf("failed to listen on %s: %v", addr, err)
+		}
+	} else {
+		log.Printf("Took over listener %s from the previous process", ln.Addr())
 	}
 
 	log.Printf("Spartan Radio listening on spartan://%s:%d/", *host, *port)
-	if *playlistFlag != "" {
+	var httpLn net.Listener
+	if *httpPort > 0 {
+		if httpLn, err = inheritedHTTPListener(); err != nil {
+			log.Fatalf("failed to take over HTTP listener: %v", err)
+		}
+		if httpLn == nil {
+			if httpLn, err = net.Listen("tcp", fmt.Sprintf(":%d", *httpPort)); err != nil {
+				log.Fatalf("-http-port: %v", err)
+			}
+		}
+		log.Printf("HTTP output on http://%s:%d/", *host, *httpPort)
+	}
+	if oggInput != nil {
+		log.Printf("Live source: Ogg from stdin (not re-encoded)")
+	} else if src != nil {
+		log.Printf("Live source: %s", src)
+	} else if *playlistFlag != "" {
 		log.Printf("Playlist file: %s", *playlistFlag)
 	} else {
 		log.Printf("Serving from (resolved): %s", root)
 	}
-	log.Printf("Output: audio/ogg (vorbis), shuffle=%v, ffmpeg=%s", *shuffleFlag, *ffmpegFlag)
+	if oggInput == nil && (emergency != nil || warmup != nil || len(fallbacks) > 0) {
+		log.Printf("Source priorities: %s", describeLevels(st.levels()))
+	}
+	log.Printf("Output: %s (%s, %d Hz), shuffle=%v, ffmpeg=%s", st.cfg.enc.contentType(), st.cfg.enc.codec(), pcmRate, *shuffleFlag, *ffmpegFlag)
+	if *shuffleFlag && *shuffleSeed != "" {
+		log.Printf("Shuffle seed: %s", *shuffleSeed)
+	}
 	if *bitrateKbps > 0 {
-		log.Printf("Vorbis bitrate: %dk", *bitrateKbps)
+		log.Printf("Bitrate: %dk", *bitrateKbps)
 	} else {
 		log.Printf("Vorbis quality: %d", *vorbisQ)
 	}
@@ -690,12 +2583,235 @@ func main() {
 		log.Printf("Stream name: %s", *streamName)
 	}
 
+	srv := &server{
+		host:       *host,
+		port:       *port,
+		streamName: *streamName,
+		stations:   append(append([]*station{st}, st.tees...), channels...),
+		started:    time.Now(),
+		reqlog:     newRequestLog(*logSample),
+		schedule:   schedule,
+		loc:        loc,
+		blog:       blog,
+	}
+	go srv.reqlog.run(time.Minute)
+	if *egressCapGB < 0 {
+		log.Fatalf("-egress-cap-gb must not be negative")
+	}
+	srv.egress = newEgressMeter(db, loc, int64(*egressCapGB*1e9))
+	go srv.egress.run()
+	if *egressCapGB > 0 {
+		log.Printf("Egress cap: %s a month", sizeText(srv.egress.cap))
+	}
+	if *maxListeners < 0 {
+		log.Fatalf("-max-listeners must not be negative")
+	}
+	if *maxListeners > 0 || *adaptiveListeners {
+		srv.limit = newListenerLimit(*maxListeners, *adaptiveListeners)
+		go srv.limit.run(srv.stations)
+	}
+	if *sessionsFlag {
+		srv.sessions = newSessionTable(*host, *port)
+	}
+	if arch != nil {
+		srv.archive, srv.archiveKey = arch, *archiveKey
+		go arch.run(srv.title)
+		log.Printf("Archive: %s, a file per %s", *archiveDir, *archiveEvery)
+	}
+	if *pollsFlag != "" {
+		polls, err := readPolls(*pollsFlag)
+		if err != nil {
+			log.Fatalf("-polls: %v", err)
+		}
+		srv.polls = newPollBox(db, polls)
+		log.Printf("Polls: %d from %s", len(polls), *pollsFlag)
+	}
+	switch {
+	case *skipVote > 1 || *skipVote < 0:
+		log.Fatalf("-skip-vote: want a fraction between 0 and 1, got %g", *skipVote)
+	case *skipVote > 0 && src == nil && oggInput == nil:
+		srv.skipVotes = newSkipVotes(*skipVote)
+		log.Printf("Skip voting: %g of listeners", *skipVote)
+	}
+	switch {
+	case *listenerReqs < 0:
+		log.Fatalf("-listener-requests: want 0 or more, got %d", *listenerReqs)
+	case *listenerReqs > 0 && src == nil && oggInput == nil:
+		srv.requests = newListenerRequests(*listenerReqs)
+		log.Printf("Listener requests: %d waiting per address", *listenerReqs)
+	}
+	if *statsExport != "" {
+		go srv.runStatsExport(*statsExport, *statsEvery)
+		log.Printf("Stats export: %s every %s", *statsExport, *statsEvery)
+	}
+	if fd.lib != nil {
+		srv.library = fd.lib
+		go srv.library.run(loadList, libraryRescan)
+		if *onDemand > 0 {
+			srv.onDemand = make(chan struct{}, *onDemand)
+		}
+	}
+	// With a config file, a reload can add the first token.
+	if tokens := adminTokens(*adminSecret, &adminTokenFlag); len(tokens) > 0 || cf != nil {
+		srv.admin = newAdminAuth(tokens, *adminSkew)
+		srv.auditLog = &auditLog{db: db, loc: loc}
+		if len(tokens) > 0 {
+			log.Printf("Admin endpoints enabled, %d tokens (skew %s)", len(tokens), *adminSkew)
+		}
+	}
+
+	if cf != nil {
+		cf.apply = func(restart bool) {
+			if *lowMemory {
+				capLowMemory(maxHeaderKB, maxBurstKB, burstFlag, connectBurst)
+			}
+			for _, t := range pipelines {
+				t.feed.setRotation(*shuffleFlag, *rescan)
+			}
+			if src == nil && oggInput == nil {
+				list, dir, base := *playlistFlag, musicDir, fd.dir()
+				if list != "" {
+					if abs, err := filepath.Abs(list); err == nil {
+						list = abs
+					}
+					base = filepath.Dir(list)
+				} else if d, err := resolveRoot(*musicDirFlag); err != nil {
+					log.Printf("-music-dir: %v; keeping %s", err, musicDir)
+				} else {
+					dir, base = d, d
+				}
+				smu.Lock()
+				listPath, musicDir = list, dir
+				smu.Unlock()
+				fd.setDir(base)
+			}
+			st.b.SetLimits(limits())
+			if srv.admin != nil {
+				srv.admin.setSkew(*adminSkew)
+				srv.admin.setTokens(adminTokens(*adminSecret, &adminTokenFlag))
+			}
+			srv.setStreamName(*streamName)
+
+			cfg := st.settings()
+			if err := checkCodec(cfg.enc.codec(), *bitrateKbps); err != nil {
+				log.Printf("-bitrate-kbps: %v; keeping %d", err, cfg.enc.bitrateKbps)
+			} else {
+				cfg.enc.bitrateKbps = *bitrateKbps
+			}
+			cfg.enc.vorbisQ, cfg.enc.streamName = *vorbisQ, *streamName
+			if err := checkStreamMIME(*streamMIME, cfg.enc.codec()); err != nil {
+				log.Printf("-stream-mime: %v; keeping %q", err, cfg.enc.contentType())
+			} else {
+				cfg.enc.mime = *streamMIME
+			}
+			cfg.rescan, cfg.fade = *rescan, *crossfadeFlag
+			cfg.maxPageMs, cfg.watermark = *maxPageMs, *watermarkFlag
+			cfg.joinAtTrack = *joinAtTrack
+			switch {
+			case *prerollFlag == "":
+				cfg.preroll = nil
+			case cfg.preroll == nil || cfg.preroll.path != *prerollFlag || cfg.preroll.enc != cfg.enc:
+				cfg.preroll = &preroll{path: *prerollFlag, enc: cfg.enc}
+			}
+			st.setSettings(cfg)
+			for _, t := range st.tees {
+				t.b.SetLimits(limits())
+				t.setSettings(lowConfig(cfg, *lowKbps, t.settings().preroll))
+			}
+			for _, ch := range channels {
+				ch.b.SetLimits(limits())
+				ch.setSettings(cfg)
+			}
+
+			if restart && oggInput == nil {
+				for _, t := range pipelines {
+					t.requestRestart()
+				}
+			}
+		}
+		srv.reload = cf.reload
+		log.Printf("Config file: %s (reload with SIGHUP)", *configFlag)
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				changes, err := cf.reload()
+				if err != nil {
+					log.Printf("Config reload failed: %v", err)
+				}
+				srv.audit(auditEntry{Action: "reload", Detail: reloadDetail(changes, err), Remote: "SIGHUP"})
+			}
+		}()
+	}
+
+	saveState := func() {
+		srv.egress.save(time.Now())
+		if *stateDir == "" {
+			return
+		}
+		for _, st := range srv.stations {
+			if err := st.saveHeader(*stateDir); err != nil {
+				log.Printf("%s: saving header: %v", st.name, err)
+			}
+		}
+	}
+	srv.upgrade = &upgrader{ln: ln.(*net.TCPListener), drain: *upgradeDrain, prepare: saveState}
+	if httpLn != nil {
+		srv.upgrade.httpLn = httpLn.(*net.TCPListener)
+		go srv.serveHTTP(httpLn)
+	}
+	if *sourceFlag == "stdin" {
+		srv.upgrade.blocked = "cannot hand over stdin input"
+	}
+	if strings.HasPrefix(*storeFlag, "bolt:") {
+		srv.upgrade.blocked = "cannot hand over a bolt store, which one process holds at a time"
+	}
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	go func() {
+		for range usr2 {
+			if err := srv.upgrade.upgrade(); err != nil {
+				log.Printf("Upgrade failed: %v", err)
+			}
+		}
+	}()
+
+	// SIGUSR1 is /admin/skip for whoever may signal the process, with no
+	// admin secret needed.
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	go func() {
+		for range usr1 {
+			st := srv.stations[0]
+			if !st.feed.skip() {
+				log.Printf("SIGUSR1: nothing to skip on %s", st.mount)
+				continue
+			}
+			log.Printf("SIGUSR1: skipped current track on %s", st.mount)
+			srv.audit(auditEntry{Action: "skip", Detail: st.mount, Remote: "SIGUSR1"})
+		}
+	}()
+
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-term
+		log.Printf("Caught %s; shutting down", sig)
+		saveState()
+		os.Exit(0)
+	}()
+
+	notifyParentReady()
 	for {
 		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			srv.drainAndExit(srv.upgrade.drain)
+		}
 		if err != nil {
 			log.Printf("accept error: %v", err)
 			continue
 		}
-		go handleRequest(conn, b, *host, *port, *streamName)
+		go srv.handleRequest(conn)
 	}
 }
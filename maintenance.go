@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// ---------------- maintenance mode ----------------
+
+// In maintenance mode, listeners that are already connected keep streaming,
+// but new stream requests get a gemtext page announcing the downtime window
+// instead, so the audience can move elsewhere before a planned restart.
+// It is switched on with /admin/maintenance and ends with
+// /admin/maintenance/off or when the window is over.
+
+type maintenance struct {
+	start, end time.Time
+	message    string
+}
+
+// parseMaintenance reads an admin payload: a first line "START END" in
+// RFC 3339 (START may be "now"), optionally followed by a message.
+func parseMaintenance(payload string, now time.Time) (*maintenance, error) {
+	first, message, _ := strings.Cut(payload, "\n")
+	f := strings.Fields(first)
+	if len(f) != 2 {
+		return nil, fmt.Errorf("expected \"START END\" on the first line")
+	}
+	m := &maintenance{start: now, message: strings.TrimSpace(message)}
+	var err error
+	if f[0] != "now" {
+		if m.start, err = time.Parse(time.RFC3339, f[0]); err != nil {
+			return nil, fmt.Errorf("bad start time: %v", err)
+		}
+	}
+	if m.end, err = time.Parse(time.RFC3339, f[1]); err != nil {
+		return nil, fmt.Errorf("bad end time: %v", err)
+	}
+	if !m.end.After(m.start) {
+		return nil, fmt.Errorf("end is not after start")
+	}
+	return m, nil
+}
+
+func (m *maintenance) window() string {
+	const layout = "2006-01-02 15:04 MST"
+	return m.start.UTC().Format(layout) + " to " + m.end.UTC().Format(layout)
+}
+
+func (m *maintenance) writePage(w io.Writer, title string) {
+	fmt.Fprintf(w, "2 text/gemini; charset=utf-8\r\n")
+	fmt.Fprintf(w, "# %s: down for maintenance\n\n", title)
+	if m.message != "" {
+		fmt.Fprintf(w, "%s\n\n", m.message)
+	}
+	fmt.Fprintf(w, "Planned downtime: %s\n", m.window())
+}
+
+// maintenance returns the active maintenance window; it ends by itself once
+// the window is over.
+func (srv *server) maintenance() *maintenance {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.maint != nil && time.Now().After(srv.maint.end) {
+		srv.maint = nil
+	}
+	return srv.maint
+}
+
+func (srv *server) setMaintenance(m *maintenance) {
+	srv.mu.Lock()
+	srv.maint = m
+	srv.mu.Unlock()
+}
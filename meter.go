@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------- level meter ----------------
+
+// The level meter watches the PCM going into the encoder and keeps the peak
+// of every half second for the last meterWindows of them, which /nowplaying
+// draws as a small ASCII waveform.
+
+const (
+	meterWindow  = time.Second / 2
+	meterWindows = 64
+
+	// Quietest level drawn; anything below is a flat line.
+	meterFloorDB = -48.0
+)
+
+type levelMeter struct {
+	mu    sync.Mutex
+	peaks []uint16 // finished windows, oldest first
+	cur   uint16   // peak of the window in progress
+	pos   int      // bytes into it
+	odd   []byte   // half a sample left over from the last write
+}
+
+// meterWriter feeds everything written to w through m.
+type meterWriter struct {
+	w io.Writer
+	m *levelMeter
+}
+
+func (mw meterWriter) Write(p []byte) (int, error) {
+	n, err := mw.w.Write(p)
+	mw.m.feed(p[:n])
+	return n, err
+}
+
+func (m *levelMeter) feed(p []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.odd) > 0 {
+		p = append(m.odd, p...)
+		m.odd = nil
+	}
+	for ; len(p) >= 2; p = p[2:] {
+		v := int32(int16(binary.LittleEndian.Uint16(p)))
+		m.cur = max(m.cur, uint16(min(32767, max(v, -v))))
+		if m.pos += 2; m.pos >= pcmBytes(meterWindow) {
+			m.peaks = append(m.peaks, m.cur)
+			if len(m.peaks) > meterWindows {
+				m.peaks = m.peaks[1:]
+			}
+			m.cur, m.pos = 0, 0
+		}
+	}
+	if len(p) == 1 {
+		m.odd = []byte{p[0]}
+	}
+}
+
+// levels returns the recent window peaks, oldest first, scaled to 0..1 on a
+// decibel scale from meterFloorDB to full scale.
+func (m *levelMeter) levels() []float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]float64, len(m.peaks))
+	for i, pk := range m.peaks {
+		if pk == 0 {
+			continue
+		}
+		db := 20 * math.Log10(float64(pk)/32767)
+		out[i] = min(1, max(0, (db-meterFloorDB)/-meterFloorDB))
+	}
+	return out
+}
+
+// waveformArt draws levels as a waveform mirrored around a center line,
+// height rows above and below it.
+func waveformArt(levels []float64, height int) []string {
+	bars := make([]int, len(levels))
+	for i, l := range levels {
+		bars[i] = int(math.Round(l * float64(height)))
+	}
+	var rows []string
+	row := func(h int) string {
+		var sb strings.Builder
+		for _, b := range bars {
+			if b >= h {
+				sb.WriteByte('|')
+			} else {
+				sb.WriteByte(' ')
+			}
+		}
+		return strings.TrimRight(sb.String(), " ")
+	}
+	for h := height; h >= 1; h-- {
+		rows = append(rows, row(h))
+	}
+	rows = append(rows, strings.Repeat("-", len(bars)))
+	for h := 1; h <= height; h++ {
+		rows = append(rows, row(h))
+	}
+	return rows
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// ---------------- mixer ----------------
+
+// mixer combines several PCM inputs (music, voice, jingles, live input) into
+// the single stream the encoder reads. Each input is a channel with its own
+// gain; a channel can also duck the others by some dB while it is playing.
+// Gain changes are ramped over mixRamp so nothing clicks.
+//
+// The mixer runs on its own real-time clock. Producers write into a channel
+// and block when it holds mixBuffer of audio; a channel that runs dry is
+// silent until mixPrebuffer has built up again (or its producer has paused),
+// which absorbs the jitter between the producers' pacing and the mixer's.
+type mixer struct {
+	mu       sync.Mutex
+	space    *sync.Cond // signalled when channel buffers drain
+	channels []*mixChannel
+	stopped  bool // no run is consuming; writes fail
+}
+
+const (
+	mixBuffer    = time.Second // per channel
+	mixPrebuffer = 200 * time.Millisecond
+	mixRamp      = 300 * time.Millisecond
+	mixTick      = 20 * time.Millisecond // per mixing step
+)
+
+func newMixer() *mixer {
+	m := &mixer{stopped: true}
+	m.space = sync.NewCond(&m.mu)
+	return m
+}
+
+// mixChannel is one mixer input. It is an io.Writer of pipeline PCM.
+type mixChannel struct {
+	m    *mixer
+	name string
+	gain float64 // linear
+	duck float64 // linear gain this channel imposes on the others while playing
+
+	buf       []byte
+	primed    bool
+	lastWrite time.Time
+	cur       float64  // current ducking gain applied to this channel
+	partial   []byte   // incomplete frame from the last write
+	proc      *mixProc // decoder started by playFile, if any
+}
+
+// channel adds an input with gain and duck given in dB (0 = unchanged).
+func (m *mixer) channel(name string, gainDB, duckDB float64) *mixChannel {
+	c := &mixChannel{m: m, name: name, gain: dbGain(gainDB), duck: dbGain(duckDB), cur: 1}
+	m.mu.Lock()
+	m.channels = append(m.channels, c)
+	m.mu.Unlock()
+	return c
+}
+
+func dbGain(db float64) float64 { return math.Pow(10, db/20) }
+
+func (c *mixChannel) Write(p []byte) (int, error) {
+	m := c.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data := append(c.partial, p...)
+	whole := len(data) &^ 3
+	c.partial = append([]byte(nil), data[whole:]...)
+	data = data[:whole]
+	for len(data) > 0 {
+		for len(c.buf) >= pcmBytes(mixBuffer) && !m.stopped {
+			m.space.Wait()
+		}
+		if m.stopped {
+			return 0, errFeederStopped
+		}
+		n := min(len(data), pcmBytes(mixBuffer)-len(c.buf))
+		c.buf = append(c.buf, data[:n]...)
+		data = data[n:]
+		c.lastWrite = time.Now()
+	}
+	return len(p), nil
+}
+
+// reset drops whatever the channel has buffered.
+func (c *mixChannel) reset() {
+	c.m.mu.Lock()
+	c.buf, c.partial, c.primed = nil, nil, false
+	c.m.mu.Unlock()
+	c.m.space.Broadcast()
+}
+
+// playFile decodes path into c as fast as the mixer takes it, replacing
+// anything c was playing. Used for voice items and jingles.
+func (c *mixChannel) playFile(ffmpegPath, path string) error {
+	cmd := exec.Command(ffmpegPath,
+		"-hide_banner", "-loglevel", "warning",
+		"-i", path,
+	)
+	cmd.Args = append(cmd.Args, pcmOutputArgs(path)...)
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = c
+
+	c.m.mu.Lock()
+	old := c.proc
+	c.proc = nil
+	c.m.mu.Unlock()
+	if old != nil {
+		_ = old.cmd.Process.Kill()
+		<-old.done
+	}
+	c.reset()
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	p := &mixProc{cmd: cmd, done: make(chan struct{})}
+	c.m.mu.Lock()
+	c.proc = p
+	c.m.mu.Unlock()
+	go func() {
+		_ = cmd.Wait()
+		close(p.done)
+	}()
+	log.Printf("Mixer %s: %s", c.name, path)
+	return nil
+}
+
+type mixProc struct {
+	cmd  *exec.Cmd
+	done chan struct{}
+}
+
+// open empties the channels and lets writes through again; call it before
+// starting run and the producers.
+func (m *mixer) open() {
+	m.mu.Lock()
+	for _, c := range m.channels {
+		c.buf, c.partial, c.primed = nil, nil, false
+	}
+	m.stopped = false
+	m.mu.Unlock()
+}
+
+// input is the channel the station's feeder writes to.
+func (m *mixer) input() *mixChannel { return m.channels[0] }
+
+// run mixes all channels into w in real time until w fails or stop closes.
+// Writes fail once it has returned.
+func (m *mixer) run(w io.Writer, stop <-chan struct{}) error {
+	defer func() {
+		m.mu.Lock()
+		m.stopped = true
+		m.mu.Unlock()
+		m.space.Broadcast()
+	}()
+
+	start := time.Now()
+	var sent int64
+	out := make([]byte, pcmBytes(mixTick))
+	for {
+		due := time.Duration(sent) * time.Second / time.Duration(pcmBytesPerSecond)
+		if wait := due - time.Since(start); wait > 0 {
+			select {
+			case <-stop:
+				return errFeederStopped
+			case <-time.After(wait):
+			}
+		}
+		m.mix(out)
+		if _, err := w.Write(out); err != nil {
+			log.Printf("encoder write failed: %v", err)
+			return &sinkError{err}
+		}
+		sent += int64(len(out))
+	}
+}
+
+// mix fills out with the next step of mixed audio.
+func (m *mixer) mix(out []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Which channels play this step, and how much they duck the others.
+	playing := make([]bool, len(m.channels))
+	for i, c := range m.channels {
+		if !c.primed && len(c.buf) > 0 && (len(c.buf) >= pcmBytes(mixPrebuffer) || time.Since(c.lastWrite) > 100*time.Millisecond) {
+			c.primed = true
+		}
+		if c.primed && len(c.buf) == 0 {
+			c.primed = false
+		}
+		playing[i] = c.primed
+	}
+
+	acc := make([]float64, len(out)/2)
+	for i, c := range m.channels {
+		target := 1.0
+		for j, o := range m.channels {
+			if j != i && playing[j] {
+				target = min(target, o.duck)
+			}
+		}
+		n := 0
+		if playing[i] {
+			n = min(len(c.buf), len(out))
+		}
+		step := 4.0 / float64(pcmBytes(mixRamp)) // per frame
+		for k := 0; k < len(out); k += 4 {
+			switch {
+			case c.cur > target:
+				c.cur = max(c.cur-step, target)
+			case c.cur < target:
+				c.cur = min(c.cur+step, target)
+			}
+			if k >= n {
+				continue
+			}
+			g := c.gain * c.cur
+			acc[k/2] += float64(int16(binary.LittleEndian.Uint16(c.buf[k:]))) * g
+			acc[k/2+1] += float64(int16(binary.LittleEndian.Uint16(c.buf[k+2:]))) * g
+		}
+		c.buf = c.buf[n:]
+	}
+	for i, v := range acc {
+		binary.LittleEndian.PutUint16(out[2*i:], uint16(clamp16(v)))
+	}
+	m.space.Broadcast()
+}
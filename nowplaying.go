@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ---------------- now playing ----------------
+
+// /nowplaying (or /now) is the listener-facing page about the track on air;
+// /nowplaying.json has the same facts for clients that draw their own
+// progress bar. Elapsed time counts the PCM fed to the encoder, so it stays
+// right across underruns and skips; the length comes from the file header
+// and is missing for formats audioDuration can't read.
+
+type nowPlayingJSON struct {
+	Mount     string      `json:"mount"`
+	Playing   bool        `json:"playing"`
+	Title     string      `json:"title,omitempty"`
+	Started   string      `json:"started,omitempty"`
+	Elapsed   float64     `json:"elapsed_seconds"`
+	Duration  float64     `json:"duration_seconds,omitempty"`
+	Remaining *float64    `json:"remaining_seconds,omitempty"` // with duration only
+	Format    *formatJSON `json:"format,omitempty"`
+}
+
+// writeNowPlaying renders /nowplaying with now in the station time zone.
+func (srv *server) writeNowPlaying(w io.Writer, now time.Time) {
+	st := srv.stations[0]
+	fmt.Fprintf(w, "2 text/gemini; charset=utf-8\r\n")
+	fmt.Fprintf(w, "# %s: now playing\n\n", srv.title())
+	track, since := st.feed.nowPlaying()
+	if track == "" {
+		fmt.Fprintf(w, "Nothing is playing.\n")
+		return
+	}
+	fmt.Fprintf(w, "%s, since %s\n", srv.itemTitle(track), since.In(now.Location()).Format("15:04"))
+	if elapsed, length := st.feed.progress(); length > 0 {
+		fmt.Fprintf(w, "%s of %s, %s to go\n", lengthText(elapsed), lengthText(length), lengthText(max(0, length-elapsed)))
+	} else {
+		fmt.Fprintf(w, "%s so far\n", lengthText(elapsed))
+	}
+	if f, _, ok := st.format(); ok {
+		fmt.Fprintf(w, "Stream: %s\n", f)
+	}
+	if levels := st.meter.levels(); len(levels) > 0 {
+		fmt.Fprintf(w, "\n```levels of the last %d seconds\n", int((time.Duration(len(levels)) * meterWindow).Seconds()))
+		for _, row := range waveformArt(levels, 4) {
+			fmt.Fprintf(w, "%s\n", row)
+		}
+		fmt.Fprintf(w, "```\n")
+	}
+	if srv.skipVotes != nil {
+		n := len(st.listenerAddrs())
+		fmt.Fprintf(w, "\nSkip votes: %d of %d needed\n", srv.skipVotes.count(track, since), srv.skipVotes.needed(n))
+		fmt.Fprintf(w, "=> /skipvote Vote to skip\n")
+	}
+	if srv.requests != nil {
+		fmt.Fprintf(w, "\n=> /queue Up next\n")
+		fmt.Fprintf(w, "=: /request Request a track\n")
+	}
+}
+
+// writeNowPlayingJSON renders /nowplaying.json.
+func (srv *server) writeNowPlayingJSON(w io.Writer) {
+	st := srv.stations[0]
+	np := nowPlayingJSON{Mount: st.mount}
+	if f, since, ok := st.format(); ok {
+		np.Format = f.json(since)
+	}
+	if track, since := st.feed.nowPlaying(); track != "" {
+		elapsed, length := st.feed.progress()
+		np.Playing = true
+		np.Title = srv.itemTitle(track)
+		np.Started = since.UTC().Format(time.RFC3339)
+		np.Elapsed = elapsed.Seconds()
+		if length > 0 {
+			np.Duration = length.Seconds()
+			left := max(0, length-elapsed).Seconds()
+			np.Remaining = &left
+		}
+	}
+	out, err := json.Marshal(np)
+	if err != nil {
+		fmt.Fprintf(w, "5 %v\r\n", err)
+		return
+	}
+	fmt.Fprintf(w, "2 application/json\r\n%s\n", out)
+}
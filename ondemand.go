@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// ---------------- play on demand ----------------
+
+// With -on-demand N, /play/<id> streams a single library track to the
+// listener, encoded with the live encoder settings as fast as the connection
+// takes it. Every request runs its own ffmpeg, so at most N run at once;
+// further requests are turned away until one finishes.
+
+func (srv *server) handlePlay(conn net.Conn, id string) {
+	t := srv.library.track(id)
+	if t == nil {
+		fmt.Fprintf(conn, "4 no such track\r\n")
+		return
+	}
+	select {
+	case srv.onDemand <- struct{}{}:
+		defer func() { <-srv.onDemand }()
+	default:
+		fmt.Fprintf(conn, "4 too many on-demand streams; try again later\r\n")
+		return
+	}
+
+	enc := srv.stations[0].settings().enc
+	args := []string{"-hide_banner", "-loglevel", "warning", "-i", t.Path}
+	args = append(args, enc.outputArgs()...)
+	args = append(args, "pipe:1")
+	cmd := exec.Command(enc.ffmpegPath, args...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		log.Printf("on demand %s: %v", t.Path, err)
+		fmt.Fprintf(conn, "5 encoder unavailable\r\n")
+		return
+	}
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	debugf("On demand: %s to %s", t.Path, conn.RemoteAddr())
+	if _, err := fmt.Fprintf(conn, "2 %s\r\n", enc.contentType()); err != nil {
+		return
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := out.Read(buf)
+		if n > 0 {
+			_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		if rerr != nil {
+			if rerr != io.EOF {
+				log.Printf("on demand %s: %v", t.Path, rerr)
+			}
+			return
+		}
+	}
+}
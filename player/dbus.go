@@ -0,0 +1,473 @@
+package main
+
+import (
+  "bufio"
+  "encoding/binary"
+  "encoding/hex"
+  "errors"
+  "fmt"
+  "io"
+  "math"
+  "net"
+  "os"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+)
+
+// A minimal D-Bus client, just enough to publish an MPRIS object on the
+// session bus without pulling in a D-Bus library: SASL EXTERNAL auth,
+// little-endian messages, and the handful of types MPRIS uses.
+
+const (
+  dbusMethodCall   = 1
+  dbusMethodReturn = 2
+  dbusError        = 3
+  dbusSignal       = 4
+
+  dbusNoReplyExpected = 0x1
+)
+
+// Header field codes.
+const (
+  dbusFieldPath        = 1
+  dbusFieldInterface   = 2
+  dbusFieldMember      = 3
+  dbusFieldErrorName   = 4
+  dbusFieldReplySerial = 5
+  dbusFieldDestination = 6
+  dbusFieldSender      = 7
+  dbusFieldSignature   = 8
+)
+
+// dbusVariant is a value of type v.
+type dbusVariant struct {
+  sig string
+  v   any
+}
+
+// dbusObjectPath is a value of type o.
+type dbusObjectPath string
+
+type dbusMsg struct {
+  typ, flags byte
+  serial     uint32
+  fields     map[byte]any
+  sig        string
+  body       []byte
+}
+
+func (m *dbusMsg) str(code byte) string {
+  switch v := m.fields[code].(type) {
+  case string:
+    return v
+  case dbusObjectPath:
+    return string(v)
+  }
+  return ""
+}
+
+// args decodes a body made only of strings.
+func (m *dbusMsg) args() ([]string, error) {
+  d := &dbusDec{buf: m.body}
+  var out []string
+  for _, c := range m.sig {
+    if c != 's' {
+      return out, fmt.Errorf("unexpected argument type %c", c)
+    }
+    s, err := d.str()
+    if err != nil {
+      return out, err
+    }
+    out = append(out, s)
+  }
+  return out, nil
+}
+
+// ---- encoding ----
+
+type dbusEnc struct {
+  buf []byte
+}
+
+func (e *dbusEnc) align(n int) {
+  for len(e.buf)%n != 0 {
+    e.buf = append(e.buf, 0)
+  }
+}
+
+func (e *dbusEnc) u32(v uint32) {
+  e.align(4)
+  e.buf = binary.LittleEndian.AppendUint32(e.buf, v)
+}
+
+func (e *dbusEnc) str(s string) {
+  e.u32(uint32(len(s)))
+  e.buf = append(append(e.buf, s...), 0)
+}
+
+func (e *dbusEnc) sig(s string) {
+  e.buf = append(append(append(e.buf, byte(len(s))), s...), 0)
+}
+
+// put appends v as a value of D-Bus type sig.
+func (e *dbusEnc) put(sig string, v any) {
+  switch sig {
+  case "y":
+    e.buf = append(e.buf, v.(byte))
+  case "b":
+    b := uint32(0)
+    if v.(bool) {
+      b = 1
+    }
+    e.u32(b)
+  case "u":
+    e.u32(v.(uint32))
+  case "x":
+    e.align(8)
+    e.buf = binary.LittleEndian.AppendUint64(e.buf, uint64(v.(int64)))
+  case "d":
+    e.align(8)
+    e.buf = binary.LittleEndian.AppendUint64(e.buf, math.Float64bits(v.(float64)))
+  case "s":
+    e.str(v.(string))
+  case "o":
+    e.str(string(v.(dbusObjectPath)))
+  case "g":
+    e.sig(v.(string))
+  case "v":
+    dv := v.(dbusVariant)
+    e.sig(dv.sig)
+    e.put(dv.sig, dv.v)
+  case "as":
+    ss := v.([]string)
+    e.array(4, func() {
+      for _, s := range ss {
+        e.str(s)
+      }
+    })
+  case "a{sv}":
+    m := v.(map[string]dbusVariant)
+    keys := make([]string, 0, len(m))
+    for k := range m {
+      keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    e.array(8, func() {
+      for _, k := range keys {
+        e.align(8)
+        e.str(k)
+        e.put("v", m[k])
+      }
+    })
+  default:
+    panic("dbus: unsupported type " + sig)
+  }
+}
+
+// array writes an array whose elements align to elemAlign.
+func (e *dbusEnc) array(elemAlign int, elems func()) {
+  e.u32(0)
+  at := len(e.buf) - 4
+  e.align(elemAlign)
+  start := len(e.buf)
+  elems()
+  binary.LittleEndian.PutUint32(e.buf[at:], uint32(len(e.buf)-start))
+}
+
+// ---- decoding ----
+
+type dbusDec struct {
+  buf []byte
+  pos int
+}
+
+var errDbusShort = errors.New("dbus: short message")
+
+func (d *dbusDec) align(n int) {
+  for d.pos%n != 0 {
+    d.pos++
+  }
+}
+
+func (d *dbusDec) u32() (uint32, error) {
+  d.align(4)
+  if d.pos+4 > len(d.buf) {
+    return 0, errDbusShort
+  }
+  v := binary.LittleEndian.Uint32(d.buf[d.pos:])
+  d.pos += 4
+  return v, nil
+}
+
+func (d *dbusDec) str() (string, error) {
+  n, err := d.u32()
+  if err != nil {
+    return "", err
+  }
+  if d.pos+int(n)+1 > len(d.buf) {
+    return "", errDbusShort
+  }
+  s := string(d.buf[d.pos : d.pos+int(n)])
+  d.pos += int(n) + 1
+  return s, nil
+}
+
+func (d *dbusDec) sig() (string, error) {
+  if d.pos >= len(d.buf) {
+    return "", errDbusShort
+  }
+  n := int(d.buf[d.pos])
+  if d.pos+1+n+1 > len(d.buf) {
+    return "", errDbusShort
+  }
+  s := string(d.buf[d.pos+1 : d.pos+1+n])
+  d.pos += n + 2
+  return s, nil
+}
+
+// variant decodes the basic types found in message headers.
+func (d *dbusDec) variant() (any, error) {
+  sig, err := d.sig()
+  if err != nil {
+    return nil, err
+  }
+  switch sig {
+  case "s":
+    return d.str()
+  case "o":
+    s, err := d.str()
+    return dbusObjectPath(s), err
+  case "g":
+    return d.sig()
+  case "u":
+    return d.u32()
+  }
+  return nil, fmt.Errorf("dbus: unsupported header type %q", sig)
+}
+
+// ---- connection ----
+
+type dbusConn struct {
+  c  net.Conn
+  br *bufio.Reader
+
+  mu     sync.Mutex // serializes writes
+  serial uint32
+}
+
+// sessionBusAddr returns the unix socket of the session bus.
+func sessionBusAddr() (string, error) {
+  addr := os.Getenv("DBUS_SESSION_BUS_ADDRESS")
+  if addr == "" {
+    p := fmt.Sprintf("/run/user/%d/bus", os.Getuid())
+    if _, err := os.Stat(p); err != nil {
+      return "", errors.New("no session bus (DBUS_SESSION_BUS_ADDRESS is not set)")
+    }
+    return p, nil
+  }
+  for _, a := range strings.Split(addr, ";") {
+    kind, params, _ := strings.Cut(a, ":")
+    if kind != "unix" {
+      continue
+    }
+    for _, kv := range strings.Split(params, ",") {
+      k, v, _ := strings.Cut(kv, "=")
+      switch k {
+      case "path":
+        return v, nil
+      case "abstract":
+        return "@" + v, nil
+      }
+    }
+  }
+  return "", fmt.Errorf("unsupported session bus address %q", addr)
+}
+
+// dialSessionBus connects and authenticates to the session bus and says
+// Hello.
+func dialSessionBus() (*dbusConn, error) {
+  addr, err := sessionBusAddr()
+  if err != nil {
+    return nil, err
+  }
+  c, err := net.Dial("unix", addr)
+  if err != nil {
+    return nil, err
+  }
+  uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+  if _, err := fmt.Fprintf(c, "\x00AUTH EXTERNAL %s\r\n", uid); err != nil {
+    c.Close()
+    return nil, err
+  }
+  br := bufio.NewReader(c)
+  line, err := br.ReadString('\n')
+  if err != nil || !strings.HasPrefix(line, "OK ") {
+    c.Close()
+    return nil, fmt.Errorf("dbus auth failed: %q %v", strings.TrimSpace(line), err)
+  }
+  if _, err := io.WriteString(c, "BEGIN\r\n"); err != nil {
+    c.Close()
+    return nil, err
+  }
+  dc := &dbusConn{c: c, br: br}
+  if err := dc.call("org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "Hello", ""); err != nil {
+    c.Close()
+    return nil, err
+  }
+  return dc, nil
+}
+
+// send writes one message with the given header fields and body.
+func (dc *dbusConn) send(typ, flags byte, fields map[byte]dbusVariant, sig string, args ...any) error {
+  body := &dbusEnc{}
+  i := 0
+  for i < len(sig) {
+    n := dbusTypeLen(sig[i:])
+    body.put(sig[i:i+n], args[0])
+    args = args[1:]
+    i += n
+  }
+  if sig != "" {
+    fields[dbusFieldSignature] = dbusVariant{"g", sig}
+  }
+
+  dc.mu.Lock()
+  defer dc.mu.Unlock()
+  dc.serial++
+  e := &dbusEnc{}
+  e.buf = append(e.buf, 'l', typ, flags, 1)
+  e.u32(uint32(len(body.buf)))
+  e.u32(dc.serial)
+  codes := make([]int, 0, len(fields))
+  for c := range fields {
+    codes = append(codes, int(c))
+  }
+  sort.Ints(codes)
+  e.array(8, func() {
+    for _, c := range codes {
+      e.align(8)
+      e.buf = append(e.buf, byte(c))
+      e.put("v", fields[byte(c)])
+    }
+  })
+  e.align(8)
+  e.buf = append(e.buf, body.buf...)
+  _, err := dc.c.Write(e.buf)
+  return err
+}
+
+// dbusTypeLen returns the length of the first complete type in sig.
+func dbusTypeLen(sig string) int {
+  switch sig[0] {
+  case 'a':
+    return 1 + dbusTypeLen(sig[1:])
+  case '{', '(':
+    depth := 0
+    for i := 0; i < len(sig); i++ {
+      switch sig[i] {
+      case '{', '(':
+        depth++
+      case '}', ')':
+        if depth--; depth == 0 {
+          return i + 1
+        }
+      }
+    }
+  }
+  return 1
+}
+
+// call sends a method call without waiting for the reply.
+func (dc *dbusConn) call(dest, path, iface, member, sig string, args ...any) error {
+  return dc.send(dbusMethodCall, dbusNoReplyExpected, map[byte]dbusVariant{
+    dbusFieldDestination: {"s", dest},
+    dbusFieldPath:        {"o", dbusObjectPath(path)},
+    dbusFieldInterface:   {"s", iface},
+    dbusFieldMember:      {"s", member},
+  }, sig, args...)
+}
+
+// reply answers the method call m.
+func (dc *dbusConn) reply(m *dbusMsg, sig string, args ...any) error {
+  if m.flags&dbusNoReplyExpected != 0 {
+    return nil
+  }
+  return dc.send(dbusMethodReturn, dbusNoReplyExpected, map[byte]dbusVariant{
+    dbusFieldReplySerial: {"u", m.serial},
+    dbusFieldDestination: {"s", m.str(dbusFieldSender)},
+  }, sig, args...)
+}
+
+// replyError answers the method call m with a D-Bus error.
+func (dc *dbusConn) replyError(m *dbusMsg, name, text string) error {
+  if m.flags&dbusNoReplyExpected != 0 {
+    return nil
+  }
+  return dc.send(dbusError, dbusNoReplyExpected, map[byte]dbusVariant{
+    dbusFieldReplySerial: {"u", m.serial},
+    dbusFieldDestination: {"s", m.str(dbusFieldSender)},
+    dbusFieldErrorName:   {"s", name},
+  }, "s", text)
+}
+
+// signal emits a signal from path.
+func (dc *dbusConn) signal(path, iface, member, sig string, args ...any) error {
+  return dc.send(dbusSignal, dbusNoReplyExpected, map[byte]dbusVariant{
+    dbusFieldPath:      {"o", dbusObjectPath(path)},
+    dbusFieldInterface: {"s", iface},
+    dbusFieldMember:    {"s", member},
+  }, sig, args...)
+}
+
+// read returns the next incoming message.
+func (dc *dbusConn) read() (*dbusMsg, error) {
+  var fixed [16]byte
+  if _, err := io.ReadFull(dc.br, fixed[:]); err != nil {
+    return nil, err
+  }
+  if fixed[0] != 'l' {
+    return nil, errors.New("dbus: big-endian messages are not supported")
+  }
+  bodyLen := binary.LittleEndian.Uint32(fixed[4:])
+  fieldsLen := binary.LittleEndian.Uint32(fixed[12:])
+  if bodyLen > 1<<20 || fieldsLen > 1<<16 {
+    return nil, errors.New("dbus: message too large")
+  }
+  headerLen := 16 + int(fieldsLen)
+  headerLen += (8 - headerLen%8) % 8
+  buf := make([]byte, headerLen+int(bodyLen))
+  copy(buf, fixed[:])
+  if _, err := io.ReadFull(dc.br, buf[16:]); err != nil {
+    return nil, err
+  }
+
+  m := &dbusMsg{
+    typ:    fixed[1],
+    flags:  fixed[2],
+    serial: binary.LittleEndian.Uint32(fixed[8:]),
+    fields: make(map[byte]any),
+    body:   buf[headerLen:],
+  }
+  d := &dbusDec{buf: buf[:16+fieldsLen], pos: 16}
+  for d.pos < len(d.buf) {
+    d.align(8)
+    if d.pos >= len(d.buf) {
+      break
+    }
+    code := d.buf[d.pos]
+    d.pos++
+    v, err := d.variant()
+    if err != nil {
+      return nil, err
+    }
+    m.fields[code] = v
+  }
+  if s, ok := m.fields[dbusFieldSignature].(string); ok {
+    m.sig = s
+  }
+  return m, nil
+}
+
+func (dc *dbusConn) close() error { return dc.c.Close() }
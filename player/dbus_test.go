@@ -0,0 +1,256 @@
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "encoding/hex"
+  "net"
+  "reflect"
+  "strings"
+  "testing"
+)
+
+// The messages below were captured off a socket from dbus-send (libdbus),
+// busctl (sd-bus) and gdbus (GDBus), so they pin the marshaller to what real
+// implementations put on the wire rather than to itself.
+
+// libdbusSeeked is
+// dbus-send --type=signal /org/mpris/MediaPlayer2 org.mpris.MediaPlayer2.Player.Seeked int64:5000000
+var libdbusSeeked = []string{
+  "6c040101 08000000 02000000 5f000000",
+  "01016f00 17000000 2f6f7267 2f6d7072",
+  "69732f4d 65646961 506c6179 65723200",
+  "02017300 1d000000 6f72672e 6d707269",
+  "732e4d65 64696150 6c617965 72322e50",
+  "6c617965 72000000 03017300 06000000",
+  "5365656b 65640000 08016700 01780000",
+  "404b4c00 00000000",
+}
+
+// libdbusGet is
+// dbus-send --dest=org.mpris.MediaPlayer2.swp /org/mpris/MediaPlayer2 org.freedesktop.DBus.Properties.Get string:org.mpris.MediaPlayer2.Player string:PlaybackStatus
+var libdbusGet = []string{
+  "6c010001 37000000 02000000 88000000",
+  "01016f00 17000000 2f6f7267 2f6d7072",
+  "69732f4d 65646961 506c6179 65723200",
+  "02017300 1f000000 6f72672e 66726565",
+  "6465736b 746f702e 44427573 2e50726f",
+  "70657274 69657300 03017300 03000000",
+  "47657400 00000000 06017300 1a000000",
+  "6f72672e 6d707269 732e4d65 64696150",
+  "6c617965 72322e73 77700000 00000000",
+  "08016700 02737300 1d000000 6f72672e",
+  "6d707269 732e4d65 64696150 6c617965",
+  "72322e50 6c617965 72000000 0e000000",
+  "506c6179 6261636b 53746174 757300",
+}
+
+// busctlGet is the same call from busctl --expect-reply=no, which orders
+// the header fields differently and sets flags 0x5.
+var busctlGet = []string{
+  "6c010501 37000000 02000000 88000000",
+  "01016f00 17000000 2f6f7267 2f6d7072",
+  "69732f4d 65646961 506c6179 65723200",
+  "03017300 03000000 47657400 00000000",
+  "02017300 1f000000 6f72672e 66726565",
+  "6465736b 746f702e 44427573 2e50726f",
+  "70657274 69657300 06017300 1a000000",
+  "6f72672e 6d707269 732e4d65 64696150",
+  "6c617965 72322e73 77700000 00000000",
+  "08016700 02737300 1d000000 6f72672e",
+  "6d707269 732e4d65 64696150 6c617965",
+  "72322e50 6c617965 72000000 0e000000",
+  "506c6179 6261636b 53746174 757300",
+}
+
+// gdbusPropertiesChanged is
+// gdbus emit --object-path /org/mpris/MediaPlayer2 --signal org.freedesktop.DBus.Properties.PropertiesChanged
+// with the properties in gdbusChanged. Its body starts at byte 136.
+var gdbusPropertiesChanged = []string{
+  "6c040101 6c010000 02000000 72000000",
+  "01016f00 17000000 2f6f7267 2f6d7072",
+  "69732f4d 65646961 506c6179 65723200",
+  "02017300 1f000000 6f72672e 66726565",
+  "6465736b 746f702e 44427573 2e50726f",
+  "70657274 69657300 08016700 0873617b",
+  "73767d61 73000000 03017300 11000000",
+  "50726f70 65727469 65734368 616e6765",
+  "64000000 00000000 1d000000 6f72672e",
+  "6d707269 732e4d65 64696150 6c617965",
+  "72322e50 6c617965 72000000 40010000",
+  "07000000 43616e50 6c617900 01620000",
+  "01000000 00000000 08000000 4d657461",
+  "64617461 0005617b 73767d00 b2000000",
+  "0c000000 6d707269 733a6c65 6e677468",
+  "00017800 00000000 c0a3d00c 00000000",
+  "0d000000 6d707269 733a7472 61636b69",
+  "6400016f 00000000 1f000000 2f6f7267",
+  "2f6d7072 69732f4d 65646961 506c6179",
+  "6572322f 74726163 6b2f3300 00000000",
+  "0c000000 78657361 6d3a6172 74697374",
+  "00026173 00000000 10000000 0b000000",
+  "4e696e61 2053696d 6f6e6500 00000000",
+  "0b000000 78657361 6d3a7469 746c6500",
+  "01730000 09000000 53696e6e 65726d61",
+  "6e000000 00000000 0e000000 506c6179",
+  "6261636b 53746174 75730001 73000000",
+  "07000000 506c6179 696e6700 00000000",
+  "08000000 506f7369 74696f6e 00017800",
+  "404b4c00 00000000 06000000 566f6c75",
+  "6d650001 64000000 00000000 0000f03f",
+  "00000000",
+}
+
+var gdbusChanged = map[string]dbusVariant{
+  "CanPlay": {"b", true},
+  "Metadata": {"a{sv}", map[string]dbusVariant{
+    "mpris:length":  {"x", int64(215000000)},
+    "mpris:trackid": {"o", dbusObjectPath("/org/mpris/MediaPlayer2/track/3")},
+    "xesam:artist":  {"as", []string{"Nina Simone"}},
+    "xesam:title":   {"s", "Sinnerman"},
+  }},
+  "PlaybackStatus": {"s", "Playing"},
+  "Position":       {"x", int64(5000000)},
+  "Volume":         {"d", 1.0},
+}
+
+// gdbusVariant is the body of a gdbus signal whose only argument is
+// <'Playing'>.
+var gdbusVariant = []string{
+  "01730000 07000000 506c6179 696e6700",
+}
+
+func unhex(t *testing.T, lines []string) []byte {
+  t.Helper()
+  b, err := hex.DecodeString(strings.ReplaceAll(strings.Join(lines, ""), " ", ""))
+  if err != nil {
+    t.Fatal(err)
+  }
+  return b
+}
+
+// recordConn keeps what is written to it.
+type recordConn struct {
+  net.Conn
+  buf bytes.Buffer
+}
+
+func (c *recordConn) Write(p []byte) (int, error) { return c.buf.Write(p) }
+
+func TestDbusSend(t *testing.T) {
+  // libdbus sent its Get expecting a reply; call never waits for one.
+  get := append([]string{"6c010101" + libdbusGet[0][8:]}, libdbusGet[1:]...)
+
+  tests := []struct {
+    name string
+    send func(dc *dbusConn) error
+    want []string
+  }{
+    {"libdbus Seeked", func(dc *dbusConn) error {
+      return dc.signal(mprisPath, mprisPlayer, "Seeked", "x", int64(5000000))
+    }, libdbusSeeked},
+    {"libdbus Get", func(dc *dbusConn) error {
+      return dc.call(mprisRoot+".swp", mprisPath, dbusProps, "Get", "ss", mprisPlayer, "PlaybackStatus")
+    }, get},
+  }
+  for _, tt := range tests {
+    rc := &recordConn{}
+    // The captures were each a client's second message, after Hello.
+    dc := &dbusConn{c: rc, serial: 1}
+    if err := tt.send(dc); err != nil {
+      t.Fatalf("%s: %v", tt.name, err)
+    }
+    if want := unhex(t, tt.want); !bytes.Equal(rc.buf.Bytes(), want) {
+      t.Errorf("%s:\n got %x\nwant %x", tt.name, rc.buf.Bytes(), want)
+    }
+  }
+}
+
+func TestDbusPut(t *testing.T) {
+  tests := []struct {
+    name string
+    sig  string
+    args []any
+    want []byte
+  }{
+    {"PropertiesChanged", "sa{sv}as", []any{mprisPlayer, gdbusChanged, []string{}}, unhex(t, gdbusPropertiesChanged)[136:]},
+    {"variant", "v", []any{dbusVariant{"s", "Playing"}}, unhex(t, gdbusVariant)},
+  }
+  for _, tt := range tests {
+    e := &dbusEnc{}
+    i := 0
+    for _, a := range tt.args {
+      n := dbusTypeLen(tt.sig[i:])
+      e.put(tt.sig[i:i+n], a)
+      i += n
+    }
+    if !bytes.Equal(e.buf, tt.want) {
+      t.Errorf("%s:\n got %x\nwant %x", tt.name, e.buf, tt.want)
+    }
+  }
+}
+
+func TestDbusRead(t *testing.T) {
+  getFields := map[byte]any{
+    dbusFieldPath:        dbusObjectPath(mprisPath),
+    dbusFieldInterface:   dbusProps,
+    dbusFieldMember:      "Get",
+    dbusFieldDestination: mprisRoot + ".swp",
+    dbusFieldSignature:   "ss",
+  }
+  tests := []struct {
+    name   string
+    msg    []byte
+    typ    byte
+    flags  byte
+    fields map[byte]any
+    args   []string
+    body   []byte
+  }{
+    {"libdbus Get", unhex(t, libdbusGet), dbusMethodCall, 0, getFields,
+      []string{mprisPlayer, "PlaybackStatus"}, nil},
+    {"busctl Get", unhex(t, busctlGet), dbusMethodCall, 0x5, getFields,
+      []string{mprisPlayer, "PlaybackStatus"}, nil},
+    {"gdbus PropertiesChanged", unhex(t, gdbusPropertiesChanged), dbusSignal, dbusNoReplyExpected, map[byte]any{
+      dbusFieldPath:      dbusObjectPath(mprisPath),
+      dbusFieldInterface: dbusProps,
+      dbusFieldMember:    "PropertiesChanged",
+      dbusFieldSignature: "sa{sv}as",
+    }, nil, unhex(t, gdbusPropertiesChanged)[136:]},
+  }
+  for _, tt := range tests {
+    // Two copies back to back: read must consume exactly one message.
+    dc := &dbusConn{br: bufio.NewReader(bytes.NewReader(append(append([]byte{}, tt.msg...), tt.msg...)))}
+    for i := 0; i < 2; i++ {
+      m, err := dc.read()
+      if err != nil {
+        t.Fatalf("%s: %v", tt.name, err)
+      }
+      if m.typ != tt.typ || m.flags != tt.flags || m.serial != 2 {
+        t.Errorf("%s: type %d flags %#x serial %d", tt.name, m.typ, m.flags, m.serial)
+      }
+      if !reflect.DeepEqual(m.fields, tt.fields) {
+        t.Errorf("%s: fields %v, want %v", tt.name, m.fields, tt.fields)
+      }
+      if m.sig != tt.fields[dbusFieldSignature] {
+        t.Errorf("%s: sig %q", tt.name, m.sig)
+      }
+      if tt.args != nil {
+        if args, err := m.args(); err != nil || !reflect.DeepEqual(args, tt.args) {
+          t.Errorf("%s: args %q, %v", tt.name, args, err)
+        }
+      }
+      if tt.body != nil && !bytes.Equal(m.body, tt.body) {
+        t.Errorf("%s: body %x", tt.name, m.body)
+      }
+    }
+  }
+}
+
+func TestDbusVariant(t *testing.T) {
+  d := &dbusDec{buf: unhex(t, gdbusVariant)}
+  v, err := d.variant()
+  if err != nil || v != "Playing" || d.pos != len(d.buf) {
+    t.Fatalf("variant = %q, %v at %d", v, err, d.pos)
+  }
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+  "fmt"
+  "log"
+  "sync"
+)
+
+// mpris publishes swp on the session bus as an MPRIS media player, so that
+// desktop media keys and applets can show the current track and pause or
+// resume the radio. Pausing disconnects from the server; playing again
+// reconnects and joins the live stream.
+type mpris struct {
+  dc *dbusConn
+
+  // play receives true for Play and false for Pause or Stop.
+  play chan bool
+
+  mu      sync.Mutex
+  playing bool
+  np      *nowPlaying
+  track   int // counts tracks, for mpris:trackid
+}
+
+const (
+  mprisPath   = "/org/mpris/MediaPlayer2"
+  mprisRoot   = "org.mpris.MediaPlayer2"
+  mprisPlayer = "org.mpris.MediaPlayer2.Player"
+  dbusProps   = "org.freedesktop.DBus.Properties"
+)
+
+const mprisIntrospection = `<!DOCTYPE node PUBLIC "-//freedesktop//DTD D-BUS Object Introspection 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/introspect.dtd">
+<node>
+ <interface name="org.freedesktop.DBus.Introspectable">
+  <method name="Introspect"><arg name="xml" type="s" direction="out"/></method>
+ </interface>
+ <interface name="org.freedesktop.DBus.Properties">
+  <method name="Get"><arg type="s" direction="in"/><arg type="s" direction="in"/><arg type="v" direction="out"/></method>
+  <method name="GetAll"><arg type="s" direction="in"/><arg type="a{sv}" direction="out"/></method>
+  <method name="Set"><arg type="s" direction="in"/><arg type="s" direction="in"/><arg type="v" direction="in"/></method>
+  <signal name="PropertiesChanged"><arg type="s"/><arg type="a{sv}"/><arg type="as"/></signal>
+ </interface>
+ <interface name="org.mpris.MediaPlayer2">
+  <method name="Raise"/><method name="Quit"/>
+  <property name="CanQuit" type="b" access="read"/>
+  <property name="CanRaise" type="b" access="read"/>
+  <property name="HasTrackList" type="b" access="read"/>
+  <property name="Identity" type="s" access="read"/>
+  <property name="SupportedUriSchemes" type="as" access="read"/>
+  <property name="SupportedMimeTypes" type="as" access="read"/>
+ </interface>
+ <interface name="org.mpris.MediaPlayer2.Player">
+  <method name="Next"/><method name="Previous"/><method name="Pause"/>
+  <method name="PlayPause"/><method name="Stop"/><method name="Play"/>
+  <property name="PlaybackStatus" type="s" access="read"/>
+  <property name="Rate" type="d" access="read"/>
+  <property name="Metadata" type="a{sv}" access="read"/>
+  <property name="Volume" type="d" access="read"/>
+  <property name="Position" type="x" access="read"/>
+  <property name="MinimumRate" type="d" access="read"/>
+  <property name="MaximumRate" type="d" access="read"/>
+  <property name="CanGoNext" type="b" access="read"/>
+  <property name="CanGoPrevious" type="b" access="read"/>
+  <property name="CanPlay" type="b" access="read"/>
+  <property name="CanPause" type="b" access="read"/>
+  <property name="CanSeek" type="b" access="read"/>
+  <property name="CanControl" type="b" access="read"/>
+ </interface>
+</node>`
+
+// startMPRIS connects to the session bus and claims the MPRIS name.
+func startMPRIS() (*mpris, error) {
+  dc, err := dialSessionBus()
+  if err != nil {
+    return nil, err
+  }
+  // Flag 4: fail rather than queue behind another swp.
+  if err := dc.call("org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "RequestName", "su", mprisRoot+".swp", uint32(4)); err != nil {
+    dc.close()
+    return nil, err
+  }
+  m := &mpris{dc: dc, play: make(chan bool, 1), playing: true}
+  go m.serve()
+  return m, nil
+}
+
+func (m *mpris) serve() {
+  for {
+    msg, err := m.dc.read()
+    if err != nil {
+      log.Printf("mpris: %v", err)
+      return
+    }
+    if msg.typ == dbusError && msg.str(dbusFieldErrorName) != "" {
+      log.Printf("mpris: %s", msg.str(dbusFieldErrorName))
+    }
+    if msg.typ != dbusMethodCall {
+      continue
+    }
+    if err := m.handle(msg); err != nil {
+      log.Printf("mpris: %v", err)
+    }
+  }
+}
+
+func (m *mpris) handle(msg *dbusMsg) error {
+  iface, member := msg.str(dbusFieldInterface), msg.str(dbusFieldMember)
+  if msg.str(dbusFieldPath) != mprisPath {
+    return m.dc.replyError(msg, "org.freedesktop.DBus.Error.UnknownObject", "no such object")
+  }
+  switch {
+  case member == "Introspect":
+    return m.dc.reply(msg, "s", mprisIntrospection)
+  case member == "Ping":
+    return m.dc.reply(msg, "")
+
+  case iface == dbusProps && member == "Get":
+    args, err := msg.args()
+    if err != nil || len(args) != 2 {
+      return m.dc.replyError(msg, "org.freedesktop.DBus.Error.InvalidArgs", "want interface and property")
+    }
+    v, ok := m.props(args[0])[args[1]]
+    if !ok {
+      return m.dc.replyError(msg, "org.freedesktop.DBus.Error.UnknownProperty", "no such property")
+    }
+    return m.dc.reply(msg, "v", v)
+  case iface == dbusProps && member == "GetAll":
+    args, err := msg.args()
+    if err != nil || len(args) != 1 {
+      return m.dc.replyError(msg, "org.freedesktop.DBus.Error.InvalidArgs", "want interface")
+    }
+    return m.dc.reply(msg, "a{sv}", m.props(args[0]))
+  case iface == dbusProps && member == "Set":
+    return m.dc.replyError(msg, "org.freedesktop.DBus.Error.PropertyReadOnly", "properties are read-only")
+
+  case member == "Play":
+    m.setPlaying(true)
+  case member == "Pause" || member == "Stop":
+    m.setPlaying(false)
+  case member == "PlayPause":
+    m.mu.Lock()
+    playing := m.playing
+    m.mu.Unlock()
+    m.setPlaying(!playing)
+  case member == "Raise" || member == "Quit" || member == "Next" || member == "Previous" ||
+    member == "Seek" || member == "SetPosition" || member == "OpenUri":
+    // Nothing to do for a radio stream.
+  default:
+    return m.dc.replyError(msg, "org.freedesktop.DBus.Error.UnknownMethod", "unknown method "+member)
+  }
+  return m.dc.reply(msg, "")
+}
+
+// setPlaying records the new state, tells the stream loop and the desktop.
+func (m *mpris) setPlaying(on bool) {
+  m.mu.Lock()
+  changed := m.playing != on
+  m.playing = on
+  m.mu.Unlock()
+  if !changed {
+    return
+  }
+  select {
+  case <-m.play:
+  default:
+  }
+  m.play <- on
+  m.changed("PlaybackStatus")
+}
+
+// setTrack publishes np as the current track.
+func (m *mpris) setTrack(np *nowPlaying) {
+  m.mu.Lock()
+  m.np = np
+  m.track++
+  m.mu.Unlock()
+  m.changed("Metadata")
+}
+
+func (m *mpris) changed(props ...string) {
+  all := m.props(mprisPlayer)
+  diff := map[string]dbusVariant{}
+  for _, p := range props {
+    diff[p] = all[p]
+  }
+  if err := m.dc.signal(mprisPath, dbusProps, "PropertiesChanged", "sa{sv}as", mprisPlayer, diff, []string{}); err != nil {
+    log.Printf("mpris: %v", err)
+  }
+}
+
+func (m *mpris) props(iface string) map[string]dbusVariant {
+  b := func(v bool) dbusVariant { return dbusVariant{"b", v} }
+  d := func(v float64) dbusVariant { return dbusVariant{"d", v} }
+  switch iface {
+  case mprisRoot:
+    return map[string]dbusVariant{
+      "CanQuit":             b(false),
+      "CanRaise":            b(false),
+      "HasTrackList":        b(false),
+      "Identity":            {"s", "swp"},
+      "SupportedUriSchemes": {"as", []string{}},
+      "SupportedMimeTypes":  {"as", []string{}},
+    }
+  case mprisPlayer:
+  default:
+    return map[string]dbusVariant{}
+  }
+
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  status := "Paused"
+  if m.playing {
+    status = "Playing"
+  }
+  meta := map[string]dbusVariant{
+    "mpris:trackid": {"o", dbusObjectPath(fmt.Sprintf("%s/track/%d", mprisPath, m.track))},
+  }
+  var position int64
+  if np := m.np; np != nil && np.Playing {
+    artist, title := splitTitle(np.Title)
+    meta["xesam:title"] = dbusVariant{"s", title}
+    if artist != "" {
+      meta["xesam:artist"] = dbusVariant{"as", []string{artist}}
+    }
+    if np.Duration > 0 {
+      meta["mpris:length"] = dbusVariant{"x", int64(np.Duration * 1e6)}
+    }
+    position = int64(np.Elapsed * 1e6)
+  }
+  return map[string]dbusVariant{
+    "PlaybackStatus": {"s", status},
+    "Rate":           d(1),
+    "MinimumRate":    d(1),
+    "MaximumRate":    d(1),
+    "Volume":         d(1),
+    "Metadata":       {"a{sv}", meta},
+    "Position":       {"x", position},
+    "CanGoNext":      b(false),
+    "CanGoPrevious":  b(false),
+    "CanPlay":        b(true),
+    "CanPause":       b(true),
+    "CanSeek":        b(false),
+    "CanControl":     b(true),
+  }
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "encoding/binary"
+  "fmt"
+  "io"
+  "log"
+  "os"
+  "path/filepath"
+  "strings"
+)
+
+// readPage reads the next Ogg page, skipping garbage before "OggS".
+func readPage(r *bufio.Reader) ([]byte, error) {
+  for {
+    b, err := r.Peek(4)
+    if err != nil {
+      return nil, err
+    }
+    if bytes.Equal(b, []byte("OggS")) {
+      break
+    }
+    _, _ = r.ReadByte()
+  }
+  hdr := make([]byte, 27)
+  if _, err := io.ReadFull(r, hdr); err != nil {
+    return nil, err
+  }
+  segs := make([]byte, int(hdr[26]))
+  if _, err := io.ReadFull(r, segs); err != nil {
+    return nil, err
+  }
+  n := 0
+  for _, v := range segs {
+    n += int(v)
+  }
+  body := make([]byte, n)
+  if _, err := io.ReadFull(r, body); err != nil {
+    return nil, err
+  }
+  page := append(hdr, segs...)
+  return append(page, body...), nil
+}
+
+// recorder splits the stream into one Ogg/Vorbis file per track, using the
+// server's SPTRACK signaling stream (-track-signals) to find boundaries.
+// Each file gets the Vorbis header pages followed by the track's audio pages.
+type recorder struct {
+  dir string
+
+  audio    uint32 // Vorbis serial
+  meta     uint32 // SPTRACK serial
+  haveMeta bool
+  header   []byte // Vorbis header pages
+  inHeader bool
+
+  f *os.File
+}
+
+func (rc *recorder) page(page []byte) {
+  if len(page) < 27 {
+    return
+  }
+  flags := page[5]
+  granule := int64(binary.LittleEndian.Uint64(page[6:14]))
+  serial := binary.LittleEndian.Uint32(page[14:18])
+  body := page[27+int(page[26]):]
+
+  if flags&0x02 != 0 {
+    switch {
+    case bytes.HasPrefix(body, []byte("\x01vorbis")):
+      rc.audio, rc.header, rc.inHeader = serial, nil, true
+    case bytes.HasPrefix(body, []byte("SPTRACK\x00")):
+      rc.meta, rc.haveMeta = serial, true
+    }
+  }
+
+  switch {
+  case rc.haveMeta && serial == rc.meta:
+    if bytes.HasPrefix(body, []byte("SPTRACK\x01")) {
+      rc.startTrack(parseTrackFields(body[8:]))
+    }
+
+  case serial == rc.audio:
+    if rc.inHeader {
+      if granule == 0 {
+        rc.header = append(rc.header, page...)
+        return
+      }
+      rc.inHeader = false
+    }
+    if rc.f != nil {
+      if _, err := rc.f.Write(page); err != nil {
+        log.Printf("record: %v", err)
+        rc.close()
+      }
+    }
+  }
+}
+
+func (rc *recorder) startTrack(fields map[string]string) {
+  rc.close()
+  if len(rc.header) == 0 {
+    return
+  }
+  title := fields["TITLE"]
+  if title == "" {
+    title = strings.TrimSuffix(fields["FILE"], filepath.Ext(fields["FILE"]))
+  }
+  path := uniquePath(rc.dir, sanitizeFilename(title), ".ogg")
+  f, err := os.Create(path)
+  if err != nil {
+    log.Printf("record: %v", err)
+    return
+  }
+  if _, err := f.Write(rc.header); err != nil {
+    log.Printf("record: %v", err)
+    _ = f.Close()
+    return
+  }
+  fmt.Fprintln(os.Stderr, "Recording:", path)
+  rc.f = f
+}
+
+func (rc *recorder) close() {
+  if rc.f != nil {
+    _ = rc.f.Close()
+    rc.f = nil
+  }
+}
+
+func parseTrackFields(b []byte) map[string]string {
+  out := map[string]string{}
+  for _, line := range strings.Split(string(b), "\n") {
+    if k, v, ok := strings.Cut(line, "="); ok {
+      out[k] = v
+    }
+  }
+  return out
+}
+
+// sanitizeFilename makes a track title safe to use as a file name.
+func sanitizeFilename(s string) string {
+  s = strings.Map(func(r rune) rune {
+    switch {
+    case r < 0x20, r == 0x7f:
+      return -1
+    case strings.ContainsRune(`/\:*?"<>|`, r):
+      return '_'
+    }
+    return r
+  }, s)
+  s = strings.Trim(strings.TrimSpace(s), ".")
+  if r := []rune(s); len(r) > 120 {
+    s = string(r[:120])
+  }
+  if s == "" {
+    s = "untitled"
+  }
+  return s
+}
+
+func uniquePath(dir, name, ext string) string {
+  path := filepath.Join(dir, name+ext)
+  for i := 2; ; i++ {
+    if _, err := os.Stat(path); os.IsNotExist(err) {
+      return path
+    }
+    path = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", name, i, ext))
+  }
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "crypto/md5"
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "io"
+  "log"
+  "net/http"
+  "net/url"
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// The scrobbler turns the track changes seen at /nowplaying.json into
+// listens for Last.fm and/or ListenBrainz. A track counts once it has been
+// heard for half its length or four minutes, whichever is less, and at
+// least 30 seconds (the Last.fm rules). Listens wait in a cache file until
+// the service takes them, so nothing is lost while offline.
+
+var (
+  listenBrainzURL = "https://api.listenbrainz.org/1/submit-listens"
+  lastfmURL       = "https://ws.audioscrobbler.com/2.0/"
+)
+
+const (
+  scrobbleBatch = 50   // most listens per request, for both services
+  scrobbleKeep  = 5000 // most listens kept in the cache
+)
+
+// listen is one scrobble waiting in the cache.
+type listen struct {
+  Service  string `json:"service"` // "lastfm" or "listenbrainz"
+  Artist   string `json:"artist"`
+  Track    string `json:"track"`
+  At       int64  `json:"listened_at"` // unix seconds the track started
+  Duration int    `json:"duration,omitempty"`
+}
+
+// lastfmAuth is what Last.fm needs to sign requests for a user.
+type lastfmAuth struct {
+  key, secret, session string
+}
+
+type scrobbler struct {
+  cache        string
+  listenBrainz string // user token
+  lastfm       *lastfmAuth
+  client       *http.Client
+
+  fmu sync.Mutex // guards the cache file
+
+  mu      sync.Mutex
+  cur     *nowPlaying
+  heard   time.Time // when cur came on for us
+  started time.Time // when cur started on air
+  paused  bool
+}
+
+// newScrobbler returns a scrobbler keeping its queue in cache, or in the
+// user cache dir if cache is "".
+func newScrobbler(cache, listenBrainz string, lastfm *lastfmAuth) (*scrobbler, error) {
+  if cache == "" {
+    dir, err := os.UserCacheDir()
+    if err != nil {
+      return nil, err
+    }
+    cache = filepath.Join(dir, "swp", "scrobbles.jsonl")
+  }
+  if err := os.MkdirAll(filepath.Dir(cache), 0o755); err != nil {
+    return nil, err
+  }
+  s := &scrobbler{
+    cache:        cache,
+    listenBrainz: listenBrainz,
+    lastfm:       lastfm,
+    client:       &http.Client{Timeout: 20 * time.Second},
+  }
+  go s.flush() // whatever was left from last time
+  return s, nil
+}
+
+// splitTitle splits a server title of the form "Artist – Title".
+func splitTitle(s string) (artist, title string) {
+  if artist, title, ok := strings.Cut(s, " – "); ok {
+    return artist, title
+  }
+  return "", s
+}
+
+// track is called with every track that comes on; it scrobbles the one
+// before it if that was heard long enough, and retries the cache.
+func (s *scrobbler) track(np *nowPlaying) {
+  now := time.Now()
+  s.mu.Lock()
+  ls := s.finish(now)
+  if !s.paused {
+    s.cur, s.heard = np, now
+    s.started = now.Add(-time.Duration(np.Elapsed * float64(time.Second)))
+  }
+  s.mu.Unlock()
+  go s.queue(ls)
+}
+
+// pause stops counting while the stream is paused; the track that is on
+// when it resumes is not scrobbled, as it was not heard from the start.
+func (s *scrobbler) pause(on bool) {
+  s.mu.Lock()
+  var ls []listen
+  if on {
+    ls = s.finish(time.Now())
+  }
+  s.paused = on
+  s.mu.Unlock()
+  if ls != nil {
+    go s.queue(ls)
+  }
+}
+
+// close scrobbles the current track if it has been heard long enough and
+// makes one last attempt to submit the cache.
+func (s *scrobbler) close() {
+  s.mu.Lock()
+  ls := s.finish(time.Now())
+  s.mu.Unlock()
+  s.queue(ls)
+}
+
+// finish ends the current track and returns its listens, or nil if it does
+// not count. Called with mu held.
+func (s *scrobbler) finish(now time.Time) []listen {
+  np := s.cur
+  s.cur = nil
+  if np == nil || !np.Playing {
+    return nil
+  }
+  artist, title := splitTitle(np.Title)
+  if artist == "" {
+    return nil // neither service takes a listen without an artist
+  }
+  length := time.Duration(np.Duration * float64(time.Second))
+  need := 30 * time.Second
+  if length > 0 {
+    if length < 30*time.Second {
+      return nil
+    }
+    need = max(need, min(length/2, 4*time.Minute))
+  }
+  if now.Sub(s.heard) < need {
+    return nil
+  }
+  var ls []listen
+  for _, svc := range s.services() {
+    ls = append(ls, listen{Service: svc, Artist: artist, Track: title, At: s.started.Unix(), Duration: int(np.Duration + 0.5)})
+  }
+  return ls
+}
+
+// queue adds ls to the cache and tries to submit everything waiting there.
+func (s *scrobbler) queue(ls []listen) {
+  if len(ls) > 0 {
+    s.fmu.Lock()
+    err := s.append(ls)
+    s.fmu.Unlock()
+    if err != nil {
+      log.Printf("scrobble: %v", err)
+    }
+  }
+  s.flush()
+}
+
+func (s *scrobbler) services() []string {
+  var svcs []string
+  if s.lastfm != nil {
+    svcs = append(svcs, "lastfm")
+  }
+  if s.listenBrainz != "" {
+    svcs = append(svcs, "listenbrainz")
+  }
+  return svcs
+}
+
+// append adds ls to the cache file. Called with fmu held.
+func (s *scrobbler) append(ls []listen) error {
+  f, err := os.OpenFile(s.cache, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+  if err != nil {
+    return err
+  }
+  enc := json.NewEncoder(f)
+  for _, l := range ls {
+    if err := enc.Encode(l); err != nil {
+      f.Close()
+      return err
+    }
+  }
+  return f.Close()
+}
+
+// load reads the cache file. Called with fmu held.
+func (s *scrobbler) load() ([]listen, error) {
+  f, err := os.Open(s.cache)
+  if os.IsNotExist(err) {
+    return nil, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+  var ls []listen
+  sc := bufio.NewScanner(f)
+  for sc.Scan() {
+    var l listen
+    if err := json.Unmarshal(sc.Bytes(), &l); err != nil {
+      log.Printf("scrobble: %s: skipping bad line: %v", s.cache, err)
+      continue
+    }
+    ls = append(ls, l)
+  }
+  return ls, sc.Err()
+}
+
+// save replaces the cache file with ls. Called with fmu held.
+func (s *scrobbler) save(ls []listen) error {
+  if len(ls) > scrobbleKeep {
+    log.Printf("scrobble: dropping %d old listens from the cache", len(ls)-scrobbleKeep)
+    ls = ls[len(ls)-scrobbleKeep:]
+  }
+  var buf bytes.Buffer
+  enc := json.NewEncoder(&buf)
+  for _, l := range ls {
+    if err := enc.Encode(l); err != nil {
+      return err
+    }
+  }
+  tmp := s.cache + ".tmp"
+  if err := os.WriteFile(tmp, buf.Bytes(), 0o600); err != nil {
+    return err
+  }
+  return os.Rename(tmp, s.cache)
+}
+
+// flush submits the cached listens to the services configured this run and
+// keeps the ones that did not go through.
+func (s *scrobbler) flush() {
+  s.fmu.Lock()
+  defer s.fmu.Unlock()
+  ls, err := s.load()
+  if err != nil {
+    log.Printf("scrobble: %v", err)
+    return
+  }
+  if len(ls) == 0 {
+    return
+  }
+  submit := map[string]func([]listen) (bool, error){}
+  if s.lastfm != nil {
+    submit["lastfm"] = s.submitLastfm
+  }
+  if s.listenBrainz != "" {
+    submit["listenbrainz"] = s.submitListenBrainz
+  }
+
+  var keep, batch []listen
+  failed := map[string]bool{}
+  send := func(svc string) {
+    if len(batch) == 0 {
+      return
+    }
+    done, err := submit[svc](batch)
+    if err != nil {
+      log.Printf("scrobble: %s: %v", svc, err)
+      failed[svc] = !done
+    }
+    if !done {
+      keep = append(keep, batch...)
+    }
+    batch = nil
+  }
+  for _, svc := range []string{"lastfm", "listenbrainz"} {
+    for _, l := range ls {
+      if l.Service != svc {
+        continue
+      }
+      if submit[svc] == nil || failed[svc] {
+        keep = append(keep, l)
+        continue
+      }
+      if batch = append(batch, l); len(batch) == scrobbleBatch {
+        send(svc)
+      }
+    }
+    send(svc)
+  }
+  for _, l := range ls {
+    if l.Service != "lastfm" && l.Service != "listenbrainz" {
+      keep = append(keep, l)
+    }
+  }
+  if len(keep) == len(ls) {
+    return
+  }
+  // Listens came in out of order per service; put them back in time order.
+  sort.SliceStable(keep, func(i, j int) bool { return keep[i].At < keep[j].At })
+  if err := s.save(keep); err != nil {
+    log.Printf("scrobble: %v", err)
+  }
+}
+
+// submitListenBrainz sends ls to ListenBrainz. done is true when the
+// listens should leave the cache, which includes ones it refused as
+// malformed.
+func (s *scrobbler) submitListenBrainz(ls []listen) (done bool, err error) {
+  type info struct {
+    Duration int    `json:"duration,omitempty"`
+    Client   string `json:"submission_client"`
+  }
+  type meta struct {
+    Artist string `json:"artist_name"`
+    Track  string `json:"track_name"`
+    Info   info   `json:"additional_info"`
+  }
+  type payload struct {
+    At   int64 `json:"listened_at"`
+    Meta meta  `json:"track_metadata"`
+  }
+  body := struct {
+    Type    string    `json:"listen_type"`
+    Payload []payload `json:"payload"`
+  }{Type: "single"}
+  if len(ls) > 1 {
+    body.Type = "import"
+  }
+  for _, l := range ls {
+    body.Payload = append(body.Payload, payload{l.At, meta{l.Artist, l.Track, info{l.Duration, "swp"}}})
+  }
+  data, err := json.Marshal(body)
+  if err != nil {
+    return false, err
+  }
+  req, err := http.NewRequest("POST", listenBrainzURL, bytes.NewReader(data))
+  if err != nil {
+    return false, err
+  }
+  req.Header.Set("Authorization", "Token "+s.listenBrainz)
+  req.Header.Set("Content-Type", "application/json")
+  resp, err := s.client.Do(req)
+  if err != nil {
+    return false, err
+  }
+  defer resp.Body.Close()
+  msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+  switch {
+  case resp.StatusCode == http.StatusOK:
+    return true, nil
+  case resp.StatusCode == http.StatusBadRequest:
+    return true, fmt.Errorf("dropping %d listens: %s: %s", len(ls), resp.Status, bytes.TrimSpace(msg))
+  default:
+    return false, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+  }
+}
+
+// lastfmCall makes a signed Last.fm API call and decodes the reply into v.
+// code is Last.fm's error code, if it returned one.
+func (a *lastfmAuth) call(client *http.Client, params url.Values, v any) (code int, err error) {
+  params.Set("api_key", a.key)
+  keys := make([]string, 0, len(params))
+  for k := range params {
+    keys = append(keys, k)
+  }
+  sort.Strings(keys)
+  var sig strings.Builder
+  for _, k := range keys {
+    sig.WriteString(k)
+    sig.WriteString(params.Get(k))
+  }
+  sig.WriteString(a.secret)
+  sum := md5.Sum([]byte(sig.String()))
+  params.Set("api_sig", hex.EncodeToString(sum[:]))
+  params.Set("format", "json")
+
+  resp, err := client.PostForm(lastfmURL, params)
+  if err != nil {
+    return 0, err
+  }
+  defer resp.Body.Close()
+  data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+  if err != nil {
+    return 0, err
+  }
+  var e struct {
+    Error   int    `json:"error"`
+    Message string `json:"message"`
+  }
+  if json.Unmarshal(data, &e) == nil && e.Error != 0 {
+    return e.Error, fmt.Errorf("last.fm error %d: %s", e.Error, e.Message)
+  }
+  if resp.StatusCode != http.StatusOK {
+    return 0, fmt.Errorf("last.fm: %s", resp.Status)
+  }
+  return 0, json.Unmarshal(data, v)
+}
+
+// submitLastfm sends ls to Last.fm with track.scrobble.
+func (s *scrobbler) submitLastfm(ls []listen) (done bool, err error) {
+  params := url.Values{"method": {"track.scrobble"}, "sk": {s.lastfm.session}}
+  for i, l := range ls {
+    n := "[" + strconv.Itoa(i) + "]"
+    params.Set("artist"+n, l.Artist)
+    params.Set("track"+n, l.Track)
+    params.Set("timestamp"+n, strconv.FormatInt(l.At, 10))
+    if l.Duration > 0 {
+      params.Set("duration"+n, strconv.Itoa(l.Duration))
+    }
+  }
+  var reply struct{}
+  code, err := s.lastfm.call(s.client, params, &reply)
+  if code == 6 || code == 13 {
+    // Invalid parameters or signature: retrying will not help.
+    return true, fmt.Errorf("dropping %d listens: %v", len(ls), err)
+  }
+  return err == nil, err
+}
+
+// lastfmLogin trades a Last.fm username and password for a session key.
+func lastfmLogin(a *lastfmAuth, user, password string) (string, error) {
+  var reply struct {
+    Session struct {
+      Key string `json:"key"`
+    } `json:"session"`
+  }
+  params := url.Values{"method": {"auth.getMobileSession"}, "username": {user}, "password": {password}}
+  if _, err := a.call(&http.Client{Timeout: 20 * time.Second}, params, &reply); err != nil {
+    return "", err
+  }
+  if reply.Session.Key == "" {
+    return "", fmt.Errorf("last.fm returned no session key")
+  }
+  return reply.Session.Key, nil
+}
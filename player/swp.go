@@ -9,7 +9,10 @@ import (
   "net"
   "os"
   "os/exec"
+  "os/signal"
+  "strconv"
   "strings"
+  "syscall"
   "time"
 )
 
@@ -17,41 +20,214 @@ func main() {
   host := flag.String("host", "localhost", "Spartan server host")
   port := flag.Int("port", 300, "Spartan server port")
   path := flag.String("path", "/radio", "path to stream (default /radio)")
-  player := flag.String("player", "ffplay", "player command (ffplay|mpv|vlc). default: ffplay")
+  player := flag.String("player", "ffplay", "player command (ffplay|mpv|mplayer|vlc|none). default: ffplay")
+  recordDir := flag.String("record-dir", "", "save the stream here, one .ogg file per track (needs a server running with -track-signals)")
+  ui := flag.Bool("ui", false, "show the current track with a progress bar (needs a server with /nowplaying.json)")
+  notify := flag.Bool("notify", false, "show a desktop notification when the track changes, via notify-send or terminal-notifier (needs a server with /nowplaying.json)")
+  notifyCmd := flag.String("notify-cmd", "", "run this shell command on track changes instead of notify-send/terminal-notifier, with the title in $SWP_TITLE (implies -notify)")
+  lbToken := flag.String("listenbrainz-token", os.Getenv("SWP_LISTENBRAINZ_TOKEN"), "scrobble to ListenBrainz with this user token (default $SWP_LISTENBRAINZ_TOKEN)")
+  lfmKey := flag.String("lastfm-key", os.Getenv("SWP_LASTFM_KEY"), "Last.fm API key, for scrobbling (default $SWP_LASTFM_KEY)")
+  lfmSecret := flag.String("lastfm-secret", os.Getenv("SWP_LASTFM_SECRET"), "Last.fm API shared secret (default $SWP_LASTFM_SECRET)")
+  lfmSession := flag.String("lastfm-session", os.Getenv("SWP_LASTFM_SESSION"), "Last.fm session key; scrobbling to Last.fm needs key, secret and session (default $SWP_LASTFM_SESSION)")
+  lfmLogin := flag.String("lastfm-login", "", "print a Last.fm session key for this user, with the password in $SWP_LASTFM_PASSWORD, and exit")
+  scrobbleCache := flag.String("scrobble-cache", "", "file for scrobbles waiting to be submitted (default swp/scrobbles.jsonl in the user cache dir)")
+  mprisFlag := flag.Bool("mpris", false, "publish the stream over MPRIS on the D-Bus session bus, for desktop media keys and applets; pause disconnects, play reconnects")
   flag.Parse()
 
-  addr := fmt.Sprintf("%s:%d", *host, *port)
-  conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+  addr := net.JoinHostPort(*host, strconv.Itoa(*port))
+
+  var lfm *lastfmAuth
+  if *lfmKey != "" && *lfmSecret != "" {
+    lfm = &lastfmAuth{key: *lfmKey, secret: *lfmSecret, session: *lfmSession}
+  }
+  if *lfmLogin != "" {
+    if lfm == nil {
+      log.Fatalf("-lastfm-login needs -lastfm-key and -lastfm-secret")
+    }
+    sk, err := lastfmLogin(lfm, *lfmLogin, os.Getenv("SWP_LASTFM_PASSWORD"))
+    if err != nil {
+      log.Fatalf("last.fm login: %v", err)
+    }
+    fmt.Println(sk)
+    return
+  }
+  if lfm != nil && lfm.session == "" {
+    log.Fatalf("scrobbling to Last.fm needs -lastfm-session (get one with -lastfm-login)")
+  }
+
+  var rec *recorder
+  if *recordDir != "" {
+    if err := os.MkdirAll(*recordDir, 0o755); err != nil {
+      log.Fatalf("record dir: %v", err)
+    }
+    rec = &recorder{dir: *recordDir}
+    defer rec.close()
+  }
+  if *player == "none" && rec == nil {
+    log.Fatalf("-player none only makes sense with -record-dir")
+  }
+
+  var mp *mpris
+  if *mprisFlag {
+    var err error
+    if mp, err = startMPRIS(); err != nil {
+      log.Fatalf("mpris: %v", err)
+    }
+  }
+
+  var onTrack []func(*nowPlaying)
+  if *notify || *notifyCmd != "" {
+    show, err := notifier(*notifyCmd)
+    if err != nil {
+      log.Fatalf("notify: %v", err)
+    }
+    onTrack = append(onTrack, func(np *nowPlaying) { show(np.Title) })
+  }
+  if mp != nil {
+    onTrack = append(onTrack, mp.setTrack)
+  }
+  var sc *scrobbler
+  if lfm != nil || *lbToken != "" {
+    var err error
+    if sc, err = newScrobbler(*scrobbleCache, *lbToken, lfm); err != nil {
+      log.Fatalf("scrobble: %v", err)
+    }
+    // Runs after the watcher has stopped, to count the last track.
+    defer sc.close()
+    stopOnSignal(sc)
+    onTrack = append(onTrack, sc.track)
+  }
+  if *ui || len(onTrack) > 0 {
+    stop := make(chan struct{})
+    done := make(chan struct{})
+    go func() {
+      watchNowPlaying(addr, *host, *ui, func(np *nowPlaying) {
+        for _, f := range onTrack {
+          f(np)
+        }
+      }, stop)
+      close(done)
+    }()
+    defer func() {
+      close(stop)
+      <-done
+    }()
+  }
+
+  s := &session{addr: addr, path: *path, player: *player, quiet: *ui, rec: rec}
+  if mp == nil {
+    if err := s.run(nil); err != nil {
+      log.Fatal(err)
+    }
+    return
+  }
+
+  // With MPRIS, pausing ends the session and playing starts a new one.
+  for {
+    pause := make(chan struct{})
+    ended := make(chan error, 1)
+    go func() { ended <- s.run(pause) }()
+    select {
+    case err := <-ended:
+      if err != nil {
+        log.Printf("%v", err)
+      }
+      mp.setPlaying(false)
+    case <-mp.play:
+      close(pause)
+      <-ended
+    }
+    if sc != nil {
+      sc.pause(true)
+    }
+    for on := range mp.play {
+      if on {
+        break
+      }
+    }
+    if sc != nil {
+      sc.pause(false)
+    }
+  }
+}
+
+// stopOnSignal scrobbles the track on air, if it has been heard long
+// enough, when swp is interrupted, which is how a listener usually stops it.
+func stopOnSignal(sc *scrobbler) {
+  sig := make(chan os.Signal, 1)
+  signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+  go func() {
+    <-sig
+    sc.close()
+    os.Exit(1)
+  }()
+}
+
+// session is one connection to the server, played and/or recorded.
+type session struct {
+  addr, path string
+  player     string
+  quiet      bool // hide the player's own output
+  rec        *recorder
+}
+
+// run streams until the server or the player stops, or pause is closed.
+func (s *session) run(pause <-chan struct{}) error {
+  conn, err := net.DialTimeout("tcp", s.addr, 5*time.Second)
   if err != nil {
-    log.Fatalf("connect failed: %v", err)
+    return fmt.Errorf("connect failed: %v", err)
   }
   defer conn.Close()
+  if pause != nil {
+    done := make(chan struct{})
+    defer close(done)
+    go func() {
+      select {
+      case <-pause:
+        conn.Close()
+      case <-done:
+      }
+    }()
+  }
 
   // Spartan request: "<method> <path> <content-length>\r\n"
-  req := fmt.Sprintf("GET %s 0\r\n", *path)
+  req := fmt.Sprintf("GET %s 0\r\n", s.path)
   if _, err := conn.Write([]byte(req)); err != nil {
-    log.Fatalf("send failed: %v", err)
+    return fmt.Errorf("send failed: %v", err)
   }
 
   br := bufio.NewReader(conn)
   hdr, err := br.ReadString('\n')
   if err != nil {
-    log.Fatalf("read header failed: %v", err)
+    return fmt.Errorf("read header failed: %v", err)
   }
   hdr = strings.TrimRight(hdr, "\r\n")
 
   if !strings.HasPrefix(hdr, "2 ") {
-    // print error header and exit
-    fmt.Fprintln(os.Stderr, "Server replied:", hdr)
-    os.Exit(1)
+    return fmt.Errorf("server replied: %s", hdr)
   }
 
   mime := strings.TrimSpace(strings.TrimPrefix(hdr, "2 "))
   fmt.Fprintln(os.Stderr, "OK, MIME:", mime)
 
+  if s.player == "none" {
+    for {
+      page, err := readPage(br)
+      if err != nil {
+        select {
+        case <-pause:
+        default:
+          log.Printf("stream ended: %v", err)
+        }
+        return nil
+      }
+      s.rec.page(page)
+    }
+  }
+
   // Launch a player that reads from stdin.
   var cmd *exec.Cmd
-  switch *player {
+  switch s.player {
   case "ffplay":
     // -nodisp: no video window; -autoexit: exit when stream ends
     cmd = exec.Command("ffplay", "-nodisp", "-autoexit", "-i", "-")
@@ -63,32 +239,56 @@ func main() {
     // VLC reads stdin via "-" on some platforms; on others you may need "fd://0"
     cmd = exec.Command("vlc", "-")
   default:
-    log.Fatalf("unknown player: %s (use ffplay|mpv|vlc)", *player)
+    return fmt.Errorf("unknown player: %s (use ffplay|mpv|mplayer|vlc|none)", s.player)
   }
 
   cmd.Stdout = os.Stdout
   cmd.Stderr = os.Stderr
+  if s.quiet {
+    // The player's own status output would garble the progress bar.
+    cmd.Stdout, cmd.Stderr = nil, nil
+  }
   in, err := cmd.StdinPipe()
   if err != nil {
-    log.Fatalf("stdin pipe failed: %v", err)
+    return fmt.Errorf("stdin pipe failed: %v", err)
   }
 
   if err := cmd.Start(); err != nil {
-    log.Fatalf("player start failed: %v", err)
+    return fmt.Errorf("player start failed: %v", err)
   }
 
-  // Copy stream bytes to player stdin
-  _, copyErr := io.Copy(in, br)
+  // Copy stream bytes to player stdin (page by page when recording)
+  var copyErr error
+  if s.rec == nil {
+    _, copyErr = io.Copy(in, br)
+  } else {
+    for {
+      page, err := readPage(br)
+      if err != nil {
+        copyErr = err
+        break
+      }
+      s.rec.page(page)
+      if _, err := in.Write(page); err != nil {
+        copyErr = err
+        break
+      }
+    }
+  }
   _ = in.Close()
 
   // Wait for player to exit
   waitErr := cmd.Wait()
 
   if copyErr != nil && copyErr != io.EOF {
-    log.Printf("stream ended with error: %v", copyErr)
+    select {
+    case <-pause:
+    default:
+      log.Printf("stream ended with error: %v", copyErr)
+    }
   }
   if waitErr != nil {
     log.Printf("player exited with error: %v", waitErr)
   }
+  return nil
 }
-
@@ -0,0 +1,155 @@
+package main
+
+import (
+  "bufio"
+  "encoding/json"
+  "fmt"
+  "log"
+  "net"
+  "os"
+  "os/exec"
+  "runtime"
+  "strings"
+  "time"
+)
+
+// nowPlaying is what the server reports at /nowplaying.json.
+type nowPlaying struct {
+  Playing   bool     `json:"playing"`
+  Title     string   `json:"title"`
+  Elapsed   float64  `json:"elapsed_seconds"`
+  Duration  float64  `json:"duration_seconds"`
+  Remaining *float64 `json:"remaining_seconds"`
+}
+
+// fetchNowPlaying asks the server at addr what is playing.
+func fetchNowPlaying(addr, host string) (*nowPlaying, error) {
+  conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+  if err != nil {
+    return nil, err
+  }
+  defer conn.Close()
+  _ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+  if _, err := fmt.Fprintf(conn, "%s /nowplaying.json 0\r\n", host); err != nil {
+    return nil, err
+  }
+  br := bufio.NewReader(conn)
+  hdr, err := br.ReadString('\n')
+  if err != nil {
+    return nil, err
+  }
+  if hdr = strings.TrimRight(hdr, "\r\n"); !strings.HasPrefix(hdr, "2 ") {
+    return nil, fmt.Errorf("server replied: %s", hdr)
+  }
+  np := &nowPlaying{}
+  if err := json.NewDecoder(br).Decode(np); err != nil {
+    return nil, err
+  }
+  return np, nil
+}
+
+// clock formats seconds as M:SS.
+func clock(s float64) string {
+  n := int(s + 0.5)
+  return fmt.Sprintf("%d:%02d", n/60, n%60)
+}
+
+// progressLine draws one status line for np, elapsed seconds into the track.
+func progressLine(np *nowPlaying, elapsed float64) string {
+  if !np.Playing {
+    return "nothing playing"
+  }
+  title := []rune(np.Title)
+  if len(title) > 40 {
+    title = append(title[:39], '…')
+  }
+  if np.Duration <= 0 {
+    return fmt.Sprintf("%s  %s", string(title), clock(elapsed))
+  }
+  const width = 30
+  elapsed = min(elapsed, np.Duration)
+  done := int(elapsed / np.Duration * width)
+  bar := strings.Repeat("#", done) + strings.Repeat("-", width-done)
+  return fmt.Sprintf("%s  [%s] %s / %s (-%s)", string(title), bar, clock(elapsed), clock(np.Duration), clock(np.Duration-elapsed))
+}
+
+// watchNowPlaying asks the server what is playing every few seconds. With
+// bar set it keeps a progress bar for the current track on stderr,
+// refreshed in place every second; notify, if not nil, is called with
+// every track that comes on.
+func watchNowPlaying(addr, host string, bar bool, notify func(np *nowPlaying), stop <-chan struct{}) {
+  const poll = 5 * time.Second
+  var np *nowPlaying
+  var fetched, asked time.Time
+  tick := time.NewTicker(time.Second)
+  defer tick.Stop()
+  for {
+    now := time.Now()
+    due := now.Sub(asked) >= poll
+    if np != nil && np.Duration > 0 && np.Elapsed+now.Sub(fetched).Seconds() >= np.Duration {
+      due = now.Sub(asked) >= time.Second // the next track should be on
+    }
+    if due {
+      asked = now
+      got, err := fetchNowPlaying(addr, host)
+      if err != nil && np == nil {
+        fmt.Fprintf(os.Stderr, "\nno now-playing info: %v\n", err)
+        return
+      }
+      if err == nil {
+        if notify != nil && got.Playing && (np == nil || got.Title != np.Title) {
+          notify(got)
+        }
+        np, fetched = got, now
+      }
+    }
+    if bar && np != nil {
+      fmt.Fprintf(os.Stderr, "\r\033[K%s", progressLine(np, np.Elapsed+time.Since(fetched).Seconds()))
+    }
+    select {
+    case <-stop:
+      if bar {
+        fmt.Fprintln(os.Stderr)
+      }
+      return
+    case <-tick.C:
+    }
+  }
+}
+
+// notifier returns a func that shows a desktop notification for a new
+// track: through cmd if set, run by the shell with the title in
+// $SWP_TITLE, or else notify-send (libnotify) or terminal-notifier,
+// whichever is installed.
+func notifier(cmd string) (func(title string), error) {
+  if cmd != "" {
+    return func(title string) {
+      c := exec.Command("sh", "-c", cmd)
+      c.Env = append(os.Environ(), "SWP_TITLE="+title)
+      if out, err := c.CombinedOutput(); err != nil {
+        log.Printf("notify: %v: %s", err, strings.TrimSpace(string(out)))
+      }
+    }, nil
+  }
+  tools := []string{"notify-send", "terminal-notifier"}
+  if runtime.GOOS == "darwin" {
+    tools = []string{"terminal-notifier", "notify-send"}
+  }
+  for _, tool := range tools {
+    if _, err := exec.LookPath(tool); err != nil {
+      continue
+    }
+    return func(title string) {
+      var c *exec.Cmd
+      if tool == "notify-send" {
+        c = exec.Command(tool, "-a", "swp", "Now playing", title)
+      } else {
+        c = exec.Command(tool, "-title", "Now playing", "-message", title)
+      }
+      if err := c.Run(); err != nil {
+        log.Printf("notify: %v", err)
+      }
+    }, nil
+  }
+  return nil, fmt.Errorf("neither notify-send nor terminal-notifier found; use -notify-cmd")
+}
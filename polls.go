@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// ---------------- polls and forms ----------------
+
+// -polls FILE defines polls and feedback forms that listeners answer with
+// Spartan input:
+//
+//	# comments and blank lines are ignored
+//	poll album Best album of the month?
+//	- Album A
+//	- Album B
+//	form feedback How are we doing? Tell us anything.
+//
+// A poll has two or more options and shows its results to everyone; a form
+// takes free text that only the station reads, through /admin/polls.
+// Answers are kept in the store, bucket "polls", one key per poll. Each
+// address may answer each poll once; the addresses themselves are only held,
+// as salted hashes, in memory, so a restart lets everyone answer again.
+
+const pollsBucket = "polls"
+
+// Longest form answer accepted, in bytes.
+const maxFormAnswer = 2000
+
+var pollIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+type poll struct {
+	id       string
+	question string
+	options  []string // nil for a form
+}
+
+func (p *poll) form() bool { return p.options == nil }
+
+// readPolls parses a -polls file.
+func readPolls(path string) ([]*poll, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var polls []*poll
+	seen := map[string]bool{}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if opt, ok := strings.CutPrefix(line, "- "); ok {
+			if len(polls) == 0 || polls[len(polls)-1].form() {
+				return nil, fmt.Errorf("%s:%d: option outside a poll", path, n)
+			}
+			p := polls[len(polls)-1]
+			p.options = append(p.options, strings.TrimSpace(opt))
+			continue
+		}
+		kind, rest, _ := strings.Cut(line, " ")
+		id, question, _ := strings.Cut(strings.TrimSpace(rest), " ")
+		question = strings.TrimSpace(question)
+		if (kind != "poll" && kind != "form") || !pollIDPattern.MatchString(id) || question == "" {
+			return nil, fmt.Errorf("%s:%d: expected poll ID QUESTION, form ID PROMPT or - OPTION", path, n)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("%s:%d: duplicate id %q", path, n, id)
+		}
+		seen[id] = true
+		p := &poll{id: id, question: question}
+		if kind == "poll" {
+			p.options = []string{}
+		}
+		polls = append(polls, p)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	for _, p := range polls {
+		if !p.form() && len(p.options) < 2 {
+			return nil, fmt.Errorf("%s: poll %q needs at least two options", path, p.id)
+		}
+	}
+	return polls, nil
+}
+
+type pollAnswer struct {
+	Time   string `json:"time"`
+	Answer string `json:"answer"`
+}
+
+type pollBox struct {
+	db    store
+	polls []*poll
+
+	mu       sync.Mutex
+	salt     [32]byte
+	answered map[string]map[string]struct{} // poll id -> hashed addresses
+}
+
+func newPollBox(db store, polls []*poll) *pollBox {
+	pb := &pollBox{db: db, polls: polls, answered: make(map[string]map[string]struct{})}
+	_, _ = rand.Read(pb.salt[:])
+	return pb
+}
+
+func (pb *pollBox) poll(id string) *poll {
+	for _, p := range pb.polls {
+		if p.id == id {
+			return p
+		}
+	}
+	return nil
+}
+
+var errAnswered = errors.New("you have already answered")
+
+// answer validates and records remote's answer to p.
+func (pb *pollBox) answer(p *poll, remote, text string, now time.Time) error {
+	text = strings.TrimSpace(text)
+	if p.form() {
+		if text == "" || len(text) > maxFormAnswer || !utf8.ValidString(text) {
+			return fmt.Errorf("send up to %d bytes of text", maxFormAnswer)
+		}
+	} else {
+		choice := ""
+		if n, err := strconv.Atoi(text); err == nil && n >= 1 && n <= len(p.options) {
+			choice = p.options[n-1]
+		}
+		for _, o := range p.options {
+			if strings.EqualFold(o, text) {
+				choice = o
+			}
+		}
+		if choice == "" {
+			return fmt.Errorf("not an option; send a number from 1 to %d", len(p.options))
+		}
+		text = choice
+	}
+
+	ip, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		ip = remote
+	}
+	mac := hmac.New(sha256.New, pb.salt[:])
+	mac.Write([]byte(ip))
+	who := string(mac.Sum(nil))
+
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	if _, ok := pb.answered[p.id][who]; ok {
+		return errAnswered
+	}
+	rows, err := pb.db.Get(pollsBucket, p.id)
+	if err != nil && !errors.Is(err, errNotFound) {
+		return err
+	}
+	var row bytes.Buffer
+	cw := csv.NewWriter(&row)
+	_ = cw.Write([]string{now.UTC().Format(time.RFC3339), text})
+	cw.Flush()
+	if err := pb.db.Put(pollsBucket, p.id, append(rows, row.Bytes()...)); err != nil {
+		return err
+	}
+	if pb.answered[p.id] == nil {
+		pb.answered[p.id] = make(map[string]struct{})
+	}
+	pb.answered[p.id][who] = struct{}{}
+	return nil
+}
+
+// answers returns every stored answer to p, oldest first.
+func (pb *pollBox) answers(p *poll) ([]pollAnswer, error) {
+	pb.mu.Lock()
+	rows, err := pb.db.Get(pollsBucket, p.id)
+	pb.mu.Unlock()
+	if errors.Is(err, errNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	recs, err := csv.NewReader(bytes.NewReader(rows)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]pollAnswer, 0, len(recs))
+	for _, r := range recs {
+		if len(r) == 2 {
+			out = append(out, pollAnswer{r[0], r[1]})
+		}
+	}
+	return out, nil
+}
+
+// tally counts the answers to a poll per option, in option order.
+func (pb *pollBox) tally(p *poll) ([]int, error) {
+	answers, err := pb.answers(p)
+	if err != nil {
+		return nil, err
+	}
+	counts := make([]int, len(p.options))
+	for _, a := range answers {
+		for i, o := range p.options {
+			if a.Answer == o {
+				counts[i]++
+			}
+		}
+	}
+	return counts, nil
+}
+
+// writePolls renders /polls.
+func (srv *server) writePolls(w io.Writer) {
+	fmt.Fprintf(w, "2 text/gemini; charset=utf-8\r\n")
+	fmt.Fprintf(w, "# %s: polls\n\n", srv.title())
+	if len(srv.polls.polls) == 0 {
+		fmt.Fprintf(w, "No polls right now.\n")
+	}
+	for _, p := range srv.polls.polls {
+		fmt.Fprintf(w, "=> /poll/%s %s\n", p.id, p.question)
+	}
+}
+
+// handlePoll renders /poll/ID, recording input as an answer first.
+func (srv *server) handlePoll(w io.Writer, id, remote, input string) {
+	p := srv.polls.poll(id)
+	if p == nil {
+		fmt.Fprintf(w, "4 no such poll\r\n")
+		return
+	}
+	thanks := false
+	if input != "" {
+		if err := srv.polls.answer(p, remote, input, time.Now()); err != nil {
+			fmt.Fprintf(w, "4 %v\r\n", err)
+			return
+		}
+		thanks = true
+	}
+
+	fmt.Fprintf(w, "2 text/gemini; charset=utf-8\r\n")
+	fmt.Fprintf(w, "# %s\n\n", p.question)
+	if thanks {
+		fmt.Fprintf(w, "Thank you, your answer is in.\n\n")
+	}
+	if p.form() {
+		if !thanks {
+			fmt.Fprintf(w, "=: /poll/%s Answer\n\n", p.id)
+		}
+		fmt.Fprintf(w, "Answers are read by the station and not published.\n")
+		fmt.Fprintf(w, "\n=> /polls All polls\n")
+		return
+	}
+
+	counts, err := srv.polls.tally(p)
+	if err != nil {
+		fmt.Fprintf(w, "Results are unavailable: %v\n", err)
+		return
+	}
+	total := 0
+	for _, c := range counts {
+		total += c
+	}
+	for i, o := range p.options {
+		pct := 0
+		if total > 0 {
+			pct = counts[i] * 100 / total
+		}
+		bar := ""
+		if pct >= 5 {
+			bar = " " + strings.Repeat("#", pct/5)
+		}
+		fmt.Fprintf(w, "%d. %s: %d (%d%%)%s\n", i+1, o, counts[i], pct, bar)
+	}
+	if total == 1 {
+		fmt.Fprintf(w, "\n1 answer\n")
+	} else {
+		fmt.Fprintf(w, "\n%d answers\n", total)
+	}
+	if !thanks {
+		fmt.Fprintf(w, "=: /poll/%s Vote: send the number of your choice\n", p.id)
+	}
+	fmt.Fprintf(w, "=> /polls All polls\n")
+}
+
+type adminPoll struct {
+	ID       string         `json:"id"`
+	Kind     string         `json:"kind"`
+	Question string         `json:"question"`
+	Results  map[string]int `json:"results,omitempty"`
+	Answers  []pollAnswer   `json:"answers,omitempty"` // forms only
+}
+
+// adminPolls returns the results of every poll and the answers to every
+// form.
+func (pb *pollBox) adminPolls() ([]adminPoll, error) {
+	var out []adminPoll
+	for _, p := range pb.polls {
+		ap := adminPoll{ID: p.id, Kind: "poll", Question: p.question}
+		if p.form() {
+			ap.Kind = "form"
+			answers, err := pb.answers(p)
+			if err != nil {
+				return nil, err
+			}
+			ap.Answers = answers
+		} else {
+			counts, err := pb.tally(p)
+			if err != nil {
+				return nil, err
+			}
+			ap.Results = make(map[string]int)
+			for i, o := range p.options {
+				ap.Results[o] = counts[i]
+			}
+		}
+		out = append(out, ap)
+	}
+	return out, nil
+}
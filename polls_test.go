@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPolls(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "polls")
+	def := "# test\npoll album Best album?\n- Album A\n- Album B\n\nform feedback How are we doing?\n"
+	if err := os.WriteFile(path, []byte(def), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	polls, err := readPolls(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(polls) != 2 || len(polls[0].options) != 2 || !polls[1].form() {
+		t.Fatalf("parsed %+v", polls)
+	}
+
+	pb := newPollBox(newMemStore(), polls)
+	album, now := pb.poll("album"), time.Now()
+	if err := pb.answer(album, "10.0.0.1:4000", "3", now); err == nil {
+		t.Error("out-of-range option accepted")
+	}
+	if err := pb.answer(album, "10.0.0.1:4000", "2", now); err != nil {
+		t.Fatal(err)
+	}
+	if err := pb.answer(album, "10.0.0.1:4001", "album a", now); !errors.Is(err, errAnswered) {
+		t.Errorf("second answer from one address: %v", err)
+	}
+	if err := pb.answer(album, "10.0.0.2:4000", "album a", now); err != nil {
+		t.Fatal(err)
+	}
+	counts, err := pb.tally(album)
+	if err != nil || counts[0] != 1 || counts[1] != 1 {
+		t.Errorf("tally %v, %v", counts, err)
+	}
+
+	// The same address may still answer another poll.
+	if err := pb.answer(pb.poll("feedback"), "10.0.0.1:4000", "Nice, \"really\"", now); err != nil {
+		t.Fatal(err)
+	}
+	answers, err := pb.answers(pb.poll("feedback"))
+	if err != nil || len(answers) != 1 || answers[0].Answer != "Nice, \"really\"" {
+		t.Errorf("answers %+v, %v", answers, err)
+	}
+
+	for _, bad := range []string{"- orphan\n", "poll x Only one?\n- A\n", "vote x Q\n", "form Bad_ID Q\n"} {
+		if err := os.WriteFile(path, []byte(bad), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readPolls(path); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
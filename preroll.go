@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// ---------------- preroll ----------------
+
+// preroll is a short clip sent to each listener before the live stream. It is
+// encoded with the live encoder settings the first time a listener needs it,
+// and again whenever the file changes.
+type preroll struct {
+	path string
+	enc  encoderConfig
+
+	mu      sync.Mutex
+	data    []byte
+	modTime time.Time
+}
+
+func (pr *preroll) bytes() ([]byte, error) {
+	st, err := os.Stat(pr.path)
+	if err != nil {
+		return nil, err
+	}
+
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	if pr.data != nil && st.ModTime().Equal(pr.modTime) {
+		return pr.data, nil
+	}
+
+	data, err := encodeFileToOgg(pr.enc, pr.path)
+	if err != nil {
+		return nil, err
+	}
+	pr.data, pr.modTime = data, st.ModTime()
+	return data, nil
+}
+
+// encodeFileToOgg encodes a whole file into an in-memory Ogg stream using the
+// same output settings as the live encoder.
+func encodeFileToOgg(cfg encoderConfig, path string) ([]byte, error) {
+	args := []string{"-hide_banner", "-loglevel", "warning", "-i", path}
+	args = append(args, cfg.outputArgs()...)
+	args = append(args, "pipe:1")
+
+	var out bytes.Buffer
+	cmd := exec.Command(cfg.ffmpegPath, args...)
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("encoding %s: %w", path, err)
+	}
+	return out.Bytes(), nil
+}
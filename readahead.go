@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// ---------------- read-ahead ----------------
+
+// While a track plays, the feeder opens the next one and reads its first
+// readAheadBytes into memory. That track's decode then starts from memory,
+// and ffmpeg reads the rest from the already open file through a pipe, so a
+// slow disk or a cold cache on a network mount is waited out during the
+// previous track instead of as a gap at the boundary. A guess that turns out
+// wrong (a request came in, the file was skipped) is dropped and the track
+// is opened when it plays.
+
+var readAheadBytes = 4 << 20 // some 20 seconds of CD-quality WAV; see -low-memory
+
+type readAhead struct {
+	path string
+	done chan struct{}
+	file *os.File // positioned after head
+	head []byte
+	err  error
+}
+
+// startReadAhead opens p and reads its beginning in the background.
+func startReadAhead(p string) *readAhead {
+	r := &readAhead{path: p, done: make(chan struct{})}
+	go func() {
+		r.file, r.head, r.err = openReadable(p, readAheadBytes)
+		close(r.done)
+	}()
+	return r
+}
+
+// reader waits for the read-ahead and returns the whole file as a stream.
+// The caller closes it.
+func (r *readAhead) reader() (io.ReadCloser, error) {
+	<-r.done
+	if r.err != nil {
+		return nil, r.err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(r.head), r.file), r.file}, nil
+}
+
+// drop abandons the read-ahead.
+func (r *readAhead) drop() {
+	go func() {
+		<-r.done
+		if r.file != nil {
+			r.file.Close()
+		}
+	}()
+}
+
+// readAhead starts reading p ahead of its turn, dropping an earlier guess.
+func (f *feeder) readAhead(p string) {
+	if f.ahead != nil {
+		if f.ahead.path == p {
+			return
+		}
+		f.ahead.drop()
+	}
+	f.ahead = startReadAhead(p)
+}
+
+// takeAhead returns the read-ahead of p, starting one now if p wasn't the
+// guess.
+func (f *feeder) takeAhead(p string) *readAhead {
+	r := f.ahead
+	f.ahead = nil
+	if r != nil && r.path == p {
+		return r
+	}
+	if r != nil {
+		r.drop()
+	}
+	return startReadAhead(p)
+}
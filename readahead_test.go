@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadAhead(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.wav"), filepath.Join(dir, "b.wav")
+	data := bytes.Repeat([]byte("0123456789"), readAheadBytes/10+100)
+	for _, p := range []string{a, b} {
+		if err := os.WriteFile(p, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f := &feeder{}
+	f.readAhead(a)
+	guess := f.ahead
+	if r := f.takeAhead(a); r != guess {
+		t.Error("the guess was not used")
+	}
+	f.readAhead(a)
+	if r := f.takeAhead(b); r == guess || r.path != b {
+		t.Error("a wrong guess was used")
+	}
+
+	src, err := startReadAhead(a).reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(src)
+	src.Close()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("read %d bytes, want %d: %v", len(got), len(data), err)
+	}
+
+	if _, err := startReadAhead(filepath.Join(dir, "gone.wav")).reader(); !os.IsNotExist(err) {
+		t.Errorf("missing file: %v", err)
+	}
+}
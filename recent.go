@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ---------------- /history ----------------
+
+// /history lists the last -recent files the feeder put on air, newest
+// first, with the time each started: for the listener who tuned in late
+// and wants to know what that song was. Station IDs are left out; requests
+// and voice items are listed. The list is kept in memory only.
+
+type recentPlay struct {
+	path string
+	at   time.Time
+}
+
+type recentPlays struct {
+	size int
+
+	mu    sync.Mutex
+	plays []recentPlay // oldest first
+}
+
+// add records that p started at at.
+func (r *recentPlays) add(p string, at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.plays = append(r.plays, recentPlay{p, at})
+	if len(r.plays) > r.size {
+		r.plays = r.plays[len(r.plays)-r.size:]
+	}
+}
+
+// list returns the plays, newest first.
+func (r *recentPlays) list() []recentPlay {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]recentPlay, len(r.plays))
+	for i, p := range r.plays {
+		out[len(out)-1-i] = p
+	}
+	return out
+}
+
+// writeHistory renders /history with now in the station time zone.
+func (srv *server) writeHistory(w io.Writer, now time.Time) {
+	st := srv.stations[0]
+	fmt.Fprintf(w, "2 text/gemini; charset=utf-8\r\n")
+	fmt.Fprintf(w, "# %s: recently played\n\n", srv.title())
+	plays := st.feed.recent.list()
+	if len(plays) == 0 {
+		fmt.Fprintf(w, "Nothing has played yet.\n")
+		return
+	}
+	current, _ := st.feed.nowPlaying()
+	today := now.Format("2006-01-02")
+	for i, p := range plays {
+		at := p.at.In(now.Location())
+		when := at.Format("15:04")
+		if at.Format("2006-01-02") != today {
+			when = at.Format("Jan 2 15:04")
+		}
+		line := fmt.Sprintf("%s  %s", when, srv.itemTitle(p.path))
+		if i == 0 && p.path == current {
+			line += " (on air)"
+		}
+		fmt.Fprintf(w, "* %s\n", line)
+	}
+}
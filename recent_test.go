@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecentPlays(t *testing.T) {
+	r := &recentPlays{size: 2}
+	start := time.Date(2026, 10, 16, 20, 0, 0, 0, time.UTC)
+	for i, p := range []string{"a.wav", "b.wav", "c.wav"} {
+		r.add(p, start.Add(time.Duration(i)*time.Minute))
+	}
+	plays := r.list()
+	if len(plays) != 2 || plays[0].path != "c.wav" || plays[1].path != "b.wav" {
+		t.Fatalf("plays %+v", plays)
+	}
+	if !plays[1].at.Equal(start.Add(time.Minute)) {
+		t.Errorf("b.wav at %v", plays[1].at)
+	}
+}
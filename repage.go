@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+)
+
+// ---------------- Ogg page building ----------------
+
+var oggCRCTable = func() (t [256]uint32) {
+	for i := range t {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		t[i] = r
+	}
+	return t
+}()
+
+func oggCRC(p []byte) uint32 {
+	var crc uint32
+	for _, c := range p {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^c]
+	}
+	return crc
+}
+
+// oggPage is a parsed page; segs are the lacing values, body the payload.
+type oggPage struct {
+	flags   byte // 0x01 continued, 0x02 BOS, 0x04 EOS
+	granule int64
+	serial  uint32
+	seq     uint32
+	segs    []byte
+	body    []byte
+}
+
+func parseOggPage(page []byte) (*oggPage, bool) {
+	if len(page) < 27 || !bytes.Equal(page[:4], []byte("OggS")) {
+		return nil, false
+	}
+	segCount := int(page[26])
+	if len(page) < 27+segCount {
+		return nil, false
+	}
+	return &oggPage{
+		flags:   page[5],
+		granule: int64(binary.LittleEndian.Uint64(page[6:14])),
+		serial:  binary.LittleEndian.Uint32(page[14:18]),
+		seq:     binary.LittleEndian.Uint32(page[18:22]),
+		segs:    page[27 : 27+segCount],
+		body:    page[27+segCount:],
+	}, true
+}
+
+// bytes serializes the page, computing its CRC.
+func (p *oggPage) bytes() []byte {
+	out := make([]byte, 27, 27+len(p.segs)+len(p.body))
+	copy(out, "OggS")
+	out[5] = p.flags
+	binary.LittleEndian.PutUint64(out[6:14], uint64(p.granule))
+	binary.LittleEndian.PutUint32(out[14:18], p.serial)
+	binary.LittleEndian.PutUint32(out[18:22], p.seq)
+	out[26] = byte(len(p.segs))
+	out = append(out, p.segs...)
+	out = append(out, p.body...)
+	binary.LittleEndian.PutUint32(out[22:26], oggCRC(out))
+	return out
+}
+
+// openStreams remembers where each logical stream that has not ended
+// stands, so that streams cut off by a dying encoder can be closed.
+type openStreams map[uint32]*oggPage
+
+func (o openStreams) see(page []byte) {
+	p, ok := parseOggPage(page)
+	if !ok {
+		return
+	}
+	if p.flags&0x04 != 0 {
+		delete(o, p.serial)
+		return
+	}
+	last := o[p.serial]
+	if last == nil {
+		last = &oggPage{serial: p.serial}
+		o[p.serial] = last
+	}
+	last.seq = p.seq
+	if p.granule != -1 { // no packet ends on the page
+		last.granule = p.granule
+	}
+}
+
+// eos returns an empty end-of-stream page for every open stream, in
+// serial order, and forgets them.
+func (o openStreams) eos() [][]byte {
+	serials := make([]uint32, 0, len(o))
+	for s := range o {
+		serials = append(serials, s)
+	}
+	slices.Sort(serials)
+	var out [][]byte
+	for _, s := range serials {
+		last := o[s]
+		end := &oggPage{flags: 0x04, granule: last.granule, serial: s, seq: last.seq + 1}
+		out = append(out, end.bytes())
+		delete(o, s)
+	}
+	return out
+}
+
+// ---------------- Vorbis packet durations ----------------
+
+// vorbisTiming knows enough about a Vorbis stream to compute the sample
+// duration of each audio packet: the two block sizes from the identification
+// header and each mode's block flag from the setup header.
+type vorbisTiming struct {
+	rate      int
+	blocksize [2]int
+	modeBlock []int // per mode: 0 short, 1 long
+	modeMask  byte
+}
+
+func (vt *vorbisTiming) parseIdent(pkt []byte) bool {
+	if len(pkt) < 30 || pkt[0] != 0x01 || !bytes.Equal(pkt[1:7], []byte("vorbis")) {
+		return false
+	}
+	vt.rate = int(binary.LittleEndian.Uint32(pkt[12:16]))
+	vt.blocksize[0] = 1 << (pkt[28] & 0x0f)
+	vt.blocksize[1] = 1 << (pkt[28] >> 4)
+	return vt.rate > 0
+}
+
+// revBits reads a byte slice back to front, which walks the LSB-first Vorbis
+// bitstream in reverse.
+type revBits struct {
+	buf []byte
+	pos int // bits consumed
+}
+
+func (r *revBits) left() int { return len(r.buf)*8 - r.pos }
+
+func (r *revBits) read(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		b := r.buf[len(r.buf)-1-r.pos/8]
+		v = v<<1 | uint32(b>>(7-r.pos%8))&1
+		r.pos++
+	}
+	return v
+}
+
+// parseSetup finds the mode block flags. The modes are the last field of the
+// setup header, so they are located by scanning backwards from the framing
+// bit rather than decoding the codebooks, floors and residues before them
+// (the same approach ffmpeg's vorbis parser and liboggz take).
+func (vt *vorbisTiming) parseSetup(pkt []byte) bool {
+	if len(pkt) < 7 || pkt[0] != 0x05 || !bytes.Equal(pkt[1:7], []byte("vorbis")) {
+		return false
+	}
+	r := &revBits{buf: pkt}
+	framing := 0
+	for r.left() > 97 {
+		if r.read(1) == 1 {
+			framing = r.pos
+			break
+		}
+	}
+	if framing == 0 {
+		return false
+	}
+
+	modeCount, lastCount := 0, 0
+	for r.left() >= 97 {
+		if r.read(8) > 63 || r.read(16) != 0 || r.read(16) != 0 {
+			break
+		}
+		r.read(1)
+		modeCount++
+		if modeCount > 64 {
+			break
+		}
+		peek := *r
+		if int(peek.read(6))+1 == modeCount {
+			lastCount = modeCount
+		}
+	}
+	if lastCount == 0 {
+		return false
+	}
+
+	r = &revBits{buf: pkt, pos: framing}
+	vt.modeBlock = make([]int, lastCount)
+	for i := lastCount - 1; i >= 0; i-- {
+		r.read(40)
+		vt.modeBlock[i] = int(r.read(1))
+	}
+	bits := 0
+	for n := lastCount - 1; n > 0; n >>= 1 {
+		bits++
+	}
+	vt.modeMask = byte((1<<bits)-1) << 1
+	return true
+}
+
+func (vt *vorbisTiming) ready() bool { return vt.rate > 0 && len(vt.modeBlock) > 0 }
+
+// packetBlock returns the block size of an audio packet given its first byte.
+func (vt *vorbisTiming) packetBlock(first byte) int {
+	mode := 0
+	if len(vt.modeBlock) > 1 {
+		mode = int(first&vt.modeMask) >> 1
+	}
+	if mode >= len(vt.modeBlock) {
+		mode = 0
+	}
+	return vt.blocksize[vt.modeBlock[mode]]
+}
+
+// ---------------- repagination ----------------
+
+// repaginator splits audio pages so that no page carries more than maxMs of
+// audio. Pages are only cut after a complete packet, and every
+// cut page gets the exact granule position of its last packet, so the
+// output remains a valid Ogg/Vorbis stream. Sequence numbers are rewritten
+// for the whole logical stream. Non-Vorbis streams pass through unchanged.
+type repaginator struct {
+	maxMs int
+
+	serial  uint32
+	vorbis  bool
+	timing  vorbisTiming
+	headers int
+	pkt     []byte // header packet being assembled
+
+	seq       uint32
+	prevBlock int  // block size of the last completed audio packet
+	openFirst byte // first byte of the packet continued onto the next page
+	open      bool
+}
+
+func newRepaginator(maxMs int) *repaginator {
+	return &repaginator{maxMs: maxMs}
+}
+
+// piece is the run of segments belonging to one packet within a page.
+type piece struct {
+	from, to int // segment indexes
+	bodyFrom int
+	bodyTo   int
+	complete bool
+	first    byte
+}
+
+func (rp *repaginator) feed(raw []byte) [][]byte {
+	p, ok := parseOggPage(raw)
+	if !ok {
+		return [][]byte{raw}
+	}
+
+	if p.flags&0x02 != 0 {
+		*rp = repaginator{maxMs: rp.maxMs, serial: p.serial, seq: p.seq}
+		rp.vorbis = len(p.body) >= 7 && p.body[0] == 0x01 && bytes.Equal(p.body[1:7], []byte("vorbis"))
+	}
+	if !rp.vorbis || p.serial != rp.serial {
+		return [][]byte{raw}
+	}
+
+	if rp.headers < 3 {
+		rp.collectHeaders(p)
+		return [][]byte{rp.renumber(p)}
+	}
+
+	pieces := rp.split(p)
+	if p.granule < 0 || !rp.timing.ready() {
+		rp.track(pieces)
+		return [][]byte{rp.renumber(p)}
+	}
+
+	// Per completed packet: its block size, duration and end granule.
+	type done struct {
+		idx      int
+		duration int64
+		granule  int64
+	}
+	var packets []done
+	prev := rp.prevBlock
+	for i, pc := range pieces {
+		if !pc.complete {
+			continue
+		}
+		bs := rp.timing.packetBlock(pc.first)
+		if prev == 0 {
+			prev = bs
+		}
+		packets = append(packets, done{idx: i, duration: int64(prev/4 + bs/4)})
+		prev = bs
+	}
+	rp.track(pieces)
+	if len(packets) < 2 {
+		return [][]byte{rp.renumber(p)}
+	}
+	g := p.granule
+	for k := len(packets) - 1; k >= 0; k-- {
+		packets[k].granule = g
+		g -= packets[k].duration
+	}
+
+	limit := int64(rp.maxMs) * int64(rp.timing.rate) / 1000
+	var out [][]byte
+	start, acc := 0, int64(0)
+	for k, pk := range packets {
+		acc += pk.duration
+		last := k == len(packets)-1
+		if last || acc < limit {
+			continue
+		}
+		end := pk.idx + 1
+		out = append(out, rp.emit(p, pieces[start:end], pk.granule, start == 0, false))
+		start, acc = end, 0
+	}
+	// The last completed packet never closes a cut, so the remainder
+	// (including any packet continued onto the next page) is never empty.
+	return append(out, rp.emit(p, pieces[start:], p.granule, start == 0, true))
+}
+
+// split groups p's segments into per-packet pieces.
+func (rp *repaginator) split(p *oggPage) []piece {
+	var pieces []piece
+	cur := piece{}
+	off := 0
+	startNew := true
+	for i, lace := range p.segs {
+		if startNew {
+			cur = piece{from: i, bodyFrom: off}
+			if i == 0 && p.flags&0x01 != 0 && rp.open {
+				cur.first = rp.openFirst
+			} else if off < len(p.body) {
+				cur.first = p.body[off]
+			}
+			startNew = false
+		}
+		off += int(lace)
+		if lace < 255 {
+			cur.to, cur.bodyTo, cur.complete = i+1, off, true
+			pieces = append(pieces, cur)
+			startNew = true
+		}
+	}
+	if !startNew {
+		cur.to, cur.bodyTo = len(p.segs), off
+		pieces = append(pieces, cur)
+	}
+	return pieces
+}
+
+// track updates the cross-page state after a page's pieces were consumed.
+func (rp *repaginator) track(pieces []piece) {
+	for _, pc := range pieces {
+		if pc.complete {
+			rp.prevBlock = rp.timing.packetBlock(pc.first)
+			rp.open = false
+		} else {
+			rp.openFirst, rp.open = pc.first, true
+		}
+	}
+}
+
+func (rp *repaginator) emit(src *oggPage, pieces []piece, granule int64, first, last bool) []byte {
+	a, z := pieces[0], pieces[len(pieces)-1]
+	p := &oggPage{
+		granule: granule,
+		serial:  src.serial,
+		segs:    src.segs[a.from:z.to],
+		body:    src.body[a.bodyFrom:z.bodyTo],
+	}
+	if first {
+		p.flags |= src.flags & 0x03
+	}
+	if last {
+		p.flags |= src.flags & 0x04
+	}
+	return rp.renumber(p)
+}
+
+func (rp *repaginator) renumber(p *oggPage) []byte {
+	p.seq = rp.seq
+	rp.seq++
+	return p.bytes()
+}
+
+func (rp *repaginator) collectHeaders(p *oggPage) {
+	if p.flags&0x01 == 0 {
+		rp.pkt = nil
+	}
+	off := 0
+	for _, lace := range p.segs {
+		n := int(lace)
+		if off+n > len(p.body) {
+			return
+		}
+		rp.pkt = append(rp.pkt, p.body[off:off+n]...)
+		off += n
+		if lace < 255 {
+			switch rp.headers {
+			case 0:
+				rp.timing.parseIdent(rp.pkt)
+			case 2:
+				rp.timing.parseSetup(rp.pkt)
+			}
+			rp.headers++
+			rp.pkt = nil
+			if rp.headers == 3 {
+				return
+			}
+		}
+	}
+}
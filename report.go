@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------- play reports ----------------
+
+// With -play-report every file the feeder puts on air is logged for
+// licensing returns: start time, artist, title, album, ISRC, the time it was
+// actually on air, and the file. Rows are kept in the store as CSV, one key
+// per day in the station time zone, and /admin/report exports a day or a
+// whole month. Station IDs are not reported; voice items and requests are.
+
+const playsBucket = "plays"
+
+var playReportHeader = []string{"start", "artist", "title", "album", "isrc", "duration_seconds", "file"}
+
+type playReport struct {
+	db  store
+	loc *time.Location
+
+	mu sync.Mutex // serializes read-modify-write of a day's rows
+}
+
+// add records p, which started at start and played for d.
+func (r *playReport) add(start time.Time, p string, d time.Duration) {
+	t, _ := readTags(p)
+	start = start.In(r.loc)
+
+	var row bytes.Buffer
+	cw := csv.NewWriter(&row)
+	_ = cw.Write([]string{
+		start.Format(time.RFC3339), t.artist, t.title, t.album, t.isrc,
+		strconv.FormatFloat(d.Seconds(), 'f', 1, 64), p,
+	})
+	cw.Flush()
+
+	day := start.Format("2006-01-02")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rows, err := r.db.Get(playsBucket, day)
+	if err != nil && !errors.Is(err, errNotFound) {
+		log.Printf("play report: %v", err)
+		return
+	}
+	if err := r.db.Put(playsBucket, day, append(rows, row.Bytes()...)); err != nil {
+		log.Printf("play report: %v", err)
+	}
+}
+
+// write exports period, a day (2006-01-02) or a month (2006-01), as CSV
+// with a header line.
+func (r *playReport) write(w io.Writer, period string) error {
+	var days []string
+	if _, err := time.Parse("2006-01-02", period); err == nil {
+		days = []string{period}
+	} else if _, err := time.Parse("2006-01", period); err == nil {
+		keys, err := r.db.Keys(playsBucket)
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if strings.HasPrefix(k, period+"-") {
+				days = append(days, k)
+			}
+		}
+	} else {
+		return fmt.Errorf("bad period %q: want YYYY-MM-DD or YYYY-MM", period)
+	}
+
+	cw := csv.NewWriter(w)
+	_ = cw.Write(playReportHeader)
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, day := range days {
+		rows, err := r.db.Get(playsBucket, day)
+		if errors.Is(err, errNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(rows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ---------------- request logging ----------------
+
+// A busy station would write a few log lines per listener connect. Instead,
+// requests are counted per route and summarized once a minute; only every
+// Nth request (-log-sample) is logged in full. With -log-level=debug every
+// request and listener change is logged.
+
+// logDebug enables per-request and per-listener log lines.
+var logDebug bool
+
+func debugf(format string, args ...any) {
+	if logDebug {
+		log.Printf(format, args...)
+	}
+}
+
+type requestLog struct {
+	sample int64 // log every sample-th request in detail; 0 = none
+
+	seen   atomic.Int64
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newRequestLog(sample int) *requestLog {
+	return &requestLog{sample: int64(sample), counts: make(map[string]int)}
+}
+
+// request counts a request for route and reports whether it should be logged
+// in detail (it then is, along with its disconnect for listeners).
+func (rl *requestLog) request(route, remote, target string) bool {
+	rl.mu.Lock()
+	rl.counts[route]++
+	rl.mu.Unlock()
+
+	n := rl.seen.Add(1)
+	detail := logDebug || rl.sample > 0 && n%rl.sample == 0
+	if detail {
+		log.Printf("Request from %s: %s", remote, target)
+	}
+	return detail
+}
+
+// run logs the per-route counts every interval.
+func (rl *requestLog) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		rl.mu.Lock()
+		counts := rl.counts
+		rl.counts = make(map[string]int)
+		rl.mu.Unlock()
+		if len(counts) == 0 {
+			continue
+		}
+
+		routes := make([]string, 0, len(counts))
+		total := 0
+		for r, n := range counts {
+			routes = append(routes, r)
+			total += n
+		}
+		sort.Slice(routes, func(i, j int) bool { return counts[routes[i]] > counts[routes[j]] })
+		parts := make([]string, len(routes))
+		for i, r := range routes {
+			parts[i] = fmt.Sprintf("%s %d", r, counts[r])
+		}
+		log.Printf("Requests in the last %s: %d (%s)", interval, total, strings.Join(parts, ", "))
+	}
+}
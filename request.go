@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ---------------- request parsing ----------------
+
+// A Spartan request line is
+//
+//	host SP path SP content-length CRLF
+//
+// where host is a bare host name or IP address (no scheme, port or path),
+// path is an absolute path with optional query, and content-length is a
+// decimal byte count. parseRequestLine checks all three and normalizes the
+// path: percent-escapes are decoded, duplicate slashes and "." segments are
+// collapsed, and ".." segments are rejected rather than resolved.
+
+type request struct {
+	host   string
+	target string // path and query exactly as sent; admin signatures cover it
+	path   string // decoded and normalized
+	query  string // raw query without '?'
+	length int
+}
+
+var (
+	errMalformedRequest = errors.New("malformed request line")
+	errBadHost          = errors.New("invalid host")
+	errBadPath          = errors.New("invalid path")
+	errBadLength        = errors.New("invalid content-length")
+)
+
+func parseRequestLine(line string) (*request, error) {
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 {
+		return nil, errMalformedRequest
+	}
+	host, target, lenStr := parts[0], parts[1], parts[2]
+
+	if !validHost(host) {
+		return nil, errBadHost
+	}
+	if lenStr == "" || strings.Trim(lenStr, "0123456789") != "" {
+		return nil, errBadLength
+	}
+	length, err := strconv.Atoi(lenStr)
+	if err != nil {
+		return nil, errBadLength
+	}
+
+	// Absolute URLs ("spartan://host/path") and relative paths are not
+	// valid request targets.
+	if !strings.HasPrefix(target, "/") {
+		return nil, errBadPath
+	}
+	rawPath, query, _ := strings.Cut(target, "?")
+	p, err := url.PathUnescape(rawPath)
+	if err != nil {
+		return nil, errBadPath
+	}
+	for _, c := range p {
+		if c < 0x20 || c == 0x7f {
+			return nil, errBadPath
+		}
+	}
+	for _, seg := range strings.Split(p, "/") {
+		if seg == ".." {
+			return nil, errBadPath
+		}
+	}
+	clean := path.Clean(p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+
+	return &request{
+		host:   host,
+		target: target,
+		path:   clean,
+		query:  query,
+		length: length,
+	}, nil
+}
+
+// validHost accepts a DNS name or an IP address literal (IPv6 optionally in
+// brackets).
+func validHost(h string) bool {
+	if h == "" || len(h) > 253 {
+		return false
+	}
+	if strings.HasPrefix(h, "[") && strings.HasSuffix(h, "]") {
+		ip := net.ParseIP(h[1 : len(h)-1])
+		return ip != nil && ip.To4() == nil
+	}
+	if net.ParseIP(h) != nil {
+		return true
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(h, "."), ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,98 @@
+package main
+
+import "testing"
+
+// Example requests from the Spartan specification plus malformed variants.
+func TestParseRequestLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		path   string
+		query  string
+		length int
+		err    error
+	}{
+		// Well-formed requests.
+		{line: "example.com / 0", path: "/"},
+		{line: "example.com /radio 0", path: "/radio"},
+		{line: "spartan.mozz.us /files/ 0", path: "/files/"},
+		{line: "example.com /submit 12", path: "/submit", length: 12},
+		{line: "127.0.0.1 /stats 0", path: "/stats"},
+		{line: "::1 /stats 0", path: "/stats"},
+		{line: "[::1] /stats 0", path: "/stats"},
+		{line: "EXAMPLE.com. /radio 0", path: "/radio"},
+		{line: "example.com /admin/status?mount=/radio 0", path: "/admin/status", query: "mount=/radio"},
+
+		// Path normalization.
+		{line: "example.com //radio 0", path: "/radio"},
+		{line: "example.com /a//b///c 0", path: "/a/b/c"},
+		{line: "example.com /./radio 0", path: "/radio"},
+		{line: "example.com /%72adio 0", path: "/radio"},
+		{line: "example.com /a%20b 0", path: "/a b"},
+		{line: "example.com /files//x/ 0", path: "/files/x/"},
+
+		// Traversal, including encoded forms.
+		{line: "example.com /../etc/passwd 0", err: errBadPath},
+		{line: "example.com /a/../../b 0", err: errBadPath},
+		{line: "example.com /a/.. 0", err: errBadPath},
+		{line: "example.com /%2e%2e/secret 0", err: errBadPath},
+		{line: "example.com /a%2f..%2fb 0", err: errBadPath},
+
+		// Bad paths.
+		{line: "example.com spartan://example.com/ 0", err: errBadPath},
+		{line: "example.com radio 0", err: errBadPath},
+		{line: "example.com /bad%zz 0", err: errBadPath},
+		{line: "example.com /a%00b 0", err: errBadPath},
+		{line: "example.com /a%0ab 0", err: errBadPath},
+
+		// Bad hosts.
+		{line: "spartan://example.com / 0", err: errBadHost},
+		{line: "example.com:300 / 0", err: errBadHost},
+		{line: "example.com/radio / 0", err: errBadHost},
+		{line: "-example.com / 0", err: errBadHost},
+		{line: "exa_mple.com / 0", err: errBadHost},
+		{line: "example..com / 0", err: errBadHost},
+		{line: "[127.0.0.1] / 0", err: errBadHost},
+
+		// Bad content lengths.
+		{line: "example.com / -1", err: errBadLength},
+		{line: "example.com / +1", err: errBadLength},
+		{line: "example.com / 1.0", err: errBadLength},
+		{line: "example.com / x", err: errBadLength},
+		{line: "example.com / ", err: errBadLength},
+
+		// Bad framing.
+		{line: "example.com /", err: errMalformedRequest},
+		{line: "example.com  / 0", err: errMalformedRequest},
+		{line: "example.com / 0 extra", err: errMalformedRequest},
+		{line: "", err: errMalformedRequest},
+	}
+
+	for _, tt := range tests {
+		req, err := parseRequestLine(tt.line)
+		if err != tt.err {
+			t.Errorf("%q: err = %v, want %v", tt.line, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if req.path != tt.path || req.query != tt.query || req.length != tt.length {
+			t.Errorf("%q: got path %q query %q length %d, want %q %q %d",
+				tt.line, req.path, req.query, req.length, tt.path, tt.query, tt.length)
+		}
+	}
+}
+
+func TestParseRequestLineKeepsTarget(t *testing.T) {
+	// Admin signatures are computed over the target as sent.
+	req, err := parseRequestLine("example.com //admin/status?mount=%2Fradio 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.target != "//admin/status?mount=%2Fradio" {
+		t.Errorf("target = %q", req.target)
+	}
+	if req.path != "/admin/status" {
+		t.Errorf("path = %q", req.path)
+	}
+}
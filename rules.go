@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------- rotation rules ----------------
+
+// -rules names a file of rules for folders of the rotation, one per line: a
+// folder (relative to -music-dir or the playlist's directory) and a rule.
+//
+//	# folder  rule
+//	ads       separate 1h
+//	archive   hours 02:00-05:00
+//
+// "separate D" lets a track from the folder start only when D has passed
+// since the last one from it started: at most one ad an hour. "hours
+// HH:MM-HH:MM" lets its tracks start only in that window of the day, in the
+// station time zone; a window may run past midnight (22:00-02:00). Rules
+// apply to every track under the folder, subfolders included, and a folder
+// may have several. A track that a rule holds back is passed over for the
+// rest of its cycle; if every track is held, the rotation waits -rescan and
+// tries again. Requests and scheduled items are played regardless, but count
+// as plays from their folder.
+
+type folderRule struct {
+	dir      string        // cleaned absolute path
+	separate time.Duration // 0: no separation
+	from, to int           // window in minutes after midnight; from == to: none
+}
+
+// rotationRules checks tracks against the rules and remembers when each
+// rule's folder last played.
+type rotationRules struct {
+	rules []folderRule
+	loc   *time.Location
+
+	mu   sync.Mutex
+	last []time.Time // by rule: start of the latest track under its folder
+}
+
+func readRules(path, baseDir string, loc *time.Location) (*rotationRules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []folderRule
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected folder separate D, or folder hours HH:MM-HH:MM", path, n)
+		}
+		r := folderRule{dir: fields[0]}
+		if !filepath.IsAbs(r.dir) {
+			r.dir = filepath.Join(baseDir, r.dir)
+		}
+		if r.dir, err = filepath.Abs(r.dir); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		switch fields[1] {
+		case "separate":
+			if r.separate, err = time.ParseDuration(fields[2]); err != nil || r.separate <= 0 {
+				return nil, fmt.Errorf("%s:%d: bad separation %q", path, n, fields[2])
+			}
+		case "hours":
+			var h1, m1, h2, m2 int
+			_, err := fmt.Sscanf(fields[2], "%d:%d-%d:%d", &h1, &m1, &h2, &m2)
+			if err != nil || h1 < 0 || h1 > 23 || m1 < 0 || m1 > 59 || h2 < 0 || m2 < 0 || m2 > 59 || h2*60+m2 > 24*60 {
+				return nil, fmt.Errorf("%s:%d: expected hours HH:MM-HH:MM", path, n)
+			}
+			r.from, r.to = h1*60+m1, (h2*60+m2)%(24*60)
+			if r.from == r.to {
+				return nil, fmt.Errorf("%s:%d: empty window %s", path, n, fields[2])
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown rule %q (want separate or hours)", path, n, fields[1])
+		}
+		rules = append(rules, r)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return &rotationRules{rules: rules, loc: loc, last: make([]time.Time, len(rules))}, nil
+}
+
+// fresh returns the same rules with no plays recorded, for another station
+// or a simulation.
+func (rr *rotationRules) fresh() *rotationRules {
+	return &rotationRules{rules: rr.rules, loc: rr.loc, last: make([]time.Time, len(rr.rules))}
+}
+
+// under reports whether p is in dir or below it.
+func under(dir, p string) bool {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, abs)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// allows reports whether p may start at now.
+func (rr *rotationRules) allows(p string, now time.Time) bool {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	for i, r := range rr.rules {
+		if !under(r.dir, p) {
+			continue
+		}
+		if r.separate > 0 && !rr.last[i].IsZero() && now.Sub(rr.last[i]) < r.separate {
+			return false
+		}
+		if r.from != r.to {
+			t := now.In(rr.loc)
+			m := t.Hour()*60 + t.Minute()
+			in := r.from <= m && m < r.to
+			if r.to < r.from { // past midnight
+				in = m >= r.from || m < r.to
+			}
+			if !in {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// played records that p started at now.
+func (rr *rotationRules) played(p string, now time.Time) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	for i, r := range rr.rules {
+		if under(r.dir, p) {
+			rr.last[i] = now
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRotationRules(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rules")
+	rules := "# folder rule\nads separate 1h\narchive hours 22:00-02:00\n"
+	if err := os.WriteFile(path, []byte(rules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rr, err := readRules(path, dir, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ad1, ad2 := filepath.Join(dir, "ads", "a.wav"), filepath.Join(dir, "ads", "sub", "b.wav")
+	old := filepath.Join(dir, "archive", "1965.wav")
+	song := filepath.Join(dir, "music", "song.wav")
+	noon := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+
+	if !rr.allows(ad1, noon) {
+		t.Fatal("first ad held")
+	}
+	rr.played(ad1, noon)
+	if rr.allows(ad2, noon.Add(59*time.Minute)) {
+		t.Error("second ad within the hour allowed")
+	}
+	if !rr.allows(ad2, noon.Add(time.Hour)) {
+		t.Error("ad an hour later held")
+	}
+	if !rr.allows(song, noon) {
+		t.Error("unruled track held")
+	}
+	for at, want := range map[int]bool{12: false, 21: false, 22: true, 23: true, 1: true, 2: false} {
+		if got := rr.allows(old, time.Date(2026, 10, 16, at, 30, 0, 0, time.UTC)); got != want {
+			t.Errorf("archive at %02d:30: allowed %v, want %v", at, got, want)
+		}
+	}
+	if !rr.fresh().allows(ad2, noon) {
+		t.Error("fresh rules kept the plays")
+	}
+
+	for _, bad := range []string{
+		"ads\n",
+		"ads separate soon\n",
+		"ads hours 2-5\n",
+		"ads hours 05:00-05:00\n",
+		"ads often 1h\n",
+	} {
+		if err := os.WriteFile(path, []byte(bad), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readRules(path, dir, time.UTC); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// ---------------- /schedule ----------------
+
+// /schedule shows listeners what the station has configured: the daily voice
+// items, station IDs and the music rotation, with what is on now and what
+// comes up next. Times are shown in the station time zone (-timezone).
+
+// itemTitle names a scheduled file for listeners: its library title if it
+// has one, else the file name.
+func (srv *server) itemTitle(path string) string {
+	if srv.library != nil {
+		if t := srv.library.lookup(path); t != nil {
+			return t.String()
+		}
+	}
+	return newTrackInfo(path).title
+}
+
+// writeSchedule renders /schedule with now in the station time zone.
+func (srv *server) writeSchedule(w io.Writer, now time.Time) {
+	st := srv.stations[0]
+	zone, offset := now.Zone()
+	fmt.Fprintf(w, "2 text/gemini; charset=utf-8\r\n")
+	fmt.Fprintf(w, "# %s: schedule\n\n", srv.title())
+	if name := now.Location().String(); name != "Local" && name != zone {
+		zone = name + ", " + zone
+	}
+	fmt.Fprintf(w, "Times are %s (UTC%s).\n", zone, utcOffset(offset))
+
+	fmt.Fprintf(w, "\n## On now\n\n")
+	current, since := st.feed.nowPlaying()
+	if current == "" {
+		fmt.Fprintf(w, "Nothing is playing.\n")
+	} else {
+		fmt.Fprintf(w, "%s, since %s\n", srv.itemTitle(current), since.In(now.Location()).Format("15:04"))
+	}
+
+	// Each item's next time, in the station time zone.
+	minute := now.Truncate(time.Minute)
+	type entry struct {
+		it voiceItem
+		at time.Time
+	}
+	var entries []entry
+	for _, it := range srv.schedule {
+		entries = append(entries, entry{it, it.next(minute).In(now.Location())})
+	}
+	clock := func(t time.Time) int { return t.Hour()*60 + t.Minute() }
+	sort.SliceStable(entries, func(i, j int) bool { return clock(entries[i].at) < clock(entries[j].at) })
+	var upNext *entry
+	for i := range entries {
+		if upNext == nil || entries[i].at.Before(upNext.at) {
+			upNext = &entries[i]
+		}
+	}
+	if upNext != nil {
+		fmt.Fprintf(w, "\n## Up next\n\n")
+		fmt.Fprintf(w, "%s at %s, in %s\n", srv.itemTitle(upNext.it.path), upNext.at.Format("15:04"), untilText(upNext.at.Sub(now)))
+	}
+
+	fmt.Fprintf(w, "\n## Every day\n\n")
+	for i := range entries {
+		e := &entries[i]
+		note := ""
+		if e.it.loc.String() != now.Location().String() {
+			note = fmt.Sprintf(" (%02d:%02d %s)", e.it.hour, e.it.min, e.it.loc)
+		}
+		// Queued items go out at the next track boundary, so allow for a
+		// late start; the same file may also be in rotation.
+		last := e.it.next(minute).AddDate(0, 0, -1)
+		switch {
+		case e.it.path == current && !since.Before(last) && since.Sub(last) < time.Hour:
+			note += " (on now)"
+		case e == upNext:
+			note += " (up next)"
+		}
+		fmt.Fprintf(w, "* %s %s%s\n", e.at.Format("15:04"), srv.itemTitle(e.it.path), note)
+	}
+	if st.feed.ids != nil {
+		fmt.Fprintf(w, "* Station IDs at least every %s\n", untilText(st.feed.ids.every))
+	}
+	if shuffle, _ := st.feed.rotation(); shuffle {
+		fmt.Fprintf(w, "* In between: music from the library, shuffled\n")
+	} else {
+		fmt.Fprintf(w, "* In between: music from the library, in order\n")
+	}
+}
+
+// untilText formats a wait in whole minutes, e.g. "2h 5m" or "under a minute".
+func untilText(d time.Duration) string {
+	m := int(d / time.Minute)
+	switch {
+	case m < 1:
+		return "under a minute"
+	case m < 60:
+		return fmt.Sprintf("%dm", m)
+	}
+	return fmt.Sprintf("%dh %dm", m/60, m%60)
+}
+
+// lengthText formats a track length as M:SS or H:MM:SS.
+func lengthText(d time.Duration) string {
+	s := int(d.Round(time.Second) / time.Second)
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
+
+// utcOffset formats a zone offset in seconds as +HH:MM.
+func utcOffset(sec int) string {
+	sign := "+"
+	if sec < 0 {
+		sign, sec = "-", -sec
+	}
+	return fmt.Sprintf("%s%02d:%02d", sign, sec/3600, sec/60%60)
+}
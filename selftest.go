@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ---------------- self-test ----------------
+
+// With -selftest the station pipeline runs without opening a port. A null
+// listener subscribes to the broadcaster for selftestDuration and checks
+// every page it receives with the server's own Ogg parsing: page layout and
+// CRC, contiguous sequence numbers and non-decreasing granule positions per
+// logical stream. Afterwards the cached header must hold the three Vorbis
+// header packets. The process exits 0 when all checks pass and 1 otherwise,
+// which makes it usable as a packaging smoke test.
+
+const selftestDuration = 5 * time.Second
+
+func selftest(st *station, d time.Duration) error {
+	sub, cancel := st.b.Subscribe(context.Background())
+	defer cancel()
+
+	type streamStats struct {
+		seq         uint32 // next expected sequence number
+		pages       int    // pages with a granule position
+		first, last int64
+	}
+	streams := make(map[uint32]*streamStats)
+	pages := 0
+
+	deadline := time.After(d)
+wait:
+	for {
+		select {
+		case <-deadline:
+			break wait
+		case raw, ok := <-sub:
+			if !ok {
+				return errors.New("broadcaster closed the listener")
+			}
+			pages++
+			p, ok := parseOggPage(raw)
+			if !ok {
+				return fmt.Errorf("page %d: not an Ogg page", pages)
+			}
+			n := 0
+			for _, lace := range p.segs {
+				n += int(lace)
+			}
+			if n != len(p.body) || !bytes.Equal(p.bytes(), raw) {
+				return fmt.Errorf("page %d: bad length or CRC", pages)
+			}
+			ss := streams[p.serial]
+			if ss == nil || p.flags&0x02 != 0 {
+				ss = &streamStats{seq: p.seq, first: -1, last: -1}
+				streams[p.serial] = ss
+			}
+			if p.seq != ss.seq {
+				return fmt.Errorf("page %d: stream %08x sequence %d, want %d", pages, p.serial, p.seq, ss.seq)
+			}
+			ss.seq++
+			if p.granule > 0 {
+				if p.granule < ss.last {
+					return fmt.Errorf("page %d: stream %08x granule went back from %d to %d", pages, p.serial, ss.last, p.granule)
+				}
+				if ss.first < 0 {
+					ss.first = p.granule
+				}
+				ss.last = p.granule
+				ss.pages++
+			}
+		}
+	}
+
+	hdr := st.b.GetHeaderCopy()
+	if len(hdr) == 0 {
+		return errors.New("no stream headers cached")
+	}
+	vh := &headerFinder{}
+	var rate int
+	var audioSerial uint32
+	br := bufio.NewReader(bytes.NewReader(hdr))
+	for {
+		raw, err := readNextOggPage(br)
+		if err != nil {
+			break
+		}
+		if rate == 0 {
+			if p, ok := parseOggPage(raw); ok && p.flags&0x02 != 0 {
+				if rate = granuleRate(p.body); rate > 0 {
+					audioSerial = p.serial
+				}
+			}
+		}
+		vh.feedPage(raw)
+	}
+	if !vh.done() {
+		return fmt.Errorf("cached header (%d bytes) is incomplete", len(hdr))
+	}
+
+	audio := streams[audioSerial]
+	if rate == 0 || audio == nil || audio.pages < 2 {
+		return fmt.Errorf("no audio pages within %s (%d pages)", d, pages)
+	}
+	played := time.Duration(audio.last-audio.first) * time.Second / time.Duration(rate)
+	log.Printf("Self-test: %d pages, %d audio pages covering %s at %d Hz; %d-byte header cached",
+		pages, audio.pages, played.Round(time.Millisecond), rate, len(hdr))
+
+	if pr := st.settings().preroll; pr != nil {
+		data, err := pr.bytes()
+		if err != nil {
+			return fmt.Errorf("preroll: %v", err)
+		}
+		if _, ok := parseOggPage(data); !ok {
+			return errors.New("preroll: not an Ogg stream")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ---------------- listener sessions ----------------
+
+// With -sessions each listener gets a session token in the stream header,
+// as the Vorbis comments SPARTAN_SESSION=<token> and
+// SPARTAN_SESSION_URL=spartan://host:port/session/<token>, which players
+// show among the stream's tags. /session/<token> shows that listener how
+// long they have been connected, what they received and at what rate, and,
+// once the connection is gone, why the server thinks it ended. That answers
+// most "my stream keeps cutting out" reports without the operator digging
+// through logs. The token is the only key to the page; sessions are kept for
+// a day after they end.
+
+const (
+	sessionTag    = "SPARTAN_SESSION"
+	sessionURLTag = "SPARTAN_SESSION_URL"
+	sessionKeep   = 24 * time.Hour
+	sessionMax    = 10000 // most sessions remembered, connected or not
+)
+
+type listenerSession struct {
+	token string
+	mount string
+	l     *listener
+
+	// Set when the connection ends; guarded by sessionTable.mu.
+	ended  time.Time
+	reason string
+}
+
+type sessionTable struct {
+	base string // spartan://host:port
+
+	mu    sync.Mutex
+	m     map[string]*listenerSession
+	order []*listenerSession // oldest first
+}
+
+func newSessionTable(host string, port int) *sessionTable {
+	return &sessionTable{
+		base: fmt.Sprintf("spartan://%s:%d", host, port),
+		m:    make(map[string]*listenerSession),
+	}
+}
+
+// start registers a session for l and returns it with the header comments
+// that carry its token.
+func (t *sessionTable) start(l *listener, mount string) (*listenerSession, []string) {
+	s := &listenerSession{token: newListenerID(), mount: mount, l: l}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// Forget sessions that ended over a day ago, and the oldest when full.
+	now := time.Now()
+	kept := t.order[:0]
+	for _, old := range t.order {
+		if !old.ended.IsZero() && now.Sub(old.ended) > sessionKeep {
+			delete(t.m, old.token)
+			continue
+		}
+		kept = append(kept, old)
+	}
+	for len(kept) >= sessionMax {
+		delete(t.m, kept[0].token)
+		kept = kept[1:]
+	}
+	t.order = append(kept, s)
+	t.m[s.token] = s
+	return s, []string{sessionTag + "=" + s.token, sessionURLTag + "=" + t.base + "/session/" + s.token}
+}
+
+// end records why s ended: err is the failed write, or nil when the stream
+// itself stopped.
+func (t *sessionTable) end(s *listenerSession, err error) {
+	var ne net.Error
+	reason := "the stream stopped on the server (a restart or shutdown)"
+	switch {
+	case errors.Is(err, errEgressCap):
+		reason = "the station reached its monthly bandwidth allowance and stopped streaming until next month"
+	case errors.As(err, &ne) && ne.Timeout():
+		reason = fmt.Sprintf("the server dropped the connection: nothing could be sent to you for %s, so your connection could not keep up or stalled", listenerWriteTimeout)
+	case err != nil:
+		reason = "the connection was closed, by your player or somewhere on the network"
+	}
+	t.mu.Lock()
+	s.ended, s.reason = time.Now(), reason
+	t.mu.Unlock()
+}
+
+// writeSession renders /session/<token>.
+func (srv *server) writeSession(w io.Writer, token string, now time.Time) {
+	t := srv.sessions
+	t.mu.Lock()
+	s := t.m[token]
+	var ended time.Time
+	var reason string
+	if s != nil {
+		ended, reason = s.ended, s.reason
+	}
+	t.mu.Unlock()
+	if s == nil {
+		fmt.Fprintf(w, "4 unknown or expired session\r\n")
+		return
+	}
+
+	since := s.l.since
+	last := now
+	if !ended.IsZero() {
+		last = ended
+	}
+	d := last.Sub(since)
+	bytes := s.l.bytes.Load()
+
+	fmt.Fprintf(w, "2 text/gemini; charset=utf-8\r\n")
+	fmt.Fprintf(w, "# %s: your session\n\n", srv.title())
+	fmt.Fprintf(w, "Station: %s\n", s.mount)
+	fmt.Fprintf(w, "Your address: %s\n", s.l.remote)
+	fmt.Fprintf(w, "Connected: %s\n", since.In(now.Location()).Format("2006-01-02 15:04:05 MST"))
+	if ended.IsZero() {
+		fmt.Fprintf(w, "Status: connected for %s\n", lengthText(d))
+	} else {
+		fmt.Fprintf(w, "Status: ended %s, after %s\n", ended.In(now.Location()).Format("2006-01-02 15:04:05"), lengthText(d))
+		fmt.Fprintf(w, "Why: %s\n", reason)
+	}
+
+	var avg float64
+	if d > 0 {
+		avg = float64(bytes) * 8 / 1000 / d.Seconds()
+	}
+	fmt.Fprintf(w, "Received: %s, on average %.0f kbit/s\n", sizeText(bytes), avg)
+	stream := 0.0
+	if st := srv.station(s.mount); st != nil {
+		stream, _ = st.b.rate.latest()
+	}
+	if stream > 0 {
+		fmt.Fprintf(w, "The stream runs at about %.0f kbit/s.\n", stream)
+		// The first seconds include the header and the join backlog, so
+		// only longer sessions say anything about the connection.
+		if d > time.Minute && avg < 0.9*stream {
+			fmt.Fprintf(w, "\nYou received less than the stream carries, so your connection or player fell behind; expect dropouts.\n")
+		}
+	}
+	fmt.Fprintf(w, "\nWhen reporting a problem, include this page's address.\n")
+}
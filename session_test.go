@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionTable(t *testing.T) {
+	st := newSessionTable("radio.example.org", 300)
+	s, comments := st.start(&listener{remote: "192.0.2.1:1", since: time.Now()}, "/radio")
+	if want := "SPARTAN_SESSION_URL=spartan://radio.example.org:300/session/" + s.token; comments[1] != want {
+		t.Errorf("comments = %q, want %q second", comments, want)
+	}
+
+	st.end(s, os.ErrDeadlineExceeded)
+	if !strings.Contains(s.reason, "could not keep up") {
+		t.Errorf("timeout reason = %q", s.reason)
+	}
+	st.end(s, errors.New("broken pipe"))
+	if !strings.Contains(s.reason, "closed") {
+		t.Errorf("closed reason = %q", s.reason)
+	}
+
+	// A day after it ended, the next listener's start forgets it.
+	s.ended = time.Now().Add(-sessionKeep - time.Minute)
+	st.start(&listener{since: time.Now()}, "/radio")
+	if st.m[s.token] != nil || len(st.order) != 1 {
+		t.Errorf("expired session still known (%d sessions)", len(st.order))
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ---------------- simulation ----------------
+
+// With -simulate D nothing is played. The feeder's rotation runs against a
+// virtual clock for D from now and the programming it would produce is
+// printed: cycles are built exactly as on air (shuffle seed, history spread,
+// new-track boost, pinned tracks), station IDs come from the same scheduler,
+// and -voice-schedule items play at the first track boundary after they are
+// due, or on time over the music with -duck-db. Lengths come from the file
+// headers. Nothing is recorded: plays don't count in the library, and the
+// shuffle history is a scratch copy.
+
+func simulate(w io.Writer, f *feeder, voice []voiceItem, duck bool, start time.Time, d time.Duration) error {
+	if h := f.history; h != nil {
+		scratch := &playHistory{db: newMemStore(), size: h.size}
+		h.mu.Lock()
+		scratch.recent = append([]string(nil), h.recent...)
+		h.mu.Unlock()
+		f.history = scratch
+	}
+	if f.rules != nil {
+		f.rules = f.rules.fresh()
+	}
+	if f.lib != nil {
+		// New tracks are boosted, so the index has to be there first.
+		if files, err := f.loadList(); err == nil {
+			f.lib.scan(files)
+		}
+	}
+
+	now, end := start, start.Add(d)
+	fmt.Fprintf(w, "Simulated programming from %s to %s\n",
+		start.Format("2006-01-02 15:04 MST"), end.Format("2006-01-02 15:04 MST"))
+	day := ""
+	line := func(at time.Time, kind, p, length string) {
+		if at.Format("2006-01-02") != day {
+			day = at.Format("2006-01-02")
+			fmt.Fprintf(w, "\n%s\n", day)
+		}
+		fmt.Fprintf(w, "%s  %-5s  %s (%s)\n", at.Format("15:04:05"), kind, simTitle(p), length)
+	}
+
+	var tracks, ids, items int
+	// air prints p at now and moves the clock past it.
+	air := func(kind, p string) time.Duration {
+		l, err := audioDuration(p)
+		if err != nil {
+			line(now, kind, p, "length unknown")
+			return 0
+		}
+		line(now, kind, p, lengthText(l))
+		now = now.Add(l)
+		return l
+	}
+	// play mirrors feeder.play.
+	play := func(kind, p string) {
+		if f.ids != nil {
+			if id, ok := f.ids.due(p); ok {
+				f.ids.played(air("id", id), true)
+				ids++
+			}
+		}
+		if f.history != nil {
+			f.history.add(p)
+		}
+		if f.rules != nil {
+			f.rules.played(p, now)
+		}
+		l := air(kind, p)
+		if f.ids != nil {
+			f.ids.played(l, false)
+		}
+	}
+
+	due := make([]time.Time, len(voice))
+	for i, it := range voice {
+		due[i] = it.next(start)
+	}
+	var events []string
+	// fire handles the voice items that came due before now.
+	fire := func() {
+		for i, it := range voice {
+			for !due[i].After(now) && due[i].Before(end) {
+				if duck {
+					line(due[i], "voice", it.path, "over the music")
+				} else {
+					events = append(events, it.path)
+				}
+				items++
+				due[i] = it.next(due[i].Add(time.Second))
+			}
+		}
+	}
+
+	sh := newShuffleState()
+	for now.Before(end) {
+		files, err := f.nextCycle(now, sh)
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return errors.New("nothing to play")
+		}
+		cycleStart, held := now, false
+		for _, p := range files {
+			fire()
+			for _, e := range events {
+				play("voice", e)
+			}
+			events = events[:0]
+			if !now.Before(end) {
+				break
+			}
+			if f.rules != nil && !f.rules.allows(p, now) {
+				held = true
+				continue
+			}
+			play("track", p)
+			tracks++
+		}
+		if now.Equal(cycleStart) && held {
+			// Every track waits for a rule, as on air.
+			_, rescan := f.rotation()
+			now = now.Add(max(rescan, time.Second))
+			continue
+		}
+		if now.Equal(cycleStart) {
+			return errors.New("no file in the rotation has a readable length")
+		}
+	}
+	fmt.Fprintf(w, "\n%d tracks, %d station IDs, %d voice items\n", tracks, ids, items)
+	return nil
+}
+
+// simTitle names a file by its tags, as the library would.
+func simTitle(p string) string {
+	t, _ := readTags(p)
+	if t.artist != "" {
+		return t.artist + " – " + t.title
+	}
+	return t.title
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// ---------------- skip voting ----------------
+
+// With -skip-vote F, listeners may vote at /skipvote to skip the track on
+// air. Only an address with a stream connection open can vote, once per
+// track however many connections it has. When the votes reach fraction F of
+// the connected addresses the feeder skips, and counting starts over with
+// every track. /nowplaying shows the tally.
+
+type skipVotes struct {
+	fraction float64
+
+	mu     sync.Mutex
+	track  string    // the track being voted on
+	since  time.Time // when it started, to tell repeats apart
+	voters map[string]struct{}
+}
+
+func newSkipVotes(fraction float64) *skipVotes {
+	return &skipVotes{fraction: fraction}
+}
+
+// needed is how many votes skip a track with n listening addresses.
+func (v *skipVotes) needed(n int) int {
+	return max(1, int(math.Ceil(v.fraction*float64(n)-1e-9)))
+}
+
+// roll starts a new count if the track has changed. Called with mu held.
+func (v *skipVotes) roll(track string, since time.Time) {
+	if track != v.track || !since.Equal(v.since) {
+		v.track, v.since, v.voters = track, since, make(map[string]struct{})
+	}
+}
+
+// vote records ip's vote against track and reports the tally; fresh is
+// false when ip had already voted.
+func (v *skipVotes) vote(track string, since time.Time, ip string) (votes int, fresh bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.roll(track, since)
+	_, dup := v.voters[ip]
+	v.voters[ip] = struct{}{}
+	return len(v.voters), !dup
+}
+
+// count returns the votes against track so far.
+func (v *skipVotes) count(track string, since time.Time) int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.roll(track, since)
+	return len(v.voters)
+}
+
+// listenerAddrs returns the distinct IP addresses connected to st.
+func (st *station) listenerAddrs() map[string]struct{} {
+	addrs := make(map[string]struct{})
+	for _, l := range st.listenerList() {
+		ip, _, err := net.SplitHostPort(l.remote)
+		if err != nil {
+			ip = l.remote
+		}
+		addrs[ip] = struct{}{}
+	}
+	return addrs
+}
+
+// handleSkipVote counts a vote from remote against the current track.
+func (srv *server) handleSkipVote(w io.Writer, remote string) {
+	st := srv.stations[0]
+	ip, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		ip = remote
+	}
+	addrs := st.listenerAddrs()
+	if _, ok := addrs[ip]; !ok {
+		fmt.Fprintf(w, "4 only listeners can vote; tune in first\r\n")
+		return
+	}
+	track, since := st.feed.nowPlaying()
+	if track == "" {
+		fmt.Fprintf(w, "4 nothing to skip\r\n")
+		return
+	}
+
+	votes, fresh := srv.skipVotes.vote(track, since, ip)
+	needed := srv.skipVotes.needed(len(addrs))
+	title := srv.itemTitle(track)
+	fmt.Fprintf(w, "2 text/gemini; charset=utf-8\r\n")
+	fmt.Fprintf(w, "# %s: skip vote\n\n", srv.title())
+	switch {
+	case votes >= needed && st.feed.skip():
+		log.Printf("Skip vote passed (%d of %d listeners): %s", votes, len(addrs), track)
+		fmt.Fprintf(w, "Voted off: %s\n", title)
+	case !fresh:
+		fmt.Fprintf(w, "You already voted to skip %s: %d of %d votes.\n", title, votes, needed)
+	default:
+		fmt.Fprintf(w, "Your vote to skip %s is in: %d of %d votes.\n", title, votes, needed)
+	}
+	fmt.Fprintf(w, "\n=> /nowplaying Now playing\n")
+}
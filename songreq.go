@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ---------------- listener requests ----------------
+
+// With -listener-requests N, listeners may send a search or a file path to
+// /request, as Spartan input or in the query. The best match in the
+// rotation is queued ahead of the shuffled list, behind scheduled voice
+// items, like /admin/queue/add; other matches are offered as links.
+// Each address may have N requests waiting, the queue holds at most
+// requestQueueMax, and a track already queued or on air is refused.
+// /queue shows what is waiting.
+
+const (
+	requestQueueMax  = 50 // listener requests waiting at once
+	requestAlternate = 5  // other matches offered as links
+)
+
+type listenerRequests struct {
+	perAddr int
+
+	mu sync.Mutex
+	by map[string]string // queued path -> requesting address
+}
+
+func newListenerRequests(perAddr int) *listenerRequests {
+	return &listenerRequests{perAddr: perAddr, by: make(map[string]string)}
+}
+
+// add queues p on f for addr, or says why not.
+func (r *listenerRequests) add(f *feeder, p, addr string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	queued := f.queued()
+	for q := range r.by {
+		if !slices.Contains(queued, q) {
+			delete(r.by, q) // played, or skipped past
+		}
+	}
+	mine := 0
+	for _, a := range r.by {
+		if a == addr {
+			mine++
+		}
+	}
+	if current, _ := f.nowPlaying(); current == p {
+		return errors.New("that track is on air now")
+	}
+	switch {
+	case slices.Contains(queued, p):
+		return errors.New("that track is already in the queue")
+	case mine >= r.perAddr:
+		return fmt.Errorf("you have %d requests waiting; wait until one has played", mine)
+	case len(r.by) >= requestQueueMax:
+		return errors.New("the request queue is full; try again later")
+	}
+	r.by[p] = addr
+	f.enqueue(p)
+	return nil
+}
+
+// requested reports whether p was queued by a listener.
+func (r *listenerRequests) requested(p string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.by[p]
+	return ok
+}
+
+// matchRequest returns the files of the rotation that input names, best
+// first: the file itself when input is its path, else the library's
+// ranking of input as a search, else the files whose path holds every word
+// of input.
+func matchRequest(files []string, input, baseDir string, lib *library) ([]string, error) {
+	inRotation := make(map[string]bool, len(files))
+	for _, p := range files {
+		inRotation[p] = true
+	}
+	if abs, ok := resolveExistingFile(input, baseDir); ok && inRotation[abs] {
+		return []string{abs}, nil
+	}
+	var out []string
+	if lib != nil {
+		tracks, err := lib.rank(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range tracks {
+			if inRotation[t.Path] {
+				out = append(out, t.Path)
+			}
+		}
+		return out, nil
+	}
+	words := strings.Fields(strings.ToLower(input))
+	for _, p := range files {
+		name := strings.ToLower(p)
+		if rel, err := filepath.Rel(baseDir, p); err == nil {
+			name = strings.ToLower(rel)
+		}
+		if len(words) > 0 && !slices.ContainsFunc(words, func(w string) bool { return !strings.Contains(name, w) }) {
+			out = append(out, p)
+		}
+	}
+	return out, nil
+}
+
+// handleSongRequest queues the best match for input from remote.
+func (srv *server) handleSongRequest(w io.Writer, remote, input string) {
+	st := srv.stations[0]
+	input = strings.TrimSpace(input)
+	if input == "" {
+		fmt.Fprintf(w, "2 text/gemini; charset=utf-8\r\n")
+		fmt.Fprintf(w, "# %s: request a track\n\n", srv.title())
+		fmt.Fprintf(w, "=: /request Request a track: a search such as artist:simone, or a file name\n")
+		fmt.Fprintf(w, "=> /queue The request queue\n")
+		return
+	}
+	files, err := st.feed.loadList()
+	if err != nil {
+		fmt.Fprintf(w, "4 the rotation is not available\r\n")
+		return
+	}
+	matches, err := matchRequest(files, input, st.feed.dir(), srv.library)
+	if err != nil {
+		fmt.Fprintf(w, "4 %v\r\n", err)
+		return
+	}
+	ip, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		ip = remote
+	}
+
+	fmt.Fprintf(w, "2 text/gemini; charset=utf-8\r\n")
+	fmt.Fprintf(w, "# %s: request a track\n\n", srv.title())
+	if len(matches) == 0 {
+		fmt.Fprintf(w, "Nothing in the rotation matches %q.\n\n", input)
+		fmt.Fprintf(w, "=: /request Try another request\n")
+		return
+	}
+	p := matches[0]
+	if err := srv.requests.add(st.feed, p, ip); err != nil {
+		fmt.Fprintf(w, "Not queued: %s (%v).\n", srv.itemTitle(p), err)
+	} else {
+		log.Printf("Request from %s: %s", ip, p)
+		fmt.Fprintf(w, "Queued: %s\n", srv.itemTitle(p))
+	}
+	if len(matches) > 1 {
+		fmt.Fprintf(w, "\n## Not what you meant?\n\n")
+		for _, m := range matches[1:min(len(matches), 1+requestAlternate)] {
+			rel, err := filepath.Rel(st.feed.dir(), m)
+			if err != nil {
+				rel = m
+			}
+			fmt.Fprintf(w, "=> /request?%s %s\n", url.QueryEscape(rel), srv.itemTitle(m))
+		}
+	}
+	fmt.Fprintf(w, "\n=> /queue The request queue\n")
+}
+
+// writeQueue renders /queue: what plays before the rotation continues.
+func (srv *server) writeQueue(w io.Writer) {
+	st := srv.stations[0]
+	fmt.Fprintf(w, "2 text/gemini; charset=utf-8\r\n")
+	fmt.Fprintf(w, "# %s: up next\n\n", srv.title())
+	queued := st.feed.queued()
+	if len(queued) == 0 {
+		fmt.Fprintf(w, "Nothing is queued; the rotation plays on.\n")
+	}
+	for _, p := range queued {
+		line := srv.itemTitle(p)
+		if srv.requests.requested(p) {
+			line += " (listener request)"
+		}
+		fmt.Fprintf(w, "* %s\n", line)
+	}
+	fmt.Fprintf(w, "\n=: /request Request a track\n")
+	fmt.Fprintf(w, "=> /nowplaying Now playing\n")
+}
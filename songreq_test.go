@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestListenerRequests(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for _, name := range []string{"Nina Simone - Feeling Good.wav", "Nina Simone - Sinnerman.wav", "Muse - Feeling Good.wav"} {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, p)
+	}
+	outside := filepath.Join(t.TempDir(), "secret.wav")
+	if err := os.WriteFile(outside, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for input, want := range map[string][]string{
+		"Nina Simone - Sinnerman.wav": {files[1]},
+		"feeling good":                {files[0], files[2]},
+		"simone":                      {files[0], files[1]},
+		"bach":                        nil,
+		outside:                       nil,
+	} {
+		got, err := matchRequest(files, input, dir, nil)
+		if err != nil || !slices.Equal(got, want) {
+			t.Errorf("%q matched %q, %v; want %q", input, got, err, want)
+		}
+	}
+
+	f := &feeder{}
+	r := newListenerRequests(2)
+	if err := r.add(f, files[0], "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.add(f, files[0], "192.0.2.2"); err == nil {
+		t.Error("queued twice")
+	}
+	if err := r.add(f, files[1], "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.add(f, files[2], "192.0.2.1"); err == nil {
+		t.Error("third request from one address queued")
+	}
+	if !r.requested(files[1]) || !slices.Equal(f.queued(), files[:2]) {
+		t.Errorf("queue %q", f.queued())
+	}
+
+	// Once a request has played, the address may ask again.
+	if p, _ := f.popQueue(); p != files[0] {
+		t.Fatalf("popped %q", p)
+	}
+	if err := r.add(f, files[2], "192.0.2.1"); err != nil {
+		t.Error(err)
+	}
+	if r.requested(files[0]) {
+		t.Error("played request still listed")
+	}
+}
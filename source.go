@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ---------------- live sources ----------------
+
+// pcmSource yields pipeline PCM (s16le at pcmRate, stereo) paced in real time,
+// as an alternative to decoding files from the playlist.
+type pcmSource interface {
+	String() string
+	Open() (io.ReadCloser, error)
+}
+
+// captureSource records from a sound card or audio server through ffmpeg's
+// input devices: alsa, pulse (also served by PipeWire) or jack.
+type captureSource struct {
+	ffmpegPath string
+	format     string
+	device     string
+}
+
+func (c *captureSource) String() string { return c.format + ":" + c.device }
+
+func (c *captureSource) Open() (io.ReadCloser, error) {
+	cmd := exec.Command(c.ffmpegPath,
+		"-hide_banner", "-loglevel", "warning",
+		"-f", c.format,
+		"-i", c.device,
+	)
+	cmd.Args = append(append(cmd.Args, pcmArgs()...), "pipe:1")
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &cmdReader{ReadCloser: out, cmd: cmd}, nil
+}
+
+// cmdReader is a child process's stdout; closing it also reaps the process.
+type cmdReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (r *cmdReader) Close() error {
+	_ = r.ReadCloser.Close()
+	_ = r.cmd.Process.Kill()
+	_ = r.cmd.Wait()
+	return nil
+}
+
+func newCaptureSource(ffmpegPath, kind, device string) (pcmSource, error) {
+	switch kind {
+	case "alsa", "pulse", "jack":
+	case "pipewire":
+		kind = "pulse"
+	default:
+		return nil, fmt.Errorf("unknown source %q (use files|stdin|fifo|alsa|pulse|pipewire|jack)", kind)
+	}
+	if device == "" {
+		device = "default"
+	}
+	return &captureSource{ffmpegPath: ffmpegPath, format: kind, device: device}, nil
+}
+
+// stdinSource is raw pipeline PCM written to the server's own stdin by an
+// external program. It can only be opened once.
+type stdinSource struct {
+	r      io.Reader
+	opened bool
+}
+
+func (s *stdinSource) String() string { return "stdin" }
+
+func (s *stdinSource) Open() (io.ReadCloser, error) {
+	if s.opened {
+		return nil, io.EOF
+	}
+	s.opened = true
+	return io.NopCloser(s.r), nil
+}
+
+// pcmRate is the sample rate of pipeline PCM, from decode to encode, and
+// pcmBytesPerSecond its data rate. Both are set once at startup
+// (-sample-rate).
+var (
+	pcmRate           = 44100
+	pcmBytesPerSecond = pcmRate * 2 * 2
+)
+
+// setPCMRate sets the pipeline sample rate: 44.1 kHz, or 48 kHz for
+// libraries mastered at that rate.
+func setPCMRate(rate int) error {
+	if rate != 44100 && rate != 48000 {
+		return fmt.Errorf("unsupported sample rate %d (use 44100 or 48000)", rate)
+	}
+	pcmRate, pcmBytesPerSecond = rate, rate*2*2
+	return nil
+}
+
+// pcmBytes is the size of d of pipeline PCM, in whole frames.
+func pcmBytes(d time.Duration) int {
+	return int(d.Seconds()*float64(pcmBytesPerSecond)) &^ 3
+}
+
+// pcmArgs are the ffmpeg format arguments for pipeline PCM.
+func pcmArgs() []string {
+	return []string{"-f", "s16le", "-ar", strconv.Itoa(pcmRate), "-ac", "2"}
+}
+
+// silenceSource produces digital silence at real-time rate.
+type silenceSource struct{}
+
+func (silenceSource) String() string { return "silence" }
+
+func (silenceSource) Open() (io.ReadCloser, error) {
+	return &silenceReader{start: time.Now()}, nil
+}
+
+// toneSource produces a quiet sine tone at real-time rate.
+type toneSource struct {
+	hz float64
+}
+
+func (t toneSource) String() string { return fmt.Sprintf("tone:%g", t.hz) }
+
+func (t toneSource) Open() (io.ReadCloser, error) {
+	return &silenceReader{start: time.Now(), hz: t.hz}, nil
+}
+
+// toneLevel is the amplitude of toneSource, about -20 dBFS.
+const toneLevel = 3277
+
+type silenceReader struct {
+	start time.Time
+	sent  int64
+	hz    float64 // tone frequency; 0 = silence
+}
+
+func (r *silenceReader) Read(p []byte) (int, error) {
+	// Never run ahead of the wall clock by more than 100ms.
+	due := time.Duration(r.sent) * time.Second / time.Duration(pcmBytesPerSecond)
+	if ahead := due - time.Since(r.start) - 100*time.Millisecond; ahead > 0 {
+		time.Sleep(ahead)
+	}
+	n := min(len(p), pcmBytesPerSecond/10) &^ 3
+	if r.hz == 0 {
+		clear(p[:n])
+	}
+	for k := 0; r.hz > 0 && k < n; k += 4 {
+		t := float64(r.sent+int64(k)) / float64(pcmBytesPerSecond)
+		v := uint16(int16(toneLevel * math.Sin(2*math.Pi*r.hz*t)))
+		binary.LittleEndian.PutUint16(p[k:], v)
+		binary.LittleEndian.PutUint16(p[k+2:], v)
+	}
+	r.sent += int64(n)
+	return n, nil
+}
+
+func (r *silenceReader) Close() error { return nil }
+
+// loopFileSource decodes one file over and over, paced in real time.
+type loopFileSource struct {
+	ffmpegPath string
+	path       string
+}
+
+func (l *loopFileSource) String() string { return l.path }
+
+func (l *loopFileSource) Open() (io.ReadCloser, error) {
+	cmd := exec.Command(l.ffmpegPath,
+		"-hide_banner", "-loglevel", "warning",
+		"-re",
+		"-stream_loop", "-1",
+		"-i", l.path,
+	)
+	cmd.Args = append(cmd.Args, pcmOutputArgs(l.path)...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &cmdReader{ReadCloser: out, cmd: cmd}, nil
+}
+
+// fifoSource reads PCM from a named pipe that an external producer may open
+// and close repeatedly. Its reader never reports EOF when a writer goes away;
+// it just has no data until the next writer shows up.
+type fifoSource struct {
+	path string
+}
+
+func (f *fifoSource) String() string { return "fifo:" + f.path }
+
+func (f *fifoSource) Open() (io.ReadCloser, error) {
+	// O_NONBLOCK: opening does not wait for a writer, and reads with no
+	// writer return EOF instead of blocking the open.
+	file, err := os.OpenFile(f.path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &fifoReader{f: file, closed: make(chan struct{})}, nil
+}
+
+type fifoReader struct {
+	f      *os.File
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (r *fifoReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.f.Read(p)
+		if n > 0 || (err != nil && err != io.EOF) {
+			return n, err
+		}
+		// No writer: poll until one connects.
+		select {
+		case <-r.closed:
+			return 0, os.ErrClosed
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
+
+func (r *fifoReader) Close() error {
+	r.once.Do(func() { close(r.closed) })
+	return r.f.Close()
+}
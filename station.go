@@ -0,0 +1,576 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ---------------- stations ----------------
+
+// A station is one independent pipeline: feeder -> encoder -> broadcaster,
+// served at its own mount path. Every goroutine a station owns runs under
+// protect(), so a panic is contained to that station and only restarts its
+// pipeline.
+type station struct {
+	name  string
+	mount string // request path, e.g. "/radio"
+
+	b      *Broadcaster
+	feed   *feeder
+	source pcmSource // live input instead of the file rotation, or nil
+	// Emergency input above everything else, or nil.
+	emergency pcmSource
+	// Played until the first real source has data, or nil.
+	warmup pcmSource
+	meter  *levelMeter // what goes into the encoder, for /nowplaying
+	// Fallback chain below the source (or the playlist); empty = none.
+	fallbacks []pcmSource
+	oggInput  io.Reader // ready-made Ogg stream that bypasses the encoder, or nil
+	mix       *mixer    // between the feeder and the encoder, or nil
+
+	// Further encodes of this station's audio (the low-bitrate mount), run
+	// by its pipeline; of points back from them.
+	tees []*station
+	of   *station
+	// Library query of a tag channel; empty for the whole rotation.
+	filter string
+
+	lmu       sync.Mutex
+	listeners map[*listener]struct{}
+	uniques   *uniqueCounter // nil with -unique-listeners=false
+
+	// Settings that a config reload may change; read through settings().
+	cmu     sync.Mutex
+	cfg     stationConfig
+	restart chan struct{} // requests a pipeline restart; buffered, may be nil
+
+	onEncoderFailure string // failExit, failRestart or failFailover
+
+	wmu       sync.Mutex
+	resets    int // pipeline resets by the output watchdog
+	lastReset incident
+	drifts    int // encoder bitrate drift alarms
+	lastDrift incident
+	underruns int // gaps in the source filled with silence
+	lastUnder incident
+
+	amu   sync.Mutex
+	onAir string // arbiter level currently feeding the encoder
+
+	chain atomic.Pointer[chainEncoder] // the running chain with -track-comments or -track-encode
+
+	economy atomic.Int32 // -cpu-pressure: stepped-down kbps; 0 when not
+
+	fmu         sync.Mutex
+	onAirFormat streamFormat // what the encoder produces now; see format.go
+	formatSince time.Time    // when it started; zero before the first encoder
+}
+
+// stationConfig holds the reloadable station settings. Encoder and
+// repagination changes only take effect when the pipeline restarts.
+type stationConfig struct {
+	enc       encoderConfig
+	rescan    time.Duration
+	fade      time.Duration
+	maxPageMs int      // repagination target, 0 = off
+	preroll   *preroll // nil when disabled
+	watermark bool     // per-listener header comment
+	// How long a listener may wait for the first headers before being
+	// told to come back later.
+	headerWait time.Duration
+	// Hold new listeners until the next track starts.
+	joinAtTrack bool
+	// Encode each track as a link of a chained stream, with its tags.
+	trackComments bool
+	// Read per-track encoder settings from sidecars (see trackenc.go).
+	trackEncode bool
+}
+
+func (st *station) settings() stationConfig {
+	st.cmu.Lock()
+	defer st.cmu.Unlock()
+	return st.cfg
+}
+
+func (st *station) setSettings(cfg stationConfig) {
+	st.cmu.Lock()
+	st.cfg = cfg
+	st.cmu.Unlock()
+}
+
+// encoder returns the encoder settings the pipeline starts with: the
+// configured ones, stepped down while the host is under CPU pressure.
+func (st *station) encoder() encoderConfig {
+	enc := st.settings().enc
+	if kbps := int(st.economy.Load()); kbps > 0 {
+		enc = enc.economy(kbps)
+	}
+	return enc
+}
+
+// onAirEncoder returns the settings of the encoder running now: st.encoder()
+// with the current track's -track-encode sidecar applied.
+func (st *station) onAirEncoder() encoderConfig {
+	if c := st.chain.Load(); c != nil {
+		return c.current()
+	}
+	return st.encoder()
+}
+
+// requestRestart asks the supervisor to restart the pipeline right away.
+func (st *station) requestRestart() {
+	select {
+	case st.restart <- struct{}{}:
+	default:
+	}
+}
+
+// listener is one connected /radio client.
+type listener struct {
+	remote string
+	id     string // anonymous listener ID; empty when not counted
+	since  time.Time
+	bytes  atomic.Int64
+}
+
+// addListener registers a client at remote that asked for host.
+func (st *station) addListener(remote, host string) *listener {
+	l := &listener{remote: remote, since: time.Now()}
+	if st.uniques != nil {
+		l.id = st.uniques.add(remote, host, l.since)
+	}
+	st.lmu.Lock()
+	if st.listeners == nil {
+		st.listeners = make(map[*listener]struct{})
+	}
+	st.listeners[l] = struct{}{}
+	st.lmu.Unlock()
+	return l
+}
+
+func (st *station) removeListener(l *listener) {
+	st.lmu.Lock()
+	delete(st.listeners, l)
+	st.lmu.Unlock()
+}
+
+// listenerList returns the connected listeners, longest connected first.
+func (st *station) listenerList() []*listener {
+	st.lmu.Lock()
+	out := make([]*listener, 0, len(st.listeners))
+	for l := range st.listeners {
+		out = append(out, l)
+	}
+	st.lmu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].since.Before(out[j].since) })
+	return out
+}
+
+var (
+	errFeederStopped = errors.New("feeder stopped")
+	errEncoderExited = errors.New("encoder exited")
+	errSourceEnded   = errors.New("source ended")
+	errRestart       = errors.New("restart requested")
+)
+
+// sourceError is a failure on the input side: a file that can't be read or
+// decoded (decode is set when ffmpeg rejected it). The feeder skips the file.
+type sourceError struct {
+	err    error
+	decode bool
+}
+
+func (e *sourceError) Error() string { return e.err.Error() }
+func (e *sourceError) Unwrap() error { return e.err }
+
+// sinkError is a failure to write to the encoder's stdin. The encoder is
+// gone, so the supervisor treats it like an encoder that exited.
+type sinkError struct{ err error }
+
+func (e *sinkError) Error() string { return "encoder input: " + e.err.Error() }
+func (e *sinkError) Unwrap() error { return e.err }
+
+// sinkWriter marks w's write errors as sinkErrors.
+type sinkWriter struct{ w io.Writer }
+
+func (sw sinkWriter) Write(p []byte) (int, error) {
+	n, err := sw.w.Write(p)
+	if err != nil {
+		err = &sinkError{err}
+	}
+	return n, err
+}
+
+const (
+	restartMinDelay = 1 * time.Second
+	restartMaxDelay = 30 * time.Second
+)
+
+// What to do when the encoder process exits (-on-encoder-failure).
+const (
+	failExit     = "exit"     // exit with status 1 for a service manager; one station only
+	failRestart  = "restart"  // restart the pipeline in process
+	failFailover = "failover" // restart, then fall back to safe encoder settings
+)
+
+// After this many encoder failures in a row, each within restartMaxDelay of
+// starting, failover switches to safe encoder settings.
+const failoverAfter = 3
+
+// safeEncoder is the failover profile: ffmpeg's default quality mode without
+// extra metadata, which any Vorbis-capable ffmpeg accepts. An Opus station
+// stays Opus, at a middling bitrate, since listeners were told the codec.
+func safeEncoder(enc encoderConfig) encoderConfig {
+	if enc.codec() == "opus" {
+		return encoderConfig{ffmpegPath: enc.ffmpegPath, codecName: "opus", bitrateKbps: 96, mime: enc.mime}
+	}
+	return encoderConfig{ffmpegPath: enc.ffmpegPath, vorbisQ: 4, mime: enc.mime}
+}
+
+// protect runs fn, converting a panic into an error.
+func protect(what string, fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("%s: panic: %v\n%s", what, r, debug.Stack())
+			err = fmt.Errorf("%s: panic: %v", what, r)
+		}
+	}()
+	return fn()
+}
+
+// levels are the station's sources in arbiter priority order.
+func (st *station) levels() []feedLevel {
+	var levels []feedLevel
+	if st.emergency != nil {
+		levels = append(levels, feedLevel{levelEmergency, st.emergency})
+	}
+	if st.source != nil {
+		levels = append(levels, feedLevel{levelLive, st.source})
+	} else {
+		levels = append(levels, feedLevel{levelRotation, &playlistSource{feed: st.feed}})
+	}
+	for _, fb := range st.fallbacks {
+		levels = append(levels, feedLevel{levelFallback, fb})
+	}
+	if st.warmup != nil {
+		levels = append(levels, feedLevel{levelWarmup, st.warmup})
+	}
+	return levels
+}
+
+func (st *station) setOnAir(l feedLevel) {
+	st.amu.Lock()
+	st.onAir = l.String()
+	st.amu.Unlock()
+}
+
+// onAirLevel names the arbiter level on air, e.g. "live: fifo:/tmp/dj".
+func (st *station) onAirLevel() string {
+	st.amu.Lock()
+	defer st.amu.Unlock()
+	return st.onAir
+}
+
+// pipeline is one running encoder plus the goroutines attached to it.
+// For Ogg input there is no encoder: cmd, chain and stdin are nil. With
+// -track-comments the encoder is a chain of them instead of cmd.
+type pipeline struct {
+	cmd    *exec.Cmd
+	chain  *chainEncoder
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	tees   []*pipeline // encoders of st.tees, in order
+}
+
+func (st *station) startPipeline() (*pipeline, error) {
+	if st.oggInput != nil {
+		return &pipeline{stdout: io.NopCloser(st.oggInput)}, nil
+	}
+	p, err := st.startEncoder()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range st.tees {
+		q, err := t.startEncoder()
+		if err != nil {
+			p.kill()
+			p.wait()
+			return nil, fmt.Errorf("%s: %v", t.name, err)
+		}
+		p.tees = append(p.tees, q)
+	}
+	return p, nil
+}
+
+// startEncoder starts st's encoder, without tees.
+func (st *station) startEncoder() (*pipeline, error) {
+	enc := st.encoder()
+	if cfg := st.settings(); cfg.trackComments || cfg.trackEncode {
+		c, err := startChain(enc)
+		if err != nil {
+			return nil, err
+		}
+		st.noteFormat(enc)
+		c.onLink = st.noteFormat
+		st.chain.Store(c)
+		return &pipeline{chain: c, stdin: c, stdout: c.output()}, nil
+	}
+	st.chain.Store(nil)
+	cmd, stdin, stdout, err := startEncoder(enc)
+	if err != nil {
+		return nil, err
+	}
+	st.noteFormat(enc)
+	return &pipeline{cmd: cmd, stdin: stdin, stdout: stdout}, nil
+}
+
+// nextLink starts a new link of the chained stream for a track tagged t
+// and encoded with o (see chainEncoder.nextTrack); nothing without
+// -track-comments or -track-encode.
+func (st *station) nextLink(t *trackTags, o trackEncode) {
+	if c := st.chain.Load(); c != nil {
+		c.nextTrack(t, o)
+	}
+}
+
+// kill stops p's encoders; wait reaps them.
+func (p *pipeline) kill() {
+	for _, q := range append([]*pipeline{p}, p.tees...) {
+		if q.chain != nil {
+			q.chain.kill()
+			continue
+		}
+		_ = q.stdin.Close()
+		_ = q.cmd.Process.Kill()
+	}
+}
+
+func (p *pipeline) wait() {
+	for _, q := range append([]*pipeline{p}, p.tees...) {
+		if q.chain != nil {
+			q.chain.wait()
+			continue
+		}
+		_ = q.cmd.Wait()
+	}
+}
+
+// restartFlush is how long a planned restart waits for the encoders to
+// finish their streams before killing them.
+const restartFlush = 3 * time.Second
+
+// flush ends p's input and waits for drained, the broadcasters, to see the
+// end of every encoder's output. It returns false if that takes longer than
+// restartFlush.
+func (p *pipeline) flush(drained *sync.WaitGroup) bool {
+	for _, q := range append([]*pipeline{p}, p.tees...) {
+		_ = q.stdin.Close()
+	}
+	flushed := make(chan struct{})
+	go func() {
+		drained.Wait()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+		return true
+	case <-time.After(restartFlush):
+		return false
+	}
+}
+
+// input is where the PCM for p goes: its encoder, and the tees' as well.
+func (p *pipeline) input() io.Writer {
+	if len(p.tees) == 0 {
+		return p.stdin
+	}
+	ws := []io.Writer{p.stdin}
+	for _, q := range p.tees {
+		ws = append(ws, q.stdin)
+	}
+	return io.MultiWriter(ws...)
+}
+
+// runPipeline feeds and drains p until either side stops, then tears it down.
+func (st *station) runPipeline(p *pipeline) error {
+	cfg := st.settings()
+	if p.cmd == nil && p.chain == nil {
+		return protect(st.name+" broadcaster", func() error {
+			err := broadcastFromEncoder(p.stdout, st.b, cfg.maxPageMs)
+			if err != nil && !errors.Is(err, io.EOF) {
+				log.Printf("%s: input ended: %v", st.name, err)
+			}
+			return errSourceEnded
+		})
+	}
+
+	stop := make(chan struct{})
+	done := make(chan error, 3+len(p.tees))
+
+	var out io.Writer = meterWriter{p.input(), st.meter}
+	in := out
+	if st.mix != nil {
+		st.mix.open()
+		in = st.mix.input()
+		go func() {
+			done <- protect(st.name+" mixer", func() error { return st.mix.run(out, stop) })
+		}()
+	}
+	go func() {
+		done <- protect(st.name+" feeder", func() error {
+			return arbitrate(st.levels(), in, cfg.rescan, cfg.fade, stop, st.setOnAir, st.noteUnderrun)
+		})
+	}()
+	go chaos.killer(p, stop)
+	// The broadcasters close the old streams as they end; the next
+	// pipeline's pages must come after that.
+	var drained sync.WaitGroup
+	drained.Add(1 + len(p.tees))
+	go func() {
+		defer drained.Done()
+		done <- protect(st.name+" broadcaster", func() error {
+			err := broadcastFromEncoder(p.stdout, st.b, cfg.maxPageMs)
+			if err != nil && !errors.Is(err, io.EOF) {
+				log.Printf("%s: encoder stdout ended: %v", st.name, err)
+			}
+			return errEncoderExited
+		})
+	}()
+	for i, q := range p.tees {
+		t, q := st.tees[i], q
+		go func() {
+			defer drained.Done()
+			done <- protect(t.name+" broadcaster", func() error {
+				err := broadcastFromEncoder(q.stdout, t.b, t.settings().maxPageMs)
+				if err != nil && !errors.Is(err, io.EOF) {
+					log.Printf("%s: encoder stdout ended: %v", t.name, err)
+				}
+				return errEncoderExited
+			})
+		}()
+	}
+
+	var err error
+	select {
+	case err = <-done:
+	case <-st.restart:
+		err = errRestart
+	}
+	if errors.Is(err, errSourceEnded) {
+		// Let the encoders flush the tail of the stream before stopping.
+		for _, q := range append([]*pipeline{p}, p.tees...) {
+			_ = q.stdin.Close()
+		}
+		<-done
+		p.wait()
+		drained.Wait()
+		return err
+	}
+	close(stop)
+	if errors.Is(err, errRestart) && p.flush(&drained) {
+		// A planned restart: the old link ended with its own EOS.
+		p.wait()
+		return err
+	}
+	p.kill()
+	<-done
+	p.wait()
+	drained.Wait()
+	return err
+}
+
+// run supervises the station forever, starting from an already running p.
+func (st *station) run(p *pipeline) {
+	for _, t := range append([]*station{st}, st.tees...) {
+		go func(t *station) {
+			for {
+				_ = protect(t.name+" hub", func() error { t.b.Run(); return nil })
+				time.Sleep(restartMinDelay)
+			}
+		}(t)
+	}
+
+	delay := restartMinDelay
+	failures := 0
+	for {
+		started := time.Now()
+		err := st.runPipeline(p)
+
+		// Whichever side noticed first, a dead encoder is an encoder failure.
+		var se *sinkError
+		if errors.Is(err, errEncoderExited) || errors.As(err, &se) {
+			switch st.onEncoderFailure {
+			case failExit:
+				// Asked for, with no other station to take down: a service
+				// manager restarts the process.
+				log.Printf("%s: encoder failed; exiting", st.name)
+				os.Exit(1)
+			case failFailover:
+				if time.Since(started) > restartMaxDelay {
+					failures = 0
+				}
+				failures++
+				if cfg := st.settings(); failures == failoverAfter && cfg.enc != safeEncoder(cfg.enc) {
+					log.Printf("%s: encoder failed %d times in a row; failing over to safe encoder settings", st.name, failures)
+					cfg.enc = safeEncoder(cfg.enc)
+					st.setSettings(cfg)
+				}
+			}
+		}
+		// A finite source such as stdin is done; so is the station.
+		if errors.Is(err, errSourceEnded) {
+			log.Printf("%s: source ended; exiting", st.name)
+			os.Exit(0)
+		}
+
+		if errors.Is(err, errRestart) {
+			log.Printf("%s: restarting pipeline with new settings", st.name)
+		} else {
+			if time.Since(started) > restartMaxDelay {
+				delay = restartMinDelay
+			}
+			log.Printf("%s: pipeline stopped (%v); restarting in %s", st.name, err, delay)
+			time.Sleep(delay)
+			delay = min(delay*2, restartMaxDelay)
+		}
+
+		for _, t := range append([]*station{st}, st.tees...) {
+			t.b.SetHeader(nil)
+			t.b.setLastTrack(nil)
+		}
+		for {
+			p, err = st.startPipeline()
+			if err == nil {
+				break
+			}
+			log.Printf("%s: failed to start ffmpeg encoder: %v", st.name, err)
+			time.Sleep(delay)
+			delay = min(delay*2, restartMaxDelay)
+		}
+	}
+}
+
+// noteUnderrun records a gap in level that was filled with silence.
+func (st *station) noteUnderrun(level feedLevel, silence time.Duration) {
+	st.wmu.Lock()
+	st.underruns++
+	st.lastUnder = incident{at: time.Now(), reason: fmt.Sprintf("%s of silence for %s", silence.Round(time.Millisecond), level.src)}
+	st.wmu.Unlock()
+}
+
+// sourceUnderruns returns how often a source underran and the latest
+// incident.
+func (st *station) sourceUnderruns() (int, incident) {
+	st.wmu.Lock()
+	defer st.wmu.Unlock()
+	return st.underruns, st.lastUnder
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"math/bits"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ---------------- station IDs ----------------
+
+// idScheduler inserts station IDs from a pool directory between tracks so
+// that IDs are at most every apart but never closer than minGap. Time is
+// broadcast time: the audio actually fed to the encoder, not the wall clock,
+// so pauses and restarts don't count. Before each track the scheduler looks
+// at the track's length and plays an ID first if waiting until after the
+// track would break the every limit. It is used from the feeder goroutine
+// only.
+type idScheduler struct {
+	dir    string
+	every  time.Duration
+	minGap time.Duration
+	rng    *rand.Rand
+
+	since time.Duration // broadcast time since the last ID started
+	last  string
+}
+
+func newIDScheduler(dir string, every, minGap time.Duration) *idScheduler {
+	return &idScheduler{
+		dir:    dir,
+		every:  every,
+		minGap: minGap,
+		rng:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		since:  every, // open with an ID
+	}
+}
+
+// due returns the ID to play before next, if one is needed.
+func (s *idScheduler) due(next string) (string, bool) {
+	length, err := audioDuration(next)
+	if err != nil {
+		length = 0 // unknown: decide on the time so far
+	}
+	if s.since+length <= s.every {
+		return "", false
+	}
+	if s.since < s.minGap {
+		log.Printf("Station ID: %s would pass the %s limit, but the last ID was only %s ago",
+			filepath.Base(next), s.every, s.since.Round(time.Second))
+		return "", false
+	}
+
+	pool, err := buildWavListFromDir(s.dir)
+	if err != nil || len(pool) == 0 {
+		log.Printf("Station ID: no IDs in %s (%v)", s.dir, err)
+		return "", false
+	}
+	id := pool[s.rng.Intn(len(pool))]
+	if id == s.last && len(pool) > 1 {
+		id = pool[(s.rng.Intn(len(pool)-1)+indexOf(pool, id)+1)%len(pool)]
+	}
+	s.last = id
+	return id, true
+}
+
+// played accounts for d of broadcast audio.
+func (s *idScheduler) played(d time.Duration, isID bool) {
+	if isID {
+		s.since = d
+		return
+	}
+	s.since += d
+}
+
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// ---------------- audio file durations ----------------
+
+// audioDuration reads the length of a WAV or FLAC file from its header.
+func audioDuration(path string) (time.Duration, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".flac":
+		return flacDuration(r)
+	case ".wav", ".wave":
+		return wavDuration(r)
+	}
+	return 0, errUnknownFormat
+}
+
+func wavDuration(r io.Reader) (time.Duration, error) {
+	h, err := readWavHeader(r)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(float64(h.dataSize) / float64(h.byteRate) * float64(time.Second)), nil
+}
+
+// wavHeader is what the fmt and data chunk headers of a WAV file say.
+type wavHeader struct {
+	format   uint16 // 1 = integer PCM, 3 = IEEE float; extensible files give their subformat
+	bits     int
+	channels int
+	mask     uint32 // speaker positions of extensible files; 0 = none given
+	byteRate uint32
+	dataSize uint32
+}
+
+const (
+	wavFormatFloat      = 3
+	wavFormatExtensible = 0xfffe
+)
+
+// readWavHeader reads r up to the start of the data chunk.
+func readWavHeader(r io.Reader) (wavHeader, error) {
+	var h wavHeader
+	var riff [12]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil {
+		return h, err
+	}
+	if !bytes.Equal(riff[0:4], []byte("RIFF")) || !bytes.Equal(riff[8:12], []byte("WAVE")) {
+		return h, errors.New("not a WAV file")
+	}
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return h, err
+		}
+		size := binary.LittleEndian.Uint32(hdr[4:])
+		switch string(hdr[:4]) {
+		case "fmt ":
+			fmtChunk := make([]byte, size+size%2)
+			if _, err := io.ReadFull(r, fmtChunk); err != nil {
+				return h, err
+			}
+			if size < 16 {
+				return h, errors.New("short WAV fmt chunk")
+			}
+			h.format = binary.LittleEndian.Uint16(fmtChunk[0:2])
+			h.channels = int(binary.LittleEndian.Uint16(fmtChunk[2:4]))
+			h.byteRate = binary.LittleEndian.Uint32(fmtChunk[8:12])
+			h.bits = int(binary.LittleEndian.Uint16(fmtChunk[14:16]))
+			// The subformat GUID starts with the format code.
+			if h.format == wavFormatExtensible && size >= 26 {
+				h.mask = binary.LittleEndian.Uint32(fmtChunk[20:24])
+				h.format = binary.LittleEndian.Uint16(fmtChunk[24:26])
+			}
+		case "data":
+			if h.byteRate == 0 {
+				return h, errors.New("WAV data before fmt")
+			}
+			h.dataSize = size
+			return h, nil
+		default:
+			if _, err := io.CopyN(io.Discard, r, int64(size+size%2)); err != nil {
+				return h, err
+			}
+		}
+	}
+}
+
+// audioFormat is the sample format of a source file, from its header.
+type audioFormat struct {
+	bits     int
+	float    bool
+	channels int
+	// The file says which speaker each channel is for. FLAC always does;
+	// WAV only with a channel mask, and ffmpeg's guess for a WAV without
+	// one does not follow the WAV channel order.
+	positioned bool
+}
+
+// errUnknownFormat is returned for files whose headers are not read here:
+// anything but WAV and FLAC.
+var errUnknownFormat = errors.New("unknown audio format")
+
+// readAudioFormat reads the sample format of a WAV or FLAC file.
+func readAudioFormat(path string) (audioFormat, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return audioFormat{}, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".flac":
+		var b [4 + 4 + 18]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return audioFormat{}, err
+		}
+		if !bytes.Equal(b[0:4], []byte("fLaC")) || b[4]&0x7f != 0 {
+			return audioFormat{}, errors.New("not a FLAC file")
+		}
+		// After the sample rate: 3 bits of channels and 5 of bits per
+		// sample, each minus one.
+		info := b[8:]
+		return audioFormat{
+			bits:       (int(info[12]&0x01)<<4 | int(info[13]>>4)) + 1,
+			channels:   int(info[12]>>1&0x07) + 1,
+			positioned: true,
+		}, nil
+	case ".wav", ".wave":
+		h, err := readWavHeader(r)
+		return audioFormat{
+			bits:       h.bits,
+			float:      h.format == wavFormatFloat,
+			channels:   h.channels,
+			positioned: h.channels <= 2 || bits.OnesCount32(h.mask) == h.channels,
+		}, err
+	}
+	return audioFormat{}, errUnknownFormat
+}
+
+func flacDuration(r io.Reader) (time.Duration, error) {
+	// "fLaC", then the STREAMINFO block header and body.
+	var b [4 + 4 + 18]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(b[0:4], []byte("fLaC")) || b[4]&0x7f != 0 {
+		return 0, errors.New("not a FLAC file")
+	}
+	info := b[8:]
+	// 20 bits sample rate, 3 channels, 5 bits per sample, 36 total samples.
+	rate := uint64(info[10])<<12 | uint64(info[11])<<4 | uint64(info[12])>>4
+	total := uint64(info[13]&0x0f)<<32 | uint64(binary.BigEndian.Uint32(info[14:18]))
+	if rate == 0 || total == 0 {
+		return 0, errors.New("FLAC length unknown")
+	}
+	return time.Duration(float64(total) / float64(rate) * float64(time.Second)), nil
+}
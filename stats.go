@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// ---------------- /stats ----------------
+
+func (srv *server) writeStats(w io.Writer) {
+	fmt.Fprintf(w, "2 text/gemini; charset=utf-8\r\n")
+	fmt.Fprintf(w, "# Stats\n\n")
+	fmt.Fprintf(w, "Uptime: %s\n", time.Since(srv.started).Round(time.Second))
+
+	for _, st := range srv.stations {
+		b := st.b
+		fmt.Fprintf(w, "\n## %s\n\n", st.mount)
+		if st.of != nil {
+			fmt.Fprintf(w, "* Encoded from %s at %d kbps\n", st.of.mount, st.settings().enc.bitrateKbps)
+		}
+		if st.filter != "" {
+			fmt.Fprintf(w, "* Channel: %s\n", st.filter)
+		}
+		fmt.Fprintf(w, "* Listeners: %d\n", b.Listeners())
+		if st.uniques != nil {
+			today, yesterday := st.uniques.counts(time.Now())
+			fmt.Fprintf(w, "* Unique listeners: %d today, %d yesterday\n", today, yesterday)
+		}
+		for _, u := range b.Buffers() {
+			fmt.Fprintf(w, "* %s: %s\n", u.name, usage(u.bytes, u.limit))
+		}
+		queued, limit := b.Queued()
+		fmt.Fprintf(w, "* Broadcast queue: %d/%d pages\n", queued, limit)
+		if n, last := st.watchdogResets(); n > 0 {
+			fmt.Fprintf(w, "* Watchdog resets: %d (last %s ago: %s)\n", n, time.Since(last.at).Round(time.Second), last.reason)
+		} else {
+			fmt.Fprintf(w, "* Watchdog resets: 0\n")
+		}
+		if on := st.onAirLevel(); on != "" {
+			fmt.Fprintf(w, "* On air: %s\n", on)
+		}
+		if kbps, at := b.rate.latest(); !at.IsZero() {
+			if target := st.onAirEncoder().bitrateKbps; target > 0 {
+				fmt.Fprintf(w, "* Encoder bitrate: %.0f kbps (target %d)\n", kbps, target)
+			} else {
+				fmt.Fprintf(w, "* Encoder bitrate: %.0f kbps\n", kbps)
+			}
+		}
+		if kbps := st.economy.Load(); kbps > 0 {
+			fmt.Fprintf(w, "* CPU pressure: encoder stepped down to %d kbps\n", kbps)
+		}
+		if n, last := st.bitrateAlarms(); n > 0 {
+			fmt.Fprintf(w, "* Bitrate alarms: %d (last %s ago: %s)\n", n, time.Since(last.at).Round(time.Second), last.reason)
+		}
+		// The file health is shared; list it under the main station only.
+		if st.feed != nil && st.feed.health != nil && st.of == nil && st.filter == "" {
+			st.feed.health.writeStats(w)
+		}
+		if n, last := st.sourceUnderruns(); n > 0 {
+			fmt.Fprintf(w, "* Source underruns: %d (last %s ago: %s)\n", n, time.Since(last.at).Round(time.Second), last.reason)
+		}
+	}
+	if srv.limit != nil {
+		srv.limit.writeStats(w, srv.listenerCount())
+	}
+	if srv.egress != nil {
+		srv.egress.writeStats(w, time.Now())
+	}
+}
+
+// usage formats a buffer's current size against its limit (0 = unlimited).
+func usage(n, limit int) string {
+	if limit <= 0 {
+		return fmt.Sprintf("%d bytes (unlimited)", n)
+	}
+	return fmt.Sprintf("%d/%d bytes", n, limit)
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3" // registers the "sqlite3" driver
+	bolt "go.etcd.io/bbolt"
+)
+
+// ---------------- storage ----------------
+
+// store is the key/value storage behind everything the server keeps across
+// restarts, so a feature that needs persistence picks a bucket instead of
+// inventing its own file. Values are opaque bytes; keys are unique within a
+// bucket.
+type store interface {
+	Get(bucket, key string) ([]byte, error) // errNotFound if missing
+	Put(bucket, key string, value []byte) error
+	Delete(bucket, key string) error
+	Keys(bucket string) ([]string, error) // sorted
+	Close() error
+}
+
+var errNotFound = errors.New("not found")
+
+// textIndexer is implemented by stores that can keep a full-text index
+// next to their buckets. The library searches through it instead of
+// building an index of its own in memory.
+type textIndexer interface {
+	// TextIndex opens, creating if need be, the index called name, whose
+	// documents have the given fields.
+	TextIndex(name string, fields []string) (textIndex, error)
+}
+
+// textIndex is a full-text index of documents, each a key with a text per
+// field. Texts are split into lower-cased words of letters and digits, as
+// by words.
+type textIndex interface {
+	// Replace indexes docs (key -> field -> text) in one transaction; a nil
+	// doc removes its key. With all set, every other key is removed too.
+	Replace(docs map[string]map[string]string, all bool) error
+	// Match returns the keys with word in field: the whole word or, with
+	// prefix, any word starting with it.
+	Match(field, word string, prefix bool) ([]string, error)
+}
+
+// openStore opens the storage named by a -store value:
+//
+//	memory       in process memory, lost on exit (default)
+//	dir:PATH     one file per key under PATH/<bucket>/
+//	bolt:PATH    a bbolt database file, one bolt bucket per bucket
+//	sqlite:PATH  an SQLite database file, one table for every bucket
+func openStore(spec string) (store, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "", "memory":
+		return newMemStore(), nil
+	case "dir", "bolt", "sqlite":
+		if arg == "" {
+			return nil, fmt.Errorf("%s store needs a path (%s:PATH)", kind, kind)
+		}
+	default:
+		return nil, fmt.Errorf("unknown store %q (use memory, dir:PATH, bolt:PATH or sqlite:PATH)", spec)
+	}
+	switch kind {
+	case "bolt":
+		return openBoltStore(arg)
+	case "sqlite":
+		return openSQLiteStore(arg)
+	}
+	return openDirStore(arg)
+}
+
+// memStore keeps everything in memory. It backs the default configuration
+// and tests.
+type memStore struct {
+	mu      sync.Mutex
+	buckets map[string]map[string][]byte
+}
+
+func newMemStore() *memStore {
+	return &memStore{buckets: make(map[string]map[string][]byte)}
+}
+
+func (m *memStore) Get(bucket, key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.buckets[bucket][key]
+	if !ok {
+		return nil, errNotFound
+	}
+	return append([]byte(nil), v...), nil
+}
+
+func (m *memStore) Put(bucket, key string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b := m.buckets[bucket]
+	if b == nil {
+		b = make(map[string][]byte)
+		m.buckets[bucket] = b
+	}
+	b[key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (m *memStore) Delete(bucket, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.buckets[bucket], key)
+	return nil
+}
+
+func (m *memStore) Keys(bucket string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.buckets[bucket]))
+	for k := range m.buckets[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (m *memStore) Close() error { return nil }
+
+// dirStore keeps each value in its own file, PATH/<bucket>/<escaped key>,
+// replaced atomically on every Put; the empty bucket is PATH itself. It suits
+// the small amounts of state the server has today and needs no dependencies.
+type dirStore struct {
+	dir string
+}
+
+func openDirStore(dir string) (*dirStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &dirStore{dir: dir}, nil
+}
+
+func (d *dirStore) path(bucket, key string) string {
+	return filepath.Join(d.dir, url.PathEscape(bucket), url.PathEscape(key))
+}
+
+func (d *dirStore) Get(bucket, key string) ([]byte, error) {
+	v, err := os.ReadFile(d.path(bucket, key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errNotFound
+	}
+	return v, err
+}
+
+func (d *dirStore) Put(bucket, key string, value []byte) error {
+	path := d.path(bucket, key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".put-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(value)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (d *dirStore) Delete(bucket, key string) error {
+	err := os.Remove(d.path(bucket, key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (d *dirStore) Keys(bucket string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(d.dir, url.PathEscape(bucket)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".put-") {
+			continue
+		}
+		if k, err := url.PathUnescape(e.Name()); err == nil {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (d *dirStore) Close() error { return nil }
+
+// boltStore keeps the buckets in a bbolt file. Bolt locks the file, so only
+// one process has it open at a time; a second one gives up after
+// boltOpenTimeout rather than waiting for the first to exit.
+type boltStore struct {
+	db *bolt.DB
+}
+
+const boltOpenTimeout = 2 * time.Second
+
+func openBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: boltOpenTimeout})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("%s is in use by another process", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (b *boltStore) Get(bucket, key string) ([]byte, error) {
+	var v []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if bk := tx.Bucket([]byte(bucket)); bk != nil {
+			if data := bk.Get([]byte(key)); data != nil {
+				v = append([]byte{}, data...) // only valid inside the transaction
+			}
+		}
+		return nil
+	})
+	if err == nil && v == nil {
+		err = errNotFound
+	}
+	return v, err
+}
+
+func (b *boltStore) Put(bucket, key string, value []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return bk.Put([]byte(key), value)
+	})
+}
+
+func (b *boltStore) Delete(bucket, key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if bk := tx.Bucket([]byte(bucket)); bk != nil {
+			return bk.Delete([]byte(key))
+		}
+		return nil
+	})
+}
+
+// Keys relies on bolt keeping keys in byte order, which is sort.Strings
+// order.
+func (b *boltStore) Keys(bucket string) ([]string, error) {
+	var keys []string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bk := tx.Bucket([]byte(bucket))
+		if bk == nil {
+			return nil
+		}
+		return bk.ForEach(func(k, _ []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	return keys, err
+}
+
+func (b *boltStore) Close() error { return b.db.Close() }
+
+// sqliteStore keeps every bucket in one table of an SQLite file. The file
+// is opened in WAL mode with a busy timeout, so a second process (the new
+// binary during an upgrade) can use it alongside the first. It needs a
+// build with cgo.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_journal_mode=WAL&_synchronous=NORMAL")
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS store (
+		bucket TEXT NOT NULL,
+		key    TEXT NOT NULL,
+		value  BLOB NOT NULL,
+		PRIMARY KEY (bucket, key)
+	) WITHOUT ROWID`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+func (s *sqliteStore) Get(bucket, key string) ([]byte, error) {
+	var v []byte
+	err := s.db.QueryRow(`SELECT value FROM store WHERE bucket = ? AND key = ?`, bucket, key).Scan(&v)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errNotFound
+	}
+	if v == nil && err == nil {
+		v = []byte{}
+	}
+	return v, err
+}
+
+func (s *sqliteStore) Put(bucket, key string, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO store (bucket, key, value) VALUES (?, ?, ?)`, bucket, key, value)
+	return err
+}
+
+func (s *sqliteStore) Delete(bucket, key string) error {
+	_, err := s.db.Exec(`DELETE FROM store WHERE bucket = ? AND key = ?`, bucket, key)
+	return err
+}
+
+// Keys relies on SQLite's default BINARY collation, which is sort.Strings
+// order.
+func (s *sqliteStore) Keys(bucket string) ([]string, error) {
+	rows, err := s.db.Query(`SELECT key FROM store WHERE bucket = ? ORDER BY key`, bucket)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (s *sqliteStore) Close() error { return s.db.Close() }
+
+// TextIndex keeps the index in an FTS4 table, "fts_<name>", whose docids
+// are the rowids of "fts_<name>_keys". The unicode61 tokenizer, keeping
+// diacritics, splits text the way words does.
+func (s *sqliteStore) TextIndex(name string, fields []string) (textIndex, error) {
+	ix := &sqliteTextIndex{
+		db:     s.db,
+		fts:    sqliteIdent("fts_" + name),
+		keys:   sqliteIdent("fts_" + name + "_keys"),
+		fields: fields,
+	}
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS ` + ix.keys + ` (id INTEGER PRIMARY KEY, key TEXT NOT NULL UNIQUE)`,
+		`CREATE VIRTUAL TABLE IF NOT EXISTS ` + ix.fts + ` USING fts4(` + strings.Join(fields, ", ") +
+			`, tokenize=unicode61 "remove_diacritics=0")`,
+	}
+	for _, q := range stmts {
+		if _, err := s.db.Exec(q); err != nil {
+			return nil, fmt.Errorf("text index %s: %v", name, err)
+		}
+	}
+	return ix, nil
+}
+
+// sqliteIdent quotes name as an SQL identifier.
+func sqliteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+type sqliteTextIndex struct {
+	db        *sql.DB
+	fts, keys string // quoted table names
+	fields    []string
+}
+
+func (ix *sqliteTextIndex) Replace(docs map[string]map[string]string, all bool) error {
+	tx, err := ix.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if all {
+		for _, t := range []string{ix.fts, ix.keys} {
+			if _, err := tx.Exec(`DELETE FROM ` + t); err != nil {
+				return err
+			}
+		}
+	}
+	marks := strings.Repeat(", ?", len(ix.fields))
+	insert, err := tx.Prepare(`INSERT INTO ` + ix.fts + ` (docid, ` + strings.Join(ix.fields, ", ") + `) VALUES (?` + marks + `)`)
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+	for key, doc := range docs {
+		var id int64
+		err := tx.QueryRow(`SELECT id FROM `+ix.keys+` WHERE key = ?`, key).Scan(&id)
+		switch {
+		case err == nil:
+			if _, err := tx.Exec(`DELETE FROM `+ix.fts+` WHERE docid = ?`, id); err != nil {
+				return err
+			}
+			if doc == nil {
+				if _, err := tx.Exec(`DELETE FROM `+ix.keys+` WHERE id = ?`, id); err != nil {
+					return err
+				}
+				continue
+			}
+		case !errors.Is(err, sql.ErrNoRows):
+			return err
+		case doc == nil:
+			continue
+		default:
+			res, err := tx.Exec(`INSERT INTO `+ix.keys+` (key) VALUES (?)`, key)
+			if err != nil {
+				return err
+			}
+			if id, err = res.LastInsertId(); err != nil {
+				return err
+			}
+		}
+		args := []any{id}
+		for _, f := range ix.fields {
+			args = append(args, doc[f])
+		}
+		if _, err := insert.Exec(args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (ix *sqliteTextIndex) Match(field, word string, prefix bool) ([]string, error) {
+	// word is one of words' letter and digit runs, lower-cased, so it
+	// holds no query syntax: not even AND, OR or NOT.
+	q := field + ":" + word
+	if prefix {
+		q += "*"
+	}
+	rows, err := ix.db.Query(`SELECT key FROM `+ix.keys+` WHERE id IN (SELECT docid FROM `+ix.fts+` WHERE `+ix.fts+` MATCH ?)`, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Every store implementation must behave the same.
+func TestStores(t *testing.T) {
+	tmp := t.TempDir()
+	dir, err := openDirStore(filepath.Join(tmp, "dir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bdb, err := openBoltStore(filepath.Join(tmp, "bolt.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bdb.Close()
+	sdb, err := openSQLiteStore(filepath.Join(tmp, "sqlite.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sdb.Close()
+	for name, db := range map[string]store{"memory": newMemStore(), "dir": dir, "bolt": bdb, "sqlite": sdb} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := db.Get("b", "missing"); !errors.Is(err, errNotFound) {
+				t.Fatalf("Get missing: err = %v, want errNotFound", err)
+			}
+			if keys, err := db.Keys("empty"); err != nil || len(keys) != 0 {
+				t.Fatalf("Keys of empty bucket = %q, %v", keys, err)
+			}
+			for _, k := range []string{"z", "/music/a b.flac", "a"} {
+				if err := db.Put("b", k, []byte("v"+k)); err != nil {
+					t.Fatalf("Put %q: %v", k, err)
+				}
+			}
+			if err := db.Put("b", "a", []byte("new")); err != nil {
+				t.Fatal(err)
+			}
+			if v, err := db.Get("b", "a"); err != nil || string(v) != "new" {
+				t.Fatalf("Get a = %q, %v; want overwritten value", v, err)
+			}
+			if v, err := db.Get("b", "/music/a b.flac"); err != nil || string(v) != "v/music/a b.flac" {
+				t.Fatalf("Get path key = %q, %v", v, err)
+			}
+			keys, err := db.Keys("b")
+			if want := []string{"/music/a b.flac", "a", "z"}; err != nil || !reflect.DeepEqual(keys, want) {
+				t.Fatalf("Keys = %q, %v; want %q", keys, err, want)
+			}
+			if err := db.Delete("b", "z"); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Delete("b", "z"); err != nil {
+				t.Fatalf("Delete missing: %v", err)
+			}
+			if _, err := db.Get("b", "z"); !errors.Is(err, errNotFound) {
+				t.Fatalf("Get deleted: err = %v", err)
+			}
+			if keys, _ := db.Keys("other"); len(keys) != 0 {
+				t.Fatalf("buckets leak: %q", keys)
+			}
+			if err := db.Put("b", "empty", nil); err != nil {
+				t.Fatal(err)
+			}
+			if v, err := db.Get("b", "empty"); err != nil || len(v) != 0 {
+				t.Fatalf("Get empty value = %q, %v", v, err)
+			}
+		})
+	}
+}
+
+func TestOpenStore(t *testing.T) {
+	for _, spec := range []string{"bolt:", "sqlite:", "dir:", "redis"} {
+		if _, err := openStore(spec); err == nil {
+			t.Errorf("openStore(%q) succeeded", spec)
+		}
+	}
+	dir := t.TempDir()
+	for _, spec := range []string{"memory", "dir:" + dir + "/d", "bolt:" + dir + "/b.db", "sqlite:" + dir + "/s.db"} {
+		db, err := openStore(spec)
+		if err != nil {
+			t.Errorf("openStore(%q): %v", spec, err)
+			continue
+		}
+		db.Close()
+	}
+
+	// A bolt file is one process's at a time; the second gives up.
+	db, err := openStore("bolt:" + dir + "/b.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := openBoltStore(dir + "/b.db"); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("second open of a bolt file: %v", err)
+	}
+}
+
+// The history survives a restart and keeps the file format of -history-file.
+func TestPlayHistoryStore(t *testing.T) {
+	dir := t.TempDir()
+	db, err := openDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := loadPlayHistory(db, "", "history", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.add("a")
+	h.add("b")
+	h.add("c")
+	if v, _ := os.ReadFile(filepath.Join(dir, "history")); string(v) != "b\nc\n" {
+		t.Fatalf("history file = %q", v)
+	}
+	h, err = loadPlayHistory(db, "", "history", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := h.spread([]string{"c", "x", "b"}); !reflect.DeepEqual(got, []string{"x", "b", "c"}) {
+		t.Fatalf("spread after reload = %q", got)
+	}
+}
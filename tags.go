@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// ---------------- file tags ----------------
+
+// trackTags are the descriptive tags of a music file: Vorbis comments in
+// FLAC, Ogg Vorbis and Ogg Opus, ID3v2 (2.3 and 2.4) in MP3, and the
+// LIST/INFO chunk in WAV. Files without a title are titled after their file
+// name. RIFF INFO has no field for the ISRC or the disc number.
+type trackTags struct {
+	artist, title, album string
+	genre                string
+	isrc                 string
+	disc, track          int // position on the album; 0 = unknown
+}
+
+func readTags(path string) (trackTags, error) {
+	var t trackTags
+	f, err := os.Open(path)
+	if err != nil {
+		return t, err
+	}
+	defer f.Close()
+
+	var magic [4]byte
+	if _, err := io.ReadFull(f, magic[:]); err != nil {
+		return t, err
+	}
+	switch {
+	case string(magic[:]) == "fLaC":
+		t, err = readFlacTags(f)
+	case string(magic[:]) == "RIFF":
+		t, err = readWavTags(f)
+	case string(magic[:]) == "OggS":
+		t, err = readOggTags(io.MultiReader(bytes.NewReader(magic[:]), f))
+	case string(magic[:3]) == "ID3":
+		t, err = readID3Tags(io.MultiReader(bytes.NewReader(magic[:]), f))
+	}
+	if t.title == "" {
+		base := filepath.Base(path)
+		t.title = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+	return t, err
+}
+
+// readFlacTags reads the metadata blocks after "fLaC" up to VORBIS_COMMENT.
+func readFlacTags(r io.ReadSeeker) (trackTags, error) {
+	var t trackTags
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return t, err
+		}
+		last, kind := hdr[0]&0x80 != 0, hdr[0]&0x7f
+		n := int64(hdr[1])<<16 | int64(hdr[2])<<8 | int64(hdr[3])
+		if kind != 4 {
+			if _, err := r.Seek(n, io.SeekCurrent); err != nil {
+				return t, err
+			}
+			if last {
+				return t, nil
+			}
+			continue
+		}
+		block := make([]byte, n)
+		if _, err := io.ReadFull(r, block); err != nil {
+			return t, err
+		}
+		for _, c := range vorbisComments(block) {
+			key, value, _ := strings.Cut(c, "=")
+			t.set(strings.ToUpper(key), value)
+		}
+		return t, nil
+	}
+}
+
+// vorbisComments splits a Vorbis comment block (little-endian lengths, no
+// framing bit) into its "KEY=value" strings.
+func vorbisComments(b []byte) []string {
+	next := func() ([]byte, bool) {
+		if len(b) < 4 {
+			return nil, false
+		}
+		n := binary.LittleEndian.Uint32(b)
+		if uint64(n) > uint64(len(b)-4) {
+			return nil, false
+		}
+		v := b[4 : 4+n]
+		b = b[4+n:]
+		return v, true
+	}
+	if _, ok := next(); !ok { // vendor string
+		return nil
+	}
+	if len(b) < 4 {
+		return nil
+	}
+	count := binary.LittleEndian.Uint32(b)
+	b = b[4:]
+	var out []string
+	for i := uint32(0); i < count; i++ {
+		c, ok := next()
+		if !ok {
+			break
+		}
+		out = append(out, string(c))
+	}
+	return out
+}
+
+// maxTagBytes bounds the tag data read from Ogg and MP3 files, which may
+// carry cover art.
+const maxTagBytes = 16 << 20
+
+// readOggTags reads the comment header, the second packet of the first
+// logical stream of an Ogg Vorbis or Opus file.
+func readOggTags(r io.Reader) (trackTags, error) {
+	var t trackTags
+	br := bufio.NewReader(r)
+	var pages []*oggPage
+	read := 0
+	for {
+		raw, err := readNextOggPage(br)
+		if err != nil {
+			return t, err
+		}
+		if read += len(raw); read > maxTagBytes {
+			return t, errors.New("comment header too large")
+		}
+		p, ok := parseOggPage(raw)
+		if !ok {
+			return t, errors.New("bad Ogg page")
+		}
+		if len(pages) > 0 && p.serial != pages[0].serial {
+			continue
+		}
+		pages = append(pages, p)
+		if pkts := oggPackets(pages); len(pkts) >= 2 {
+			c := pkts[1]
+			switch {
+			case bytes.HasPrefix(c, []byte("\x03vorbis")):
+				c = c[7:]
+			case bytes.HasPrefix(c, []byte("OpusTags")):
+				c = c[8:]
+			default:
+				return t, errors.New("no Vorbis or Opus comments")
+			}
+			for _, kv := range vorbisComments(c) {
+				key, value, _ := strings.Cut(kv, "=")
+				t.set(strings.ToUpper(key), value)
+			}
+			return t, nil
+		}
+	}
+}
+
+// id3Frames maps ID3v2 text frames to the Vorbis comment names set takes.
+var id3Frames = map[string]string{
+	"TPE1": "ARTIST",
+	"TIT2": "TITLE",
+	"TALB": "ALBUM",
+	"TCON": "GENRE",
+	"TSRC": "ISRC",
+	"TRCK": "TRACKNUMBER",
+	"TPOS": "DISCNUMBER",
+}
+
+// readID3Tags reads the text frames of an ID3v2.3 or 2.4 tag at the start
+// of r. Unsynchronised tags and ID3v2.2 are not read.
+func readID3Tags(r io.Reader) (trackTags, error) {
+	var t trackTags
+	var hdr [10]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return t, err
+	}
+	version, flags := hdr[3], hdr[5]
+	if version != 3 && version != 4 {
+		return t, fmt.Errorf("ID3v2.%d not supported", version)
+	}
+	if flags&0x80 != 0 {
+		return t, errors.New("unsynchronised ID3 tag not supported")
+	}
+	size := syncsafe(hdr[6:10])
+	if size > maxTagBytes {
+		return t, errors.New("ID3 tag too large")
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return t, err
+	}
+	if flags&0x40 != 0 && len(b) >= 4 { // extended header
+		n := int(binary.BigEndian.Uint32(b))
+		if version == 4 {
+			n = syncsafe(b[:4])
+		} else {
+			n += 4 // 2.3 doesn't count the size itself
+		}
+		b = b[min(n, len(b)):]
+	}
+	for len(b) >= 10 && b[0] != 0 {
+		id := string(b[:4])
+		n := int(binary.BigEndian.Uint32(b[4:8]))
+		if version == 4 {
+			n = syncsafe(b[4:8])
+		}
+		if n > len(b)-10 {
+			break
+		}
+		if key, ok := id3Frames[id]; ok && n > 0 {
+			t.set(key, id3Text(b[10:10+n]))
+		}
+		b = b[10+n:]
+	}
+	return t, nil
+}
+
+// syncsafe decodes an ID3 syncsafe integer: 7 bits per byte.
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+// id3Text decodes the first string of a text frame, after its encoding
+// byte: ISO-8859-1, UTF-16 with a byte order mark, UTF-16BE or UTF-8.
+func id3Text(b []byte) string {
+	enc, b := b[0], b[1:]
+	switch enc {
+	case 0:
+		r := make([]rune, 0, len(b))
+		for _, c := range b {
+			if c == 0 {
+				break
+			}
+			r = append(r, rune(c))
+		}
+		return string(r)
+	case 1, 2:
+		var order binary.ByteOrder = binary.BigEndian
+		if enc == 1 && len(b) >= 2 {
+			if b[0] == 0xff && b[1] == 0xfe {
+				order = binary.LittleEndian
+			}
+			b = b[2:]
+		}
+		u := make([]uint16, 0, len(b)/2)
+		for ; len(b) >= 2; b = b[2:] {
+			c := order.Uint16(b)
+			if c == 0 {
+				break
+			}
+			u = append(u, c)
+		}
+		return string(utf16.Decode(u))
+	}
+	s, _, _ := strings.Cut(string(b), "\x00")
+	return s
+}
+
+// readWavTags looks for a LIST/INFO chunk after the "RIFF" magic.
+func readWavTags(r io.ReadSeeker) (trackTags, error) {
+	var t trackTags
+	var riff [8]byte // RIFF size, form type
+	if _, err := io.ReadFull(r, riff[:]); err != nil {
+		return t, err
+	}
+	if string(riff[4:]) != "WAVE" {
+		return t, errors.New("not a WAVE file")
+	}
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return t, err
+		}
+		n := int64(binary.LittleEndian.Uint32(hdr[4:])) + int64(hdr[4]&1) // chunks are padded to even sizes
+		if string(hdr[:4]) != "LIST" || n < 4 || n > 1<<20 {
+			if _, err := r.Seek(n, io.SeekCurrent); err != nil {
+				return t, err
+			}
+			continue
+		}
+		list := make([]byte, n)
+		if _, err := io.ReadFull(r, list); err != nil {
+			return t, err
+		}
+		if string(list[:4]) != "INFO" {
+			continue
+		}
+		for b := list[4:]; len(b) >= 8; {
+			id, size := string(b[:4]), int(binary.LittleEndian.Uint32(b[4:8]))
+			if size > len(b)-8 {
+				break
+			}
+			value := string(bytes.TrimRight(b[8:8+size], "\x00"))
+			switch id {
+			case "IART":
+				t.set("ARTIST", value)
+			case "INAM":
+				t.set("TITLE", value)
+			case "IPRD":
+				t.set("ALBUM", value)
+			case "IGNR":
+				t.set("GENRE", value)
+			case "ITRK":
+				t.set("TRACKNUMBER", value)
+			}
+			b = b[min(8+size+size&1, len(b)):]
+		}
+		return t, nil
+	}
+}
+
+// set keeps the first value of each tag.
+func (t *trackTags) set(key, value string) {
+	value = strings.TrimSpace(value)
+	var dst *string
+	switch key {
+	case "ARTIST":
+		dst = &t.artist
+	case "TITLE":
+		dst = &t.title
+	case "ALBUM":
+		dst = &t.album
+	case "GENRE":
+		dst = &t.genre
+	case "ISRC":
+		dst = &t.isrc
+	case "TRACKNUMBER", "DISCNUMBER":
+		// "3" or "3/12"
+		n, _ := strconv.Atoi(strings.TrimSpace(strings.SplitN(value, "/", 2)[0]))
+		if key == "DISCNUMBER" && t.disc == 0 {
+			t.disc = n
+		} else if key == "TRACKNUMBER" && t.track == 0 {
+			t.track = n
+		}
+		return
+	default:
+		return
+	}
+	if *dst == "" {
+		*dst = value
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ---------------- per-track encoder settings ----------------
+
+// With -track-encode a track may carry a sidecar, its file name plus
+// ".encode", of "name = value" lines that change how it is encoded:
+//
+//	bitrate-kbps = 48
+//	channels = 1
+//
+// Such a track is encoded as a link of a chained Ogg stream of its own,
+// the way -track-comments encodes every track, so players reopen the
+// decoder with the new settings at the join. Consecutive tracks with the
+// same settings share a link; without -track-comments a track with no
+// sidecar goes back to the station's settings only if the link on air has
+// others. A sidecar can only lower the bitrate: the station's -bitrate-kbps
+// stays the ceiling, so the low-bitrate mount and CPU pressure keep their
+// limits. A sidecar that cannot be read is logged and the track plays with
+// the station's settings.
+
+const trackEncodeExt = ".encode"
+
+// trackEncode holds what a sidecar overrides; zero fields keep the
+// station's settings.
+type trackEncode struct {
+	bitrateKbps int
+	mono        bool
+}
+
+// readTrackEncode reads the sidecar of path; no sidecar is no override.
+func readTrackEncode(path string) (trackEncode, error) {
+	var o trackEncode
+	data, err := os.ReadFile(path + trackEncodeExt)
+	if errors.Is(err, os.ErrNotExist) {
+		return o, nil
+	}
+	if err != nil {
+		return o, err
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return o, fmt.Errorf("%s%s:%d: expected name = value", path, trackEncodeExt, i+1)
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		n, err := strconv.Atoi(value)
+		switch {
+		case name == "bitrate-kbps" && err == nil && n > 0:
+			o.bitrateKbps = n
+		case name == "channels" && err == nil && (n == 1 || n == 2):
+			o.mono = n == 1
+		case name == "bitrate-kbps" || name == "channels":
+			return o, fmt.Errorf("%s%s:%d: bad %s %q", path, trackEncodeExt, i+1, name, value)
+		default:
+			return o, fmt.Errorf("%s%s:%d: unknown setting %q", path, trackEncodeExt, i+1, name)
+		}
+	}
+	return o, nil
+}
+
+// apply returns cfg with o's settings. A Vorbis station in quality mode
+// switches to the sidecar's bitrate.
+func (o trackEncode) apply(cfg encoderConfig) encoderConfig {
+	if o.bitrateKbps > 0 && (cfg.bitrateKbps <= 0 || o.bitrateKbps < cfg.bitrateKbps) {
+		cfg.bitrateKbps = o.bitrateKbps
+	}
+	cfg.mono = cfg.mono || o.mono
+	return cfg
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ---------------- track boundary signaling ----------------
+
+// With -track-signals, a second logical stream is multiplexed into the Ogg
+// container next to the Vorbis audio. Its first (BOS) packet is
+//
+//	"SPTRACK\x00" <version byte 1>
+//
+// and every later packet announces a track change:
+//
+//	"SPTRACK\x01" followed by UTF-8 "KEY=value\n" lines
+//
+// with at least TITLE, FILE and START (unix seconds). Each packet sits on its
+// own page whose granule position is the audio granule at the time the track
+// started. Players that don't know the stream ignore it; clients like swp use
+// it to show track changes and split recordings.
+
+const (
+	trackMetaMagic   = "SPTRACK"
+	trackMetaVersion = 1
+)
+
+// trackInfo describes a track change for the signaling stream.
+type trackInfo struct {
+	path  string
+	title string
+	start time.Time
+}
+
+func newTrackInfo(path string) trackInfo {
+	base := filepath.Base(path)
+	return trackInfo{
+		path:  path,
+		title: strings.TrimSuffix(base, filepath.Ext(base)),
+		start: time.Now(),
+	}
+}
+
+// trackMetaStream emits the pages of one signaling logical stream. A new
+// one is started for every Vorbis BOS the encoder produces.
+type trackMetaStream struct {
+	serial  uint32
+	seq     uint32
+	granule int64 // latest audio granule seen
+}
+
+func newTrackMetaStream(audioSerial uint32) *trackMetaStream {
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	serial := binary.LittleEndian.Uint32(b[:])
+	if serial == audioSerial {
+		serial++
+	}
+	return &trackMetaStream{serial: serial}
+}
+
+func (ts *trackMetaStream) page(flags byte, packet []byte) []byte {
+	pages := paginate(ts.serial, ts.seq, [][]byte{packet})
+	ts.seq += uint32(len(pages))
+	for i, raw := range pages {
+		p, _ := parseOggPage(raw)
+		p.granule = ts.granule
+		if i == 0 {
+			p.flags |= flags
+		}
+		pages[i] = p.bytes()
+	}
+	return bytes.Join(pages, nil)
+}
+
+func (ts *trackMetaStream) bos() []byte {
+	return ts.page(0x02, append([]byte(trackMetaMagic+"\x00"), trackMetaVersion))
+}
+
+// eos ends the stream, before the next link of a chained stream begins
+// (see -track-comments).
+func (ts *trackMetaStream) eos() []byte {
+	end := &oggPage{flags: 0x04, granule: ts.granule, serial: ts.serial, seq: ts.seq}
+	ts.seq++
+	return end.bytes()
+}
+
+func (ts *trackMetaStream) track(t trackInfo) []byte {
+	var b bytes.Buffer
+	b.WriteString(trackMetaMagic + "\x01")
+	fmt.Fprintf(&b, "TITLE=%s\n", oneLine(t.title))
+	fmt.Fprintf(&b, "FILE=%s\n", oneLine(filepath.Base(t.path)))
+	fmt.Fprintf(&b, "START=%d\n", t.start.Unix())
+	return ts.page(0, b.Bytes())
+}
+
+func oneLine(s string) string {
+	return strings.NewReplacer("\n", " ", "\r", " ").Replace(s)
+}
+
+// trackSignaler interleaves signaling pages with the encoder's pages.
+type trackSignaler struct {
+	b       *Broadcaster
+	cur     *trackMetaStream
+	audio   uint32 // serial of the audio stream cur belongs to
+	started bool   // audio data pages have begun, so metadata may follow
+	pending []trackInfo
+}
+
+func (sg *trackSignaler) add(pages [][]byte) [][]byte {
+	out := make([][]byte, 0, len(pages)+1)
+	for _, raw := range pages {
+		p, ok := parseOggPage(raw)
+		if !ok {
+			out = append(out, raw)
+			continue
+		}
+		if p.flags&0x02 != 0 && granuleRate(p.body) > 0 && sg.cur != nil {
+			out = append(out, sg.cur.eos())
+		}
+		out = append(out, raw)
+		if p.flags&0x02 != 0 && granuleRate(p.body) > 0 {
+			sg.cur = newTrackMetaStream(p.serial)
+			sg.audio, sg.started = p.serial, false
+			out = append(out, sg.cur.bos())
+			continue
+		}
+		if sg.cur != nil && p.serial == sg.audio && p.granule > 0 {
+			sg.cur.granule = p.granule
+			sg.started = true
+		}
+	}
+
+	for drained := false; !drained; {
+		select {
+		case t := <-sg.b.tracks:
+			sg.pending = append(sg.pending, t)
+		default:
+			drained = true
+		}
+	}
+	if sg.cur != nil && sg.started {
+		for _, t := range sg.pending {
+			page := sg.cur.track(t)
+			sg.b.setLastTrack(page)
+			out = append(out, page)
+		}
+		sg.pending = nil
+	}
+	return out
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------- archive transcoding ----------------
+
+// "spartan-radio archive-transcode" re-encodes the segments of an
+// -archive-dir at a lower Vorbis bitrate or as Opus, to keep old broadcasts
+// for less disk. Each segment is encoded next to itself and renamed over the
+// original, keeping its name, tags, modification time and .cue, so /archive
+// lists it as before. Segments already at the target are skipped, which
+// makes an interrupted run safe to repeat, and an encode that comes out no
+// smaller than the original is thrown away.
+
+type transcodeJob struct {
+	rel  string // 2026-10-16/140000.ogg
+	path string
+	size int64
+}
+
+type transcodeResult struct {
+	job  transcodeJob
+	size int64 // after; 0 if the original was kept
+	err  error
+}
+
+// archiveTranscode runs the archive-transcode subcommand with args.
+func archiveTranscode(args []string) error {
+	fs := flag.NewFlagSet("archive-transcode", flag.ExitOnError)
+	dir := fs.String("archive-dir", "", "archive to transcode (as given to the server)")
+	codec := fs.String("codec", "opus", "target codec: opus or vorbis")
+	kbps := fs.Int("bitrate-kbps", 64, "target bitrate kbps")
+	olderThan := fs.Duration("older-than", 24*time.Hour, "only transcode segments last written at least this long ago")
+	workers := fs.Int("workers", runtime.NumCPU(), "segments to encode at once")
+	ffmpegPath := fs.String("ffmpeg", "ffmpeg", "path to ffmpeg binary")
+	dryRun := fs.Bool("n", false, "list the segments that would be transcoded and exit")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s archive-transcode -archive-dir DIR [flags]\n\nflags:\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	switch {
+	case *dir == "":
+		return errors.New("-archive-dir is required")
+	case *codec != "opus" && *codec != "vorbis":
+		return fmt.Errorf("unknown -codec %q (use opus or vorbis)", *codec)
+	case *kbps <= 0:
+		return errors.New("-bitrate-kbps must be positive")
+	case *olderThan < time.Minute:
+		// The segment being recorded is written every second or so.
+		return errors.New("-older-than must be at least 1m, to leave the segment being recorded alone")
+	case *workers < 1:
+		return errors.New("-workers must be at least 1")
+	}
+
+	jobs, err := transcodeJobs(*dir, *codec, *kbps, time.Now().Add(-*olderThan))
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, j := range jobs {
+		total += j.size
+	}
+	fmt.Printf("%d segments to transcode to %s at %d kbit/s, %s\n", len(jobs), *codec, *kbps, sizeText(total))
+	if *dryRun {
+		for _, j := range jobs {
+			fmt.Printf("%s\t%s\n", j.rel, sizeText(j.size))
+		}
+		return nil
+	}
+
+	queue := make(chan transcodeJob)
+	results := make(chan transcodeResult)
+	var wg sync.WaitGroup
+	for i := 0; i < min(*workers, len(jobs)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range queue {
+				size, err := transcodeSegment(*ffmpegPath, j, *codec, *kbps)
+				results <- transcodeResult{j, size, err}
+			}
+		}()
+	}
+	go func() {
+		for _, j := range jobs {
+			queue <- j
+		}
+		close(queue)
+		wg.Wait()
+		close(results)
+	}()
+
+	var done, failed int
+	var saved int64
+	for r := range results {
+		done++
+		switch {
+		case r.err != nil:
+			failed++
+			fmt.Printf("[%d/%d] %s: %v\n", done, len(jobs), r.job.rel, r.err)
+		case r.size == 0:
+			fmt.Printf("[%d/%d] %s: kept, the transcode was no smaller\n", done, len(jobs), r.job.rel)
+		default:
+			saved += r.job.size - r.size
+			fmt.Printf("[%d/%d] %s: %s -> %s\n", done, len(jobs), r.job.rel, sizeText(r.job.size), sizeText(r.size))
+		}
+	}
+	fmt.Printf("saved %s\n", sizeText(saved))
+	if failed > 0 {
+		return fmt.Errorf("%d of %d segments failed", failed, len(jobs))
+	}
+	return nil
+}
+
+// transcodeJobs lists the segments under dir last modified before cutoff
+// that are not already in codec at kbps or below, oldest first.
+func transcodeJobs(dir, codec string, kbps int, cutoff time.Time) ([]transcodeJob, error) {
+	days, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var jobs []transcodeJob
+	for _, d := range days {
+		if _, err := time.Parse("2006-01-02", d.Name()); err != nil || !d.IsDir() {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(dir, d.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if _, err := time.Parse("150405.ogg", e.Name()); err != nil {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil || !info.ModTime().Before(cutoff) {
+				continue
+			}
+			path := filepath.Join(dir, d.Name(), e.Name())
+			if !needsTranscode(path, codec, kbps) {
+				continue
+			}
+			jobs = append(jobs, transcodeJob{d.Name() + "/" + e.Name(), path, info.Size()})
+		}
+	}
+	return jobs, nil
+}
+
+// needsTranscode reports whether the segment at path would shrink by going
+// to codec at kbps. Opus is never taken back to Vorbis, and a Vorbis file
+// without a nominal bitrate is assumed to be above the target.
+func needsTranscode(path, codec string, kbps int) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, 64)
+	if _, err := io.ReadFull(f, head); err != nil {
+		return false
+	}
+	p, ok := parseOggPage(head)
+	if !ok {
+		return false
+	}
+	switch {
+	case bytes.HasPrefix(p.body, []byte("OpusHead")):
+		return false
+	case len(p.body) >= 24 && p.body[0] == 0x01 && bytes.Equal(p.body[1:7], []byte("vorbis")):
+		nominal := int32(binary.LittleEndian.Uint32(p.body[20:24]))
+		return codec == "opus" || nominal <= 0 || int(nominal) > kbps*1000
+	}
+	return false
+}
+
+// transcodeSegment encodes j and replaces it with the result, returning the
+// new size, or 0 if the result was no smaller and the original was kept.
+func transcodeSegment(ffmpegPath string, j transcodeJob, codec string, kbps int) (int64, error) {
+	info, err := os.Stat(j.path)
+	if err != nil {
+		return 0, err
+	}
+	// Hidden, and not a segment name, so /archive never lists it.
+	tmp := filepath.Join(filepath.Dir(j.path), "."+filepath.Base(j.path)+".tmp")
+	enc := map[string]string{"opus": "libopus", "vorbis": "libvorbis"}[codec]
+	cmd := exec.Command(ffmpegPath,
+		"-hide_banner", "-nostdin", "-loglevel", "error", "-y",
+		"-i", j.path,
+		"-map", "0:a", "-map_metadata", "0", "-map_metadata:s:a", "0:s:a",
+		"-c:a", enc, "-b:a", fmt.Sprintf("%dk", kbps),
+		"-f", "ogg", tmp,
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		_ = os.Remove(tmp)
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return 0, fmt.Errorf("ffmpeg: %v: %s", err, msg)
+		}
+		return 0, fmt.Errorf("ffmpeg: %v", err)
+	}
+	out, err := os.Stat(tmp)
+	if err == nil && out.Size() >= info.Size() {
+		return 0, os.Remove(tmp)
+	}
+	if err == nil {
+		err = os.Chtimes(tmp, info.ModTime(), info.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(tmp, j.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return 0, err
+	}
+	return out.Size(), nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"sync"
+	"time"
+)
+
+// ---------------- unique listeners ----------------
+
+// Reconnects make the listener count a poor measure of the audience. Each
+// stream connection is therefore given an anonymous listener ID,
+//
+//	hex(HMAC-SHA256(salt, IP \n host))[:16]
+//
+// where host is the host the client named in its request line, the closest
+// thing Spartan has to a user agent. The salt is random, lives only in
+// memory and is replaced at midnight in the station time zone together with
+// the set of IDs seen, so an ID can neither be traced back to an address nor
+// linked to the same device on another day. Nothing is written to disk; only
+// counts are shown. -unique-listeners=false turns all of it off.
+
+type uniqueCounter struct {
+	loc *time.Location
+
+	mu        sync.Mutex
+	day       string // station-local date the salt belongs to
+	salt      [32]byte
+	seen      map[string]struct{}
+	yesterday int // IDs seen on the previous day, if it was counted
+}
+
+func newUniqueCounter(loc *time.Location) *uniqueCounter {
+	return &uniqueCounter{loc: loc}
+}
+
+// roll starts a new day if now is past the current one. Called with mu held.
+func (u *uniqueCounter) roll(now time.Time) {
+	day := now.In(u.loc).Format("2006-01-02")
+	if day == u.day {
+		return
+	}
+	if u.day != "" && now.In(u.loc).AddDate(0, 0, -1).Format("2006-01-02") == u.day {
+		u.yesterday = len(u.seen)
+	} else {
+		u.yesterday = 0
+	}
+	u.day = day
+	_, _ = rand.Read(u.salt[:])
+	u.seen = make(map[string]struct{})
+}
+
+// add counts a connection from remote asking for host and returns its ID.
+func (u *uniqueCounter) add(remote, host string, now time.Time) string {
+	ip, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		ip = remote
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.roll(now)
+	mac := hmac.New(sha256.New, u.salt[:])
+	mac.Write([]byte(ip + "\n" + host))
+	id := hex.EncodeToString(mac.Sum(nil))[:16]
+	u.seen[id] = struct{}{}
+	return id
+}
+
+// counts returns the number of distinct listeners today and yesterday.
+func (u *uniqueCounter) counts(now time.Time) (today, yesterday int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.roll(now)
+	return len(u.seen), u.yesterday
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// ---------------- binary upgrade ----------------
+
+// On SIGUSR2 or /admin/upgrade the server starts a new copy of its binary
+// (whatever is installed at its path now) with the same arguments and hands
+// it the listening socket as fd 3. The new process starts its own pipeline,
+// then reports ready on fd 4. From then on it accepts all new connections;
+// the old process stops accepting, lets its current listeners play on until
+// they leave or -upgrade-drain runs out, and exits. New connections are never
+// refused during the switch. With -http-port the HTTP socket goes along as
+// fd 5.
+
+const (
+	listenFDEnv      = "SPARTAN_LISTEN_FD"
+	httpFDEnv        = "SPARTAN_HTTP_FD"
+	upgradeReadyWait = 30 * time.Second
+)
+
+// inheritedListener returns the socket handed over by an upgrading parent,
+// or nil when the process was started normally.
+func inheritedListener() (net.Listener, error) {
+	if os.Getenv(listenFDEnv) == "" {
+		return nil, nil
+	}
+	f := os.NewFile(3, "listener")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// inheritedHTTPListener returns the -http-port socket handed over by an
+// upgrading parent, or nil.
+func inheritedHTTPListener() (net.Listener, error) {
+	if os.Getenv(httpFDEnv) == "" {
+		return nil, nil
+	}
+	f := os.NewFile(5, "http listener")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// notifyParentReady tells an upgrading parent that this process is serving.
+func notifyParentReady() {
+	if os.Getenv(listenFDEnv) == "" {
+		return
+	}
+	os.Unsetenv(listenFDEnv)
+	os.Unsetenv(httpFDEnv)
+	ready := os.NewFile(4, "ready")
+	_, _ = ready.Write([]byte("ready\n"))
+	_ = ready.Close()
+}
+
+type upgrader struct {
+	ln      *net.TCPListener
+	httpLn  *net.TCPListener // -http-port; may be nil
+	drain   time.Duration
+	blocked string // reason upgrades are impossible, e.g. stdin input
+	prepare func() // run before the new binary starts; may be nil
+
+	mu     sync.Mutex
+	active bool
+}
+
+// upgrade starts the new binary and, once it is ready, closes ln so that the
+// accept loop ends and the old process drains.
+func (u *upgrader) upgrade() error {
+	if u.blocked != "" {
+		return errors.New(u.blocked)
+	}
+	u.mu.Lock()
+	if u.active {
+		u.mu.Unlock()
+		return errors.New("upgrade already in progress")
+	}
+	u.active = true
+	u.mu.Unlock()
+	ok := false
+	defer func() {
+		if !ok {
+			u.mu.Lock()
+			u.active = false
+			u.mu.Unlock()
+		}
+	}()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	lf, err := u.ln.File()
+	if err != nil {
+		return err
+	}
+	defer lf.Close()
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+
+	if u.prepare != nil {
+		u.prepare()
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), listenFDEnv+"=3")
+	cmd.ExtraFiles = []*os.File{lf, readyW}
+	if u.httpLn != nil {
+		hf, err := u.httpLn.File()
+		if err != nil {
+			readyW.Close()
+			return err
+		}
+		defer hf.Close()
+		cmd.Env = append(cmd.Env, httpFDEnv+"=5")
+		cmd.ExtraFiles = append(cmd.ExtraFiles, hf)
+	}
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return err
+	}
+	log.Printf("Upgrade: started %s (pid %d); waiting for it to be ready", exe, cmd.Process.Pid)
+
+	_ = readyR.SetReadDeadline(time.Now().Add(upgradeReadyWait))
+	buf := make([]byte, 6)
+	if n, err := readyR.Read(buf); err != nil || string(buf[:n]) != "ready\n" {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return fmt.Errorf("new process did not become ready: %v", err)
+	}
+	go func() { _ = cmd.Wait() }() // the child outlives us; just avoid a zombie meanwhile
+
+	ok = true
+	log.Printf("Upgrade: pid %d is serving; draining", cmd.Process.Pid)
+	if u.httpLn != nil {
+		_ = u.httpLn.Close()
+	}
+	return u.ln.Close()
+}
+
+// drainAndExit waits until the stations have no listeners or the drain time
+// is up, then exits.
+func (srv *server) drainAndExit(drain time.Duration) {
+	deadline := time.Now().Add(drain)
+	// Let short requests in flight finish.
+	time.Sleep(time.Second)
+	for time.Now().Before(deadline) {
+		n := 0
+		for _, st := range srv.stations {
+			n += len(st.listenerList())
+		}
+		if n == 0 {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	log.Printf("Upgrade: old process exiting")
+	os.Exit(0)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------- library validation ----------------
+
+// With -validate-library every file of the rotation is probed before the
+// station goes on air: its header is read for the sample format, and ffmpeg
+// decodes its first few seconds. The formats found and the files that fail
+// either step are logged. Formats without a header reader (MP3, Ogg) are
+// only decoded. With -validate-max-bad the station refuses to
+// start when more than that percentage of the library fails; otherwise the
+// rotation skips bad files as it meets them (see unreadable files).
+
+const validateDecode = 2 * time.Second // of each file, decoded by the probe
+
+// libraryReport is the outcome of validateLibrary.
+type libraryReport struct {
+	files    int
+	formats  map[string]int // files per format, e.g. "16-bit, 2 ch"
+	problems []fileProblem  // sorted by path
+}
+
+type fileProblem struct {
+	path string
+	err  error
+}
+
+// validateLibrary probes files with workers probes at a time.
+func validateLibrary(ffmpegPath string, files []string, workers int) libraryReport {
+	rep := libraryReport{files: len(files), formats: make(map[string]int)}
+	var mu sync.Mutex
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < min(workers, len(files)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range queue {
+				format, err := probeFile(ffmpegPath, p)
+				mu.Lock()
+				if err != nil {
+					rep.problems = append(rep.problems, fileProblem{p, err})
+				} else {
+					rep.formats[format]++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, p := range files {
+		queue <- p
+	}
+	close(queue)
+	wg.Wait()
+	sort.Slice(rep.problems, func(i, j int) bool { return rep.problems[i].path < rep.problems[j].path })
+	return rep
+}
+
+// probeFile describes p's sample format, or says why it won't play.
+func probeFile(ffmpegPath, p string) (string, error) {
+	af, err := readAudioFormat(p)
+	switch {
+	case errors.Is(err, errUnknownFormat):
+		// Only the decode can tell.
+	case err != nil:
+		return "", fmt.Errorf("header: %v", err)
+	case af.channels == 0 || af.bits == 0:
+		return "", errors.New("header: no audio format")
+	}
+	cmd := exec.Command(ffmpegPath,
+		"-hide_banner", "-loglevel", "error", "-xerror",
+		"-t", fmt.Sprintf("%.3f", validateDecode.Seconds()),
+		"-i", p,
+		"-f", "null", "-")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if line, _, _ := strings.Cut(strings.TrimSpace(stderr.String()), "\n"); line != "" {
+			return "", fmt.Errorf("decode: %s", line)
+		}
+		return "", fmt.Errorf("decode: %v", err)
+	}
+	if af.bits == 0 {
+		return strings.TrimPrefix(strings.ToLower(filepath.Ext(p)), "."), nil
+	}
+	format := fmt.Sprintf("%d-bit", af.bits)
+	if af.float {
+		format += " float"
+	}
+	return fmt.Sprintf("%s, %d ch", format, af.channels), nil
+}
+
+// badPercent is the share of the library that failed, in percent.
+func (r libraryReport) badPercent() float64 {
+	if r.files == 0 {
+		return 0
+	}
+	return 100 * float64(len(r.problems)) / float64(r.files)
+}
+
+func (r libraryReport) log() {
+	formats := make([]string, 0, len(r.formats))
+	for f := range r.formats {
+		formats = append(formats, f)
+	}
+	sort.Strings(formats)
+	for i, f := range formats {
+		formats[i] = fmt.Sprintf("%s: %d", f, r.formats[f])
+	}
+	log.Printf("Library check: %d files, %d unplayable (%.1f%%)", r.files, len(r.problems), r.badPercent())
+	if len(formats) > 0 {
+		log.Printf("Library check: formats %s", strings.Join(formats, "; "))
+	}
+	for _, pr := range r.problems {
+		log.Printf("Library check: %s: %v", pr.path, pr.err)
+	}
+}
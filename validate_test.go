@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateLibrary(t *testing.T) {
+	dir := t.TempDir()
+	good := wavWithInfo(nil)
+	binary.LittleEndian.PutUint16(good[22:], 2)         // channels
+	binary.LittleEndian.PutUint32(good[28:], 44100*2*2) // byte rate
+	binary.LittleEndian.PutUint16(good[34:], 16)        // bits per sample
+	files := map[string][]byte{
+		"good.wav":       good,
+		"empty.wav":      nil,
+		"truncated.wav":  good[:20],
+		"formatless.wav": wavWithInfo(nil),
+	}
+	var paths []string
+	for name, b := range files {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, p)
+	}
+
+	// true stands in for an ffmpeg that decodes everything.
+	rep := validateLibrary("true", paths, 2)
+	if rep.files != 4 || rep.formats["16-bit, 2 ch"] != 1 || len(rep.formats) != 1 {
+		t.Fatalf("report %+v", rep)
+	}
+	var bad []string
+	for _, pr := range rep.problems {
+		bad = append(bad, filepath.Base(pr.path))
+		if !strings.HasPrefix(pr.err.Error(), "header: ") {
+			t.Errorf("%s: %v", pr.path, pr.err)
+		}
+	}
+	if strings.Join(bad, " ") != "empty.wav formatless.wav truncated.wav" {
+		t.Fatalf("problems %v", bad)
+	}
+	if rep.badPercent() != 75 {
+		t.Fatalf("bad %g%%", rep.badPercent())
+	}
+
+	// false fails every decode.
+	rep = validateLibrary("false", paths[:0:0], 2)
+	if rep.badPercent() != 0 {
+		t.Fatalf("empty library: %g%%", rep.badPercent())
+	}
+	rep = validateLibrary("false", []string{filepath.Join(dir, "good.wav")}, 2)
+	if len(rep.problems) != 1 || !strings.HasPrefix(rep.problems[0].err.Error(), "decode: ") {
+		t.Fatalf("problems %+v", rep.problems)
+	}
+}
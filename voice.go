@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// ---------------- scheduled voice items ----------------
+
+// A voice schedule lists spoken items (news, announcements) by time of day:
+//
+//	# HH:MM  file
+//	08:00    news/morning.flac
+//	12:30    announcements/lunch.wav
+//	timezone America/New_York
+//	09:00    news/new-york.flac
+//
+// Times are in the station time zone (-timezone) until a "timezone NAME" line
+// switches the items after it to that IANA zone. Every day at each time the
+// item is played. A time skipped by a daylight saving change plays when the
+// clock has moved on (02:30 becomes 03:30); a time that occurs twice plays
+// once. Without ducking the item is queued and goes out at the next track
+// boundary. With -duck-db it starts on time on the mixer's voice channel, and
+// the music keeps running underneath at reduced gain.
+
+type voiceItem struct {
+	hour, min int
+	loc       *time.Location
+	path      string
+}
+
+// next returns the item's first scheduled time at or after t.
+func (it voiceItem) next(t time.Time) time.Time {
+	day := t.In(it.loc)
+	for d := 0; ; d++ {
+		at := time.Date(day.Year(), day.Month(), day.Day()+d, it.hour, it.min, 0, 0, it.loc)
+		if !at.Before(t) {
+			return at
+		}
+	}
+}
+
+func readVoiceSchedule(path string, loc *time.Location, resolve func(string) (string, error)) ([]voiceItem, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var items []voiceItem
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		at, file, ok := strings.Cut(line, " ")
+		if at == "timezone" {
+			if file = strings.TrimSpace(file); file == "" {
+				return nil, fmt.Errorf("%s:%d: expected timezone NAME", path, n)
+			}
+			if loc, err = time.LoadLocation(file); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+			}
+			continue
+		}
+		it := voiceItem{loc: loc}
+		if ok {
+			_, err = fmt.Sscanf(at, "%d:%d", &it.hour, &it.min)
+		}
+		if !ok || err != nil || it.hour > 23 || it.min > 59 {
+			return nil, fmt.Errorf("%s:%d: expected HH:MM file", path, n)
+		}
+		if it.path, err = resolve(strings.TrimSpace(file)); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		items = append(items, it)
+	}
+	return items, sc.Err()
+}
+
+// runVoiceSchedule fires items at their time of day until the process exits.
+func runVoiceSchedule(items []voiceItem, fire func(path string)) {
+	if len(items) == 0 {
+		return
+	}
+	now := time.Now()
+	due := make([]time.Time, len(items))
+	for i, it := range items {
+		due[i] = it.next(now)
+	}
+	for {
+		first := due[0]
+		for _, t := range due {
+			if t.Before(first) {
+				first = t
+			}
+		}
+		// Wake at least once a minute so that a wall clock change is noticed.
+		time.Sleep(min(time.Until(first), time.Minute))
+		// Fire everything that is due, so a late wakeup doesn't lose an item.
+		now = time.Now()
+		for i, it := range items {
+			if !now.Before(due[i]) {
+				fire(it.path)
+				due[i] = it.next(now.Add(time.Second))
+			}
+		}
+	}
+}
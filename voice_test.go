@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVoiceItemNext(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	utc := func(s string) time.Time {
+		tm, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	tests := []struct {
+		name      string
+		hour, min int
+		after     string
+		want      string
+	}{
+		{"later today", 8, 0, "2026-06-01T05:00:00Z", "2026-06-01T06:00:00Z"},
+		{"exactly now", 8, 0, "2026-06-01T06:00:00Z", "2026-06-01T06:00:00Z"},
+		{"tomorrow", 8, 0, "2026-06-01T06:00:01Z", "2026-06-02T06:00:00Z"},
+		// A server in UTC: 00:30 Berlin is still the previous day in UTC.
+		{"day boundary", 0, 30, "2026-06-01T21:00:00Z", "2026-06-01T22:30:00Z"},
+		// Same wall clock either side of a DST change.
+		{"before spring forward", 8, 0, "2026-03-28T12:00:00Z", "2026-03-29T06:00:00Z"},
+		{"before fall back", 8, 0, "2026-10-24T12:00:00Z", "2026-10-25T07:00:00Z"},
+		// 02:30 doesn't exist on 29 March; it plays at 03:30 CEST.
+		{"skipped time", 2, 30, "2026-03-29T00:00:00Z", "2026-03-29T01:30:00Z"},
+		// 02:30 happens twice on 25 October; it plays once.
+		{"repeated time", 2, 30, "2026-10-25T00:00:00Z", "2026-10-25T01:30:00Z"},
+		{"after repeated time", 2, 30, "2026-10-25T01:30:01Z", "2026-10-26T01:30:00Z"},
+	}
+	for _, tt := range tests {
+		it := voiceItem{hour: tt.hour, min: tt.min, loc: berlin}
+		if got := it.next(utc(tt.after)); !got.Equal(utc(tt.want)) {
+			t.Errorf("%s: next(%s) = %s, want %s", tt.name, tt.after, got.UTC().Format(time.RFC3339), tt.want)
+		}
+	}
+}
+
+func TestReadVoiceScheduleTimezone(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "schedule")
+	schedule := "08:00 a.wav\ntimezone America/New_York\n09:00 b.wav\n"
+	if err := os.WriteFile(path, []byte(schedule), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	resolve := func(p string) (string, error) { return p, nil }
+	items, err := readVoiceSchedule(path, time.UTC, resolve)
+	if err != nil {
+		t.Skip(err) // no zone database
+	}
+	if len(items) != 2 || items[0].loc != time.UTC || items[1].loc.String() != "America/New_York" {
+		t.Fatalf("items = %+v", items)
+	}
+
+	for _, bad := range []string{"timezone\n", "timezone Mars/Olympus\n", "8am a.wav\n"} {
+		if err := os.WriteFile(path, []byte(bad), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readVoiceSchedule(path, time.UTC, resolve); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ---------------- warm header handoff ----------------
+
+// With -state-dir, each station's cached Vorbis header set is written to
+// <state-dir>/<station>.header when the process shuts down or hands over to
+// an upgraded binary, and the burst buffer's pages of those streams to
+// <state-dir>/<station>.burst. If the header is at most warmHeaderMaxAge old
+// at the next start, both are loaded right away. Listeners reconnecting
+// during the restart then get a decodable header and their connect burst or
+// offset= audio immediately. When the new encoder's first page arrives, the
+// restored pages are dropped and the restored streams are ended with EOS
+// pages, as after a restart, so that its pages start a fresh link of a
+// chained stream after them.
+
+const warmHeaderMaxAge = 5 * time.Minute
+
+func (st *station) headerStatePath(dir string) string {
+	return filepath.Join(dir, st.name+".header")
+}
+
+func (st *station) burstStatePath(dir string) string {
+	return filepath.Join(dir, st.name+".burst")
+}
+
+func (st *station) saveHeader(dir string) error {
+	hdr := st.b.GetHeaderCopy()
+	if len(hdr) == 0 {
+		return nil
+	}
+	if err := writeStateFile(st.headerStatePath(dir), hdr); err != nil {
+		return err
+	}
+	burst := encodeBurst(streamPages(hdr, st.b.burstPages()))
+	if len(burst) == 0 {
+		if err := os.Remove(st.burstStatePath(dir)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	return writeStateFile(st.burstStatePath(dir), burst)
+}
+
+func writeStateFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (st *station) loadHeader(dir string) {
+	path := st.headerStatePath(dir)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if age := time.Since(fi.ModTime()); age > warmHeaderMaxAge {
+		log.Printf("%s: saved header is %s old; not using it", st.name, age.Round(time.Second))
+		return
+	}
+	hdr, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("%s: %v", st.name, err)
+		return
+	}
+	vh := &headerFinder{}
+	br := bufio.NewReader(bytes.NewReader(hdr))
+	for {
+		page, err := readNextOggPage(br)
+		if err != nil {
+			break
+		}
+		vh.feedPage(page)
+	}
+	if !vh.done() {
+		log.Printf("%s: saved header %s is incomplete; not using it", st.name, path)
+		return
+	}
+	var burst []burstPage
+	if data, err := os.ReadFile(st.burstStatePath(dir)); err == nil {
+		if burst, err = decodeBurst(data); err != nil {
+			log.Printf("%s: saved burst buffer: %v; not using it", st.name, err)
+		}
+		burst = streamPages(hdr, burst)
+	}
+	st.b.restoreHeader(hdr, burst, time.Now())
+	log.Printf("%s: restored %d-byte header and %d burst pages from %s", st.name, len(hdr), len(burst), dir)
+}
+
+// streamPages returns the pages that belong to the streams hdr begins.
+func streamPages(hdr []byte, pages []burstPage) []burstPage {
+	serials := openStreams{}
+	br := bufio.NewReader(bytes.NewReader(hdr))
+	for {
+		page, err := readNextOggPage(br)
+		if err != nil {
+			break
+		}
+		serials.see(page)
+	}
+	var out []burstPage
+	for _, bp := range pages {
+		if p, ok := parseOggPage(bp.page); ok && serials[p.serial] != nil {
+			out = append(out, bp)
+		}
+	}
+	return out
+}
+
+// encodeBurst writes each page after the time it reached the hub, in
+// nanoseconds since 1970, little-endian.
+func encodeBurst(pages []burstPage) []byte {
+	var out []byte
+	for _, bp := range pages {
+		out = binary.LittleEndian.AppendUint64(out, uint64(bp.at.UnixNano()))
+		out = append(out, bp.page...)
+	}
+	return out
+}
+
+func decodeBurst(data []byte) ([]burstPage, error) {
+	var pages []burstPage
+	br := bufio.NewReader(bytes.NewReader(data))
+	for {
+		var at [8]byte
+		if _, err := io.ReadFull(br, at[:]); err == io.EOF {
+			return pages, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if b, err := br.Peek(4); err != nil || string(b) != "OggS" {
+			return nil, errors.New("not an Ogg page")
+		}
+		page, err := readNextOggPage(br)
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, burstPage{time.Unix(0, int64(binary.LittleEndian.Uint64(at[:]))), page})
+	}
+}
+
+// restoreHeader caches hdr, saved by an earlier process, until this
+// process's encoder has a header of its own, and refills the burst buffer
+// with pages of its streams. The time the process was down is left out:
+// the newest page is taken to have arrived at now.
+func (b *Broadcaster) restoreHeader(hdr []byte, burst []burstPage, now time.Time) {
+	b.SetHeader(hdr)
+	b.hmu.Lock()
+	b.restored = hdr
+	b.hmu.Unlock()
+	if len(burst) == 0 {
+		return
+	}
+	shift := now.Sub(burst[len(burst)-1].at)
+	var pages []burstPage
+	for _, bp := range burst {
+		pages = append(pages, burstPage{bp.at.Add(shift), bp.page})
+	}
+	b.smu.Lock()
+	b.setBurst(pages)
+	b.smu.Unlock()
+}
+
+// burstPages returns a copy of the burst buffer.
+func (b *Broadcaster) burstPages() []burstPage {
+	b.smu.Lock()
+	defer b.smu.Unlock()
+	return append([]burstPage(nil), b.burst...)
+}
+
+// endRestored is called with the encoder's first page. Listeners who joined
+// on a restored header have its streams open: each gets an empty EOS page
+// ahead of the encoder's own pages. The restored header leaves the cache and
+// its pages the burst buffer, so later listeners wait for the encoder's.
+func (b *Broadcaster) endRestored() {
+	b.hmu.Lock()
+	hdr := b.restored
+	b.restored = nil
+	b.hmu.Unlock()
+	if hdr == nil {
+		return
+	}
+	open := openStreams{}
+	br := bufio.NewReader(bytes.NewReader(hdr))
+	for {
+		page, err := readNextOggPage(br)
+		if err != nil {
+			break
+		}
+		open.see(page)
+	}
+	b.smu.Lock()
+	for _, bp := range b.burst {
+		open.see(bp.page)
+	}
+	b.setBurst(nil)
+	b.smu.Unlock()
+	b.SetHeader(nil)
+	for _, page := range open.eos() {
+		b.Publish(page)
+	}
+}
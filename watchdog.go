@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// ---------------- output watchdog ----------------
+
+// The watchdog counts the pages leaving the broadcaster. If none leave for
+// the stall timeout while listeners are connected, the encoder or a source
+// has hung without exiting; the station's pipeline is torn down and rebuilt
+// in place and the incident is recorded for /stats and /admin/status.
+
+type incident struct {
+	at     time.Time
+	reason string
+}
+
+func (st *station) watch(stall time.Duration) {
+	const every = time.Second
+	last := st.b.pagesOut.Load()
+	quiet := time.Duration(0)
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for range tick.C {
+		n := st.b.pagesOut.Load()
+		if n != last || st.b.Listeners() == 0 {
+			last, quiet = n, 0
+			continue
+		}
+		if quiet += every; quiet < stall {
+			continue
+		}
+		reason := fmt.Sprintf("no output for %s with %d listeners", quiet, st.b.Listeners())
+		log.Printf("%s: watchdog: %s; resetting pipeline", st.name, reason)
+		st.wmu.Lock()
+		st.resets++
+		st.lastReset = incident{at: time.Now(), reason: reason}
+		st.wmu.Unlock()
+		st.requestRestart()
+		quiet = 0
+	}
+}
+
+// watchdogResets returns how often the watchdog reset the pipeline and the
+// latest incident.
+func (st *station) watchdogResets() (int, incident) {
+	st.wmu.Lock()
+	defer st.wmu.Unlock()
+	return st.resets, st.lastReset
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+)
+
+// ---------------- per-listener watermark ----------------
+
+// Each watermarked listener gets the cached header with one extra comment
+// (Vorbis comment or OpusTags), SPARTAN_LISTENER=<id>. The id is logged
+// with the listener's address, so a re-streamed copy of the broadcast can be
+// traced back to the session it was captured from. The audio itself is
+// untouched.
+
+const watermarkTag = "SPARTAN_LISTENER"
+
+func newListenerID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// commentHeader rewrites the comment packet of a cached Vorbis or Opus
+// header set, adding comments ("NAME=value").
+func commentHeader(header []byte, comments ...string) ([]byte, error) {
+	pages, ok := parseOggPages(header)
+	if !ok {
+		return nil, errors.New("header comments: bad header page")
+	}
+	if len(pages) == 0 {
+		return nil, errors.New("header comments: empty header")
+	}
+
+	// Other logical streams (track signaling) are passed through in place.
+	first := pages[0]
+	var audio []*oggPage
+	var others []byte
+	for _, p := range pages {
+		if p.serial == first.serial {
+			audio = append(audio, p)
+		} else {
+			others = append(others, p.bytes()...)
+		}
+	}
+
+	packets := oggPackets(audio)
+	need := 3 // Vorbis: ident, comment, setup
+	if len(packets) > 0 && bytes.HasPrefix(packets[0], []byte("OpusHead")) {
+		need = 2 // OpusHead, OpusTags
+	}
+	if len(packets) < need {
+		return nil, errors.New("header comments: incomplete header")
+	}
+	comment := packets[1]
+	for _, c := range comments {
+		var err error
+		if comment, err = addComment(comment, c); err != nil {
+			return nil, err
+		}
+	}
+
+	out := append(first.bytes(), others...)
+	for _, p := range paginate(first.serial, first.seq+1, append([][]byte{comment}, packets[2:need]...)) {
+		out = append(out, p...)
+	}
+	return out, nil
+}
+
+// parseOggPages splits data, a run of whole pages, into parsed pages.
+func parseOggPages(data []byte) ([]*oggPage, bool) {
+	var pages []*oggPage
+	br := bufio.NewReader(bytes.NewReader(data))
+	for {
+		raw, err := readNextOggPage(br)
+		if err != nil {
+			return pages, true
+		}
+		p, ok := parseOggPage(raw)
+		if !ok {
+			return nil, false
+		}
+		pages = append(pages, p)
+	}
+}
+
+// oggPackets reassembles the complete packets carried by pages.
+func oggPackets(pages []*oggPage) [][]byte {
+	var out [][]byte
+	var cur []byte
+	for _, p := range pages {
+		off := 0
+		for _, lace := range p.segs {
+			n := int(lace)
+			if off+n > len(p.body) {
+				return out
+			}
+			cur = append(cur, p.body[off:off+n]...)
+			off += n
+			if lace < 255 {
+				out = append(out, cur)
+				cur = nil
+			}
+		}
+	}
+	return out
+}
+
+// paginate lays header packets out on pages with granule position 0; the
+// last packet ends its page so audio starts on a fresh one.
+func paginate(serial uint32, seq uint32, packets [][]byte) [][]byte {
+	var out [][]byte
+	p := &oggPage{serial: serial, seq: seq}
+	flush := func(continued bool) {
+		out = append(out, p.bytes())
+		seq++
+		p = &oggPage{serial: serial, seq: seq}
+		if continued {
+			p.flags = 0x01
+		}
+	}
+	for _, pkt := range packets {
+		n := len(pkt)
+		off := 0
+		for {
+			if len(p.segs) == 255 {
+				flush(true)
+			}
+			lace := min(n-off, 255)
+			p.segs = append(p.segs, byte(lace))
+			p.body = append(p.body, pkt[off:off+lace]...)
+			off += lace
+			if lace < 255 {
+				break
+			}
+		}
+		if len(p.segs) == 255 {
+			flush(false)
+		}
+	}
+	if len(p.segs) > 0 {
+		flush(false)
+	}
+	return out
+}
+
+// addComment appends one user comment to a Vorbis comment packet or an
+// OpusTags packet; past their magic the two are laid out alike.
+func addComment(pkt []byte, comment string) ([]byte, error) {
+	bad := errors.New("header comments: bad comment packet")
+	var off int
+	switch {
+	case len(pkt) >= 7 && pkt[0] == 0x03 && bytes.Equal(pkt[1:7], []byte("vorbis")):
+		off = 7
+	case bytes.HasPrefix(pkt, []byte("OpusTags")):
+		off = 8
+	default:
+		return nil, bad
+	}
+	if off+4 > len(pkt) {
+		return nil, bad
+	}
+	vendorLen := int(binary.LittleEndian.Uint32(pkt[off:]))
+	off += 4 + vendorLen
+	if off+4 > len(pkt) {
+		return nil, bad
+	}
+	countAt := off
+	count := binary.LittleEndian.Uint32(pkt[off:])
+	off += 4
+	for i := uint32(0); i < count; i++ {
+		if off+4 > len(pkt) {
+			return nil, bad
+		}
+		off += 4 + int(binary.LittleEndian.Uint32(pkt[off:]))
+	}
+	if off > len(pkt) {
+		return nil, bad
+	}
+
+	out := make([]byte, 0, len(pkt)+4+len(comment))
+	out = append(out, pkt[:off]...)
+	binary.LittleEndian.PutUint32(out[countAt:], count+1)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(comment)))
+	out = append(out, comment...)
+	out = append(out, pkt[off:]...) // Vorbis framing bit, Opus padding
+	return out, nil
+}